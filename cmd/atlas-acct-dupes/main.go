@@ -0,0 +1,110 @@
+// Command atlas-acct-dupes reports accounts in an atlas database which share a
+// username.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/r2northstar/atlas/db/atlasdb"
+	"github.com/r2northstar/atlas/pkg/api/api0"
+	"github.com/spf13/pflag"
+)
+
+var opt struct {
+	Help bool
+}
+
+func init() {
+	pflag.BoolVarP(&opt.Help, "help", "h", false, "Show this help text")
+}
+
+func main() {
+	pflag.Parse()
+
+	if pflag.NArg() != 1 || opt.Help {
+		fmt.Printf("usage: %s [options] atlas_db\n\noptions:\n%s\nAccounts are grouped by username (case-insensitive). For each username with\nmultiple accounts, the uid, last auth token expiry (which is the last auth time\nplus the token expiry), last auth ip, last server id, and flags are shown.\n", os.Args[0], pflag.CommandLine.FlagUsages())
+		if opt.Help {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	n, g, err := report(pflag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "found %d duplicate usernames with %d accounts\n", g, n)
+}
+
+func report(atlasfn string) (int, int, error) {
+	if _, err := os.Stat(atlasfn); err != nil {
+		return 0, 0, fmt.Errorf("open atlas db: %w", err)
+	}
+
+	db, err := atlasdb.OpenReadOnly(atlasfn)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open atlas db: %w", err)
+	}
+	defer db.Close()
+
+	if cur, to, err := db.Version(); err != nil {
+		return 0, 0, fmt.Errorf("check atlas db version: %w", err)
+	} else if cur != to {
+		return 0, 0, fmt.Errorf("atlas db version %d does not match the expected version %d", cur, to)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "USERNAME\tUID\tAUTH_EXPIRY\tAUTH_IP\tLAST_SERVER\tFLAGS\n")
+
+	var (
+		n, g  int
+		group []*api0.Account
+	)
+	flush := func() {
+		if len(group) > 1 {
+			for _, a := range group {
+				var exp string
+				if !a.AuthTokenExpiry.IsZero() {
+					exp = a.AuthTokenExpiry.UTC().Format(time.RFC3339)
+				}
+				var ip string
+				if a.AuthIP.IsValid() {
+					ip = a.AuthIP.String()
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", a.Username, strconv.FormatUint(a.UID, 10), orDash(exp), orDash(ip), orDash(a.LastServerID), orDash(a.Flags.String()))
+			}
+			n += len(group)
+			g++
+		}
+		group = group[:0]
+	}
+	if err := db.IterAccounts(func(a *api0.Account) error {
+		if a.Username == "" {
+			return nil
+		}
+		if len(group) != 0 && !strings.EqualFold(group[0].Username, a.Username) {
+			flush()
+		}
+		group = append(group, a)
+		return nil
+	}); err != nil {
+		return n, g, err
+	}
+	flush()
+
+	return n, g, tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
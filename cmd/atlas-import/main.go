@@ -6,7 +6,10 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/netip"
 	"os"
 	"time"
@@ -21,11 +24,13 @@ import (
 )
 
 var opt struct {
+	JSON     bool
 	Progress bool
 	Help     bool
 }
 
 func init() {
+	pflag.BoolVarP(&opt.JSON, "json", "j", false, "Read northstar_db as a JSON array of account objects instead of a sqlite database")
 	pflag.BoolVarP(&opt.Progress, "progress", "p", false, "Show progress")
 	pflag.BoolVarP(&opt.Help, "help", "h", false, "Show this help text")
 }
@@ -34,14 +39,29 @@ func main() {
 	pflag.Parse()
 
 	if pflag.NArg() != 3 || opt.Help {
-		fmt.Printf("usage: %s [options] northstar_db atlas_db pdata_db\n\noptions:\n%s", os.Args[0], pflag.CommandLine.FlagUsages())
+		fmt.Printf("usage: %s [options] northstar_db atlas_db pdata_db\n\noptions:\n%s\nIf --json is specified, northstar_db should contain an array of objects\nwith the same fields as the accounts table (persistentDataBaseline as base64).\n", os.Args[0], pflag.CommandLine.FlagUsages())
 		if opt.Help {
 			os.Exit(2)
 		}
 		os.Exit(0)
 	}
 
-	na, np, err := migrate(pflag.Arg(0), pflag.Arg(1), pflag.Arg(2))
+	var (
+		src nssource
+		err error
+	)
+	if opt.JSON {
+		src, err = openJSON(pflag.Arg(0))
+	} else {
+		src, err = openSQLite(pflag.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	na, np, err := migrate(src, pflag.Arg(1), pflag.Arg(2))
+	src.Close()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -50,23 +70,104 @@ func main() {
 }
 
 type nsacct struct {
-	ID                             uint64  `db:"id"`
-	CurrentAuthToken               string  `db:"currentAuthToken"`
-	CurrentAuthTokenExpirationTime int64   `db:"currentAuthTokenExpirationTime"`
-	CurrentServerID                *string `db:"currentServerId"`
-	PersistentDataBaseline         []byte  `db:"persistentDataBaseline"`
-	LastAuthIP                     *string `db:"lastAuthIp"`
-	Username                       string  `db:"username"`
+	ID                             uint64  `db:"id" json:"id"`
+	CurrentAuthToken               string  `db:"currentAuthToken" json:"currentAuthToken"`
+	CurrentAuthTokenExpirationTime int64   `db:"currentAuthTokenExpirationTime" json:"currentAuthTokenExpirationTime"`
+	CurrentServerID                *string `db:"currentServerId" json:"currentServerId"`
+	PersistentDataBaseline         []byte  `db:"persistentDataBaseline" json:"persistentDataBaseline"`
+	LastAuthIP                     *string `db:"lastAuthIp" json:"lastAuthIp"`
+	Username                       string  `db:"username" json:"username"`
 }
 
-func migrate(nsfn, atlasfn, pdatafn string) (int, int, error) {
-	ctx := context.Background()
+// nssource reads accounts from the old master server.
+type nssource interface {
+	// Next reads the next account, returning io.EOF if there are no more.
+	Next(*nsacct) error
+
+	// Close releases resources associated with the source.
+	Close() error
+}
+
+type sqliteSource struct {
+	db   *sqlx.DB
+	rows *sqlx.Rows
+}
 
-	nsdb, err := sqlx.Connect("sqlite3", nsfn+"?mode=ro")
+// openSQLite reads accounts from a northstar sqlite database.
+func openSQLite(fn string) (*sqliteSource, error) {
+	db, err := sqlx.Connect("sqlite3", fn+"?mode=ro")
 	if err != nil {
-		return 0, 0, fmt.Errorf("open northstar db %q: %w", nsfn, err)
+		return nil, fmt.Errorf("open northstar db %q: %w", fn, err)
 	}
-	defer nsdb.Close()
+	rows, err := db.Queryx(`SELECT * FROM accounts`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("query northstar db: %w", err)
+	}
+	return &sqliteSource{db, rows}, nil
+}
+
+func (s *sqliteSource) Next(n *nsacct) error {
+	if !s.rows.Next() {
+		if err := s.rows.Err(); err != nil {
+			return fmt.Errorf("query northstar db: scan rows: %w", err)
+		}
+		return io.EOF
+	}
+	*n = nsacct{}
+	if err := s.rows.StructScan(n); err != nil {
+		return fmt.Errorf("query northstar db: scan row: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteSource) Close() error {
+	s.rows.Close()
+	return s.db.Close()
+}
+
+type jsonSource struct {
+	f   *os.File
+	dec *json.Decoder
+}
+
+// openJSON reads accounts from a file containing a JSON array of accounts.
+func openJSON(fn string) (*jsonSource, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("open northstar json %q: %w", fn, err)
+	}
+	dec := json.NewDecoder(f)
+	if t, err := dec.Token(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read northstar json: %w", err)
+	} else if t != json.Delim('[') {
+		f.Close()
+		return nil, fmt.Errorf("read northstar json: expected array, got %v", t)
+	}
+	return &jsonSource{f, dec}, nil
+}
+
+func (s *jsonSource) Next(n *nsacct) error {
+	if !s.dec.More() {
+		if _, err := s.dec.Token(); err != nil {
+			return fmt.Errorf("read northstar json: %w", err)
+		}
+		return io.EOF
+	}
+	*n = nsacct{}
+	if err := s.dec.Decode(n); err != nil {
+		return fmt.Errorf("read northstar json: decode account: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonSource) Close() error {
+	return s.f.Close()
+}
+
+func migrate(src nssource, atlasfn, pdatafn string) (int, int, error) {
+	ctx := context.Background()
 
 	if _, err := os.Stat(atlasfn); err == nil {
 		return 0, 0, fmt.Errorf("create atlas db: %q already exists", atlasfn)
@@ -99,17 +200,16 @@ func migrate(nsfn, atlasfn, pdatafn string) (int, int, error) {
 		return 0, 0, fmt.Errorf("migrate pdata db: %w", err)
 	}
 
-	rows, err := nsdb.Queryx(`SELECT * FROM accounts`)
-	if err != nil {
-		return 0, 0, fmt.Errorf("query northstar db: %w", err)
-	}
-	defer rows.Close()
-
-	var na, np int
-	for rows.Next() {
-		var n nsacct
-		if err := rows.StructScan(&n); err != nil {
-			return 0, 0, fmt.Errorf("query northstar db: scan row: %w", err)
+	var (
+		na, np int
+		n      nsacct
+	)
+	for {
+		if err := src.Next(&n); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return 0, 0, err
 		}
 		if err := insertA(&n, adb); err != nil {
 			return 0, 0, fmt.Errorf("migrate uid %d (%s): %w", n.ID, n.Username, err)
@@ -125,9 +225,6 @@ func migrate(nsfn, atlasfn, pdatafn string) (int, int, error) {
 			fmt.Printf("done %d\n", na)
 		}
 	}
-	if err := rows.Err(); err != nil {
-		return 0, 0, fmt.Errorf("query northstar db: scan rows: %w", err)
-	}
 	return na, np, nil
 }
 
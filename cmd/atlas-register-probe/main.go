@@ -0,0 +1,201 @@
+// Command atlas-register-probe simulates a full game server registration
+// against a running Atlas instance and reports the end-to-end latency.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r2northstar/atlas/pkg/nspkt"
+	"github.com/spf13/pflag"
+)
+
+var opt struct {
+	Addr     string
+	Name     string
+	Version  string
+	Count    int
+	Timeout  time.Duration
+	Interval time.Duration
+	Silent   bool
+	Help     bool
+}
+
+func init() {
+	pflag.StringVarP(&opt.Addr, "listen", "a", "[::]:0", "UDP listen address for the simulated game server")
+	pflag.StringVarP(&opt.Name, "name", "n", "atlas-register-probe", "Server name to register with")
+	pflag.StringVarP(&opt.Version, "launcher-version", "v", "0.0.0+dev", "Launcher version to send in the User-Agent")
+	pflag.IntVarP(&opt.Count, "count", "c", 1, "Number of registrations to perform")
+	pflag.DurationVarP(&opt.Timeout, "timeout", "t", time.Second*15, "Amount of time to wait for each registration")
+	pflag.DurationVarP(&opt.Interval, "interval", "i", time.Second, "Interval between registrations")
+	pflag.BoolVarP(&opt.Silent, "silent", "s", false, "Don't show the result")
+	pflag.BoolVarP(&opt.Help, "help", "h", false, "Show this help text")
+}
+
+func main() {
+	pflag.Parse()
+
+	if pflag.NArg() != 1 || opt.Help {
+		fmt.Printf("usage: %s [options] atlas_url\n\noptions:\n%s", os.Args[0], pflag.CommandLine.FlagUsages())
+		if opt.Help {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	base, err := url.Parse(strings.TrimSuffix(pflag.Arg(0), "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		fmt.Fprintf(os.Stderr, "fatal: invalid atlas url %q\n", pflag.Arg(0))
+		os.Exit(2)
+	}
+
+	uaddr, err := netip.ParseAddrPort(opt.Addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: invalid udp listen address: %v\n", err)
+		os.Exit(2)
+	}
+
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(uaddr))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+		os.Exit(2)
+	}
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	l := nspkt.NewListener()
+	l.HandleConnect(func(addr netip.AddrPort, uid uint64) {
+		if err := l.SendConnectReply(addr, uid); err != nil && !opt.Silent {
+			fmt.Fprintf(os.Stderr, "warning: failed to reply to connect from %s: %v\n", addr, err)
+		}
+	})
+	go l.Serve(conn)
+	defer l.Close()
+
+	var fail bool
+	for i := 0; i < opt.Count; i++ {
+		if i != 0 {
+			time.Sleep(opt.Interval)
+		}
+		id, d, err := probe(base, port)
+		if !opt.Silent {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: error: %v (after %s)\n", base, err, d.Truncate(time.Millisecond))
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: ok: registered %s in %s\n", base, id, d.Truncate(time.Millisecond))
+			}
+		}
+		if err != nil {
+			fail = true
+		}
+	}
+	if fail {
+		os.Exit(1)
+	}
+}
+
+// probe registers a server listening on the provided UDP port, returning the
+// server ID and the time it took for the registration (including verification)
+// to complete. The server is removed afterwards.
+func probe(base *url.URL, port uint16) (string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opt.Timeout)
+	defer cancel()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if fw, err := mw.CreateFormFile("modinfo", "modinfo.json"); err != nil {
+		return "", 0, err
+	} else if _, err := io.WriteString(fw, `{"Mods":[]}`); err != nil {
+		return "", 0, err
+	}
+	if err := mw.Close(); err != nil {
+		return "", 0, err
+	}
+
+	// note: mp_lobby servers which aren't private_match are hidden from the
+	// server list, so the probe won't show up for players
+	q := url.Values{
+		"port":        {strconv.Itoa(int(port))},
+		"authPort":    {"udp"},
+		"name":        {opt.Name},
+		"description": {"registration probe"},
+		"map":         {"mp_lobby"},
+		"playlist":    {"atlas_register_probe"},
+		"playerCount": {"0"},
+		"maxPlayers":  {"0"},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base.String()+"/server/add_server?"+q.Encode(), &body)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("User-Agent", "R2Northstar/"+opt.Version+" atlas-register-probe")
+
+	start := time.Now()
+
+	var obj struct {
+		Success bool   `json:"success"`
+		ID      string `json:"id"`
+		Error   *struct {
+			Code    string `json:"enum"`
+			Message string `json:"msg"`
+		} `json:"error"`
+	}
+	if err := doJSON(req, &obj); err != nil {
+		return "", time.Since(start), err
+	}
+	d := time.Since(start)
+
+	if !obj.Success {
+		if obj.Error != nil {
+			return "", d, fmt.Errorf("registration failed: %s: %s", obj.Error.Code, obj.Error.Message)
+		}
+		return "", d, fmt.Errorf("registration failed")
+	}
+	if obj.ID == "" {
+		return "", d, fmt.Errorf("registration succeeded, but no server id was returned")
+	}
+
+	if req, err := http.NewRequestWithContext(ctx, http.MethodDelete, base.String()+"/server/remove_server?id="+url.QueryEscape(obj.ID), nil); err == nil {
+		req.Header.Set("User-Agent", "R2Northstar/"+opt.Version+" atlas-register-probe")
+		if err := doJSON(req, nil); err != nil && !opt.Silent {
+			fmt.Fprintf(os.Stderr, "warning: failed to remove server %s: %v\n", obj.ID, err)
+		}
+	}
+	return obj.ID, d, nil
+}
+
+// doJSON does req, decoding the JSON response into obj if it is non-nil.
+func doJSON(req *http.Request, obj any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return fmt.Errorf("response status %d (%.128q)", resp.StatusCode, buf)
+	}
+	if obj != nil {
+		if err := json.Unmarshal(buf, obj); err != nil {
+			return fmt.Errorf("decode response: %w", err)
+		}
+	}
+	return nil
+}
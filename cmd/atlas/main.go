@@ -93,7 +93,7 @@ func main() {
 	go func() {
 		for range hch {
 			fmt.Println("got SIGHUP")
-			s.HandleSIGHUP()
+			s.HandleSIGHUP(reloadConfig(e))
 		}
 	}()
 
@@ -103,6 +103,28 @@ func main() {
 	}
 }
 
+// reloadConfig re-reads the config from the env file, if one was provided. If
+// it wasn't, or the config is invalid, nil is returned.
+func reloadConfig(e []string) *atlas.Config {
+	if pflag.NArg() == 0 {
+		return nil
+	}
+	x, err := readEnv(pflag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: reload: read env file: %v\n", err)
+		return nil
+	}
+	if v, ok := getEnvList("NOTIFY_SOCKET", e); ok {
+		x = append(x, "NOTIFY_SOCKET="+v)
+	}
+	var c atlas.Config
+	if err := c.UnmarshalEnv(x, false); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: reload: parse config: %v\n", err)
+		return nil
+	}
+	return &c
+}
+
 func getEnvList(k string, e ...[]string) (string, bool) {
 	for _, l := range e {
 		for _, x := range l {
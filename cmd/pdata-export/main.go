@@ -0,0 +1,111 @@
+// Command pdata-export exports all pdata from a pdata database to a tar
+// archive for backup.
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/r2northstar/atlas/db/pdatadb"
+	"github.com/spf13/pflag"
+)
+
+var opt struct {
+	Progress bool
+	Help     bool
+}
+
+func init() {
+	pflag.BoolVarP(&opt.Progress, "progress", "p", false, "Show progress")
+	pflag.BoolVarP(&opt.Help, "help", "h", false, "Show this help text")
+}
+
+func main() {
+	pflag.Parse()
+
+	if pflag.NArg() != 2 || opt.Help {
+		fmt.Printf("usage: %s [options] pdata_db output_tar|-\n\noptions:\n%s\nEach pdata blob is written as a file named UID.pdata.\n", os.Args[0], pflag.CommandLine.FlagUsages())
+		if opt.Help {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	n, err := export(pflag.Arg(0), pflag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d pdata blobs\n", n)
+}
+
+func export(pdatafn, outfn string) (int, error) {
+	if _, err := os.Stat(pdatafn); err != nil {
+		return 0, fmt.Errorf("open pdata db: %w", err)
+	}
+
+	pdb, err := pdatadb.Open(pdatafn)
+	if err != nil {
+		return 0, fmt.Errorf("open pdata db: %w", err)
+	}
+	defer pdb.Close()
+
+	if cur, to, err := pdb.Version(); err != nil {
+		return 0, fmt.Errorf("check pdata db version: %w", err)
+	} else if cur != to {
+		return 0, fmt.Errorf("pdata db version %d does not match the expected version %d", cur, to)
+	}
+
+	var w io.Writer
+	if outfn == "-" {
+		w = os.Stdout
+	} else {
+		if _, err := os.Stat(outfn); err == nil {
+			return 0, fmt.Errorf("create output: %q already exists", outfn)
+		}
+		f, err := os.Create(outfn)
+		if err != nil {
+			return 0, fmt.Errorf("create output: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var n int
+	t := time.Now()
+	tw := tar.NewWriter(w)
+	if err := pdb.IterPdata(func(uid uint64, buf []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strconv.FormatUint(uid, 10) + ".pdata",
+			Size:     int64(len(buf)),
+			Mode:     0644,
+			ModTime:  t,
+		}); err != nil {
+			return fmt.Errorf("write uid %d: %w", uid, err)
+		}
+		if _, err := tw.Write(buf); err != nil {
+			return fmt.Errorf("write uid %d: %w", uid, err)
+		}
+		if n++; opt.Progress && n%1000 == 0 {
+			fmt.Fprintf(os.Stderr, "... %d\n", n)
+		}
+		return nil
+	}); err != nil {
+		return n, err
+	}
+	if err := tw.Close(); err != nil {
+		return n, fmt.Errorf("write output: %w", err)
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err := f.Close(); err != nil {
+			return n, fmt.Errorf("write output: %w", err)
+		}
+	}
+	return n, nil
+}
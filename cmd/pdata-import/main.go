@@ -0,0 +1,123 @@
+// Command pdata-import imports pdata from a tar archive created by
+// pdata-export into a pdata database.
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/r2northstar/atlas/db/pdatadb"
+	"github.com/spf13/pflag"
+)
+
+var opt struct {
+	Overwrite bool
+	Progress  bool
+	Help      bool
+}
+
+func init() {
+	pflag.BoolVarP(&opt.Overwrite, "overwrite", "f", false, "Replace existing pdata instead of skipping it")
+	pflag.BoolVarP(&opt.Progress, "progress", "p", false, "Show progress")
+	pflag.BoolVarP(&opt.Help, "help", "h", false, "Show this help text")
+}
+
+func main() {
+	pflag.Parse()
+
+	if pflag.NArg() != 2 || opt.Help {
+		fmt.Printf("usage: %s [options] input_tar|- pdata_db\n\noptions:\n%s\nThe pdata db will be created and migrated if required.\n", os.Args[0], pflag.CommandLine.FlagUsages())
+		if opt.Help {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	n, skipped, err := import_(pflag.Arg(0), pflag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d pdata blobs, skipped %d existing\n", n, skipped)
+}
+
+func import_(infn, pdatafn string) (int, int, error) {
+	var r io.Reader
+	if infn == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(infn)
+		if err != nil {
+			return 0, 0, fmt.Errorf("open input: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	pdb, err := pdatadb.Open(pdatafn)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open pdata db: %w", err)
+	}
+	defer pdb.Close()
+
+	if cur, to, err := pdb.Version(); err != nil {
+		return 0, 0, fmt.Errorf("migrate pdata db: %w", err)
+	} else if cur > to {
+		return 0, 0, fmt.Errorf("migrate pdata db: database version %d is too new", cur)
+	} else if err = pdb.MigrateUp(context.Background(), to); err != nil {
+		return 0, 0, fmt.Errorf("migrate pdata db: %w", err)
+	}
+
+	var n, skipped int
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return n, skipped, fmt.Errorf("read input: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Base(hdr.Name)
+		uid, err := strconv.ParseUint(strings.TrimSuffix(name, ".pdata"), 10, 64)
+		if err != nil || !strings.HasSuffix(name, ".pdata") {
+			return n, skipped, fmt.Errorf("read input: invalid file name %q", hdr.Name)
+		}
+		if hdr.Size > 2<<20 {
+			return n, skipped, fmt.Errorf("read input: uid %d: pdata too large (%d bytes)", uid, hdr.Size)
+		}
+
+		if !opt.Overwrite {
+			if _, exists, err := pdb.GetPdataHash(uid); err != nil {
+				return n, skipped, fmt.Errorf("import uid %d: check existing: %w", uid, err)
+			} else if exists {
+				skipped++
+				continue
+			}
+		}
+
+		buf, err := io.ReadAll(tr)
+		if err != nil {
+			return n, skipped, fmt.Errorf("read input: uid %d: %w", uid, err)
+		}
+		if _, err := pdb.SetPdata(uid, buf); err != nil {
+			return n, skipped, fmt.Errorf("import uid %d: %w", uid, err)
+		}
+		if n++; opt.Progress && n%1000 == 0 {
+			fmt.Fprintf(os.Stderr, "... %d\n", n)
+		}
+	}
+	return n, skipped, nil
+}
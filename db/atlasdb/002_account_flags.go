@@ -0,0 +1,26 @@
+package atlasdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	migrate(up002, down002)
+}
+
+func up002(ctx context.Context, tx *sqlx.Tx) error {
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE accounts ADD COLUMN flags INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return fmt.Errorf("add accounts flags column: %w", err)
+	}
+	return nil
+}
+
+func down002(ctx context.Context, tx *sqlx.Tx) error {
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE accounts DROP COLUMN flags`); err != nil {
+		return fmt.Errorf("drop accounts flags column: %w", err)
+	}
+	return nil
+}
@@ -35,6 +35,24 @@ func Open(name string) (*DB, error) {
 	return &DB{x}, nil
 }
 
+// OpenReadOnly opens a read-only connection to an existing database (e.g., a
+// replica of another one). It will not be migrated, and writes will fail.
+func OpenReadOnly(name string) (*DB, error) {
+	x, err := sqlx.Connect("sqlite3", (&url.URL{
+		Scheme: "file", // required for sqlite to handle mode
+		Path:   name,
+		RawQuery: (url.Values{
+			"mode":          {"ro"},
+			"_cache_size":   {"-32000"},
+			"_busy_timeout": {"6000"},
+		}).Encode(),
+	}).String())
+	if err != nil {
+		return nil, err
+	}
+	return &DB{x}, nil
+}
+
 func (db *DB) Close() error {
 	return db.x.Close()
 }
@@ -49,22 +67,55 @@ func (db *DB) GetUIDsByUsername(username string) ([]uint64, error) {
 	return u, nil
 }
 
+// accountRow is a row in the accounts table.
+type accountRow struct {
+	UID        uint64 `db:"uid"`
+	Username   string `db:"username"`
+	AuthIP     string `db:"auth_ip"`
+	AuthToken  string `db:"auth_token"`
+	AuthExpiry int64  `db:"auth_expiry"`
+	LastServer string `db:"last_server"`
+	Flags      int64  `db:"flags"`
+}
+
 func (db *DB) GetAccount(uid uint64) (*api0.Account, error) {
-	var obj struct {
-		UID        uint64 `db:"uid"`
-		Username   string `db:"username"`
-		AuthIP     string `db:"auth_ip"`
-		AuthToken  string `db:"auth_token"`
-		AuthExpiry int64  `db:"auth_expiry"`
-		LastServer string `db:"last_server"`
-	}
+	var obj accountRow
 	if err := db.x.Get(&obj, `SELECT * FROM accounts WHERE uid = ?`, uid); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
+	return obj.account()
+}
+
+// IterAccounts calls fn for each account in the database, in ascending order
+// by username (case-insensitive), then uid, stopping if fn returns an error.
+func (db *DB) IterAccounts(fn func(a *api0.Account) error) error {
+	rows, err := db.x.Queryx(`SELECT * FROM accounts ORDER BY username, uid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var obj accountRow
+		if err := rows.StructScan(&obj); err != nil {
+			return err
+		}
+		a, err := obj.account()
+		if err != nil {
+			return fmt.Errorf("uid %d: %w", obj.UID, err)
+		}
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
 
+// account converts obj into an Account.
+func (obj accountRow) account() (*api0.Account, error) {
 	var authExpiry time.Time
 	if obj.AuthExpiry != 0 {
 		authExpiry = time.Unix(obj.AuthExpiry, 0)
@@ -86,6 +137,7 @@ func (db *DB) GetAccount(uid uint64) (*api0.Account, error) {
 		AuthToken:       obj.AuthToken,
 		AuthTokenExpiry: authExpiry,
 		LastServerID:    obj.LastServer,
+		Flags:           api0.AccountFlags(obj.Flags),
 	}, nil
 }
 
@@ -102,8 +154,8 @@ func (db *DB) SaveAccount(a *api0.Account) error {
 
 	if _, err := db.x.NamedExec(`
 		INSERT OR REPLACE INTO
-		accounts ( uid,  username,  auth_ip,  auth_token,  auth_expiry,  last_server)
-		VALUES   (:uid, :username, :auth_ip, :auth_token, :auth_expiry, :last_server)
+		accounts ( uid,  username,  auth_ip,  auth_token,  auth_expiry,  last_server,  flags)
+		VALUES   (:uid, :username, :auth_ip, :auth_token, :auth_expiry, :last_server, :flags)
 	`, map[string]any{
 		"uid":         a.UID,
 		"username":    a.Username,
@@ -111,6 +163,7 @@ func (db *DB) SaveAccount(a *api0.Account) error {
 		"auth_token":  a.AuthToken,
 		"auth_expiry": authExpiry,
 		"last_server": a.LastServerID,
+		"flags":       int64(a.Flags),
 	}); err != nil {
 		return err
 	}
@@ -3,9 +3,11 @@ package atlasdb
 import (
 	"context"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/r2northstar/atlas/pkg/api/api0"
 	"github.com/r2northstar/atlas/pkg/api/api0/api0testutil"
 )
 
@@ -29,3 +31,76 @@ func TestAccountStorage(t *testing.T) {
 
 	api0testutil.TestAccountStorage(t, db)
 }
+
+func TestOpenReadOnly(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "atlas.db")
+
+	db, err := Open(p)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, tgt, err := db.Version()
+	if err != nil {
+		panic(err)
+	}
+	if err := db.MigrateUp(context.Background(), tgt); err != nil {
+		panic(err)
+	}
+	if err := db.SaveAccount(&api0.Account{UID: 1234, Username: "test"}); err != nil {
+		panic(err)
+	}
+
+	ro, err := OpenReadOnly(p)
+	if err != nil {
+		t.Fatalf("open read-only: %v", err)
+	}
+	defer ro.Close()
+
+	if a, err := ro.GetAccount(1234); err != nil {
+		t.Errorf("get account: %v", err)
+	} else if a == nil || a.Username != "test" {
+		t.Errorf("get account: incorrect account %#v", a)
+	}
+	if err := ro.SaveAccount(&api0.Account{UID: 5678}); err == nil {
+		t.Errorf("expected write to read-only database to fail")
+	}
+}
+
+func TestIterAccounts(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "atlas.db"))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, tgt, err := db.Version()
+	if err != nil {
+		panic(err)
+	}
+	if err := db.MigrateUp(context.Background(), tgt); err != nil {
+		panic(err)
+	}
+	for _, a := range []api0.Account{
+		{UID: 3, Username: "b"},
+		{UID: 2, Username: "A"},
+		{UID: 1, Username: "a"},
+		{UID: 4, Username: ""},
+	} {
+		if err := db.SaveAccount(&a); err != nil {
+			panic(err)
+		}
+	}
+
+	var uids []uint64
+	if err := db.IterAccounts(func(a *api0.Account) error {
+		uids = append(uids, a.UID)
+		return nil
+	}); err != nil {
+		t.Fatalf("iterate accounts: %v", err)
+	}
+	if exp := []uint64{4, 1, 2, 3}; !slices.Equal(uids, exp) {
+		t.Errorf("expected uids %v, got %v", exp, uids)
+	}
+}
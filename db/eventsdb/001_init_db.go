@@ -0,0 +1,50 @@
+package eventsdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	migrate(up001, down001)
+}
+
+func up001(ctx context.Context, tx *sqlx.Tx) error {
+	if _, err := tx.ExecContext(ctx, strings.ReplaceAll(`
+		CREATE TABLE server_events (
+			time   INTEGER NOT NULL,
+			type   TEXT    NOT NULL,
+			server TEXT    NOT NULL,
+			addr   TEXT    NOT NULL,
+			name   TEXT    NOT NULL DEFAULT '',
+			region TEXT    NOT NULL DEFAULT '',
+			gap    INTEGER NOT NULL DEFAULT 0
+		) STRICT;
+	`, `
+		`, "\n")); err != nil {
+		return fmt.Errorf("create server_events table: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE INDEX server_events_time_idx ON server_events(time)`); err != nil {
+		return fmt.Errorf("create server_events time index: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE INDEX server_events_server_idx ON server_events(server, time)`); err != nil {
+		return fmt.Errorf("create server_events server index: %w", err)
+	}
+	return nil
+}
+
+func down001(ctx context.Context, tx *sqlx.Tx) error {
+	if _, err := tx.ExecContext(ctx, `DROP INDEX server_events_server_idx`); err != nil {
+		return fmt.Errorf("drop server_events_server_idx index: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DROP INDEX server_events_time_idx`); err != nil {
+		return fmt.Errorf("drop server_events_time_idx index: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DROP TABLE server_events`); err != nil {
+		return fmt.Errorf("drop server_events table: %w", err)
+	}
+	return nil
+}
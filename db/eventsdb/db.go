@@ -0,0 +1,100 @@
+// Package eventsdb implements sqlite3 database storage for server lifecycle
+// events.
+package eventsdb
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/r2northstar/atlas/pkg/api/api0"
+)
+
+// DB stores server events in a sqlite3 database.
+type DB struct {
+	x *sqlx.DB
+}
+
+// Open opens a DB from the provided sqlite3 filename.
+func Open(name string) (*DB, error) {
+	// note: WAL and a larger cache makes our writes and queries MUCH faster
+	x, err := sqlx.Connect("sqlite3", (&url.URL{
+		Path: name,
+		RawQuery: (url.Values{
+			"_journal":      {"WAL"},
+			"_cache_size":   {"-32000"},
+			"_busy_timeout": {"6000"},
+		}).Encode(),
+	}).String())
+	if err != nil {
+		return nil, err
+	}
+	return &DB{x}, nil
+}
+
+func (db *DB) Close() error {
+	return db.x.Close()
+}
+
+// AddServerEvents inserts events in a single transaction.
+func (db *DB) AddServerEvents(es []api0.ServerEvent) error {
+	tx, err := db.x.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Preparex(`
+		INSERT INTO
+		server_events (time, type, server, addr, name, region, gap)
+		VALUES        (?,    ?,    ?,      ?,    ?,    ?,      ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range es {
+		if _, err := stmt.Exec(e.Time.UnixMilli(), string(e.Type), e.ID, e.Addr.String(), e.Name, e.Region, e.Gap.Milliseconds()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetServerEvents gets the events for the server with the provided ID, oldest
+// first.
+func (db *DB) GetServerEvents(id string) ([]api0.ServerEvent, error) {
+	var objs []struct {
+		Time   int64  `db:"time"`
+		Type   string `db:"type"`
+		Server string `db:"server"`
+		Addr   string `db:"addr"`
+		Name   string `db:"name"`
+		Region string `db:"region"`
+		Gap    int64  `db:"gap"`
+	}
+	if err := db.x.Select(&objs, `SELECT * FROM server_events WHERE server = ? ORDER BY time, rowid`, id); err != nil {
+		return nil, err
+	}
+
+	es := make([]api0.ServerEvent, len(objs))
+	for i, obj := range objs {
+		addr, err := netip.ParseAddrPort(obj.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("parse addr: %w", err)
+		}
+		es[i] = api0.ServerEvent{
+			Time:   time.UnixMilli(obj.Time),
+			Type:   api0.ServerEventType(obj.Type),
+			ID:     obj.Server,
+			Addr:   addr,
+			Name:   obj.Name,
+			Region: obj.Region,
+			Gap:    time.Duration(obj.Gap) * time.Millisecond,
+		}
+	}
+	return es, nil
+}
@@ -0,0 +1,55 @@
+package eventsdb
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/r2northstar/atlas/pkg/api/api0"
+)
+
+func TestServerEvents(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	cur, tgt, err := db.Version()
+	if err != nil {
+		panic(err)
+	}
+	if cur != 0 {
+		panic("current version not 0")
+	}
+	if err := db.MigrateUp(context.Background(), tgt); err != nil {
+		panic(err)
+	}
+
+	t0 := time.UnixMilli(time.Now().UnixMilli())
+	es := []api0.ServerEvent{
+		{Time: t0, Type: api0.ServerEventRegister, ID: "a", Addr: netip.MustParseAddrPort("127.0.0.1:37015"), Name: "test", Region: "Local"},
+		{Time: t0.Add(time.Second), Type: api0.ServerEventVerify, ID: "a", Addr: netip.MustParseAddrPort("127.0.0.1:37015"), Name: "test", Region: "Local"},
+		{Time: t0.Add(time.Second), Type: api0.ServerEventRegister, ID: "b", Addr: netip.MustParseAddrPort("[::1]:37015"), Name: "test2"},
+		{Time: t0.Add(time.Minute), Type: api0.ServerEventRevive, ID: "a", Addr: netip.MustParseAddrPort("127.0.0.1:37015"), Name: "test", Region: "Local", Gap: time.Second * 45},
+	}
+	if err := db.AddServerEvents(es); err != nil {
+		t.Fatalf("add events: %v", err)
+	}
+
+	if act, err := db.GetServerEvents("a"); err != nil {
+		t.Fatalf("get events: %v", err)
+	} else if exp := []api0.ServerEvent{es[0], es[1], es[3]}; !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+
+	if act, err := db.GetServerEvents("c"); err != nil {
+		t.Fatalf("get events: %v", err)
+	} else if len(act) != 0 {
+		t.Errorf("expected no events, got %v", act)
+	}
+}
@@ -99,43 +99,82 @@ func (db *DB) GetPdataCached(uid uint64, sha [sha256.Size]byte) (buf []byte, exi
 		return nil, false, err
 	}
 
-	switch obj.PdataComp {
+	if buf, err = db.decodePdata(obj.PdataComp, obj.PdataHash, obj.Pdata); err != nil {
+		return nil, false, err
+	}
+	return buf, true, nil
+}
+
+// IterPdata calls fn for each pdata blob in the database, in ascending order
+// by uid, stopping if fn returns an error. The buffer passed to fn must not be
+// retained after it returns.
+func (db *DB) IterPdata(fn func(uid uint64, buf []byte) error) error {
+	rows, err := db.x.Queryx(`SELECT uid, pdata_comp, pdata_hash, pdata FROM pdata ORDER BY uid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var obj struct {
+			UID       uint64 `db:"uid"`
+			PdataComp string `db:"pdata_comp"`
+			PdataHash string `db:"pdata_hash"`
+			Pdata     []byte `db:"pdata"`
+		}
+		if err := rows.StructScan(&obj); err != nil {
+			return err
+		}
+		buf, err := db.decodePdata(obj.PdataComp, obj.PdataHash, obj.Pdata)
+		if err != nil {
+			return fmt.Errorf("uid %d: %w", obj.UID, err)
+		}
+		if err := fn(obj.UID, buf); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// decodePdata decompresses and verifies a pdata blob.
+func (db *DB) decodePdata(pdataComp, pdataHash string, pdata []byte) ([]byte, error) {
+	switch pdataComp {
 	case "":
 	case "gzip":
 		var b bytes.Buffer
 		var zr *gzip.Reader
 		var err error
 		if o := db.gzipR.Get(); o == nil {
-			zr, err = gzip.NewReader(bytes.NewReader(obj.Pdata))
+			zr, err = gzip.NewReader(bytes.NewReader(pdata))
 		} else {
 			zr = o.(*gzip.Reader)
-			err = zr.Reset(bytes.NewReader(obj.Pdata))
+			err = zr.Reset(bytes.NewReader(pdata))
 		}
 		defer db.gzipR.Put(zr)
 		if err != nil {
-			return nil, false, fmt.Errorf("decompress gzip: %w", err)
+			return nil, fmt.Errorf("decompress gzip: %w", err)
 		}
 		if _, err := b.ReadFrom(zr); err != nil {
-			return nil, false, fmt.Errorf("decompress gzip: %w", err)
+			return nil, fmt.Errorf("decompress gzip: %w", err)
 		}
 		if err := zr.Close(); err != nil {
-			return nil, false, fmt.Errorf("decompress gzip: %w", err)
+			return nil, fmt.Errorf("decompress gzip: %w", err)
 		}
-		obj.Pdata = b.Bytes()
+		pdata = b.Bytes()
 	default:
-		return nil, false, fmt.Errorf("unsupported compression method %q", obj.PdataComp)
+		return nil, fmt.Errorf("unsupported compression method %q", pdataComp)
 	}
 
 	var pdataHashB [sha256.Size]byte
-	if b, err := hex.DecodeString(obj.PdataHash); err != nil || len(b) != len(pdataHashB) {
-		return nil, false, fmt.Errorf("invalid pdata hash")
+	if b, err := hex.DecodeString(pdataHash); err != nil || len(b) != len(pdataHashB) {
+		return nil, fmt.Errorf("invalid pdata hash")
 	} else {
 		copy(pdataHashB[:], b)
 	}
-	if sha256.Sum256(obj.Pdata) != pdataHashB {
-		return nil, false, fmt.Errorf("pdata checksum mismatch")
+	if sha256.Sum256(pdata) != pdataHashB {
+		return nil, fmt.Errorf("pdata checksum mismatch")
 	}
-	return obj.Pdata, true, nil
+	return pdata, nil
 }
 
 func (db *DB) SetPdata(uid uint64, buf []byte) (n int, err error) {
@@ -1,7 +1,9 @@
 package pdatadb
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"path/filepath"
 	"testing"
 
@@ -29,3 +31,59 @@ func TestPdataStorage(t *testing.T) {
 
 	api0testutil.TestPdataStorage(t, db)
 }
+
+func TestIterPdata(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "pdata.db"))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	if _, tgt, err := db.Version(); err != nil {
+		panic(err)
+	} else if err := db.MigrateUp(context.Background(), tgt); err != nil {
+		panic(err)
+	}
+
+	exp := map[uint64][]byte{
+		3: bytes.Repeat([]byte{'a'}, 4096), // compressible
+		1: {1, 2, 3},                       // not compressible
+		2: {},
+	}
+	for uid, buf := range exp {
+		if _, err := db.SetPdata(uid, buf); err != nil {
+			t.Fatalf("set pdata %d: %v", uid, err)
+		}
+	}
+
+	var last uint64
+	var n int
+	if err := db.IterPdata(func(uid uint64, buf []byte) error {
+		if uid <= last {
+			t.Errorf("expected ascending uids, got %d after %d", uid, last)
+		}
+		last = uid
+		if !bytes.Equal(buf, exp[uid]) {
+			t.Errorf("uid %d: incorrect pdata", uid)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatalf("iter pdata: %v", err)
+	}
+	if n != len(exp) {
+		t.Errorf("expected %d pdata, got %d", len(exp), n)
+	}
+
+	stop := errors.New("stop")
+	n = 0
+	if err := db.IterPdata(func(uid uint64, buf []byte) error {
+		n++
+		return stop
+	}); err != stop {
+		t.Errorf("expected iteration error to be returned, got %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected iteration to stop after the first error")
+	}
+}
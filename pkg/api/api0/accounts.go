@@ -1,11 +1,14 @@
 package api0
 
 import (
+	"errors"
 	"io"
 	"net/http"
-	"net/netip"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/klauspost/compress/gzip"
 	"github.com/r2northstar/atlas/pkg/pdata"
 	"github.com/rs/zerolog/hlog"
 )
@@ -29,7 +32,34 @@ func (h *Handler) handleAccountsWritePersistence(w http.ResponseWriter, r *http.
 		return
 	}
 
+	switch ce := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); ce {
+	case "", "identity":
+		h.m().accounts_writepersistence_uploads_total.none.Inc()
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			h.m().accounts_writepersistence_requests_total.reject_bad_request.Inc()
+			respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("invalid gzip request body: %v", err))
+			return
+		}
+		defer zr.Close()
+
+		// limit the decompressed size to the max pdata size plus some room
+		// for the rest of the multipart form
+		r.Body = http.MaxBytesReader(w, io.NopCloser(zr), (2<<20)+(64<<10))
+		h.m().accounts_writepersistence_uploads_total.gzip.Inc()
+	default:
+		h.m().accounts_writepersistence_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusUnsupportedMediaType, ErrorCode_BAD_REQUEST.MessageObjf("unsupported content encoding %q", ce))
+		return
+	}
+
 	if err := r.ParseMultipartForm(2 << 20); err != nil {
+		if mbe := new(http.MaxBytesError); errors.As(err, &mbe) {
+			h.m().accounts_writepersistence_requests_total.reject_too_large.Inc()
+			respFail(w, r, http.StatusNotFound, ErrorCode_BAD_REQUEST.MessageObjf("decompressed request body is too large"))
+			return
+		}
 		h.m().accounts_writepersistence_requests_total.reject_bad_request.Inc()
 		respFail(w, r, http.StatusNotFound, ErrorCode_BAD_REQUEST.MessageObjf("failed to parse multipart form: %v", err))
 		return
@@ -96,16 +126,21 @@ func (h *Handler) handleAccountsWritePersistence(w http.ResponseWriter, r *http.
 
 	serverID := r.URL.Query().Get("serverId") // blank on listen server
 
-	raddr, err := netip.ParseAddrPort(r.RemoteAddr)
+	raddr, err := parseRemoteAddr(r)
 	if err != nil {
-		hlog.FromRequest(r).Error().
+		hlog.FromRequest(r).Warn().
 			Err(err).
 			Msgf("failed to parse remote ip %q", r.RemoteAddr)
-		h.m().accounts_writepersistence_requests_total.fail_other_error.Inc()
-		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		h.m().accounts_writepersistence_requests_total.reject_bad_remote_addr.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("unable to determine client address"))
 		return
 	}
 
+	// ensure the account doesn't change (e.g., due to a concurrent
+	// origin_auth) between checking it and saving the pdata
+	unlock := h.acctLock.Lock(uid)
+	defer unlock()
+
 	acct, err := h.AccountStorage.GetAccount(uid)
 	if err != nil {
 		hlog.FromRequest(r).Error().
@@ -157,6 +192,18 @@ func (h *Handler) handleAccountsWritePersistence(w http.ResponseWriter, r *http.
 		return
 	} else {
 		h.m().accounts_writepersistence_stored_size_bytes.Update(float64(n))
+		if len(buf) != 0 {
+			h.m().pdata_compression_ratio.Update(float64(n) / float64(len(buf)))
+		}
+		if h.PdataWarnSize > 0 && n > h.PdataWarnSize {
+			hlog.FromRequest(r).Warn().
+				Uint64("uid", uid).
+				Int("size", n).
+				Int("raw_size", len(buf)).
+				Int("warn_size", h.PdataWarnSize).
+				Msgf("stored pdata exceeds warning threshold")
+			h.m().pdata_stored_size_warnings_total.Inc()
+		}
 	}
 
 	h.m().accounts_writepersistence_requests_total.success.Inc()
@@ -184,11 +231,9 @@ func (h *Handler) handleAccountsLookupUID(w http.ResponseWriter, r *http.Request
 	username := r.URL.Query().Get("username")
 	if username == "" {
 		h.m().accounts_lookupuid_requests_total.reject_bad_request.Inc()
-		respJSON(w, r, http.StatusBadRequest, map[string]any{
-			"success":  false,
+		respFailFields(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("username param is required"), map[string]any{
 			"username": "",
 			"matches":  []uint64{},
-			"error":    ErrorCode_BAD_REQUEST.MessageObjf("username param is required"),
 		})
 		return
 	}
@@ -198,19 +243,30 @@ func (h *Handler) handleAccountsLookupUID(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	uids, err := h.AccountStorage.GetUIDsByUsername(username)
-	if err != nil {
-		hlog.FromRequest(r).Error().
-			Err(err).
-			Msgf("failed to find account uids from storage for %q", username)
-		h.m().accounts_lookupuid_requests_total.fail_storage_error_account.Inc()
-		respJSON(w, r, http.StatusInternalServerError, map[string]any{
-			"success":  false,
-			"username": username,
-			"matches":  []uint64{},
-			"error":    ErrorCode_INTERNAL_SERVER_ERROR.MessageObj(),
-		})
-		return
+	_, uidsCache := h.accountLookupCaches()
+	uids, cached := uidsCache.Get(strings.ToLower(username), time.Now())
+	if uidsCache.TTL > 0 {
+		if cached {
+			h.m().accounts_lookup_cache_requests_total.lookupuid_hit.Inc()
+		} else {
+			h.m().accounts_lookup_cache_requests_total.lookupuid_miss.Inc()
+		}
+	}
+	if !cached {
+		var err error
+		uids, err = h.accountLookupStorage().GetUIDsByUsername(username)
+		if err != nil {
+			hlog.FromRequest(r).Error().
+				Err(err).
+				Msgf("failed to find account uids from storage for %q", username)
+			h.m().accounts_lookupuid_requests_total.fail_storage_error_account.Inc()
+			respFailFields(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj(), map[string]any{
+				"username": username,
+				"matches":  []uint64{},
+			})
+			return
+		}
+		uidsCache.Set(strings.ToLower(username), uids, time.Now())
 	}
 
 	switch len(uids) {
@@ -249,11 +305,9 @@ func (h *Handler) handleAccountsGetUsername(w http.ResponseWriter, r *http.Reque
 	uidQ := r.URL.Query().Get("uid")
 	if uidQ == "" {
 		h.m().accounts_getusername_requests_total.reject_bad_request.Inc()
-		respJSON(w, r, http.StatusBadRequest, map[string]any{
-			"success": false,
+		respFailFields(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("uid param is required"), map[string]any{
 			"uid":     "",
 			"matches": []string{},
-			"error":   ErrorCode_BAD_REQUEST.MessageObjf("uid param is required"),
 		})
 		return
 	}
@@ -261,34 +315,40 @@ func (h *Handler) handleAccountsGetUsername(w http.ResponseWriter, r *http.Reque
 	uid, err := strconv.ParseUint(uidQ, 10, 64)
 	if err != nil {
 		h.m().accounts_getusername_requests_total.reject_bad_request.Inc()
-		respJSON(w, r, http.StatusNotFound, map[string]any{
-			"success": false,
+		respFailFields(w, r, http.StatusNotFound, ErrorCode_PLAYER_NOT_FOUND.MessageObj(), map[string]any{
 			"uid":     strconv.FormatUint(uid, 10),
 			"matches": []string{},
-			"error":   ErrorCode_PLAYER_NOT_FOUND.MessageObj(),
 		})
 		return
 	}
 
-	acct, err := h.AccountStorage.GetAccount(uid)
-	if err != nil {
-		hlog.FromRequest(r).Error().
-			Err(err).
-			Uint64("uid", uid).
-			Msgf("failed to read account from storage")
-		h.m().accounts_getusername_requests_total.fail_storage_error_account.Inc()
-		respJSON(w, r, http.StatusInternalServerError, map[string]any{
-			"success": false,
-			"uid":     strconv.FormatUint(uid, 10),
-			"matches": []string{},
-			"error":   ErrorCode_INTERNAL_SERVER_ERROR.MessageObj(),
-		})
-		return
+	usernameCache, _ := h.accountLookupCaches()
+	username, cached := usernameCache.Get(uid, time.Now())
+	if usernameCache.TTL > 0 {
+		if cached {
+			h.m().accounts_lookup_cache_requests_total.getusername_hit.Inc()
+		} else {
+			h.m().accounts_lookup_cache_requests_total.getusername_miss.Inc()
+		}
 	}
-
-	var username string
-	if acct != nil {
-		username = acct.Username
+	if !cached {
+		acct, err := h.accountLookupStorage().GetAccount(uid)
+		if err != nil {
+			hlog.FromRequest(r).Error().
+				Err(err).
+				Uint64("uid", uid).
+				Msgf("failed to read account from storage")
+			h.m().accounts_getusername_requests_total.fail_storage_error_account.Inc()
+			respFailFields(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj(), map[string]any{
+				"uid":     strconv.FormatUint(uid, 10),
+				"matches": []string{},
+			})
+			return
+		}
+		if acct != nil {
+			username = acct.Username
+		}
+		usernameCache.Set(uid, username, time.Now())
 	}
 	if username == "" {
 		h.m().accounts_getusername_requests_total.success_match.Inc()
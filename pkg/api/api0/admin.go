@@ -0,0 +1,187 @@
+package api0
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// checkAdminAuth checks whether r has the AdminSecret as a bearer token. If
+// AdminSecret is empty, it always returns false.
+func (h *Handler) checkAdminAuth(r *http.Request) bool {
+	if h.AdminSecret == "" {
+		return false
+	}
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(tok), []byte(h.AdminSecret)) == 1
+}
+
+// handleAdminAccountFlags gets (GET) or replaces (POST, with the flags param)
+// the flags for the account with the id param.
+func (h *Handler) handleAdminAccountFlags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		h.m().admin_account_flags_requests_total.http_method_not_allowed.Inc()
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache, no-store")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Pragma", "no-cache")
+
+	if !h.checkAdminAuth(r) {
+		h.m().admin_account_flags_requests_total.reject_unauthorized.Inc()
+		respFail(w, r, http.StatusUnauthorized, ErrorCode_BAD_REQUEST.MessageObjf("unauthorized"))
+		return
+	}
+
+	uidQ := r.URL.Query().Get("id")
+	if uidQ == "" {
+		h.m().admin_account_flags_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("id param is required"))
+		return
+	}
+
+	uid, err := strconv.ParseUint(uidQ, 10, 64)
+	if err != nil {
+		h.m().admin_account_flags_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_PLAYER_NOT_FOUND.MessageObj())
+		return
+	}
+
+	var flags AccountFlags
+	if r.Method == http.MethodPost {
+		if !r.URL.Query().Has("flags") {
+			h.m().admin_account_flags_requests_total.reject_bad_request.Inc()
+			respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("flags param is required"))
+			return
+		}
+		if flags, err = ParseAccountFlags(r.URL.Query().Get("flags")); err != nil {
+			h.m().admin_account_flags_requests_total.reject_bad_request.Inc()
+			respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("invalid flags: %v", err))
+			return
+		}
+
+		// prevent concurrent auth requests from clobbering the change (all
+		// account read-modify-writes are done under this lock)
+		unlock := h.acctLock.Lock(uid)
+		defer unlock()
+	}
+
+	acct, err := h.AccountStorage.GetAccount(uid)
+	if err != nil {
+		hlog.FromRequest(r).Error().
+			Err(err).
+			Uint64("uid", uid).
+			Msgf("failed to read account from storage")
+		h.m().admin_account_flags_requests_total.fail_storage_error_account.Inc()
+		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		return
+	}
+	if acct == nil {
+		h.m().admin_account_flags_requests_total.reject_player_not_found.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_PLAYER_NOT_FOUND.MessageObj())
+		return
+	}
+
+	if r.Method == http.MethodPost && acct.Flags != flags {
+		prev := acct.Flags
+		acct.Flags = flags
+
+		if err := h.AccountStorage.SaveAccount(acct); err != nil {
+			hlog.FromRequest(r).Error().
+				Err(err).
+				Uint64("uid", uid).
+				Msgf("failed to save account to storage")
+			h.m().admin_account_flags_requests_total.fail_storage_error_account.Inc()
+			respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+			return
+		}
+
+		hlog.FromRequest(r).Info().
+			Uint64("uid", uid).
+			Stringer("flags", flags).
+			Stringer("prev_flags", prev).
+			Msg("updated account flags")
+	}
+
+	h.m().admin_account_flags_requests_total.success.Inc()
+	respJSON(w, r, http.StatusOK, map[string]any{
+		"success": true,
+		"uid":     strconv.FormatUint(acct.UID, 10),
+		"flags":   acct.Flags.String(),
+	})
+}
+
+// handleAdminAccountAuth gets the auth session status for the account with the
+// id param.
+func (h *Handler) handleAdminAccountAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.m().admin_account_auth_requests_total.http_method_not_allowed.Inc()
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache, no-store")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Pragma", "no-cache")
+
+	if !h.checkAdminAuth(r) {
+		h.m().admin_account_auth_requests_total.reject_unauthorized.Inc()
+		respFail(w, r, http.StatusUnauthorized, ErrorCode_BAD_REQUEST.MessageObjf("unauthorized"))
+		return
+	}
+
+	uidQ := r.URL.Query().Get("id")
+	if uidQ == "" {
+		h.m().admin_account_auth_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("id param is required"))
+		return
+	}
+
+	uid, err := strconv.ParseUint(uidQ, 10, 64)
+	if err != nil {
+		h.m().admin_account_auth_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_PLAYER_NOT_FOUND.MessageObj())
+		return
+	}
+
+	acct, err := h.AccountStorage.GetAccount(uid)
+	if err != nil {
+		hlog.FromRequest(r).Error().
+			Err(err).
+			Uint64("uid", uid).
+			Msgf("failed to read account from storage")
+		h.m().admin_account_auth_requests_total.fail_storage_error_account.Inc()
+		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		return
+	}
+	if acct == nil {
+		h.m().admin_account_auth_requests_total.reject_player_not_found.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_PLAYER_NOT_FOUND.MessageObj())
+		return
+	}
+
+	obj := map[string]any{
+		"success":       true,
+		"uid":           strconv.FormatUint(acct.UID, 10),
+		"authenticated": acct.AuthToken != "" && time.Now().Before(acct.AuthTokenExpiry),
+		"lastServerId":  acct.LastServerID,
+	}
+	if !acct.AuthTokenExpiry.IsZero() {
+		// note: the issue time is derived from the current token expiry
+		// time, so it will be inaccurate if it has been changed since
+		obj["authIssued"] = acct.AuthTokenExpiry.Add(-h.tokenExpiryTime()).Unix()
+		obj["authExpiry"] = acct.AuthTokenExpiry.Unix()
+	}
+	if acct.AuthIP.IsValid() {
+		obj["authIp"] = acct.AuthIP.String()
+	}
+
+	h.m().admin_account_auth_requests_total.success.Inc()
+	respJSON(w, r, http.StatusOK, obj)
+}
@@ -14,22 +14,30 @@ package api0
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/netip"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/klauspost/compress/gzip"
 	"github.com/pg9182/ip2x"
 	"github.com/r2northstar/atlas/pkg/eax"
 	"github.com/r2northstar/atlas/pkg/metricsx"
 	"github.com/r2northstar/atlas/pkg/nspkt"
+	"github.com/r2northstar/atlas/pkg/pdata"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"golang.org/x/mod/semver"
 )
@@ -42,6 +50,12 @@ type Handler struct {
 	// AccountStorage stores accounts. It must be non-nil.
 	AccountStorage AccountStorage
 
+	// AccountLookupStorage, if provided, is used instead of AccountStorage for
+	// read-only account lookups (lookup_uid and get_username), e.g., to offload
+	// them to a replica. It may be slightly stale. Account reads which may be
+	// followed by a write always use AccountStorage.
+	AccountLookupStorage AccountStorage
+
 	// PdataStorage stores player data. It must be non-nil.
 	PdataStorage PdataStorage
 
@@ -54,10 +68,58 @@ type Handler struct {
 	// EAXClient makes requests to the EAX API.
 	EAXClient *eax.Client
 
+	// ServerAuditLog, if provided, is used to log an entry for each successful
+	// server registration, update, heartbeat, and removal.
+	ServerAuditLog *zerolog.Logger
+
 	// CleanBadWords is used to filter bad words from server names and
 	// descriptions. If not provided, words will not be filtered.
 	CleanBadWords func(s string) string
 
+	// BlockServerName checks whether a game server name should be rejected
+	// outright. It is called with the name before bad words are cleaned. If
+	// not provided, no names are blocked.
+	BlockServerName func(name string) bool
+
+	// SanitizeServerText controls whether to remove control and format
+	// characters (e.g., zero-width spaces and bidi overrides) and invalid UTF-8
+	// from server names and descriptions before cleaning bad words. Newlines
+	// are kept in descriptions.
+	SanitizeServerText bool
+
+	// AllowRequiredMod checks whether a game server is allowed to mark a mod as
+	// required on the client. If it returns false, RequiredOnClient is forced
+	// to false. If not provided, all mods are allowed.
+	AllowRequiredMod func(name string) bool
+
+	// RequireMod, if set, is the case-insensitive name of a mod which game
+	// servers must be running to be listed.
+	RequireMod string
+
+	// RequireModMinVersion, if set, is the minimum semver version of RequireMod
+	// which game servers must be running. If it is not valid semver, the
+	// version must match exactly.
+	RequireModMinVersion string
+
+	// RequestTimeout is the overall deadline for handlers which depend on
+	// external services (origin auth and auth with server). If zero, no
+	// additional deadline is applied.
+	RequestTimeout time.Duration
+
+	// DefaultPdata is the pdata to use for players without any stored pdata.
+	// If not provided, pdata.DefaultPdata is used.
+	DefaultPdata []byte
+
+	// PdataWarnSize, if non-zero, is the stored pdata size (in bytes, as
+	// returned by PdataStorage) above which a warning is logged when pdata is
+	// written. This is intended to help detect pdata bloat or abuse.
+	PdataWarnSize int
+
+	// MOTD, if provided, gets a message of the day to include in successful
+	// auth responses as "motd". If it returns an empty string, the field is
+	// omitted.
+	MOTD func() string
+
 	// MainMenuPromos gets the main menu promos to return for a request.
 	MainMenuPromos func(*http.Request) MainMenuPromos
 
@@ -72,28 +134,169 @@ type Handler struct {
 	// limit is applied. If 0, a reasonable default is used.
 	MaxServersPerIP int
 
+	// TrustedServerLimits overrides MaxServersPerIP for servers registering
+	// from specific prefixes (e.g., community hosters running many servers
+	// from one IP). If a server matches multiple prefixes, the highest limit
+	// is used.
+	TrustedServerLimits []TrustedServerLimit
+
+	// MaxServerListWebSockets limits the number of concurrent server list
+	// WebSocket connections. If -1, no limit is applied. If 0, a reasonable
+	// default is used.
+	MaxServerListWebSockets int
+
+	// MaxServerListSSE limits the number of concurrent server list
+	// Server-Sent Events streams. If -1, no limit is applied. If 0, a
+	// reasonable default is used.
+	MaxServerListSSE int
+
+	// MinCompressSize is the minimum size of the server list response to
+	// compress. If -1, the response is always compressed if the client
+	// supports it. If 0, a reasonable default is used.
+	MinCompressSize int
+
+	// AllowedEncodings is the list of content encodings which may be used to
+	// compress responses if the client accepts them. If nil, all supported
+	// encodings (currently only gzip) are allowed. If empty, responses are
+	// never compressed.
+	AllowedEncodings []string
+
+	// CompressWithoutAcceptEncoding, if true, allows responses to requests
+	// without an Accept-Encoding header to be compressed with any allowed
+	// encoding, which is permitted by RFC 9110 (an empty header still means
+	// that only identity is acceptable). This is disabled by default since
+	// some clients don't expect compressed responses unless they ask for them.
+	CompressWithoutAcceptEncoding bool
+
+	// MaxConnectStates limits the number of pending UDP connection
+	// authentication requests. If -1, no limit is applied. If 0, a reasonable
+	// default is used.
+	MaxConnectStates int
+
+	// MaxServerNameLength and MaxServerDescriptionLength limit the length in
+	// bytes of server names and descriptions after bad words are cleaned. If
+	// zero, only the hard caps (256 and 1024 bytes) are applied. Values larger
+	// than the hard caps have no effect.
+	MaxServerNameLength, MaxServerDescriptionLength int
+
+	// RejectLongServerNameDescription controls whether to reject servers with
+	// names or descriptions longer than MaxServerNameLength or
+	// MaxServerDescriptionLength instead of truncating them. This does not
+	// apply to the hard caps.
+	RejectLongServerNameDescription bool
+
+	// MaxModInfoSize limits the size in bytes of the modinfo file sent by game
+	// servers, and MaxMods limits the number of mods listed for a server. If
+	// zero, only the hard cap on the modinfo size (256 KiB) is applied. Values
+	// larger than the hard cap have no effect.
+	MaxModInfoSize, MaxMods int
+
+	// RejectModInfoLimit controls whether to reject servers with more than
+	// MaxMods mods or a modinfo file larger than MaxModInfoSize instead of
+	// truncating the mod list (or ignoring the modinfo).
+	RejectModInfoLimit bool
+
+	// PlaylistPlayerCaps maps playlists to the expected maximum number of
+	// players. Servers advertising a larger playerCount or maxPlayers are
+	// still accepted, but are logged and counted in metrics.
+	PlaylistPlayerCaps map[string]int
+
+	// RejectUnknownMapsPlaylists controls whether to reject server
+	// registrations and updates with a map or playlist which isn't known (see
+	// nstypes). If false, unknown values are passed through as-is (but still
+	// length-limited). Known values are always normalized.
+	RejectUnknownMapsPlaylists bool
+
 	// InsecureDevNoCheckPlayerAuth is an option you shouldn't use since it
 	// makes the server trust that clients are who they say they are. Blame
 	// @BobTheBob9 for this option even existing in the first place.
 	InsecureDevNoCheckPlayerAuth bool
 
+	// CheckStorageConsistency enables logging and metrics for disagreements
+	// between AccountStorage and PdataStorage, i.e., pdata which exists
+	// without an account (checked when creating a new account), and accounts
+	// which have connected to a server but don't have any pdata (checked
+	// during auth). Note that the latter can also happen if a player's first
+	// connection failed before the server wrote their pdata.
+	CheckStorageConsistency bool
+
+	// AdminSecret, if provided, enables the /admin endpoints, which require it
+	// as a bearer token in the Authorization header.
+	AdminSecret string
+
 	// MinimumLauncherVersion* restricts authentication and server registration
 	// to clients with at least this version, which must be valid semver. +dev
 	// versions are always allowed.
 	MinimumLauncherVersionClient, MinimumLauncherVersionServer string
 
+	// RetryAfter is the default Retry-After duration to suggest to clients
+	// when rejecting requests due to rate limits, maintenance, or overload. If
+	// zero, a reasonable default is used. If negative, no Retry-After header
+	// is sent.
+	RetryAfter time.Duration
+
 	// TokenExpiryTime controls the expiry of player masterserver auth tokens.
 	// If zero, a reasonable a default is used.
 	TokenExpiryTime time.Duration
 
+	// HashAuthTokens controls whether player masterserver auth tokens are
+	// stored as a hash instead of in plaintext. Existing plaintext tokens are
+	// still accepted, and are hashed after the next successful auth.
+	HashAuthTokens bool
+
+	// TokenSigningKey, if provided, is used to issue player masterserver auth
+	// tokens signed with the UID and expiry, which can be verified without
+	// comparing them against the stored token. The latest token is still
+	// stored, so it continues to work until it expires if this is changed or
+	// removed. Unlike random tokens, signed tokens are not invalidated when
+	// the player re-authenticates, and changing the key only revokes the ones
+	// which aren't the latest stored token for their account. As such,
+	// TokenExpiryTime should be kept reasonably short.
+	TokenSigningKey []byte
+
+	// AccountLookupCacheTTL is the amount of time to cache results for the
+	// get_username and lookup_uid endpoints. Cached entries are invalidated
+	// when origin_auth updates a username. If zero, results are not cached.
+	AccountLookupCacheTTL time.Duration
+
+	// AuthFailLimit is the number of failed masterserver auth token checks for
+	// a UID from a client IP (or IPv6 /64) within AuthFailWindow after which
+	// further attempts for the UID from that IP are rejected for
+	// AuthFailLockout. A successful auth resets the count. If zero, there is no
+	// limit.
+	AuthFailLimit int
+
+	// AuthFailWindow and AuthFailLockout are used with AuthFailLimit.
+	AuthFailWindow, AuthFailLockout time.Duration
+
+	// OriginAuthFailLimit is the number of failed stryder auths from an IP
+	// (or IPv6 /64) within OriginAuthFailWindow after which further attempts
+	// are rejected for OriginAuthFailLockout without contacting stryder. A
+	// successful auth resets the count. If zero, there is no limit.
+	OriginAuthFailLimit int
+
+	// OriginAuthFailWindow and OriginAuthFailLockout are used with
+	// OriginAuthFailLimit.
+	OriginAuthFailWindow, OriginAuthFailLockout time.Duration
+
 	// AllowGameServerIPv6 controls whether to allow game servers to use IPv6.
 	AllowGameServerIPv6 bool
 
+	// ReadOnlyServerList rejects game server registrations, updates, and
+	// removals (e.g., if the ServerList is mirroring another masterserver).
+	ReadOnlyServerList bool
+
 	// LookupIP looks up an IP2Location record for an IP. If not provided,
 	// server regions and geo metrics are disabled. If it doesn't include latlon
 	// info, geo metrics will be disabled too.
 	LookupIP func(netip.Addr) (ip2x.Record, error)
 
+	// LookupIPTimeout is the maximum amount of time to wait for LookupIP
+	// during server registration. If it takes longer, the server is registered
+	// as if the lookup failed (i.e., with RegionFallback). If zero, there is no
+	// limit.
+	LookupIPTimeout time.Duration
+
 	// GetRegion gets the region name from an IP2Location record. If not
 	// provided, server regions are disabled.
 	//
@@ -105,10 +308,63 @@ type Handler struct {
 	// empty region and no error if no region is to be assigned.
 	GetRegion func(netip.Addr, ip2x.Record) (string, error)
 
+	// VerifySkip is a list of prefixes which game servers can register from
+	// without being verified (i.e., the auth and game ports aren't checked).
+	// This should only be used for trusted hosts or local testing.
+	VerifySkip []netip.Prefix
+
+	// MaxConcurrentVerifications limits the number of game server
+	// verifications which can be in progress at once. Additional
+	// registrations wait for a slot until their verification deadline. If
+	// zero, no limit is applied.
+	MaxConcurrentVerifications int
+
+	// VerifyDedupTTL is the amount of time to remember successful game server
+	// verifications for. New servers with the same game and auth address
+	// verified within this window are accepted without verifying them again.
+	// If zero, verification results aren't cached.
+	VerifyDedupTTL time.Duration
+
+	// RegionFallback is the region to assign to servers if GetRegion returns
+	// an empty region or the IP lookup fails. It has no effect if server
+	// regions are disabled.
+	RegionFallback string
+
 	metricsInit sync.Once
 	metricsObj  apiMetrics
 
-	connect sync.Map // [connectStateKey]*connectState
+	connect      sync.Map // [connectStateKey]*connectState
+	connectCount atomic.Int64
+
+	acctLock  uidLock                  // serializes account/pdata read-modify-write by uid
+	eaxLookup uidFlight[*eax.PlayerID] // coalesces concurrent eax username lookups by uid
+
+	acctCacheInit sync.Once
+	usernameCache ttlCache[uint64, string]   // username by uid
+	uidsCache     ttlCache[string, []uint64] // uids by lowercase username
+
+	authFailInit sync.Once
+	authFail     failLimiter[authFailKey] // failed auth token checks by uid and ip
+
+	originAuthFailInit sync.Once
+	originAuthFail     failLimiter[netip.Addr] // failed stryder auths by ip
+
+	limitsOverride atomic.Pointer[ServerLimits] // set by SetServerLimits
+
+	verifySemInit sync.Once
+	verifySemChan chan struct{} // nil if unlimited
+
+	verifiedCacheInit sync.Once
+	verifiedCache     ttlCache[verifiedKey, struct{}] // recently verified servers
+
+	serverListWS  atomic.Int64 // number of open server list websockets
+	serverListSSE atomic.Int64 // number of open server list sse streams
+
+	usernameHealthStryder usernameSourceHealth // for UsernameSourceAuto
+	usernameHealthEAX     usernameSourceHealth // for UsernameSourceAuto
+
+	eaxSelfTestInit sync.Once
+	eaxSelfTest     atomic.Bool // whether the last EAX self-test succeeded
 }
 
 type connectStateKey struct {
@@ -120,14 +376,94 @@ type connectState struct {
 	res      chan<- string // buffer 1
 	pdata    []byte
 	gotPdata atomic.Bool
+	expiry   time.Time
 }
 
-// ServeHTTP routes requests to Handler.
+// connectStateTTL is the maximum amount of time a connect state is kept for
+// before being evicted, even if it hasn't been deleted by the request which
+// created it.
+const connectStateTTL = time.Second * 30
+
+// errConnectStateLimit is returned by connectStore if there are too many
+// pending connect states.
+var errConnectStateLimit = errors.New("too many pending connections")
+
+// connectStore stores a connect state, evicting expired ones if the limit is
+// reached.
+func (h *Handler) connectStore(key connectStateKey, st *connectState) error {
+	max := h.MaxConnectStates
+	if max == 0 {
+		max = 10000
+	}
+	if n := h.connectCount.Add(1); max > 0 && n > int64(max) {
+		h.ReapConnectStates()
+		if n = h.connectCount.Load(); n > int64(max) {
+			h.connectCount.Add(-1)
+			return errConnectStateLimit
+		}
+	}
+	st.expiry = time.Now().Add(connectStateTTL)
+	if _, loaded := h.connect.Swap(key, st); loaded {
+		h.connectCount.Add(-1)
+	}
+	return nil
+}
+
+// connectLoad gets an unexpired connect state.
+func (h *Handler) connectLoad(key connectStateKey) (*connectState, bool) {
+	if v, ok := h.connect.Load(key); ok {
+		if st := v.(*connectState); time.Now().Before(st.expiry) {
+			return st, true
+		}
+	}
+	return nil, false
+}
+
+// connectDelete deletes a connect state if it exists.
+func (h *Handler) connectDelete(key connectStateKey) {
+	if _, loaded := h.connect.LoadAndDelete(key); loaded {
+		h.connectCount.Add(-1)
+	}
+}
+
+// ReapConnectStates evicts expired connect states. These are normally cleaned
+// up when the request which created them finishes, so this is only a
+// safeguard, but it should still be called periodically.
+func (h *Handler) ReapConnectStates() {
+	t := time.Now()
+	h.connect.Range(func(k, v any) bool {
+		if t.After(v.(*connectState).expiry) {
+			if h.connect.CompareAndDelete(k, v) {
+				h.connectCount.Add(-1)
+				h.m().client_authwithserver_connect_state_evictions_total.Inc()
+			}
+		}
+		return true
+	})
+}
+
+// ServeHTTP routes requests to Handler. Panics in handlers (including NotFound)
+// are recovered, logged, and responded to with an internal server error.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var notPanicked bool // this lets us catch panics without swallowing them
 	defer func() {
-		if !notPanicked {
+		if err := recover(); err != nil {
+			if err == http.ErrAbortHandler {
+				panic(err) // this is used to intentionally abort the response
+			}
 			h.m().request_panics_total.Inc()
+
+			e := hlog.FromRequest(r).Error()
+			if rid, ok := hlog.IDFromRequest(r); ok {
+				e = e.Stringer("rid", rid)
+			}
+			e.
+				Str("panic", fmt.Sprint(err)).
+				Bytes("stack", debug.Stack()).
+				Str("request_method", r.Method).
+				Stringer("request_uri", r.URL).
+				Msg("recovered panic in request handler")
+
+			respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
 		}
 	}()
 
@@ -144,10 +480,20 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleClientAuthWithSelf(w, r)
 	case "/client/servers":
 		h.handleClientServers(w, r)
+	case "/client/servers/ws":
+		h.handleClientServersWS(w, r)
+	case "/client/servers/sse":
+		h.handleClientServersSSE(w, r)
 	case "/server/add_server", "/server/update_values", "/server/heartbeat":
 		h.handleServerUpsert(w, r)
 	case "/server/remove_server":
 		h.handleServerRemove(w, r)
+	case "/server/history":
+		h.handleServerHistory(w, r)
+	case "/server/status":
+		h.handleServerStatus(w, r)
+	case "/server/self":
+		h.handleServerSelf(w, r)
 	case "/server/connect":
 		h.handleServerConnect(w, r)
 	case "/accounts/write_persistence":
@@ -158,15 +504,19 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleAccountsLookupUID(w, r)
 	case "/player/pdata", "/player/info", "/player/stats", "/player/loadout":
 		h.handlePlayer(w, r)
+	case "/player/pdata/hash":
+		h.handlePlayerPdataHash(w, r)
+	case "/admin/account/flags":
+		h.handleAdminAccountFlags(w, r)
+	case "/admin/account/auth":
+		h.handleAdminAccountAuth(w, r)
 	default:
 		if h.NotFound == nil {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		} else {
-			notPanicked = true
 			h.NotFound.ServeHTTP(w, r)
 		}
 	}
-	notPanicked = true
 }
 
 // CheckLauncherVersion checks if the r was made by NorthstarLauncher and if it
@@ -241,13 +591,114 @@ func (h *Handler) ExtractLauncherVersion(r *http.Request) string {
 	return ""
 }
 
+// maxLauncherVersionLabels is the maximum number of distinct launcher version
+// labels. Once reached, new versions are bucketed into "other".
+const maxLauncherVersionLabels = 128
+
+// launcherVersionLabels contains the launcher version labels which have been
+// used so far.
+var launcherVersionLabels = newLabelSet(maxLauncherVersionLabels)
+
+// launcherVersionLabel normalizes a launcher version from
+// ExtractLauncherVersion for use as a metric label. Since semver allows
+// arbitrary pre-release and build identifiers, anything other than
+// MAJOR.MINOR.PATCH with an optional -rcN suffix and an optional +dev suffix
+// is bucketed into "invalid", and the numbers are canonicalized. Since a
+// spoofed User-Agent can still produce any number of valid versions, versions
+// beyond the first maxLauncherVersionLabels are bucketed into "other".
+func launcherVersionLabel(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	x, dev := strings.CutSuffix(v, "+dev")
+	x, rc, isRC := strings.Cut(x, "-rc")
+	if isRC && !isLabelNumber(rc, 3) {
+		return "invalid"
+	}
+	b := make([]byte, 0, len(v))
+	for i := 0; i < 3; i++ {
+		var n string
+		if i != 2 {
+			n, x, _ = strings.Cut(x, ".")
+		} else {
+			n, x = x, ""
+		}
+		if !isLabelNumber(n, 4) {
+			return "invalid"
+		}
+		if i != 0 {
+			b = append(b, '.')
+		}
+		b = appendLabelNumber(b, n)
+	}
+	if isRC {
+		b = append(b, "-rc"...)
+		b = appendLabelNumber(b, rc)
+	}
+	if dev {
+		b = append(b, "+dev"...)
+	}
+	if l := string(b); launcherVersionLabels.Add(l) {
+		return l
+	}
+	return "other"
+}
+
+// appendLabelNumber appends the decimal number s (which must consist of ASCII
+// digits) to b without leading zeros.
+func appendLabelNumber(b []byte, s string) []byte {
+	if s = strings.TrimLeft(s, "0"); s == "" {
+		s = "0"
+	}
+	return append(b, s...)
+}
+
+// isLabelNumber checks if s consists of between 1 and max ASCII digits.
+func isLabelNumber(s string, max int) bool {
+	if len(s) == 0 || len(s) > max {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// labelSet is a concurrency-safe set of metric label values with a maximum
+// size.
+type labelSet struct {
+	mu  sync.Mutex
+	max int
+	m   map[string]struct{}
+}
+
+func newLabelSet(max int) *labelSet {
+	return &labelSet{max: max, m: make(map[string]struct{})}
+}
+
+// Add adds l to the set, returning false if it is not already in the set and
+// the set is full.
+func (s *labelSet) Add(l string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[l]; !ok {
+		if len(s.m) >= s.max {
+			return false
+		}
+		s.m[l] = struct{}{}
+	}
+	return true
+}
+
 // geoCounter2 increments a [metricsx.GeoCounter2] for the location of r.
 func (h *Handler) geoCounter2(r *http.Request, ctr *metricsx.GeoCounter2) {
 	if h.LookupIP == nil {
 		return
 	}
 
-	a, err := netip.ParseAddrPort(r.RemoteAddr)
+	a, err := parseRemoteAddr(r)
 	if err != nil {
 		return
 	}
@@ -267,21 +718,104 @@ func (h *Handler) geoCounter2(r *http.Request, ctr *metricsx.GeoCounter2) {
 	}
 }
 
-// respFail writes a {success:false,error:ErrorObj} response with the provided
-// response status.
+// parseRemoteAddr parses r.RemoteAddr, tolerating a missing port (in which case
+// the port will be zero). This may happen when running behind some proxies.
+func parseRemoteAddr(r *http.Request) (netip.AddrPort, error) {
+	if a, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return a, nil
+	}
+	if a, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(r.RemoteAddr, "["), "]")); err == nil {
+		return netip.AddrPortFrom(a, 0), nil
+	}
+	return netip.AddrPort{}, fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+}
+
+// accountLookupStorage gets the storage to use for read-only account lookups.
+func (h *Handler) accountLookupStorage() AccountStorage {
+	if h.AccountLookupStorage != nil {
+		return h.AccountLookupStorage
+	}
+	return h.AccountStorage
+}
+
+// defaultPdata gets the pdata to use for players without any stored pdata.
+func (h *Handler) defaultPdata() []byte {
+	if h.DefaultPdata == nil {
+		return pdata.DefaultPdata
+	}
+	return h.DefaultPdata
+}
+
+// minCompressSize gets the minimum server list response size to compress.
+func (h *Handler) minCompressSize() int {
+	if h.MinCompressSize == 0 {
+		return 512
+	}
+	if h.MinCompressSize < 0 {
+		return 0
+	}
+	return h.MinCompressSize
+}
+
+// withRequestTimeout applies RequestTimeout to r. The returned function must
+// be called when the request is finished.
+func (h *Handler) withRequestTimeout(r *http.Request) (*http.Request, context.CancelFunc) {
+	if h.RequestTimeout <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), h.RequestTimeout)
+	return r.WithContext(ctx), cancel
+}
+
+// respRequestTimeout responds with a 504 and increments ctr if the deadline
+// from withRequestTimeout has been exceeded, returning true if it has.
+func respRequestTimeout(w http.ResponseWriter, r *http.Request, ctr *metrics.Counter) bool {
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		hlog.FromRequest(r).Warn().Msg("request timed out")
+		ctr.Inc()
+		respFail(w, r, http.StatusGatewayTimeout, ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("request timed out"))
+		return true
+	}
+	return false
+}
+
+// respFail writes a {success:false,error:ErrorObj,errorCode:ErrorCode}
+// response with the provided response status.
 func respFail(w http.ResponseWriter, r *http.Request, status int, obj ErrorObj) {
+	respFailFields(w, r, status, obj, nil)
+}
+
+// respFailFields is like respFail, but also includes the endpoint-specific
+// fields in extra (which must not include the standard error fields).
+func respFailFields(w http.ResponseWriter, r *http.Request, status int, obj ErrorObj, extra map[string]any) {
+	m := make(map[string]any, len(extra)+4)
+	for k, v := range extra {
+		m[k] = v
+	}
+	m["success"] = false
+	m["error"] = obj
+	m["errorCode"] = obj.Code // so clients don't need to parse the nested error object
 	if rid, ok := hlog.IDFromRequest(r); ok {
-		respJSON(w, r, status, map[string]any{
-			"success":    false,
-			"error":      obj,
-			"request_id": rid.String(),
-		})
-	} else {
-		respJSON(w, r, status, map[string]any{
-			"success": false,
-			"error":   obj,
-		})
+		m["request_id"] = rid.String()
+	}
+	respJSON(w, r, status, m)
+}
+
+// respFailRetry is like respFail, but also sets the Retry-After header if
+// retryAfter is positive.
+func respFailRetry(w http.ResponseWriter, r *http.Request, status int, obj ErrorObj, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+	}
+	respFail(w, r, status, obj)
+}
+
+// retryAfter gets the default Retry-After duration.
+func (h *Handler) retryAfter() time.Duration {
+	if h.RetryAfter == 0 {
+		return time.Second * 30
 	}
+	return h.RetryAfter
 }
 
 // respJSON writes the JSON encoding of obj with the provided response status.
@@ -304,25 +838,27 @@ func respJSON(w http.ResponseWriter, r *http.Request, status int, obj any) {
 
 // respMaybeCompress writes buf with the provided response status, compressing
 // it with gzip if the client supports it and the result is smaller.
-func respMaybeCompress(w http.ResponseWriter, r *http.Request, status int, buf []byte) {
-	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
-		if t, _, _ := strings.Cut(e, ";"); strings.TrimSpace(t) == "gzip" {
-			var cbuf bytes.Buffer
-			gw := gzip.NewWriter(&cbuf)
-			if _, err := gw.Write(buf); err != nil {
-				break
-			}
-			if err := gw.Close(); err != nil {
-				break
+func (h *Handler) respMaybeCompress(w http.ResponseWriter, r *http.Request, status int, buf []byte) {
+	var compressed bool
+	refuseIdentity := refusesIdentityEncoding(r.Header)
+	if h.acceptsEncoding(r, "gzip") {
+		var cbuf bytes.Buffer
+		gw := gzip.NewWriter(&cbuf)
+		if _, err := gw.Write(buf); err == nil {
+			if err := gw.Close(); err == nil {
+				if refuseIdentity || cbuf.Len() < int(float64(len(buf))*0.8) {
+					buf = cbuf.Bytes()
+					compressed = true
+					w.Header().Set("Content-Encoding", "gzip")
+					w.Header().Del("ETag") // to avoid breaking caching proxies since ETag must be unique if Content-Encoding is different
+				}
 			}
-			if cbuf.Len() < int(float64(len(buf))*0.8) {
-				buf = cbuf.Bytes()
-				w.Header().Set("Content-Encoding", "gzip")
-				w.Header().Del("ETag") // to avoid breaking caching proxies since ETag must be unique if Content-Encoding is different
-			}
-			break
 		}
 	}
+	if refuseIdentity && !compressed {
+		respNotAcceptableEncoding(w, r)
+		return
+	}
 	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
 	w.WriteHeader(status)
 	if r.Method != http.MethodHead {
@@ -330,6 +866,100 @@ func respMaybeCompress(w http.ResponseWriter, r *http.Request, status int, buf [
 	}
 }
 
+// maxAcceptEncodingTokens is the maximum number of Accept-Encoding tokens to
+// parse. Anything after that is ignored.
+const maxAcceptEncodingTokens = 16
+
+// acceptsEncoding checks whether r accepts the content encoding enc and it is
+// allowed by AllowedEncodings. If CompressWithoutAcceptEncoding is true,
+// requests without an Accept-Encoding header accept any allowed encoding.
+func (h *Handler) acceptsEncoding(r *http.Request, enc string) bool {
+	if h.AllowedEncodings != nil && !slices.Contains(h.AllowedEncodings, enc) {
+		return false
+	}
+	if h.CompressWithoutAcceptEncoding && len(r.Header.Values("Accept-Encoding")) == 0 {
+		return true
+	}
+	return acceptsEncoding(r.Header, enc)
+}
+
+// acceptsEncoding checks whether the Accept-Encoding header in hdr explicitly
+// accepts enc (i.e., it is listed without a q-value of zero). Malformed tokens
+// are ignored, and only the first maxAcceptEncodingTokens tokens are
+// considered. It does not allocate.
+func acceptsEncoding(hdr http.Header, enc string) bool {
+	listed, refused := acceptEncodingToken(hdr, enc)
+	return listed && !refused
+}
+
+// refusesIdentityEncoding checks whether the Accept-Encoding header in hdr
+// explicitly refuses an uncompressed response, i.e., identity has a q-value of
+// zero, or it isn't listed and * has a q-value of zero. It does not allocate.
+func refusesIdentityEncoding(hdr http.Header) bool {
+	if listed, refused := acceptEncodingToken(hdr, "identity"); listed {
+		return refused
+	}
+	listed, refused := acceptEncodingToken(hdr, "*")
+	return listed && refused
+}
+
+// acceptEncodingToken checks whether enc is listed in the Accept-Encoding
+// header in hdr, and if so, whether it has a q-value of zero. Malformed tokens
+// are ignored, and only the first maxAcceptEncodingTokens tokens are
+// considered.
+func acceptEncodingToken(hdr http.Header, enc string) (listed, refused bool) {
+	var n int
+	for _, v := range hdr.Values("Accept-Encoding") {
+		for v != "" {
+			if n++; n > maxAcceptEncodingTokens {
+				return false, false
+			}
+			var e string
+			e, v, _ = strings.Cut(v, ",")
+
+			t, p, _ := strings.Cut(e, ";")
+			if !strings.EqualFold(strings.TrimSpace(t), enc) {
+				continue
+			}
+			for p != "" {
+				var x string
+				x, p, _ = strings.Cut(p, ";")
+				if k, v, ok := strings.Cut(x, "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+					return true, isZeroQValue(strings.TrimSpace(v))
+				}
+			}
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// respNotAcceptableEncoding responds with an error for requests which refuse
+// an uncompressed response, but don't accept any allowed encoding. Note that
+// the error itself is sent uncompressed, as permitted by RFC 9110.
+func respNotAcceptableEncoding(w http.ResponseWriter, r *http.Request) {
+	respFail(w, r, http.StatusNotAcceptable, ErrorCode_BAD_REQUEST.MessageObjf("no acceptable content encoding (identity is refused)"))
+}
+
+// isZeroQValue checks if v is a q-value of zero (0, 0., 0.0, 0.00, or 0.000).
+func isZeroQValue(v string) bool {
+	if v == "" || v[0] != '0' {
+		return false
+	}
+	if v = v[1:]; v == "" {
+		return true
+	}
+	if v[0] != '.' || len(v) > 4 {
+		return false
+	}
+	for _, c := range v[1:] {
+		if c != '0' {
+			return false
+		}
+	}
+	return true
+}
+
 // cryptoRandHex gets a string of random hex digits with length n.
 func cryptoRandHex(n int) (string, error) {
 	b := make([]byte, (n+1)/2) // round up
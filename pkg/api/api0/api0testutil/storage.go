@@ -32,6 +32,7 @@ func TestAccountStorage(t *testing.T, s api0.AccountStorage) {
 		act1 := &api0.Account{
 			UID:      uid1,
 			Username: "act1",
+			Flags:    api0.AccountFlagTrusted | 1<<63,
 		}
 		t.Run("GetNonexistent", func(t *testing.T) {
 			acct, err := s.GetAccount(uid0)
@@ -354,6 +355,37 @@ func TestAccountStorage(t *testing.T, s api0.AccountStorage) {
 	})
 }
 
+// TestAccountStorageLimit tests whether an EMPTY account storage instance
+// limited to max accounts refuses to create new accounts past the limit while
+// still allowing existing ones to be updated.
+func TestAccountStorageLimit(t *testing.T, s api0.AccountStorage, max int) {
+	for i := 0; i < max; i++ {
+		if err := s.SaveAccount(&api0.Account{UID: uint64(1000 + i)}); err != nil {
+			t.Fatalf("save account %d: unexpected error: %v", i, err)
+		}
+	}
+	t.Run("SaveNew", func(t *testing.T) {
+		if err := s.SaveAccount(&api0.Account{UID: 1}); err == nil {
+			t.Fatalf("expected error when exceeding limit")
+		}
+		if acct, err := s.GetAccount(1); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if acct != nil {
+			t.Fatalf("account should not have been created")
+		}
+	})
+	t.Run("Update", func(t *testing.T) {
+		if err := s.SaveAccount(&api0.Account{UID: 1000, Username: "test"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if acct, err := s.GetAccount(1000); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if acct == nil || acct.Username != "test" {
+			t.Fatalf("account should have been updated")
+		}
+	})
+}
+
 // TestPdataStorage tests whether an EMPTY pdata storage instance implements the
 // interface correctly.
 func TestPdataStorage(t *testing.T, s api0.PdataStorage) {
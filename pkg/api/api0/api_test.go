@@ -0,0 +1,148 @@
+package api0
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerPanic(t *testing.T) {
+	h := &Handler{
+		NotFound: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/abort" {
+				panic(http.ErrAbortHandler)
+			}
+			panic("test")
+		}),
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/panic")
+		if err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i, err)
+		}
+		var obj struct {
+			Success   bool      `json:"success"`
+			Error     ErrorObj  `json:"error"`
+			ErrorCode ErrorCode `json:"errorCode"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&obj)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("request %d: decode response: %v", i, err)
+		}
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("request %d: expected status 500, got %d", i, resp.StatusCode)
+		}
+		if obj.Success || obj.Error.Code != ErrorCode_INTERNAL_SERVER_ERROR || obj.ErrorCode != obj.Error.Code {
+			t.Errorf("request %d: expected internal server error, got %+v", i, obj)
+		}
+	}
+	if n := h.m().request_panics_total.Get(); n != 2 {
+		t.Errorf("expected 2 panics to be counted, got %d", n)
+	}
+
+	if _, err := http.Get(srv.URL + "/abort"); err == nil {
+		t.Errorf("expected aborted request to fail")
+	}
+	if n := h.m().request_panics_total.Get(); n != 2 {
+		t.Errorf("expected aborted request not to be counted, got %d panics", n)
+	}
+}
+
+func TestLauncherVersionLabel(t *testing.T) {
+	for v, exp := range map[string]string{
+		"":                  "unknown",
+		"1.24.0":            "1.24.0",
+		"1.24.0-rc1":        "1.24.0-rc1",
+		"1.24.0+dev":        "1.24.0+dev",
+		"1.24.0-rc12+dev":   "1.24.0-rc12+dev",
+		"01.024.000":        "1.24.0",
+		"1.24.0-rc01":       "1.24.0-rc1",
+		"1.24":              "invalid",
+		"1.24.0.1":          "invalid",
+		"1.24.0-rc":         "invalid",
+		"1.24.0-beta":       "invalid",
+		"1.24.0+build":      "invalid",
+		"1.24.0-rc1234":     "invalid",
+		"12345.0.0":         "invalid",
+		"1.24.0-aaaaaaaaaa": "invalid",
+	} {
+		if act := launcherVersionLabel(v); act != exp {
+			t.Errorf("%q: expected %q, got %q", v, exp, act)
+		}
+	}
+}
+
+func TestLabelSet(t *testing.T) {
+	s := newLabelSet(2)
+	for _, c := range []struct {
+		Label string
+		Added bool
+	}{
+		{"a", true},
+		{"b", true},
+		{"a", true},
+		{"c", false},
+		{"b", true},
+	} {
+		if act := s.Add(c.Label); act != c.Added {
+			t.Errorf("%q: expected %t, got %t", c.Label, c.Added, act)
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, c := range []struct {
+		Header []string
+		Accept bool
+	}{
+		{nil, false},
+		{[]string{""}, false},
+		{[]string{"gzip"}, true},
+		{[]string{"GZIP"}, true},
+		{[]string{"deflate, gzip;q=1.0, *;q=0.5"}, true},
+		{[]string{"br", "gzip"}, true},
+		{[]string{"gzip;q=0"}, false},
+		{[]string{"gzip; q=0.000"}, false},
+		{[]string{"gzip;q=0.001"}, true},
+		{[]string{"gzip;level=1;q=0"}, false},
+		{[]string{"*"}, false},
+		{[]string{"x-gzip"}, false},
+		{[]string{",,;;=,gzip;;"}, true},
+		{[]string{strings.Repeat("a,", 16) + "gzip"}, false},
+		{[]string{strings.Repeat("a,", 15) + "gzip"}, true},
+	} {
+		if act := acceptsEncoding(http.Header{"Accept-Encoding": c.Header}, "gzip"); act != c.Accept {
+			t.Errorf("%q: expected %t, got %t", c.Header, c.Accept, act)
+		}
+	}
+}
+
+func TestRefusesIdentityEncoding(t *testing.T) {
+	for _, c := range []struct {
+		Header []string
+		Refuse bool
+	}{
+		{nil, false},
+		{[]string{""}, false},
+		{[]string{"gzip"}, false},
+		{[]string{"identity"}, false},
+		{[]string{"gzip, identity;q=0"}, true},
+		{[]string{"gzip", "IDENTITY; q=0.000"}, true},
+		{[]string{"identity;q=0.5"}, false},
+		{[]string{"gzip, *;q=0"}, true},
+		{[]string{"identity, *;q=0"}, false},
+		{[]string{"identity;q=0, *"}, true},
+		{[]string{strings.Repeat("a,", 16) + "identity;q=0"}, false},
+	} {
+		if act := refusesIdentityEncoding(http.Header{"Accept-Encoding": c.Header}); act != c.Refuse {
+			t.Errorf("%q: expected %t, got %t", c.Header, c.Refuse, act)
+		}
+	}
+}
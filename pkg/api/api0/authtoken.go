@@ -0,0 +1,57 @@
+package api0
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// Signed auth tokens are 32 hex characters (the same length as the random
+// ones, which is what the game expects) consisting of a 32-bit big-endian
+// unix expiry time followed by the first 12 bytes of a HMAC-SHA256 over the
+// UID and expiry.
+const (
+	signedAuthTokenExpirySize = 4
+	signedAuthTokenMACSize    = 12
+	signedAuthTokenSize       = signedAuthTokenExpirySize + signedAuthTokenMACSize
+)
+
+// signedAuthTokenMAC computes the truncated MAC for a signed auth token.
+func signedAuthTokenMAC(key []byte, uid uint64, exp uint32) []byte {
+	var b [8 + 4]byte
+	binary.BigEndian.PutUint64(b[0:], uid)
+	binary.BigEndian.PutUint32(b[8:], exp)
+
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("atlas-auth-token-v1\x00"))
+	m.Write(b[:])
+	return m.Sum(nil)[:signedAuthTokenMACSize]
+}
+
+// signAuthToken creates a signed auth token for uid which expires at exp.
+func signAuthToken(key []byte, uid uint64, exp time.Time) string {
+	var b [signedAuthTokenSize]byte
+	t := uint32(exp.Unix())
+	binary.BigEndian.PutUint32(b[:], t)
+	copy(b[signedAuthTokenExpirySize:], signedAuthTokenMAC(key, uid, t))
+	return hex.EncodeToString(b[:])
+}
+
+// verifySignedAuthToken checks whether token is a valid signed auth token for
+// uid which hasn't expired as of t.
+func verifySignedAuthToken(key []byte, uid uint64, token string, t time.Time) bool {
+	if len(key) == 0 || len(token) != signedAuthTokenSize*2 {
+		return false
+	}
+	var b [signedAuthTokenSize]byte
+	if _, err := hex.Decode(b[:], []byte(token)); err != nil {
+		return false
+	}
+	exp := binary.BigEndian.Uint32(b[:])
+	if !hmac.Equal(b[signedAuthTokenExpirySize:], signedAuthTokenMAC(key, uid, exp)) {
+		return false
+	}
+	return t.Before(time.Unix(int64(exp), 0))
+}
@@ -0,0 +1,41 @@
+package api0
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignedAuthToken(t *testing.T) {
+	var (
+		key = []byte("test")
+		uid = uint64(1234567890)
+		now = time.Unix(1700000000, 0)
+		exp = now.Add(time.Hour)
+	)
+
+	tok := signAuthToken(key, uid, exp)
+	if len(tok) != 32 {
+		t.Fatalf("expected token to have length 32, got %d (%q)", len(tok), tok)
+	}
+	if !verifySignedAuthToken(key, uid, tok, now) {
+		t.Errorf("expected token to be valid")
+	}
+	if verifySignedAuthToken(key, uid, tok, exp) {
+		t.Errorf("expected token to be expired")
+	}
+	if verifySignedAuthToken(key, uid+1, tok, now) {
+		t.Errorf("expected token to be invalid for a different uid")
+	}
+	if verifySignedAuthToken([]byte("test1"), uid, tok, now) {
+		t.Errorf("expected token to be invalid for a different key")
+	}
+	if verifySignedAuthToken(nil, uid, tok, now) {
+		t.Errorf("expected token to be invalid without a key")
+	}
+	if verifySignedAuthToken(key, uid, signAuthToken(key, uid, exp.Add(time.Hour))[:8]+tok[8:], now) {
+		t.Errorf("expected token with modified expiry to be invalid")
+	}
+	if verifySignedAuthToken(key, uid, "not a token", now) {
+		t.Errorf("expected malformed token to be invalid")
+	}
+}
@@ -1,20 +1,24 @@
 package api0
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/r2northstar/atlas/pkg/api/api0/api0gameserver"
 	"github.com/r2northstar/atlas/pkg/eax"
-	"github.com/r2northstar/atlas/pkg/pdata"
 	"github.com/r2northstar/atlas/pkg/stryder"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 )
 
@@ -38,8 +42,53 @@ const (
 	// Get the username from Stryder, but also check EAX and warn if it's
 	// different.
 	UsernameSourceStryderEAXDebug UsernameSource = "stryder-eax-debug"
+
+	// Get the username from whichever of Stryder or EAX has been more reliable
+	// recently (preferring Stryder if equal), falling back to the other one on
+	// missing/failure.
+	UsernameSourceAuto UsernameSource = "auto"
 )
 
+// usernameSourceHealthAlpha is the smoothing factor for the username source
+// success rate.
+const usernameSourceHealthAlpha = 0.1
+
+// usernameSourceHealthReset is the amount of time after which the health of a
+// username source which hasn't been used is reset so it gets tried again.
+const usernameSourceHealthReset = time.Minute * 5
+
+// usernameSourceHealth tracks the recent success rate of a username source.
+type usernameSourceHealth struct {
+	mu   sync.Mutex
+	rate float64
+	last time.Time
+}
+
+// Score returns the recent success rate between 0 and 1.
+func (u *usernameSourceHealth) Score() float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.last.IsZero() || time.Since(u.last) > usernameSourceHealthReset {
+		return 1
+	}
+	return u.rate
+}
+
+// Observe records the result of a lookup.
+func (u *usernameSourceHealth) Observe(success bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.last.IsZero() || time.Since(u.last) > usernameSourceHealthReset {
+		u.rate = 1
+	}
+	var x float64
+	if success {
+		x = 1
+	}
+	u.rate = u.rate*(1-usernameSourceHealthAlpha) + x*usernameSourceHealthAlpha
+	u.last = time.Now()
+}
+
 type MainMenuPromos struct {
 	NewInfo      MainMenuPromosNew         `json:"newInfo"`
 	LargeButton  MainMenuPromosButtonLarge `json:"largeButton"`
@@ -110,6 +159,9 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	r, cancel := h.withRequestTimeout(r)
+	defer cancel()
+
 	if !h.CheckLauncherVersion(r, true) {
 		h.m().client_originauth_requests_total.reject_versiongate.Inc()
 		respFail(w, r, http.StatusBadRequest, ErrorCode_UNSUPPORTED_VERSION.MessageObj())
@@ -130,18 +182,19 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	raddr, err := netip.ParseAddrPort(r.RemoteAddr)
+	raddr, err := parseRemoteAddr(r)
 	if err != nil {
-		hlog.FromRequest(r).Error().
+		hlog.FromRequest(r).Warn().
 			Err(err).
 			Msgf("failed to parse remote ip %q", r.RemoteAddr)
-		h.m().client_originauth_requests_total.fail_other_error.Inc()
-		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		h.m().client_originauth_requests_total.reject_bad_remote_addr.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("unable to determine client address"))
 		return
 	}
 
 	select {
 	case <-r.Context().Done(): // check if the request was canceled to avoid making unnecessary requests
+		respRequestTimeout(w, r, h.m().client_originauth_requests_total.fail_request_timeout)
 		return
 	default:
 	}
@@ -155,6 +208,13 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
+		failKey := originAuthFailKey(raddr.Addr())
+		if d, locked := h.originAuthFailLimiter().Locked(failKey, time.Now()); locked {
+			h.m().client_originauth_requests_total.reject_ip_locked.Inc()
+			respFailRetry(w, r, http.StatusTooManyRequests, ErrorCode_UNAUTHORIZED_GAME.MessageObjf("too many failed attempts; try again later"), d)
+			return
+		}
+
 		stryderStart := time.Now()
 
 		stryderCtx, cancel := context.WithTimeout(r.Context(), time.Second*5)
@@ -163,6 +223,9 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 		stryderRes, err = stryder.NucleusAuth(stryderCtx, token, uid)
 		h.m().client_originauth_stryder_auth_duration_seconds.UpdateDuration(stryderStart)
 		if err != nil {
+			if respRequestTimeout(w, r, h.m().client_originauth_requests_total.fail_request_timeout) {
+				return
+			}
 			switch {
 			case errors.Is(err, context.Canceled):
 				// ignore
@@ -183,11 +246,17 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 			case errors.Is(err, stryder.ErrInvalidToken):
 				fallthrough
 			case errors.Is(err, stryder.ErrMultiplayerNotAllowed):
+				if h.originAuthFailLimiter().Fail(failKey, time.Now()) {
+					hlog.FromRequest(r).Warn().
+						Str("ip", failKey.String()).
+						Msgf("too many failed stryder auths, locking out ip")
+				}
 				hlog.FromRequest(r).Info().
 					Err(err).
 					Uint64("uid", uid).
 					Str("stryder_token", string(token)).
 					Str("stryder_resp", string(stryderRes)).
+					Func(stryderFields(stryderRes)).
 					Msgf("invalid stryder token")
 				respFail(w, r, http.StatusForbidden, ErrorCode_UNAUTHORIZED_GAME.MessageObj())
 				return
@@ -197,6 +266,7 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 					Uint64("uid", uid).
 					Str("stryder_token", string(token)).
 					Str("stryder_resp", string(stryderRes)).
+					Func(stryderFields(stryderRes)).
 					Msgf("unexpected stryder error")
 				respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
 				return
@@ -207,16 +277,19 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 						Uint64("uid", uid).
 						Str("stryder_token", string(token)).
 						Str("stryder_resp", string(stryderRes)).
+						Func(stryderFields(stryderRes)).
 						Msgf("unexpected stryder error")
 				}
 				respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("stryder is down: %v", err))
 				return
 			}
 		}
+		h.originAuthFailLimiter().Reset(failKey)
 	}
 
 	select {
 	case <-r.Context().Done(): // check if the request was canceled to avoid making unnecessary requests
+		respRequestTimeout(w, r, h.m().client_originauth_requests_total.fail_request_timeout)
 		return
 	default:
 	}
@@ -225,14 +298,15 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 
 	select {
 	case <-r.Context().Done(): // check if the request was canceled to avoid making unnecessary requests
+		respRequestTimeout(w, r, h.m().client_originauth_requests_total.fail_request_timeout)
 		return
 	default:
 	}
 
-	// note: there's small chance of race conditions here if there are multiple
-	// concurrent origin_auth calls, but since we only ever support one session
-	// at a time per uid, it's not a big deal which token gets saved (if it is
-	// ever a problem, we can change AccountStorage to support transactions)
+	// prevent concurrent origin_auth calls and pdata writes for the same uid
+	// from clobbering each other's account changes
+	unlock := h.acctLock.Lock(uid)
+	defer unlock()
 
 	acct, err := h.AccountStorage.GetAccount(uid)
 	if err != nil {
@@ -241,28 +315,51 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 			Uint64("uid", uid).
 			Msgf("failed to read account from storage")
 		h.m().client_originauth_requests_total.fail_storage_error_account.Inc()
-		respJSON(w, r, http.StatusInternalServerError, map[string]any{
-			"success": false,
-			"error":   ErrorCode_INTERNAL_SERVER_ERROR,
-			"msg":     ErrorCode_INTERNAL_SERVER_ERROR.Message(),
-		})
+		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
 		return
 	}
 
+	var (
+		prevUsername    string
+		usernameChanged bool
+	)
 	if acct != nil && username != "" && acct.Username != username {
 		hlog.FromRequest(r).Info().Uint64("uid", acct.UID).Str("username", username).Str("prev_username", acct.Username).Msg("got updated username")
+		prevUsername = acct.Username
+		usernameChanged = true
 	}
+	var isNew bool
 	if acct == nil {
 		acct = &Account{
 			UID: uid,
 		}
+		isNew = true
 		hlog.FromRequest(r).Info().Uint64("uid", acct.UID).Str("username", username).Msg("created new account")
+
+		if h.CheckStorageConsistency {
+			if _, exists, err := h.PdataStorage.GetPdataHash(uid); err != nil {
+				hlog.FromRequest(r).Warn().
+					Err(err).
+					Uint64("uid", uid).
+					Msgf("failed to check pdata storage consistency")
+			} else if exists {
+				h.m().storage_inconsistencies_total.missing_account.Inc()
+				hlog.FromRequest(r).Warn().
+					Uint64("uid", uid).
+					Msgf("storage inconsistency: pdata exists for new account")
+			}
+		}
 	}
 	if username != "" {
 		acct.Username = username
 	}
 
-	if t, err := cryptoRandHex(32); err != nil {
+	acct.AuthTokenExpiry = time.Now().Add(h.tokenExpiryTime())
+
+	var token string
+	if len(h.TokenSigningKey) != 0 {
+		token = signAuthToken(h.TokenSigningKey, acct.UID, acct.AuthTokenExpiry)
+	} else if t, err := cryptoRandHex(32); err != nil {
 		hlog.FromRequest(r).Error().
 			Err(err).
 			Msgf("failed to generate random token")
@@ -270,12 +367,12 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
 		return
 	} else {
-		acct.AuthToken = t
+		token = t
 	}
-	if h.TokenExpiryTime > 0 {
-		acct.AuthTokenExpiry = time.Now().Add(h.TokenExpiryTime)
+	if h.HashAuthTokens {
+		acct.AuthToken = HashAuthToken(token)
 	} else {
-		acct.AuthTokenExpiry = time.Now().Add(time.Hour * 24)
+		acct.AuthToken = token
 	}
 	acct.AuthIP = raddr.Addr()
 
@@ -289,30 +386,54 @@ func (h *Handler) handleClientOriginAuth(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if usernameChanged || isNew {
+		usernameCache, uidsCache := h.accountLookupCaches()
+		usernameCache.Delete(uid)
+		if prevUsername != "" {
+			uidsCache.Delete(strings.ToLower(prevUsername))
+		}
+		uidsCache.Delete(strings.ToLower(username))
+	}
+
 	h.m().client_originauth_requests_total.success.Inc()
 	h.geoCounter2(r, h.m().client_originauth_requests_map)
 
-	respJSON(w, r, http.StatusOK, map[string]any{
+	obj := map[string]any{
 		"success": true,
-		"token":   acct.AuthToken,
-	})
+		"token":   token,
+	}
+	if acct.Flags != 0 {
+		obj["flags"] = acct.Flags.String()
+	}
+	respJSON(w, r, http.StatusOK, obj)
 }
 
 // lookupUsername gets the username for uid according to the configured
 // UsernameSource, returning an empty string if not found or on error.
 func (h *Handler) lookupUsername(r *http.Request, uid uint64, stryderRes []byte) (username string) {
+	var source string
+	defer func() {
+		if username == "" {
+			source = "none"
+		}
+		h.m().client_originauth_username_source_total(source).Inc()
+	}()
 	switch h.UsernameSource {
 	case UsernameSourceNone:
 		break
 	case UsernameSourceEAX:
 		username, _ = h.lookupUsernameEAX(r, uid)
+		source = "eax"
 	case UsernameSourceStryder:
 		username, _ = h.lookupUsernameStryder(r, uid, stryderRes)
+		source = "stryder"
 	case UsernameSourceStryderEAX:
 		username, _ = h.lookupUsernameStryder(r, uid, stryderRes)
+		source = "stryder"
 		if username == "" {
 			if eaxUsername, ok := h.lookupUsernameEAX(r, uid); ok {
 				username = eaxUsername
+				source = "eax"
 				hlog.FromRequest(r).Warn().
 					Uint64("uid", uid).
 					Str("eax_username", eaxUsername).
@@ -321,6 +442,7 @@ func (h *Handler) lookupUsername(r *http.Request, uid uint64, stryderRes []byte)
 		}
 	case UsernameSourceStryderEAXDebug:
 		username, _ = h.lookupUsernameStryder(r, uid, stryderRes)
+		source = "stryder"
 		if eaxUsername, ok := h.lookupUsernameEAX(r, uid); ok {
 			if eaxUsername != username {
 				hlog.FromRequest(r).Warn().
@@ -335,6 +457,44 @@ func (h *Handler) lookupUsername(r *http.Request, uid uint64, stryderRes []byte)
 				Str("stryder_username", username).
 				Msgf("got username from stryder, but failed to get username from eax")
 		}
+	case UsernameSourceAuto:
+		// note: a missing username counts as a failure for both sources since
+		// the other one may still have it
+		stryderFn := func() (string, bool) {
+			u, ok := h.lookupUsernameStryder(r, uid, stryderRes)
+			ok = ok && u != ""
+			h.usernameHealthStryder.Observe(ok)
+			return u, ok
+		}
+		eaxFn := func() (string, bool) {
+			u, ok := h.lookupUsernameEAX(r, uid)
+			ok = ok && u != ""
+			h.usernameHealthEAX.Observe(ok)
+			return u, ok
+		}
+		order := [2]string{"stryder", "eax"}
+		if h.usernameHealthEAX.Score() > h.usernameHealthStryder.Score() {
+			order[0], order[1] = order[1], order[0]
+		}
+		for i, src := range order {
+			var ok bool
+			switch src {
+			case "stryder":
+				username, ok = stryderFn()
+			case "eax":
+				username, ok = eaxFn()
+			}
+			if ok {
+				source = src
+				if i != 0 {
+					hlog.FromRequest(r).Warn().
+						Uint64("uid", uid).
+						Str("username_source", src).
+						Msgf("failed to get username from %s, but got it from %s", order[0], src)
+				}
+				break
+			}
+		}
 	default:
 		hlog.FromRequest(r).Error().
 			Msgf("unknown username source %q", h.UsernameSource)
@@ -342,6 +502,10 @@ func (h *Handler) lookupUsername(r *http.Request, uid uint64, stryderRes []byte)
 	return
 }
 
+// eaxLookupTimeout is the timeout for EAX username lookups if RequestTimeout
+// is not set.
+const eaxLookupTimeout = time.Second * 15
+
 // lookupUsernameEAX gets the username for uid from the EAX API, returning an
 // empty string if a username does not exist for the uid, and false on error.
 func (h *Handler) lookupUsernameEAX(r *http.Request, uid uint64) (username string, ok bool) {
@@ -357,17 +521,36 @@ func (h *Handler) lookupUsernameEAX(r *http.Request, uid uint64) (username strin
 		return
 	}
 	eaxStart := time.Now()
-	if p, err := h.EAXClient.PlayerIDByPD(r.Context(), uid); err == nil {
+
+	// note: concurrent lookups for the same uid share the first request's
+	// call, so it must not be canceled if the first request is
+	p, err, shared := h.eaxLookup.Do(uid, func() (*eax.PlayerID, error) {
+		timeout := h.RequestTimeout
+		if timeout <= 0 {
+			timeout = eaxLookupTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+		defer cancel()
+		return h.EAXClient.PlayerIDByPD(ctx, uid)
+	})
+	if shared {
+		h.m().client_originauth_eax_username_lookup_coalesced_total.Inc()
+	}
+	if err == nil {
 		if p != nil {
 			username = p.DisplayName
-			h.m().client_originauth_eax_username_lookup_calls_total.success.Inc()
+			if !shared {
+				h.m().client_originauth_eax_username_lookup_calls_total.success.Inc()
+			}
 		} else {
 			hlog.FromRequest(r).Warn().
 				Err(err).
 				Uint64("uid", uid).
 				Str("username_source", "eax").
 				Msgf("no eax username found for uid")
-			h.m().client_originauth_eax_username_lookup_calls_total.notfound.Inc()
+			if !shared {
+				h.m().client_originauth_eax_username_lookup_calls_total.notfound.Inc()
+			}
 		}
 		ok = true
 	} else if errors.Is(err, eax.ErrVersionRequired) || errors.Is(err, eax.ErrAutoUpdateBackoff) {
@@ -375,15 +558,21 @@ func (h *Handler) lookupUsernameEAX(r *http.Request, uid uint64) (username strin
 			Err(err).
 			Str("username_source", "eax").
 			Msgf("eax update check failure")
-		h.m().client_originauth_eax_username_lookup_calls_total.fail_update_check.Inc()
+		if !shared {
+			h.m().client_originauth_eax_username_lookup_calls_total.fail_update_check.Inc()
+		}
 	} else if !errors.Is(err, context.Canceled) {
 		hlog.FromRequest(r).Error().
 			Err(err).
 			Str("username_source", "eax").
 			Msgf("failed to get eax player info")
-		h.m().client_originauth_eax_username_lookup_calls_total.fail_other_error.Inc()
+		if !shared {
+			h.m().client_originauth_eax_username_lookup_calls_total.fail_other_error.Inc()
+		}
+	}
+	if !shared {
+		h.m().client_originauth_eax_username_lookup_duration_seconds.UpdateDuration(eaxStart)
 	}
-	h.m().client_originauth_eax_username_lookup_duration_seconds.UpdateDuration(eaxStart)
 	return
 }
 
@@ -412,6 +601,48 @@ func (h *Handler) lookupUsernameStryder(r *http.Request, uid uint64, res []byte)
 	return u, err == nil
 }
 
+// CheckEAXHealth looks up uid (which should be a known existing account) using
+// the EAX API to check whether username lookups are still working, updating
+// the atlas_origin_auth_healthy gauge. If it fails, the EAX client version is
+// force-updated since that is the most likely cause.
+func (h *Handler) CheckEAXHealth(ctx context.Context, uid uint64) error {
+	h.eaxSelfTestInit.Do(func() {
+		h.m().set.NewGauge(`atlas_origin_auth_healthy`, func() float64 {
+			if h.eaxSelfTest.Load() {
+				return 1
+			}
+			return 0
+		})
+	})
+	if h.EAXClient == nil {
+		h.eaxSelfTest.Store(false)
+		return fmt.Errorf("eax client not configured")
+	}
+
+	p, err := h.EAXClient.PlayerIDByPD(ctx, uid)
+	if err == nil && p == nil {
+		err = fmt.Errorf("player %d not found", uid)
+	}
+	h.eaxSelfTest.Store(err == nil)
+
+	if err != nil && h.EAXClient.UpdateMgr != nil {
+		if _, _, uerr := h.EAXClient.UpdateMgr.Update(true); uerr != nil {
+			return fmt.Errorf("%w (and failed to update eax client version: %v)", err, uerr)
+		}
+	}
+	return err
+}
+
+// stryderFields adds the parsed fields of a stryder nucleus auth response to a
+// log event, if possible.
+func stryderFields(res []byte) func(e *zerolog.Event) {
+	return func(e *zerolog.Event) {
+		if v, err := stryder.DecodeNucleusAuth(res); err == nil {
+			e.Interface("stryder", v)
+		}
+	}
+}
+
 func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodOptions && r.Method != http.MethodPost {
 		h.m().client_authwithserver_requests_total.http_method_not_allowed.Inc()
@@ -429,19 +660,22 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	r, cancel := h.withRequestTimeout(r)
+	defer cancel()
+
 	if !h.CheckLauncherVersion(r, true) {
 		h.m().client_authwithserver_requests_total.reject_versiongate.Inc()
 		respFail(w, r, http.StatusBadRequest, ErrorCode_UNSUPPORTED_VERSION.MessageObj())
 		return
 	}
 
-	raddr, err := netip.ParseAddrPort(r.RemoteAddr)
+	raddr, err := parseRemoteAddr(r)
 	if err != nil {
-		hlog.FromRequest(r).Error().
+		hlog.FromRequest(r).Warn().
 			Err(err).
 			Msgf("failed to parse remote ip %q", r.RemoteAddr)
-		h.m().client_authwithself_requests_total.fail_other_error.Inc()
-		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		h.m().client_authwithserver_requests_total.reject_bad_remote_addr.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("unable to determine client address"))
 		return
 	}
 
@@ -459,6 +693,13 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	failKey := authFailKey{uid, originAuthFailKey(raddr.Addr())}
+	if d, locked := h.authFailLimiter().Locked(failKey, time.Now()); locked {
+		h.m().client_authwithserver_requests_total.reject_auth_locked.Inc()
+		respFailRetry(w, r, http.StatusTooManyRequests, ErrorCode_INVALID_MASTERSERVER_TOKEN.MessageObjf("too many failed attempts; try again later"), d)
+		return
+	}
+
 	playerToken := r.URL.Query().Get("playerToken")
 	server := r.URL.Query().Get("server")
 	password := r.URL.Query().Get("password")
@@ -492,11 +733,18 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 	}
 
 	if !h.InsecureDevNoCheckPlayerAuth {
-		if playerToken != acct.AuthToken || !time.Now().Before(acct.AuthTokenExpiry) {
+		if !h.checkPlayerToken(acct, playerToken) {
+			if h.authFailLimiter().Fail(failKey, time.Now()) {
+				hlog.FromRequest(r).Warn().
+					Uint64("uid", uid).
+					Stringer("ip", raddr.Addr()).
+					Msgf("too many failed auth attempts, locking out uid for ip")
+			}
 			h.m().client_authwithserver_requests_total.reject_masterserver_token.Inc()
 			respFail(w, r, http.StatusUnauthorized, ErrorCode_INVALID_MASTERSERVER_TOKEN.MessageObj())
 			return
 		}
+		h.authFailLimiter().Reset(failKey)
 	}
 
 	var authToken string
@@ -511,6 +759,7 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 		authToken = v
 	}
 
+	// note: the gameserver always needs the full pdata
 	var pbuf []byte
 	if b, exists, err := h.PdataStorage.GetPdataCached(acct.UID, [sha256.Size]byte{}); err != nil {
 		hlog.FromRequest(r).Error().
@@ -520,8 +769,9 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 		h.m().client_authwithserver_requests_total.fail_storage_error_pdata.Inc()
 		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
 		return
-	} else if !exists {
-		pbuf = pdata.DefaultPdata
+	} else if h.m().pdata_cache_requests_total.authwithserver.inc([sha256.Size]byte{}, b, exists); !exists {
+		h.checkMissingPdata(r, acct.UID, acct.LastServerID)
+		pbuf = h.defaultPdata()
 	} else {
 		pbuf = b
 	}
@@ -535,6 +785,9 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 		if srv.AuthPort != 0 {
 			if err := api0gameserver.AuthenticateIncomingPlayer(ctx, srv.AuthAddr(), acct.UID, acct.Username, authToken, srv.ServerAuthToken, pbuf); err != nil {
 				h.m().client_authwithserver_gameserverauth_duration_seconds.UpdateDuration(authStart)
+				if respRequestTimeout(w, r, h.m().client_authwithserver_requests_total.fail_request_timeout) {
+					return
+				}
 				if errors.Is(err, context.DeadlineExceeded) {
 					err = fmt.Errorf("request timed out")
 				}
@@ -583,11 +836,13 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 				}
 
 				ch := make(chan string, 1)
-				h.connect.Store(key, &connectState{
+				if err := h.connectStore(key, &connectState{
 					res:   ch,
 					pdata: pbuf,
-				})
-				defer h.connect.Delete(key)
+				}); err != nil {
+					return "", err
+				}
+				defer h.connectDelete(key)
 
 				ctx, cancel := context.WithCancel(ctx)
 				defer cancel()
@@ -628,6 +883,9 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 				}
 			}(); err != nil {
 				h.m().client_authwithserver_gameserverauthudp_duration_seconds.UpdateDuration(authStart)
+				if respRequestTimeout(w, r, h.m().client_authwithserver_requests_total.fail_request_timeout) {
+					return
+				}
 				switch {
 				case errors.Is(err, context.DeadlineExceeded):
 					hlog.FromRequest(r).Error().
@@ -635,6 +893,9 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 						Msgf("failed to make gameserver udp auth request")
 					h.m().client_authwithserver_requests_total.fail_gameserverauthudp.Inc()
 					respFail(w, r, http.StatusGatewayTimeout, ErrorCode_NO_GAMESERVER_RESPONSE.MessageObj())
+				case errors.Is(err, errConnectStateLimit):
+					h.m().client_authwithserver_requests_total.fail_connect_state_limit.Inc()
+					respFailRetry(w, r, http.StatusServiceUnavailable, ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("%v", err), h.retryAfter())
 				default:
 					if !errors.Is(err, context.Canceled) {
 						hlog.FromRequest(r).Error().
@@ -658,6 +919,27 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
+	// re-read the account under the lock since it may have been changed
+	// (e.g., by a concurrent origin_auth) during the game server auth, and we
+	// only want to update the last server
+	unlock := h.acctLock.Lock(uid)
+	defer unlock()
+
+	if acct, err = h.AccountStorage.GetAccount(uid); err != nil {
+		hlog.FromRequest(r).Error().
+			Err(err).
+			Uint64("uid", uid).
+			Msgf("failed to read account from storage")
+		h.m().client_authwithserver_requests_total.fail_storage_error_account.Inc()
+		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		return
+	}
+	if acct == nil {
+		h.m().client_authwithserver_requests_total.reject_player_not_found.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_PLAYER_NOT_FOUND.MessageObj())
+		return
+	}
+
 	acct.LastServerID = srv.ID
 
 	if err := h.AccountStorage.SaveAccount(acct); err != nil {
@@ -670,13 +952,24 @@ func (h *Handler) handleClientAuthWithServer(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	h.m().client_authwithserver_requests_total.success.Inc()
-	respJSON(w, r, http.StatusOK, map[string]any{
+	obj := map[string]any{
 		"success":   true,
 		"ip":        srv.Addr.Addr().String(),
 		"port":      srv.Addr.Port(),
 		"authToken": authToken,
-	})
+	}
+	if v := h.motd(); v != "" {
+		obj["motd"] = v
+	}
+	if v := srv.ConnectMetadata; v != "" {
+		obj["connectMetadata"] = v
+	}
+	if acct.Flags != 0 {
+		obj["flags"] = acct.Flags.String()
+	}
+
+	h.m().client_authwithserver_requests_total.success.Inc()
+	respJSON(w, r, http.StatusOK, obj)
 }
 
 func (h *Handler) handleClientAuthWithSelf(w http.ResponseWriter, r *http.Request) {
@@ -718,6 +1011,10 @@ func (h *Handler) handleClientAuthWithSelf(w http.ResponseWriter, r *http.Reques
 
 	playerToken := r.URL.Query().Get("playerToken")
 
+	// prevent concurrent account changes from being clobbered
+	unlock := h.acctLock.Lock(uid)
+	defer unlock()
+
 	acct, err := h.AccountStorage.GetAccount(uid)
 	if err != nil {
 		hlog.FromRequest(r).Error().
@@ -735,13 +1032,14 @@ func (h *Handler) handleClientAuthWithSelf(w http.ResponseWriter, r *http.Reques
 	}
 
 	if !h.InsecureDevNoCheckPlayerAuth {
-		if playerToken != acct.AuthToken || !time.Now().Before(acct.AuthTokenExpiry) {
+		if !h.checkPlayerToken(acct, playerToken) {
 			h.m().client_authwithself_requests_total.reject_masterserver_token.Inc()
 			respFail(w, r, http.StatusUnauthorized, ErrorCode_INVALID_MASTERSERVER_TOKEN.MessageObj())
 			return
 		}
 	}
 
+	lastServerID := acct.LastServerID
 	acct.LastServerID = "self"
 
 	if err := h.AccountStorage.SaveAccount(acct); err != nil {
@@ -759,8 +1057,21 @@ func (h *Handler) handleClientAuthWithSelf(w http.ResponseWriter, r *http.Reques
 		"id":      strconv.FormatUint(acct.UID, 10),
 	}
 
+	// if the client provides the hash of the pdata it already has, we can
+	// skip sending it if it's unchanged
+	var pdataHash [sha256.Size]byte
+	if v := r.URL.Query().Get("pdataHash"); v != "" {
+		if b, err := hex.DecodeString(v); err != nil || len(b) != sha256.Size {
+			h.m().client_authwithself_requests_total.reject_bad_request.Inc()
+			respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("invalid pdataHash"))
+			return
+		} else {
+			pdataHash = [sha256.Size]byte(b)
+		}
+	}
+
 	// the way we encode this is utterly absurd and inefficient, but we need to do it for backwards compatibility
-	if b, exists, err := h.PdataStorage.GetPdataCached(acct.UID, [sha256.Size]byte{}); err != nil {
+	if b, exists, err := h.PdataStorage.GetPdataCached(acct.UID, pdataHash); err != nil {
 		hlog.FromRequest(r).Error().
 			Err(err).
 			Uint64("uid", acct.UID).
@@ -768,8 +1079,11 @@ func (h *Handler) handleClientAuthWithSelf(w http.ResponseWriter, r *http.Reques
 		h.m().client_authwithself_requests_total.fail_storage_error_pdata.Inc()
 		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
 		return
-	} else if !exists {
-		obj["persistentData"] = marshalJSONBytesAsArray(pdata.DefaultPdata)
+	} else if h.m().pdata_cache_requests_total.authwithself.inc(pdataHash, b, exists); !exists {
+		h.checkMissingPdata(r, acct.UID, lastServerID)
+		obj["persistentData"] = marshalJSONBytesAsArray(h.defaultPdata())
+	} else if b == nil {
+		obj["persistentDataUnchanged"] = true
 	} else {
 		obj["persistentData"] = marshalJSONBytesAsArray(b)
 	}
@@ -787,10 +1101,18 @@ func (h *Handler) handleClientAuthWithSelf(w http.ResponseWriter, r *http.Reques
 		obj["authToken"] = v
 	}
 
+	if v := h.motd(); v != "" {
+		obj["motd"] = v
+	}
+
 	h.m().client_authwithself_requests_total.success.Inc()
 	respJSON(w, r, http.StatusOK, obj)
 }
 
+// maxServerListMods is the maximum number of distinct mods accepted by the mods
+// filter for /client/servers.
+const maxServerListMods = 256
+
 func (h *Handler) handleClientServers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodOptions && r.Method != http.MethodHead && r.Method != http.MethodGet {
 		h.m().client_servers_requests_total.http_method_not_allowed.Inc()
@@ -812,22 +1134,104 @@ func (h *Handler) handleClientServers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if q := r.URL.Query(); q.Has("mods") {
+		// only include servers where all client-required mods are in the
+		// comma-separated list
+		mods := []string{}
+		for _, v := range q["mods"] {
+			for _, m := range strings.Split(v, ",") {
+				if m = strings.TrimSpace(m); m != "" && !slices.Contains(mods, m) {
+					if len(mods) == maxServerListMods {
+						h.m().client_servers_requests_total.reject_bad_request.Inc()
+						respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("too many mods (max %d)", maxServerListMods))
+						return
+					}
+					mods = append(mods, m)
+				}
+			}
+		}
+		buf := h.ServerList.csGetJSONMods(mods)
+
+		lver := h.ExtractLauncherVersion(r)
+		h.m().client_servers_requests_total.success(lver).Inc()
+		if lver != "" {
+			h.geoCounter2(r, h.m().client_servers_requests_map.northstar)
+		} else {
+			h.geoCounter2(r, h.m().client_servers_requests_map.other)
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		h.respMaybeCompress(w, r, http.StatusOK, buf)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "binary" || acceptsBinaryServerList(r) {
+		buf := h.ServerList.csGet().bin
+		h.m().client_servers_response_size_bytes.binary.Update(float64(len(buf)))
+
+		lver := h.ExtractLauncherVersion(r)
+		h.m().client_servers_requests_total.success(lver).Inc()
+		if lver != "" {
+			h.geoCounter2(r, h.m().client_servers_requests_map.northstar)
+		} else {
+			h.geoCounter2(r, h.m().client_servers_requests_map.other)
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(buf)
+		}
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
+	if r.URL.Query().Get("wrap") == "1" {
+		c := h.ServerList.csGet()
+
+		var b bytes.Buffer
+		b.Grow(len(c.buf) + 64)
+		b.WriteString(`{"servers":`)
+		b.Write(c.buf)
+		b.WriteString(`,"generatedAt":`)
+		b.WriteString(strconv.FormatInt(c.time.Unix(), 10))
+		b.WriteString(`,"count":`)
+		b.WriteString(strconv.Itoa(c.count))
+		b.WriteString(`}`)
+
+		lver := h.ExtractLauncherVersion(r)
+		h.m().client_servers_requests_total.success(lver).Inc()
+		if lver != "" {
+			h.geoCounter2(r, h.m().client_servers_requests_map.northstar)
+		} else {
+			h.geoCounter2(r, h.m().client_servers_requests_map.other)
+		}
+
+		// note: this is for tooling rather than the game, so we don't bother
+		// caching the compressed response
+		h.respMaybeCompress(w, r, http.StatusOK, b.Bytes())
+		return
+	}
+
 	var compressed bool
 	buf := h.ServerList.csGetJSON()
-	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
-		if t, _, _ := strings.Cut(e, ";"); strings.TrimSpace(t) == "gzip" {
-			if zbuf, ok := h.ServerList.csGetJSONGzip(); ok {
-				buf = zbuf
-				w.Header().Set("Content-Encoding", "gzip")
-				compressed = true
-			} else {
-				hlog.FromRequest(r).Error().Msg("failed to gzip server list")
-			}
-			break
+	refuseIdentity := refusesIdentityEncoding(r.Header)
+	if (refuseIdentity || len(buf) >= h.minCompressSize()) && h.acceptsEncoding(r, "gzip") {
+		if zbuf, ok := h.ServerList.csGetJSONGzip(); ok {
+			buf = zbuf
+			w.Header().Set("Content-Encoding", "gzip")
+			compressed = true
+		} else {
+			hlog.FromRequest(r).Error().Msg("failed to gzip server list")
 		}
 	}
+	if refuseIdentity && !compressed {
+		h.m().client_servers_requests_total.reject_not_acceptable.Inc()
+		respNotAcceptableEncoding(w, r)
+		return
+	}
 	if compressed {
 		h.m().client_servers_response_size_bytes.gzip.Update(float64(len(buf)))
 	} else {
@@ -848,3 +1252,365 @@ func (h *Handler) handleClientServers(w http.ResponseWriter, r *http.Request) {
 		w.Write(buf)
 	}
 }
+
+// handleClientServersWS pushes the server list over a WebSocket whenever it
+// changes. The first message is the full server list, and subsequent messages
+// are full snapshots. If the client requests the "gzip" subprotocol, messages
+// are sent as binary gzipped JSON instead of text.
+func (h *Handler) handleClientServersWS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.m().client_servers_ws_requests_total.http_method_not_allowed.Inc()
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache, no-store")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Pragma", "no-cache")
+
+	if !wsIsUpgrade(r) {
+		h.m().client_servers_ws_requests_total.reject_bad_request.Inc()
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", "websocket")
+		respFail(w, r, http.StatusUpgradeRequired, ErrorCode_BAD_REQUEST.MessageObjf("websocket upgrade required"))
+		return
+	}
+
+	accept, protocol, err := wsHandshake(r, "gzip")
+	if err != nil {
+		h.m().client_servers_ws_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("%v", err))
+		return
+	}
+
+	max := h.MaxServerListWebSockets
+	if max == 0 {
+		max = 1000
+	}
+	if n := h.serverListWS.Add(1); max > 0 && n > int64(max) {
+		h.serverListWS.Add(-1)
+		h.m().client_servers_ws_requests_total.reject_limit.Inc()
+		respFailRetry(w, r, http.StatusServiceUnavailable, ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("too many server list websocket connections"), h.retryAfter())
+		return
+	}
+	defer h.serverListWS.Add(-1)
+
+	ws, err := wsHijack(w, accept, protocol)
+	if err != nil {
+		hlog.FromRequest(r).Error().
+			Err(err).
+			Msgf("failed to hijack websocket connection")
+		h.m().client_servers_ws_requests_total.fail_other_error.Inc()
+		return
+	}
+	defer ws.Close()
+
+	lver := h.ExtractLauncherVersion(r)
+	h.m().client_servers_ws_requests_total.success.Inc()
+	if lver != "" {
+		h.geoCounter2(r, h.m().client_servers_requests_map.northstar)
+	} else {
+		h.geoCounter2(r, h.m().client_servers_requests_map.other)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ws.ReadLoop()
+	}()
+
+	ping := time.NewTicker(time.Second * 30)
+	defer ping.Stop()
+
+	next := time.NewTimer(0)
+	defer next.Stop()
+
+	var last []byte
+	for {
+		// get this before the server list so we don't miss any changes
+		watch := h.ServerList.csWatchChan()
+
+		buf := h.ServerList.csGetJSON()
+		if last == nil || !bytes.Equal(buf, last) {
+			last = buf
+
+			op, msg := byte(wsOpText), buf
+			if protocol == "gzip" {
+				if zbuf, ok := h.ServerList.csGetJSONGzip(); ok {
+					op, msg = wsOpBinary, zbuf
+				} else {
+					hlog.FromRequest(r).Error().Msg("failed to gzip server list")
+					return
+				}
+			}
+			if err := ws.WriteMessage(op, msg, time.Second*10); err != nil {
+				return
+			}
+			if op == wsOpBinary {
+				h.m().client_servers_ws_pushes_total.gzip.Inc()
+			} else {
+				h.m().client_servers_ws_pushes_total.none.Inc()
+			}
+		}
+
+		// the list can also change when servers expire, but don't update more
+		// than once a second for that
+		wait := time.Minute
+		if t := h.ServerList.csNext.Load(); t != nil && !t.IsZero() {
+			wait = time.Until(*t)
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		if !next.Stop() {
+			select {
+			case <-next.C:
+			default:
+			}
+		}
+		next.Reset(wait)
+
+	wait:
+		for {
+			select {
+			case <-watch:
+				break wait
+			case <-next.C:
+				break wait
+			case <-ping.C:
+				if err := ws.WriteMessage(wsOpPing, nil, time.Second*10); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// handleClientServersSSE streams the server list as Server-Sent Events
+// whenever it changes. Each "servers" event contains the full server list
+// JSON. Keepalive comments are sent periodically.
+func (h *Handler) handleClientServersSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.m().client_servers_sse_requests_total.http_method_not_allowed.Inc()
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache, no-store")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Pragma", "no-cache")
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	max := h.MaxServerListSSE
+	if max == 0 {
+		max = 1000
+	}
+	if n := h.serverListSSE.Add(1); max > 0 && n > int64(max) {
+		h.serverListSSE.Add(-1)
+		h.m().client_servers_sse_requests_total.reject_limit.Inc()
+		respFailRetry(w, r, http.StatusServiceUnavailable, ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("too many server list sse streams"), h.retryAfter())
+		return
+	}
+	defer h.serverListSSE.Add(-1)
+
+	lver := h.ExtractLauncherVersion(r)
+	h.m().client_servers_sse_requests_total.success.Inc()
+	if lver != "" {
+		h.geoCounter2(r, h.m().client_servers_requests_map.northstar)
+	} else {
+		h.geoCounter2(r, h.m().client_servers_requests_map.other)
+	}
+
+	rc := http.NewResponseController(w)
+	write := func(b ...[]byte) bool {
+		// note: this also overrides the server write timeout
+		rc.SetWriteDeadline(time.Now().Add(time.Second * 10))
+		for _, x := range b {
+			if _, err := w.Write(x); err != nil {
+				return false
+			}
+		}
+		return rc.Flush() == nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if !write([]byte("retry: 5000\n\n")) {
+		return
+	}
+
+	keepalive := time.NewTicker(time.Second * 30)
+	defer keepalive.Stop()
+
+	next := time.NewTimer(0)
+	defer next.Stop()
+
+	var last []byte
+	for {
+		// get this before the server list so we don't miss any changes
+		watch := h.ServerList.csWatchChan()
+
+		// note: the generated json never contains newlines
+		buf := h.ServerList.csGetJSON()
+		if last == nil || !bytes.Equal(buf, last) {
+			last = buf
+			if !write([]byte("event: servers\ndata: "), buf, []byte("\n\n")) {
+				return
+			}
+			h.m().client_servers_sse_pushes_total.Inc()
+		}
+
+		// the list can also change when servers expire, but don't update more
+		// than once a second for that
+		wait := time.Minute
+		if t := h.ServerList.csNext.Load(); t != nil && !t.IsZero() {
+			wait = time.Until(*t)
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		if !next.Stop() {
+			select {
+			case <-next.C:
+			default:
+			}
+		}
+		next.Reset(wait)
+
+	wait:
+		for {
+			select {
+			case <-watch:
+				break wait
+			case <-next.C:
+				break wait
+			case <-keepalive.C:
+				if !write([]byte(": keepalive\n\n")) {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// acceptsBinaryServerList checks if the client explicitly asked for the binary
+// server list encoding via the Accept header.
+func acceptsBinaryServerList(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(v, ",") {
+			if t, _, _ := strings.Cut(t, ";"); strings.TrimSpace(t) == "application/octet-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenExpiryTime gets the expiry time for new player auth tokens.
+func (h *Handler) tokenExpiryTime() time.Duration {
+	if h.TokenExpiryTime > 0 {
+		return h.TokenExpiryTime
+	}
+	return time.Hour * 24
+}
+
+// motd gets the message of the day, if any.
+func (h *Handler) motd() string {
+	if h.MOTD == nil {
+		return ""
+	}
+	return h.MOTD()
+}
+
+// accountLookupCaches gets the caches for the get_username and lookup_uid
+// endpoints.
+func (h *Handler) accountLookupCaches() (*ttlCache[uint64, string], *ttlCache[string, []uint64]) {
+	h.acctCacheInit.Do(func() {
+		h.usernameCache.TTL = h.AccountLookupCacheTTL
+		h.uidsCache.TTL = h.AccountLookupCacheTTL
+	})
+	return &h.usernameCache, &h.uidsCache
+}
+
+// originAuthFailLimiter gets the limiter for failed stryder auths.
+func (h *Handler) originAuthFailLimiter() *failLimiter[netip.Addr] {
+	h.originAuthFailInit.Do(func() {
+		h.originAuthFail.Limit = h.OriginAuthFailLimit
+		h.originAuthFail.Window = h.OriginAuthFailWindow
+		h.originAuthFail.Lockout = h.OriginAuthFailLockout
+	})
+	return &h.originAuthFail
+}
+
+// originAuthFailKey gets the key to use for originAuthFailLimiter. IPv6
+// addresses are grouped by /64 since clients usually have an entire subnet.
+func originAuthFailKey(a netip.Addr) netip.Addr {
+	if a = a.Unmap(); a.Is6() {
+		if p, err := a.Prefix(64); err == nil {
+			return p.Addr()
+		}
+	}
+	return a
+}
+
+// authFailKey is the key for authFailLimiter. Since UIDs are public, failures
+// are tracked per client IP (grouped like originAuthFailKey) so other clients
+// can't lock a player out.
+type authFailKey struct {
+	UID uint64
+	IP  netip.Addr
+}
+
+// authFailLimiter gets the limiter for failed auth token checks.
+func (h *Handler) authFailLimiter() *failLimiter[authFailKey] {
+	h.authFailInit.Do(func() {
+		h.authFail.Limit = h.AuthFailLimit
+		h.authFail.Window = h.AuthFailWindow
+		h.authFail.Lockout = h.AuthFailLockout
+	})
+	return &h.authFail
+}
+
+// checkAuthToken checks token against acct. If HashAuthTokens is enabled and
+// the stored token is in plaintext, it is replaced with the hash (it is up to
+// the caller to save the account).
+func (h *Handler) checkAuthToken(acct *Account, token string) bool {
+	if !acct.CheckAuthToken(token) {
+		return false
+	}
+	if h.HashAuthTokens && !acct.HasHashedAuthToken() {
+		acct.AuthToken = HashAuthToken(token)
+	}
+	return true
+}
+
+// checkMissingPdata is called when the account for uid doesn't have any pdata.
+// If CheckStorageConsistency is enabled and the account has previously
+// connected to a server (which should have written pdata for it), the
+// inconsistency is logged.
+func (h *Handler) checkMissingPdata(r *http.Request, uid uint64, lastServerID string) {
+	if h.CheckStorageConsistency && lastServerID != "" {
+		h.m().storage_inconsistencies_total.missing_pdata.Inc()
+		hlog.FromRequest(r).Warn().
+			Uint64("uid", uid).
+			Str("last_server_id", lastServerID).
+			Msgf("storage inconsistency: no pdata for account which has connected to a server")
+	}
+}
+
+// checkPlayerToken checks whether token is a valid unexpired auth token for
+// acct, accepting signed tokens if TokenSigningKey is set. It is otherwise
+// like checkAuthToken.
+func (h *Handler) checkPlayerToken(acct *Account, token string) bool {
+	t := time.Now()
+	if verifySignedAuthToken(h.TokenSigningKey, acct.UID, token, t) {
+		return true
+	}
+	return h.checkAuthToken(acct, token) && t.Before(acct.AuthTokenExpiry)
+}
@@ -0,0 +1,125 @@
+package api0
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/r2northstar/atlas/pkg/eax"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+func TestUsernameSourceHealth(t *testing.T) {
+	var u usernameSourceHealth
+	if act := u.Score(); act != 1 {
+		t.Errorf("expected initial score to be 1, got %f", act)
+	}
+	u.Observe(true)
+	if act := u.Score(); act != 1 {
+		t.Errorf("expected score to be 1 after success, got %f", act)
+	}
+	u.Observe(false)
+	a := u.Score()
+	if a >= 1 {
+		t.Errorf("expected score to decrease after failure, got %f", a)
+	}
+	u.Observe(false)
+	if b := u.Score(); b >= a {
+		t.Errorf("expected score to decrease after another failure, got %f", b)
+	}
+}
+
+func TestLookupUsernameAuto(t *testing.T) {
+	const (
+		stryderFound   = `{"userName":"stryder"}`
+		stryderMissing = `{"userName":""}`
+		stryderError   = ``
+		eaxFound       = `{"data":{"playerByPd":{"pd":"1","psd":"1","displayName":"eax","nickname":"eax"}}}`
+		eaxMissing     = `{"data":{"playerByPd":null}}`
+		eaxError       = `{"errors":[{"message":"test"}]}`
+	)
+	// expected health observations
+	const (
+		none = iota
+		success
+		failure
+	)
+	for _, c := range []struct {
+		Name            string
+		StryderFailures int // previous failures
+		Stryder         string
+		EAX             string
+		Username        string
+		StryderHealth   int
+		EAXHealth       int
+	}{
+		{"StryderFound", 0, stryderFound, eaxFound, "stryder", success, none},
+		{"StryderMissingEAXFound", 0, stryderMissing, eaxFound, "eax", failure, success},
+		{"StryderErrorEAXFound", 0, stryderError, eaxFound, "eax", failure, success},
+		{"StryderMissingEAXMissing", 0, stryderMissing, eaxMissing, "", failure, failure},
+		{"StryderErrorEAXMissing", 0, stryderError, eaxMissing, "", failure, failure},
+		{"StryderMissingEAXError", 0, stryderMissing, eaxError, "", failure, failure},
+		{"StryderUnhealthyEAXFound", 3, stryderFound, eaxFound, "eax", none, success},
+		{"StryderUnhealthyEAXMissing", 3, stryderFound, eaxMissing, "stryder", success, failure},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			var eaxCalled bool
+			um := new(eax.UpdateMgr)
+			um.SetVersion("test")
+			h := &Handler{
+				UsernameSource: UsernameSourceAuto,
+				EAXClient: &eax.Client{
+					Client: &http.Client{
+						Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+							eaxCalled = true
+							return &http.Response{
+								StatusCode: http.StatusOK,
+								Header:     http.Header{"Content-Type": {"application/json"}},
+								Body:       io.NopCloser(strings.NewReader(c.EAX)),
+								Request:    r,
+							}, nil
+						}),
+					},
+					UpdateMgr: um,
+				},
+			}
+			for i := 0; i < c.StryderFailures; i++ {
+				h.usernameHealthStryder.Observe(false)
+			}
+			stryderScore := h.usernameHealthStryder.Score()
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if act := h.lookupUsername(r, 1, []byte(c.Stryder)); act != c.Username {
+				t.Errorf("expected username %q, got %q", c.Username, act)
+			}
+			checkHealth := func(name string, u *usernameSourceHealth, prev float64, exp int) {
+				switch score := u.Score(); exp {
+				case none:
+					if score != prev {
+						t.Errorf("expected %s not to be used", name)
+					}
+				case success:
+					if score < prev {
+						t.Errorf("expected %s lookup to succeed, but health decreased", name)
+					}
+				case failure:
+					if score >= prev {
+						t.Errorf("expected %s lookup to fail, but health didn't decrease", name)
+					}
+				}
+			}
+			checkHealth("stryder", &h.usernameHealthStryder, stryderScore, c.StryderHealth)
+			checkHealth("eax", &h.usernameHealthEAX, 1, c.EAXHealth)
+			if eaxCalled != (c.EAXHealth != none) {
+				t.Errorf("expected eax to be called: %t, got %t", c.EAXHealth != none, eaxCalled)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package api0
+
+import (
+	"sync"
+	"time"
+)
+
+// failLimiterMaxEntries is the maximum number of keys tracked by a
+// failLimiter. Once reached, new keys are not tracked until old ones expire.
+const failLimiterMaxEntries = 1 << 16
+
+// failLimiter locks out keys after too many failures within a window. The zero
+// value is ready to use, but doesn't lock anything out.
+type failLimiter[K comparable] struct {
+	Limit   int           // number of failures within Window to lock out after (zero to disable)
+	Window  time.Duration // time window for counting failures
+	Lockout time.Duration // amount of time to lock out for
+
+	mu sync.Mutex
+	m  map[K]*failLimiterEntry
+}
+
+type failLimiterEntry struct {
+	start time.Time // start of the current window
+	count int       // failures since start
+	until time.Time // locked out until
+}
+
+// Locked checks whether k is locked out at t, returning the remaining lockout
+// time.
+func (l *failLimiter[K]) Locked(k K, t time.Time) (time.Duration, bool) {
+	if l.Limit <= 0 {
+		return 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.m[k]; ok && t.Before(e.until) {
+		return e.until.Sub(t), true
+	}
+	return 0, false
+}
+
+// Fail records a failure for k at t, returning true if k is now locked out.
+func (l *failLimiter[K]) Fail(k K, t time.Time) bool {
+	if l.Limit <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.m[k]
+	if !ok {
+		if l.m == nil {
+			l.m = map[K]*failLimiterEntry{}
+		}
+		if len(l.m) >= failLimiterMaxEntries {
+			l.prune(t)
+			if len(l.m) >= failLimiterMaxEntries {
+				return false
+			}
+		}
+		e = &failLimiterEntry{start: t}
+		l.m[k] = e
+	}
+	if t.Sub(e.start) > l.Window && !t.Before(e.until) {
+		e.start, e.count = t, 0
+	}
+	if e.count++; e.count >= l.Limit {
+		e.until = t.Add(l.Lockout)
+		e.start, e.count = e.until, 0
+		return true
+	}
+	return false
+}
+
+// Reset clears failures for k.
+func (l *failLimiter[K]) Reset(k K) {
+	if l.Limit <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.m, k)
+}
+
+// prune removes expired entries. The lock must be held.
+func (l *failLimiter[K]) prune(t time.Time) {
+	for k, e := range l.m {
+		if t.Sub(e.start) > l.Window && !t.Before(e.until) {
+			delete(l.m, k)
+		}
+	}
+}
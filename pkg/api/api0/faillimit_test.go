@@ -0,0 +1,59 @@
+package api0
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailLimiter(t *testing.T) {
+	l := failLimiter[uint64]{
+		Limit:   3,
+		Window:  time.Minute,
+		Lockout: time.Minute * 5,
+	}
+	t0 := time.Unix(1000000, 0)
+
+	for i := 0; i < 2; i++ {
+		if l.Fail(1, t0.Add(time.Second*time.Duration(i))) {
+			t.Fatalf("unexpected lockout after %d failures", i+1)
+		}
+	}
+	if _, locked := l.Locked(1, t0.Add(time.Second*2)); locked {
+		t.Fatalf("unexpected lockout before limit")
+	}
+	if !l.Fail(1, t0.Add(time.Second*2)) {
+		t.Fatalf("expected lockout after limit")
+	}
+	if d, locked := l.Locked(1, t0.Add(time.Minute)); !locked || d != time.Minute*4+time.Second*2 {
+		t.Errorf("expected lockout with 4m2s remaining, got %t %s", locked, d)
+	}
+	if _, locked := l.Locked(2, t0.Add(time.Minute)); locked {
+		t.Errorf("unexpected lockout for other key")
+	}
+	if _, locked := l.Locked(1, t0.Add(time.Minute*6)); locked {
+		t.Errorf("expected lockout to expire")
+	}
+
+	// failures outside the window don't count
+	l.Fail(3, t0)
+	l.Fail(3, t0.Add(time.Second))
+	if l.Fail(3, t0.Add(time.Minute*2)) {
+		t.Errorf("unexpected lockout for failures outside window")
+	}
+
+	// reset clears failures
+	l.Fail(4, t0)
+	l.Fail(4, t0)
+	l.Reset(4)
+	if l.Fail(4, t0) {
+		t.Errorf("unexpected lockout after reset")
+	}
+
+	// disabled
+	var z failLimiter[uint64]
+	for i := 0; i < 10; i++ {
+		if z.Fail(1, t0) {
+			t.Fatalf("unexpected lockout with limit disabled")
+		}
+	}
+}
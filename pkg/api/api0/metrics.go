@@ -1,6 +1,7 @@
 package api0
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"reflect"
@@ -22,8 +23,14 @@ type apiMetrics struct {
 		reject_notns   *metrics.Counter
 	}
 	accounts_writepersistence_extradata_size_bytes *metrics.Histogram // only includes successful updates
-	accounts_writepersistence_stored_size_bytes    *metrics.Histogram
-	accounts_writepersistence_requests_total       struct {
+	accounts_writepersistence_stored_size_bytes    *metrics.Histogram // actual size stored by PdataStorage
+	pdata_compression_ratio                        *metrics.Histogram // stored size / raw size
+	pdata_stored_size_warnings_total               *metrics.Counter   // stored size exceeded PdataWarnSize
+	accounts_writepersistence_uploads_total        struct {
+		gzip *metrics.Counter
+		none *metrics.Counter
+	}
+	accounts_writepersistence_requests_total struct {
 		success                    *metrics.Counter
 		reject_too_much_extradata  *metrics.Counter
 		reject_too_large           *metrics.Counter
@@ -33,6 +40,7 @@ type apiMetrics struct {
 		reject_unauthorized        *metrics.Counter
 		fail_storage_error_account *metrics.Counter
 		fail_storage_error_pdata   *metrics.Counter
+		reject_bad_remote_addr     *metrics.Counter
 		fail_other_error           *metrics.Counter
 		http_method_not_allowed    *metrics.Counter
 	}
@@ -44,6 +52,12 @@ type apiMetrics struct {
 		fail_storage_error_account *metrics.Counter
 		http_method_not_allowed    *metrics.Counter
 	}
+	accounts_lookup_cache_requests_total struct {
+		getusername_hit  *metrics.Counter
+		getusername_miss *metrics.Counter
+		lookupuid_hit    *metrics.Counter
+		lookupuid_miss   *metrics.Counter
+	}
 	accounts_getusername_requests_total struct {
 		success_match              *metrics.Counter
 		success_missing            *metrics.Counter
@@ -52,6 +66,22 @@ type apiMetrics struct {
 		fail_storage_error_account *metrics.Counter
 		http_method_not_allowed    *metrics.Counter
 	}
+	admin_account_flags_requests_total struct {
+		success                    *metrics.Counter
+		reject_unauthorized        *metrics.Counter
+		reject_bad_request         *metrics.Counter
+		reject_player_not_found    *metrics.Counter
+		fail_storage_error_account *metrics.Counter
+		http_method_not_allowed    *metrics.Counter
+	}
+	admin_account_auth_requests_total struct {
+		success                    *metrics.Counter
+		reject_unauthorized        *metrics.Counter
+		reject_bad_request         *metrics.Counter
+		reject_player_not_found    *metrics.Counter
+		fail_storage_error_account *metrics.Counter
+		http_method_not_allowed    *metrics.Counter
+	}
 	client_mainmenupromos_requests_total struct {
 		success                 func(version string) *metrics.Counter
 		http_method_not_allowed *metrics.Counter
@@ -65,20 +95,29 @@ type apiMetrics struct {
 		reject_stryder_invalidtoken *metrics.Counter
 		reject_stryder_mpnotallowed *metrics.Counter
 		reject_stryder_other        *metrics.Counter
+		reject_ip_locked            *metrics.Counter
 		fail_storage_error_account  *metrics.Counter
 		fail_stryder_error          *metrics.Counter
+		reject_bad_remote_addr      *metrics.Counter
+		fail_request_timeout        *metrics.Counter
 		fail_other_error            *metrics.Counter
 		http_method_not_allowed     *metrics.Counter
 	}
 	client_originauth_requests_map                         *metricsx.GeoCounter2
 	client_originauth_stryder_auth_duration_seconds        *metrics.Histogram
 	client_originauth_eax_username_lookup_duration_seconds *metrics.Histogram
+	client_originauth_eax_username_lookup_coalesced_total  *metrics.Counter
 	client_originauth_eax_username_lookup_calls_total      struct {
 		success           *metrics.Counter
 		notfound          *metrics.Counter
 		fail_update_check *metrics.Counter
 		fail_other_error  *metrics.Counter
 	}
+	client_originauth_username_source_total  func(source string) *metrics.Counter
+	client_originauth_username_source_health struct {
+		stryder *metrics.Gauge
+		eax     *metrics.Gauge
+	}
 	client_originauth_stryder_username_lookup_calls_total struct {
 		success          *metrics.Counter
 		notfound         *metrics.Counter
@@ -91,19 +130,25 @@ type apiMetrics struct {
 		reject_gameserver_not_found *metrics.Counter
 		reject_player_not_found     *metrics.Counter
 		reject_masterserver_token   *metrics.Counter
+		reject_auth_locked          *metrics.Counter
 		reject_password             *metrics.Counter
 		reject_gameserverauth       *metrics.Counter
 		reject_gameserver           *metrics.Counter
 		fail_gameserverauth         *metrics.Counter
 		fail_gameserverauthudp      *metrics.Counter
+		fail_connect_state_limit    *metrics.Counter
 		fail_storage_error_account  *metrics.Counter
 		fail_storage_error_pdata    *metrics.Counter
+		fail_request_timeout        *metrics.Counter
+		reject_bad_remote_addr      *metrics.Counter
 		fail_other_error            *metrics.Counter
 		http_method_not_allowed     *metrics.Counter
 	}
 	client_authwithserver_gameserverauth_duration_seconds    *metrics.Histogram
 	client_authwithserver_gameserverauthudp_duration_seconds *metrics.Histogram
 	client_authwithserver_gameserverauthudp_attempts         *metrics.Histogram
+	client_authwithserver_connect_states                     *metrics.Gauge
+	client_authwithserver_connect_state_evictions_total      *metrics.Counter
 	client_authwithself_requests_total                       struct {
 		success                    *metrics.Counter
 		reject_bad_request         *metrics.Counter
@@ -112,11 +157,14 @@ type apiMetrics struct {
 		reject_masterserver_token  *metrics.Counter
 		fail_storage_error_account *metrics.Counter
 		fail_storage_error_pdata   *metrics.Counter
+		reject_bad_remote_addr     *metrics.Counter
 		fail_other_error           *metrics.Counter
 		http_method_not_allowed    *metrics.Counter
 	}
 	client_servers_requests_total struct {
 		success                 func(version string) *metrics.Counter
+		reject_bad_request      *metrics.Counter
+		reject_not_acceptable   *metrics.Counter
 		http_method_not_allowed *metrics.Counter
 	}
 	client_servers_requests_map struct {
@@ -124,40 +172,101 @@ type apiMetrics struct {
 		other     *metricsx.GeoCounter2
 	}
 	client_servers_response_size_bytes struct {
-		gzip *metrics.Histogram
-		none *metrics.Histogram
-	}
-	server_upsert_requests_total struct {
-		success_updated            func(action string) *metrics.Counter
-		success_verified           func(action string) *metrics.Counter
-		reject_versiongate         func(action string) *metrics.Counter
-		reject_ipv6                func(action string) *metrics.Counter
-		reject_bad_request         func(action string) *metrics.Counter
-		reject_unauthorized_ip     func(action string) *metrics.Counter
-		reject_server_not_found    func(action string) *metrics.Counter
-		reject_duplicate_auth_addr func(action string) *metrics.Counter
-		reject_limits_exceeded     func(action string) *metrics.Counter
-		reject_verify_authtimeout  func(action string) *metrics.Counter
-		reject_verify_authresp     func(action string) *metrics.Counter
-		reject_verify_autherr      func(action string) *metrics.Counter
-		reject_verify_udptimeout   func(action string) *metrics.Counter
-		reject_verify_udperr       func(action string) *metrics.Counter
-		fail_other_error           func(action string) *metrics.Counter
-		fail_serverlist_error      func(action string) *metrics.Counter
-		http_method_not_allowed    func(action string) *metrics.Counter
-	}
-	server_upsert_modinfo_parse_errors_total func(action string) *metrics.Counter
-	server_upsert_verify_time_seconds        struct {
+		gzip   *metrics.Histogram
+		none   *metrics.Histogram
+		binary *metrics.Histogram
+	}
+	client_servers_ws_connections    *metrics.Gauge
+	client_servers_ws_requests_total struct {
+		success                 *metrics.Counter
+		reject_bad_request      *metrics.Counter
+		reject_limit            *metrics.Counter
+		fail_other_error        *metrics.Counter
+		http_method_not_allowed *metrics.Counter
+	}
+	client_servers_ws_pushes_total struct {
+		gzip *metrics.Counter
+		none *metrics.Counter
+	}
+	client_servers_sse_connections    *metrics.Gauge
+	client_servers_sse_requests_total struct {
+		success                 *metrics.Counter
+		reject_limit            *metrics.Counter
+		http_method_not_allowed *metrics.Counter
+	}
+	client_servers_sse_pushes_total *metrics.Counter
+	server_upsert_requests_total    struct {
+		success_updated                func(action string) *metrics.Counter
+		success_verified               func(action string) *metrics.Counter
+		success_verified_skipped       func(action string) *metrics.Counter
+		success_verified_recent        func(action string) *metrics.Counter
+		reject_versiongate             func(action string) *metrics.Counter
+		reject_read_only               func(action string) *metrics.Counter
+		reject_ipv6                    func(action string) *metrics.Counter
+		reject_bad_request             func(action string) *metrics.Counter
+		reject_unauthorized_ip         func(action string) *metrics.Counter
+		reject_server_not_found        func(action string) *metrics.Counter
+		reject_server_gone             func(action string) *metrics.Counter
+		reject_duplicate_auth_addr     func(action string) *metrics.Counter
+		reject_limits_exceeded         func(action string) *metrics.Counter
+		reject_limits_exceeded_trusted func(action string) *metrics.Counter
+		reject_quarantined             func(action string) *metrics.Counter
+		reject_required_mod            func(action string) *metrics.Counter
+		reject_blocked_name            func(action string) *metrics.Counter
+		reject_unknown_map_playlist    func(action string) *metrics.Counter
+		reject_verify_authtimeout      func(action string) *metrics.Counter
+		reject_verify_authresp         func(action string) *metrics.Counter
+		reject_verify_autherr          func(action string) *metrics.Counter
+		reject_verify_udptimeout       func(action string) *metrics.Counter
+		reject_verify_udperr           func(action string) *metrics.Counter
+		reject_verify_queue_timeout    func(action string) *metrics.Counter
+		reject_bad_remote_addr         func(action string) *metrics.Counter
+		fail_other_error               func(action string) *metrics.Counter
+		fail_serverlist_error          func(action string) *metrics.Counter
+		http_method_not_allowed        func(action string) *metrics.Counter
+	}
+	server_upsert_modinfo_parse_errors_total      func(action string) *metrics.Counter
+	server_upsert_modinfo_required_filtered_total *metrics.Counter
+	server_upsert_modinfo_truncated_total         *metrics.Counter
+	server_upsert_sanitized_total                 *metrics.Counter
+	server_upsert_verify_time_seconds             struct {
 		success *metrics.Histogram
 		failure *metrics.Histogram
 	}
-	server_upsert_ip2location_errors_total *metrics.Counter
-	server_upsert_getregion_errors_total   *metrics.Counter
-	server_remove_requests_total           struct {
+	server_upsert_reverify_total struct {
+		success *metrics.Counter
+		failure *metrics.Counter
+	}
+	server_upsert_ip2location_errors_total    *metrics.Counter
+	server_upsert_ip2location_timeouts_total  *metrics.Counter
+	server_upsert_getregion_errors_total      *metrics.Counter
+	server_upsert_region_fallback_total       *metrics.Counter
+	server_upsert_playlist_cap_exceeded_total func(playlist string) *metrics.Counter
+	server_history_requests_total             struct {
+		success                 *metrics.Counter
+		reject_bad_request      *metrics.Counter
+		reject_server_not_found *metrics.Counter
+		http_method_not_allowed *metrics.Counter
+	}
+	server_status_requests_total struct {
+		success                 *metrics.Counter
+		reject_bad_request      *metrics.Counter
+		reject_server_not_found *metrics.Counter
+		http_method_not_allowed *metrics.Counter
+	}
+	server_self_requests_total struct {
+		success                 *metrics.Counter
+		reject_bad_request      *metrics.Counter
+		reject_server_not_found *metrics.Counter
+		http_method_not_allowed *metrics.Counter
+	}
+	server_remove_requests_total struct {
 		success                 *metrics.Counter
 		reject_unauthorized_ip  *metrics.Counter
 		reject_bad_request      *metrics.Counter
 		reject_server_not_found *metrics.Counter
+		reject_bad_remote_addr  *metrics.Counter
+		reject_read_only        *metrics.Counter
 		fail_other_error        *metrics.Counter
 		http_method_not_allowed *metrics.Counter
 	}
@@ -170,6 +279,7 @@ type apiMetrics struct {
 		reject_invalid_connection_token *metrics.Counter
 		reject_must_get_pdata           *metrics.Counter
 		reject_bad_request              *metrics.Counter
+		reject_bad_remote_addr          *metrics.Counter
 		fail_other_error                *metrics.Counter
 		http_method_not_allowed         *metrics.Counter
 	}
@@ -182,6 +292,43 @@ type apiMetrics struct {
 		fail_other_error         *metrics.Counter
 		http_method_not_allowed  *metrics.Counter
 	}
+	player_pdata_hash_requests_total struct {
+		success                    *metrics.Counter
+		reject_bad_request         *metrics.Counter
+		reject_player_not_found    *metrics.Counter
+		reject_masterserver_token  *metrics.Counter
+		fail_storage_error_account *metrics.Counter
+		fail_storage_error_pdata   *metrics.Counter
+		http_method_not_allowed    *metrics.Counter
+	}
+	storage_inconsistencies_total struct {
+		missing_pdata   *metrics.Counter
+		missing_account *metrics.Counter
+	}
+	pdata_cache_requests_total struct {
+		authwithserver pdataCacheCounters
+		authwithself   pdataCacheCounters
+		player_pdata   pdataCacheCounters
+	}
+}
+
+type pdataCacheCounters struct {
+	hit  *metrics.Counter // client-provided hash matched
+	miss *metrics.Counter // client-provided hash didn't match
+	none *metrics.Counter // no client-provided hash
+}
+
+// inc increments the counter for a GetPdataCached call with the provided
+// hash returning the provided buffer.
+func (c pdataCacheCounters) inc(sha [sha256.Size]byte, buf []byte, exists bool) {
+	switch {
+	case sha == [sha256.Size]byte{}:
+		c.none.Inc()
+	case exists && buf == nil:
+		c.hit.Inc()
+	default:
+		c.miss.Inc()
+	}
 }
 
 func (h *Handler) Metrics() *metrics.Set {
@@ -218,6 +365,10 @@ func (h *Handler) m() *apiMetrics {
 		mo.versiongate_checks_total.reject_notns = mo.set.NewCounter(`atlas_api0_versiongate_checks_total{result="reject_notns"}`)
 		mo.accounts_writepersistence_extradata_size_bytes = mo.set.NewHistogram(`atlas_api0_accounts_writepersistence_extradata_size_bytes`)
 		mo.accounts_writepersistence_stored_size_bytes = mo.set.NewHistogram(`atlas_api0_accounts_writepersistence_stored_size_bytes`)
+		mo.pdata_compression_ratio = mo.set.NewHistogram(`atlas_pdata_compression_ratio`)
+		mo.pdata_stored_size_warnings_total = mo.set.NewCounter(`atlas_pdata_stored_size_warnings_total`)
+		mo.accounts_writepersistence_uploads_total.gzip = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_uploads_total{compression="gzip"}`)
+		mo.accounts_writepersistence_uploads_total.none = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_uploads_total{compression="none"}`)
 		mo.accounts_writepersistence_requests_total.success = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_requests_total{result="success"}`)
 		mo.accounts_writepersistence_requests_total.reject_too_much_extradata = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_requests_total{result="reject_too_much_extradata"}`)
 		mo.accounts_writepersistence_requests_total.reject_too_large = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_requests_total{result="reject_too_large"}`)
@@ -227,6 +378,7 @@ func (h *Handler) m() *apiMetrics {
 		mo.accounts_writepersistence_requests_total.reject_unauthorized = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_requests_total{result="reject_unauthorized"}`)
 		mo.accounts_writepersistence_requests_total.fail_storage_error_account = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_requests_total{result="fail_storage_error_account"}`)
 		mo.accounts_writepersistence_requests_total.fail_storage_error_pdata = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_requests_total{result="fail_storage_error_pdata"}`)
+		mo.accounts_writepersistence_requests_total.reject_bad_remote_addr = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_requests_total{result="reject_bad_remote_addr"}`)
 		mo.accounts_writepersistence_requests_total.fail_other_error = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_requests_total{result="fail_other_error"}`)
 		mo.accounts_writepersistence_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_accounts_writepersistence_requests_total{result="http_method_not_allowed"}`)
 		mo.accounts_lookupuid_requests_total.success_singlematch = mo.set.NewCounter(`atlas_api0_accounts_lookupuid_requests_total{result="success_singlematch"}`)
@@ -235,19 +387,33 @@ func (h *Handler) m() *apiMetrics {
 		mo.accounts_lookupuid_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_accounts_lookupuid_requests_total{result="reject_bad_request"}`)
 		mo.accounts_lookupuid_requests_total.fail_storage_error_account = mo.set.NewCounter(`atlas_api0_accounts_lookupuid_requests_total{result="fail_storage_error_account"}`)
 		mo.accounts_lookupuid_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_accounts_lookupuid_requests_total{result="http_method_not_allowed"}`)
+		mo.accounts_lookup_cache_requests_total.getusername_hit = mo.set.NewCounter(`atlas_api0_accounts_lookup_cache_requests_total{endpoint="getusername",result="hit"}`)
+		mo.accounts_lookup_cache_requests_total.getusername_miss = mo.set.NewCounter(`atlas_api0_accounts_lookup_cache_requests_total{endpoint="getusername",result="miss"}`)
+		mo.accounts_lookup_cache_requests_total.lookupuid_hit = mo.set.NewCounter(`atlas_api0_accounts_lookup_cache_requests_total{endpoint="lookupuid",result="hit"}`)
+		mo.accounts_lookup_cache_requests_total.lookupuid_miss = mo.set.NewCounter(`atlas_api0_accounts_lookup_cache_requests_total{endpoint="lookupuid",result="miss"}`)
 		mo.accounts_getusername_requests_total.success_match = mo.set.NewCounter(`atlas_api0_accounts_getusername_requests_total{result="success_match"}`)
 		mo.accounts_getusername_requests_total.success_missing = mo.set.NewCounter(`atlas_api0_accounts_getusername_requests_total{result="success_missing"}`)
 		mo.accounts_getusername_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_accounts_getusername_requests_total{result="reject_bad_request"}`)
 		mo.accounts_getusername_requests_total.reject_player_not_found = mo.set.NewCounter(`atlas_api0_accounts_getusername_requests_total{result="reject_player_not_found"}`)
 		mo.accounts_getusername_requests_total.fail_storage_error_account = mo.set.NewCounter(`atlas_api0_accounts_getusername_requests_total{result="fail_storage_error_account"}`)
 		mo.accounts_getusername_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_accounts_getusername_requests_total{result="http_method_not_allowed"}`)
+		mo.admin_account_flags_requests_total.success = mo.set.NewCounter(`atlas_api0_admin_account_flags_requests_total{result="success"}`)
+		mo.admin_account_flags_requests_total.reject_unauthorized = mo.set.NewCounter(`atlas_api0_admin_account_flags_requests_total{result="reject_unauthorized"}`)
+		mo.admin_account_flags_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_admin_account_flags_requests_total{result="reject_bad_request"}`)
+		mo.admin_account_flags_requests_total.reject_player_not_found = mo.set.NewCounter(`atlas_api0_admin_account_flags_requests_total{result="reject_player_not_found"}`)
+		mo.admin_account_flags_requests_total.fail_storage_error_account = mo.set.NewCounter(`atlas_api0_admin_account_flags_requests_total{result="fail_storage_error_account"}`)
+		mo.admin_account_flags_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_admin_account_flags_requests_total{result="http_method_not_allowed"}`)
+		mo.admin_account_auth_requests_total.success = mo.set.NewCounter(`atlas_api0_admin_account_auth_requests_total{result="success"}`)
+		mo.admin_account_auth_requests_total.reject_unauthorized = mo.set.NewCounter(`atlas_api0_admin_account_auth_requests_total{result="reject_unauthorized"}`)
+		mo.admin_account_auth_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_admin_account_auth_requests_total{result="reject_bad_request"}`)
+		mo.admin_account_auth_requests_total.reject_player_not_found = mo.set.NewCounter(`atlas_api0_admin_account_auth_requests_total{result="reject_player_not_found"}`)
+		mo.admin_account_auth_requests_total.fail_storage_error_account = mo.set.NewCounter(`atlas_api0_admin_account_auth_requests_total{result="fail_storage_error_account"}`)
+		mo.admin_account_auth_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_admin_account_auth_requests_total{result="http_method_not_allowed"}`)
 		mo.client_mainmenupromos_requests_total.success = func(launcher_version string) *metrics.Counter {
-			if launcher_version == "" {
-				launcher_version = "unknown"
-			}
+			launcher_version = launcherVersionLabel(launcher_version)
 			return mo.set.GetOrCreateCounter(`atlas_api0_client_mainmenupromos_requests_total{result="success",launcher_version="` + launcher_version + `"}`)
 		}
-		mo.client_mainmenupromos_requests_total.success("unknown")
+		mo.client_mainmenupromos_requests_total.success("")
 		mo.client_mainmenupromos_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_client_servers_response_size_bytes{result="http_method_not_allowed"}`)
 		mo.client_mainmenupromos_requests_map = metricsx.NewGeoCounter2(`atlas_api0_client_mainmenupromos_requests_map`)
 		mo.client_originauth_requests_total.success = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="success"}`)
@@ -257,17 +423,36 @@ func (h *Handler) m() *apiMetrics {
 		mo.client_originauth_requests_total.reject_stryder_invalidtoken = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="reject_stryder_invalidtoken"}`)
 		mo.client_originauth_requests_total.reject_stryder_mpnotallowed = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="reject_stryder_mpnotallowed"}`)
 		mo.client_originauth_requests_total.reject_stryder_other = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="reject_stryder_other"}`)
+		mo.client_originauth_requests_total.reject_ip_locked = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="reject_ip_locked"}`)
 		mo.client_originauth_requests_total.fail_storage_error_account = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="fail_storage_error_account"}`)
 		mo.client_originauth_requests_total.fail_stryder_error = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="fail_stryder_error"}`)
+		mo.client_originauth_requests_total.reject_bad_remote_addr = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="reject_bad_remote_addr"}`)
+		mo.client_originauth_requests_total.fail_request_timeout = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="fail_request_timeout"}`)
 		mo.client_originauth_requests_total.fail_other_error = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="fail_other_error"}`)
 		mo.client_originauth_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_client_originauth_requests_total{result="http_method_not_allowed"}`)
 		mo.client_originauth_requests_map = metricsx.NewGeoCounter2(`atlas_api0_client_originauth_requests_map`)
 		mo.client_originauth_stryder_auth_duration_seconds = mo.set.NewHistogram(`atlas_api0_client_originauth_stryder_auth_duration_seconds`)
 		mo.client_originauth_eax_username_lookup_duration_seconds = mo.set.NewHistogram(`atlas_api0_client_originauth_eax_username_lookup_duration_seconds`)
+		mo.client_originauth_eax_username_lookup_coalesced_total = mo.set.NewCounter(`atlas_api0_client_originauth_eax_username_lookup_coalesced_total`)
 		mo.client_originauth_eax_username_lookup_calls_total.success = mo.set.NewCounter(`atlas_api0_client_originauth_eax_username_lookup_calls_total{result="success"}`)
 		mo.client_originauth_eax_username_lookup_calls_total.notfound = mo.set.NewCounter(`atlas_api0_client_originauth_eax_username_lookup_calls_total{result="notfound"}`)
 		mo.client_originauth_eax_username_lookup_calls_total.fail_update_check = mo.set.NewCounter(`atlas_api0_client_originauth_eax_username_lookup_calls_total{result="fail_update_check"}`)
 		mo.client_originauth_eax_username_lookup_calls_total.fail_other_error = mo.set.NewCounter(`atlas_api0_client_originauth_eax_username_lookup_calls_total{result="fail_other_error"}`)
+		mo.client_originauth_username_source_total = func(source string) *metrics.Counter {
+			if source == "" {
+				panic("invalid source")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_client_originauth_username_source_total{source="` + source + `"}`)
+		}
+		mo.client_originauth_username_source_total("none")
+		mo.client_originauth_username_source_total("stryder")
+		mo.client_originauth_username_source_total("eax")
+		mo.client_originauth_username_source_health.stryder = mo.set.NewGauge(`atlas_api0_client_originauth_username_source_health{source="stryder"}`, func() float64 {
+			return h.usernameHealthStryder.Score()
+		})
+		mo.client_originauth_username_source_health.eax = mo.set.NewGauge(`atlas_api0_client_originauth_username_source_health{source="eax"}`, func() float64 {
+			return h.usernameHealthEAX.Score()
+		})
 		mo.client_originauth_stryder_username_lookup_calls_total.success = mo.set.NewCounter(`atlas_api0_client_originauth_stryder_username_lookup_calls_total{result="success"}`)
 		mo.client_originauth_stryder_username_lookup_calls_total.notfound = mo.set.NewCounter(`atlas_api0_client_originauth_stryder_username_lookup_calls_total{result="notfound"}`)
 		mo.client_originauth_stryder_username_lookup_calls_total.fail_other_error = mo.set.NewCounter(`atlas_api0_client_originauth_stryder_username_lookup_calls_total{result="fail_other_error"}`)
@@ -277,18 +462,26 @@ func (h *Handler) m() *apiMetrics {
 		mo.client_authwithserver_requests_total.reject_gameserver_not_found = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="reject_gameserver_not_found"}`)
 		mo.client_authwithserver_requests_total.reject_player_not_found = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="reject_player_not_found"}`)
 		mo.client_authwithserver_requests_total.reject_masterserver_token = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="reject_masterserver_token"}`)
+		mo.client_authwithserver_requests_total.reject_auth_locked = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="reject_auth_locked"}`)
 		mo.client_authwithserver_requests_total.reject_password = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="reject_password"}`)
 		mo.client_authwithserver_requests_total.reject_gameserverauth = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="reject_gameserverauth"}`)
 		mo.client_authwithserver_requests_total.reject_gameserver = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="reject_gameserver"}`)
 		mo.client_authwithserver_requests_total.fail_gameserverauth = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="fail_gameserverauth"}`)
 		mo.client_authwithserver_requests_total.fail_gameserverauthudp = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="fail_gameserverauthudp"}`)
+		mo.client_authwithserver_requests_total.fail_connect_state_limit = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="fail_connect_state_limit"}`)
 		mo.client_authwithserver_requests_total.fail_storage_error_account = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="fail_storage_error_account"}`)
 		mo.client_authwithserver_requests_total.fail_storage_error_pdata = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="fail_storage_error_pdata"}`)
+		mo.client_authwithserver_requests_total.fail_request_timeout = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="fail_request_timeout"}`)
 		mo.client_authwithserver_requests_total.fail_other_error = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="fail_other_error"}`)
+		mo.client_authwithserver_requests_total.reject_bad_remote_addr = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="reject_bad_remote_addr"}`)
 		mo.client_authwithserver_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_client_authwithserver_requests_total{result="http_method_not_allowed"}`)
 		mo.client_authwithserver_gameserverauth_duration_seconds = mo.set.NewHistogram(`atlas_api0_client_authwithserver_gameserverauth_duration_seconds`)
 		mo.client_authwithserver_gameserverauthudp_duration_seconds = mo.set.NewHistogram(`atlas_api0_client_authwithserver_gameserverauthudp_duration_seconds`)
 		mo.client_authwithserver_gameserverauthudp_attempts = mo.set.NewHistogram(`atlas_api0_client_authwithserver_gameserverauthudp_attempts`)
+		mo.client_authwithserver_connect_states = mo.set.NewGauge(`atlas_api0_client_authwithserver_connect_states`, func() float64 {
+			return float64(h.connectCount.Load())
+		})
+		mo.client_authwithserver_connect_state_evictions_total = mo.set.NewCounter(`atlas_api0_client_authwithserver_connect_state_evictions_total`)
 		mo.client_authwithself_requests_total.success = mo.set.NewCounter(`atlas_api0_client_authwithself_requests_total{result="success"}`)
 		mo.client_authwithself_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_client_authwithself_requests_total{result="reject_bad_request"}`)
 		mo.client_authwithself_requests_total.reject_versiongate = mo.set.NewCounter(`atlas_api0_client_authwithself_requests_total{result="reject_versiongate"}`)
@@ -296,20 +489,65 @@ func (h *Handler) m() *apiMetrics {
 		mo.client_authwithself_requests_total.reject_masterserver_token = mo.set.NewCounter(`atlas_api0_client_authwithself_requests_total{result="reject_masterserver_token"}`)
 		mo.client_authwithself_requests_total.fail_storage_error_account = mo.set.NewCounter(`atlas_api0_client_authwithself_requests_total{result="fail_storage_error_account"}`)
 		mo.client_authwithself_requests_total.fail_storage_error_pdata = mo.set.NewCounter(`atlas_api0_client_authwithself_requests_total{result="fail_storage_error_pdata"}`)
+		mo.client_authwithself_requests_total.reject_bad_remote_addr = mo.set.NewCounter(`atlas_api0_client_authwithself_requests_total{result="reject_bad_remote_addr"}`)
 		mo.client_authwithself_requests_total.fail_other_error = mo.set.NewCounter(`atlas_api0_client_authwithself_requests_total{result="fail_other_error"}`)
 		mo.client_authwithself_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_client_authwithself_requests_total{result="http_method_not_allowed"}`)
 		mo.client_servers_requests_total.success = func(launcher_version string) *metrics.Counter {
-			if launcher_version == "" {
-				launcher_version = "unknown"
-			}
+			launcher_version = launcherVersionLabel(launcher_version)
 			return mo.set.GetOrCreateCounter(`atlas_api0_client_servers_requests_total{result="success",launcher_version="` + launcher_version + `"}`)
 		}
-		mo.client_servers_requests_total.success("unknown")
+		mo.client_servers_requests_total.success("")
+		mo.client_servers_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_client_servers_requests_total{result="reject_bad_request"}`)
+		mo.client_servers_requests_total.reject_not_acceptable = mo.set.NewCounter(`atlas_api0_client_servers_requests_total{result="reject_not_acceptable"}`)
 		mo.client_servers_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_client_servers_requests_total{result="http_method_not_allowed"}`)
 		mo.client_servers_requests_map.northstar = metricsx.NewGeoCounter2(`atlas_api0_client_servers_requests_map{user_agent="northstar"}`)
 		mo.client_servers_requests_map.other = metricsx.NewGeoCounter2(`atlas_api0_client_servers_requests_map{user_agent="other"}`)
-		mo.client_servers_response_size_bytes.gzip = mo.set.NewHistogram(`atlas_api0_client_servers_response_size_bytes{compression="gzip"}`)
-		mo.client_servers_response_size_bytes.none = mo.set.NewHistogram(`atlas_api0_client_servers_response_size_bytes{compression="none"}`)
+		for _, x := range []struct {
+			endpoint string
+			ctr      []*metricsx.GeoCounter2
+		}{
+			{"mainmenupromos", []*metricsx.GeoCounter2{mo.client_mainmenupromos_requests_map}},
+			{"originauth", []*metricsx.GeoCounter2{mo.client_originauth_requests_map}},
+			{"servers", []*metricsx.GeoCounter2{mo.client_servers_requests_map.northstar, mo.client_servers_requests_map.other}},
+		} {
+			x := x
+			mo.set.NewGauge(`atlas_api0_geo_requests{endpoint="`+x.endpoint+`",location="known"}`, func() float64 {
+				var n uint64
+				for _, c := range x.ctr {
+					k, _ := c.Resolution()
+					n += k
+				}
+				return float64(n)
+			})
+			mo.set.NewGauge(`atlas_api0_geo_requests{endpoint="`+x.endpoint+`",location="unknown"}`, func() float64 {
+				var n uint64
+				for _, c := range x.ctr {
+					_, u := c.Resolution()
+					n += u
+				}
+				return float64(n)
+			})
+		}
+		mo.client_servers_response_size_bytes.gzip = mo.set.NewHistogram(`atlas_api0_client_servers_response_size_bytes{compression="gzip",format="json"}`)
+		mo.client_servers_response_size_bytes.none = mo.set.NewHistogram(`atlas_api0_client_servers_response_size_bytes{compression="none",format="json"}`)
+		mo.client_servers_response_size_bytes.binary = mo.set.NewHistogram(`atlas_api0_client_servers_response_size_bytes{compression="none",format="binary"}`)
+		mo.client_servers_ws_connections = mo.set.NewGauge(`atlas_api0_client_servers_ws_connections`, func() float64 {
+			return float64(h.serverListWS.Load())
+		})
+		mo.client_servers_ws_requests_total.success = mo.set.NewCounter(`atlas_api0_client_servers_ws_requests_total{result="success"}`)
+		mo.client_servers_ws_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_client_servers_ws_requests_total{result="reject_bad_request"}`)
+		mo.client_servers_ws_requests_total.reject_limit = mo.set.NewCounter(`atlas_api0_client_servers_ws_requests_total{result="reject_limit"}`)
+		mo.client_servers_ws_requests_total.fail_other_error = mo.set.NewCounter(`atlas_api0_client_servers_ws_requests_total{result="fail_other_error"}`)
+		mo.client_servers_ws_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_client_servers_ws_requests_total{result="http_method_not_allowed"}`)
+		mo.client_servers_ws_pushes_total.gzip = mo.set.NewCounter(`atlas_api0_client_servers_ws_pushes_total{compression="gzip"}`)
+		mo.client_servers_ws_pushes_total.none = mo.set.NewCounter(`atlas_api0_client_servers_ws_pushes_total{compression="none"}`)
+		mo.client_servers_sse_connections = mo.set.NewGauge(`atlas_api0_client_servers_sse_connections`, func() float64 {
+			return float64(h.serverListSSE.Load())
+		})
+		mo.client_servers_sse_requests_total.success = mo.set.NewCounter(`atlas_api0_client_servers_sse_requests_total{result="success"}`)
+		mo.client_servers_sse_requests_total.reject_limit = mo.set.NewCounter(`atlas_api0_client_servers_sse_requests_total{result="reject_limit"}`)
+		mo.client_servers_sse_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_client_servers_sse_requests_total{result="http_method_not_allowed"}`)
+		mo.client_servers_sse_pushes_total = mo.set.NewCounter(`atlas_api0_client_servers_sse_pushes_total`)
 		mo.server_upsert_requests_total.success_updated = func(action string) *metrics.Counter {
 			if action == "" {
 				panic("invalid action")
@@ -322,12 +560,30 @@ func (h *Handler) m() *apiMetrics {
 			}
 			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="success_verified",action="` + action + `"}`)
 		}
+		mo.server_upsert_requests_total.success_verified_skipped = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="success_verified_skipped",action="` + action + `"}`)
+		}
+		mo.server_upsert_requests_total.success_verified_recent = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="success_verified_recent",action="` + action + `"}`)
+		}
 		mo.server_upsert_requests_total.reject_versiongate = func(action string) *metrics.Counter {
 			if action == "" {
 				panic("invalid action")
 			}
 			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_versiongate",action="` + action + `"}`)
 		}
+		mo.server_upsert_requests_total.reject_read_only = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_read_only",action="` + action + `"}`)
+		}
 		mo.server_upsert_requests_total.reject_ipv6 = func(action string) *metrics.Counter {
 			if action == "" {
 				panic("invalid action")
@@ -352,6 +608,12 @@ func (h *Handler) m() *apiMetrics {
 			}
 			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_server_not_found",action="` + action + `"}`)
 		}
+		mo.server_upsert_requests_total.reject_server_gone = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_server_gone",action="` + action + `"}`)
+		}
 		mo.server_upsert_requests_total.reject_duplicate_auth_addr = func(action string) *metrics.Counter {
 			if action == "" {
 				panic("invalid action")
@@ -364,6 +626,36 @@ func (h *Handler) m() *apiMetrics {
 			}
 			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_limits_exceeded",action="` + action + `"}`)
 		}
+		mo.server_upsert_requests_total.reject_limits_exceeded_trusted = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_limits_exceeded_trusted",action="` + action + `"}`)
+		}
+		mo.server_upsert_requests_total.reject_quarantined = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_quarantined",action="` + action + `"}`)
+		}
+		mo.server_upsert_requests_total.reject_required_mod = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_required_mod",action="` + action + `"}`)
+		}
+		mo.server_upsert_requests_total.reject_blocked_name = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_blocked_name",action="` + action + `"}`)
+		}
+		mo.server_upsert_requests_total.reject_unknown_map_playlist = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_unknown_map_playlist",action="` + action + `"}`)
+		}
 		mo.server_upsert_requests_total.reject_verify_authtimeout = func(action string) *metrics.Counter {
 			if action == "" {
 				panic("invalid action")
@@ -394,6 +686,18 @@ func (h *Handler) m() *apiMetrics {
 			}
 			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_verify_udperr",action="` + action + `"}`)
 		}
+		mo.server_upsert_requests_total.reject_verify_queue_timeout = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_verify_queue_timeout",action="` + action + `"}`)
+		}
+		mo.server_upsert_requests_total.reject_bad_remote_addr = func(action string) *metrics.Counter {
+			if action == "" {
+				panic("invalid action")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="reject_bad_remote_addr",action="` + action + `"}`)
+		}
 		mo.server_upsert_requests_total.fail_other_error = func(action string) *metrics.Counter {
 			if action == "" {
 				panic("invalid action")
@@ -412,6 +716,9 @@ func (h *Handler) m() *apiMetrics {
 			}
 			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_requests_total{result="http_method_not_allowed",action="` + action + `"}`)
 		}
+		mo.server_upsert_modinfo_required_filtered_total = mo.set.NewCounter(`atlas_api0_server_upsert_modinfo_required_filtered_total`)
+		mo.server_upsert_modinfo_truncated_total = mo.set.NewCounter(`atlas_api0_server_upsert_modinfo_truncated_total`)
+		mo.server_upsert_sanitized_total = mo.set.NewCounter(`atlas_api0_server_upsert_sanitized_total`)
 		mo.server_upsert_modinfo_parse_errors_total = func(action string) *metrics.Counter {
 			if action == "" {
 				panic("invalid action")
@@ -421,18 +728,29 @@ func (h *Handler) m() *apiMetrics {
 		for _, action := range []string{"add_server", "update_values", "heartbeat"} {
 			mo.server_upsert_requests_total.success_updated(action)
 			mo.server_upsert_requests_total.success_verified(action)
+			mo.server_upsert_requests_total.success_verified_skipped(action)
+			mo.server_upsert_requests_total.success_verified_recent(action)
 			mo.server_upsert_requests_total.reject_versiongate(action)
+			mo.server_upsert_requests_total.reject_read_only(action)
 			mo.server_upsert_requests_total.reject_ipv6(action)
 			mo.server_upsert_requests_total.reject_bad_request(action)
 			mo.server_upsert_requests_total.reject_unauthorized_ip(action)
 			mo.server_upsert_requests_total.reject_server_not_found(action)
+			mo.server_upsert_requests_total.reject_server_gone(action)
 			mo.server_upsert_requests_total.reject_duplicate_auth_addr(action)
 			mo.server_upsert_requests_total.reject_limits_exceeded(action)
+			mo.server_upsert_requests_total.reject_limits_exceeded_trusted(action)
+			mo.server_upsert_requests_total.reject_quarantined(action)
+			mo.server_upsert_requests_total.reject_required_mod(action)
+			mo.server_upsert_requests_total.reject_blocked_name(action)
+			mo.server_upsert_requests_total.reject_unknown_map_playlist(action)
 			mo.server_upsert_requests_total.reject_verify_authtimeout(action)
 			mo.server_upsert_requests_total.reject_verify_authresp(action)
 			mo.server_upsert_requests_total.reject_verify_autherr(action)
 			mo.server_upsert_requests_total.reject_verify_udptimeout(action)
 			mo.server_upsert_requests_total.reject_verify_udperr(action)
+			mo.server_upsert_requests_total.reject_verify_queue_timeout(action)
+			mo.server_upsert_requests_total.reject_bad_remote_addr(action)
 			mo.server_upsert_requests_total.fail_other_error(action)
 			mo.server_upsert_requests_total.fail_serverlist_error(action)
 			mo.server_upsert_requests_total.http_method_not_allowed(action)
@@ -440,12 +758,39 @@ func (h *Handler) m() *apiMetrics {
 		}
 		mo.server_upsert_verify_time_seconds.success = mo.set.NewHistogram(`atlas_api0_server_upsert_verify_time_seconds{success="true"}`)
 		mo.server_upsert_verify_time_seconds.failure = mo.set.NewHistogram(`atlas_api0_server_upsert_verify_time_seconds{success="false"}`)
+		mo.server_upsert_reverify_total.success = mo.set.NewCounter(`atlas_api0_server_upsert_reverify_total{success="true"}`)
+		mo.server_upsert_reverify_total.failure = mo.set.NewCounter(`atlas_api0_server_upsert_reverify_total{success="false"}`)
 		mo.server_upsert_ip2location_errors_total = mo.set.NewCounter(`atlas_api0_server_upsert_ip2location_errors_total`)
+		mo.server_upsert_ip2location_timeouts_total = mo.set.NewCounter(`atlas_api0_server_upsert_ip2location_timeouts_total`)
 		mo.server_upsert_getregion_errors_total = mo.set.NewCounter(`atlas_api0_server_upsert_getregion_errors_total`)
+		mo.server_upsert_region_fallback_total = mo.set.NewCounter(`atlas_api0_server_upsert_region_fallback_total`)
+		mo.server_upsert_playlist_cap_exceeded_total = func(playlist string) *metrics.Counter {
+			if playlist == "" {
+				panic("invalid playlist")
+			}
+			return mo.set.GetOrCreateCounter(`atlas_api0_server_upsert_playlist_cap_exceeded_total{playlist="` + playlist + `"}`)
+		}
+		for playlist := range h.PlaylistPlayerCaps {
+			mo.server_upsert_playlist_cap_exceeded_total(playlist)
+		}
+		mo.server_history_requests_total.success = mo.set.NewCounter(`atlas_api0_server_history_requests_total{result="success"}`)
+		mo.server_history_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_server_history_requests_total{result="reject_bad_request"}`)
+		mo.server_history_requests_total.reject_server_not_found = mo.set.NewCounter(`atlas_api0_server_history_requests_total{result="reject_server_not_found"}`)
+		mo.server_history_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_server_history_requests_total{result="http_method_not_allowed"}`)
+		mo.server_status_requests_total.success = mo.set.NewCounter(`atlas_api0_server_status_requests_total{result="success"}`)
+		mo.server_status_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_server_status_requests_total{result="reject_bad_request"}`)
+		mo.server_status_requests_total.reject_server_not_found = mo.set.NewCounter(`atlas_api0_server_status_requests_total{result="reject_server_not_found"}`)
+		mo.server_status_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_server_status_requests_total{result="http_method_not_allowed"}`)
+		mo.server_self_requests_total.success = mo.set.NewCounter(`atlas_api0_server_self_requests_total{result="success"}`)
+		mo.server_self_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_server_self_requests_total{result="reject_bad_request"}`)
+		mo.server_self_requests_total.reject_server_not_found = mo.set.NewCounter(`atlas_api0_server_self_requests_total{result="reject_server_not_found"}`)
+		mo.server_self_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_server_self_requests_total{result="http_method_not_allowed"}`)
 		mo.server_remove_requests_total.success = mo.set.NewCounter(`atlas_api0_server_remove_requests_total{result="success"}`)
 		mo.server_remove_requests_total.reject_unauthorized_ip = mo.set.NewCounter(`atlas_api0_server_remove_requests_total{result="reject_unauthorized_ip"}`)
 		mo.server_remove_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_server_remove_requests_total{result="reject_bad_request"}`)
 		mo.server_remove_requests_total.reject_server_not_found = mo.set.NewCounter(`atlas_api0_server_remove_requests_total{result="reject_server_not_found"}`)
+		mo.server_remove_requests_total.reject_bad_remote_addr = mo.set.NewCounter(`atlas_api0_server_remove_requests_total{result="reject_bad_remote_addr"}`)
+		mo.server_remove_requests_total.reject_read_only = mo.set.NewCounter(`atlas_api0_server_remove_requests_total{result="reject_read_only"}`)
 		mo.server_remove_requests_total.fail_other_error = mo.set.NewCounter(`atlas_api0_server_remove_requests_total{result="fail_other_error"}`)
 		mo.server_remove_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_server_remove_requests_total{result="http_method_not_allowed"}`)
 		mo.server_connect_requests_total.success = mo.set.NewCounter(`atlas_api0_server_connect_requests_total{result="success"}`)
@@ -456,6 +801,7 @@ func (h *Handler) m() *apiMetrics {
 		mo.server_connect_requests_total.reject_invalid_connection_token = mo.set.NewCounter(`atlas_api0_server_connect_requests_total{result="reject_invalid_connection_token"}`)
 		mo.server_connect_requests_total.reject_must_get_pdata = mo.set.NewCounter(`atlas_api0_server_connect_requests_total{result="reject_must_get_pdata"}`)
 		mo.server_connect_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_server_connect_requests_total{result="reject_bad_request"}`)
+		mo.server_connect_requests_total.reject_bad_remote_addr = mo.set.NewCounter(`atlas_api0_server_connect_requests_total{result="reject_bad_remote_addr"}`)
 		mo.server_connect_requests_total.fail_other_error = mo.set.NewCounter(`atlas_api0_server_connect_requests_total{result="fail_other_error"}`)
 		mo.server_connect_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_server_connect_requests_total{result="http_method_not_allowed"}`)
 		mo.player_pdata_requests_total.success = func(filter string) *metrics.Counter {
@@ -470,6 +816,24 @@ func (h *Handler) m() *apiMetrics {
 		mo.player_pdata_requests_total.fail_pdata_invalid = mo.set.NewCounter(`atlas_api0_player_pdata_requests_total{result="fail_pdata_invalid"}`)
 		mo.player_pdata_requests_total.fail_other_error = mo.set.NewCounter(`atlas_api0_player_pdata_requests_total{result="fail_other_error"}`)
 		mo.player_pdata_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_player_pdata_requests_total{result="http_method_not_allowed"}`)
+		mo.player_pdata_hash_requests_total.success = mo.set.NewCounter(`atlas_api0_player_pdata_hash_requests_total{result="success"}`)
+		mo.player_pdata_hash_requests_total.reject_bad_request = mo.set.NewCounter(`atlas_api0_player_pdata_hash_requests_total{result="reject_bad_request"}`)
+		mo.player_pdata_hash_requests_total.reject_player_not_found = mo.set.NewCounter(`atlas_api0_player_pdata_hash_requests_total{result="reject_player_not_found"}`)
+		mo.player_pdata_hash_requests_total.reject_masterserver_token = mo.set.NewCounter(`atlas_api0_player_pdata_hash_requests_total{result="reject_masterserver_token"}`)
+		mo.player_pdata_hash_requests_total.fail_storage_error_account = mo.set.NewCounter(`atlas_api0_player_pdata_hash_requests_total{result="fail_storage_error_account"}`)
+		mo.player_pdata_hash_requests_total.fail_storage_error_pdata = mo.set.NewCounter(`atlas_api0_player_pdata_hash_requests_total{result="fail_storage_error_pdata"}`)
+		mo.player_pdata_hash_requests_total.http_method_not_allowed = mo.set.NewCounter(`atlas_api0_player_pdata_hash_requests_total{result="http_method_not_allowed"}`)
+		mo.storage_inconsistencies_total.missing_pdata = mo.set.NewCounter(`atlas_api0_storage_inconsistencies_total{kind="missing_pdata"}`)
+		mo.storage_inconsistencies_total.missing_account = mo.set.NewCounter(`atlas_api0_storage_inconsistencies_total{kind="missing_account"}`)
+		for endpoint, c := range map[string]*pdataCacheCounters{
+			"authwithserver": &mo.pdata_cache_requests_total.authwithserver,
+			"authwithself":   &mo.pdata_cache_requests_total.authwithself,
+			"player_pdata":   &mo.pdata_cache_requests_total.player_pdata,
+		} {
+			c.hit = mo.set.NewCounter(`atlas_api0_pdata_cache_requests_total{endpoint="` + endpoint + `",result="hit"}`)
+			c.miss = mo.set.NewCounter(`atlas_api0_pdata_cache_requests_total{endpoint="` + endpoint + `",result="miss"}`)
+			c.none = mo.set.NewCounter(`atlas_api0_pdata_cache_requests_total{endpoint="` + endpoint + `",result="none"}`)
+		}
 	})
 
 	// ensure we initialized everything
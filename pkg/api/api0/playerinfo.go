@@ -118,7 +118,14 @@ func (h *Handler) handlePlayer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	buf, exists, err := h.PdataStorage.GetPdataCached(uid, [sha256.Size]byte{})
+	// if the client has a cached response, we don't need to get the pdata if
+	// it's unchanged
+	var etag [sha256.Size]byte
+	if v, ok := parsePdataETag(r.Header.Get("If-None-Match")); ok {
+		etag = v
+	}
+
+	buf, exists, err := h.PdataStorage.GetPdataCached(uid, etag)
 	if err != nil {
 		hlog.FromRequest(r).Error().
 			Err(err).
@@ -128,11 +135,18 @@ func (h *Handler) handlePlayer(w http.ResponseWriter, r *http.Request) {
 		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
 		return
 	}
+	h.m().pdata_cache_requests_total.player_pdata.inc(etag, buf, exists)
 	if !exists {
 		h.m().player_pdata_requests_total.reject_player_not_found.Inc()
 		respFail(w, r, http.StatusNotFound, ErrorCode_PLAYER_NOT_FOUND.MessageObj())
 		return
 	}
+	if buf == nil {
+		h.m().player_pdata_requests_total.success(pdataFilterName).Inc()
+		w.Header().Set("ETag", `W/"`+hex.EncodeToString(etag[:])+`"`)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
 	hash := sha256.Sum256(buf)
 	w.Header().Set("ETag", `W/"`+hex.EncodeToString(hash[:])+`"`)
@@ -164,5 +178,104 @@ func (h *Handler) handlePlayer(w http.ResponseWriter, r *http.Request) {
 
 	h.m().player_pdata_requests_total.success(pdataFilterName).Inc()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	respMaybeCompress(w, r, http.StatusOK, jbuf)
+	h.respMaybeCompress(w, r, http.StatusOK, jbuf)
+}
+
+// handlePlayerPdataHash returns the sha256 of the stored pdata for a player,
+// allowing clients to check whether it changed without downloading it.
+func (h *Handler) handlePlayerPdataHash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodOptions && r.Method != http.MethodGet {
+		h.m().player_pdata_hash_requests_total.http_method_not_allowed.Inc()
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache, no-store")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Pragma", "no-cache")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "OPTIONS, GET")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	uidQ := r.URL.Query().Get("uid")
+	if uidQ == "" {
+		h.m().player_pdata_hash_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("uid param is required"))
+		return
+	}
+
+	uid, err := strconv.ParseUint(uidQ, 10, 64)
+	if err != nil {
+		h.m().player_pdata_hash_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_PLAYER_NOT_FOUND.MessageObj())
+		return
+	}
+
+	playerToken := r.URL.Query().Get("playerToken")
+
+	acct, err := h.AccountStorage.GetAccount(uid)
+	if err != nil {
+		hlog.FromRequest(r).Error().
+			Err(err).
+			Uint64("uid", uid).
+			Msgf("failed to read account from storage")
+		h.m().player_pdata_hash_requests_total.fail_storage_error_account.Inc()
+		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		return
+	}
+	if acct == nil {
+		h.m().player_pdata_hash_requests_total.reject_player_not_found.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_PLAYER_NOT_FOUND.MessageObj())
+		return
+	}
+
+	if !h.InsecureDevNoCheckPlayerAuth {
+		// note: we don't use h.checkAuthToken since we don't save the account
+		if !verifySignedAuthToken(h.TokenSigningKey, uid, playerToken, time.Now()) && (!acct.CheckAuthToken(playerToken) || !time.Now().Before(acct.AuthTokenExpiry)) {
+			h.m().player_pdata_hash_requests_total.reject_masterserver_token.Inc()
+			respFail(w, r, http.StatusUnauthorized, ErrorCode_INVALID_MASTERSERVER_TOKEN.MessageObj())
+			return
+		}
+	}
+
+	hash, exists, err := h.PdataStorage.GetPdataHash(uid)
+	if err != nil {
+		hlog.FromRequest(r).Error().
+			Err(err).
+			Uint64("uid", uid).
+			Msgf("failed to read pdata hash from storage")
+		h.m().player_pdata_hash_requests_total.fail_storage_error_pdata.Inc()
+		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		return
+	}
+
+	var sha string
+	if exists {
+		sha = hex.EncodeToString(hash[:])
+	}
+
+	h.m().player_pdata_hash_requests_total.success.Inc()
+	respJSON(w, r, http.StatusOK, map[string]any{
+		"success": true,
+		"uid":     strconv.FormatUint(uid, 10),
+		"exists":  exists,
+		"sha256":  sha,
+	})
+}
+
+// parsePdataETag parses a single pdata ETag (as set by handlePlayerPdata) from
+// an If-None-Match header.
+func parsePdataETag(v string) ([sha256.Size]byte, bool) {
+	var sha [sha256.Size]byte
+	v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+	if len(v) != 2+sha256.Size*2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return sha, false
+	}
+	if _, err := hex.Decode(sha[:], []byte(v[1:len(v)-1])); err != nil {
+		return sha, false
+	}
+	return sha, true
 }
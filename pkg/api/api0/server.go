@@ -2,6 +2,7 @@ package api0
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,10 +12,14 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/pg9182/ip2x"
 	"github.com/r2northstar/atlas/pkg/api/api0/api0gameserver"
+	"github.com/r2northstar/atlas/pkg/nstypes"
 	"github.com/rs/zerolog/hlog"
+	"golang.org/x/mod/semver"
 )
 
 func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
@@ -54,19 +59,25 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.ReadOnlyServerList {
+		h.m().server_upsert_requests_total.reject_read_only(action).Inc()
+		respFailRetry(w, r, http.StatusServiceUnavailable, ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("server list is read-only"), h.retryAfter())
+		return
+	}
+
 	if !h.CheckLauncherVersion(r, false) {
 		h.m().server_upsert_requests_total.reject_versiongate(action).Inc()
 		respFail(w, r, http.StatusBadRequest, ErrorCode_UNSUPPORTED_VERSION.MessageObj())
 		return
 	}
 
-	raddr, err := netip.ParseAddrPort(r.RemoteAddr)
+	raddr, err := parseRemoteAddr(r)
 	if err != nil {
-		hlog.FromRequest(r).Error().
+		hlog.FromRequest(r).Warn().
 			Err(err).
 			Msgf("failed to parse remote ip %q", r.RemoteAddr)
-		h.m().server_upsert_requests_total.fail_other_error(action).Inc()
-		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		h.m().server_upsert_requests_total.reject_bad_remote_addr(action).Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("unable to determine client address"))
 		return
 	}
 
@@ -78,17 +89,7 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var l ServerListLimit
-	if n := h.MaxServers; n > 0 {
-		l.MaxServers = n
-	} else if n == 0 {
-		l.MaxServers = 1000
-	}
-	if n := h.MaxServersPerIP; n > 0 {
-		l.MaxServersPerIP = n
-	} else if n == 0 {
-		l.MaxServersPerIP = 50
-	}
+	l, trusted := h.serverListLimit(raddr.Addr())
 
 	var s *Server
 	if canCreate {
@@ -159,11 +160,21 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 		} else {
 			s.Password = v
 		}
+
+		if v := q.Get("connectMetadata"); len(v) > maxConnectMetadataSize {
+			if isCreate {
+				h.m().server_upsert_requests_total.reject_bad_request(action).Inc()
+				respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("connectMetadata must be at most %d bytes", maxConnectMetadataSize))
+				return
+			}
+		} else {
+			s.ConnectMetadata = sanitizeConnectMetadata(v)
+		}
 	}
 
 	if canCreate || canUpdate {
 		if h.LookupIP != nil && h.GetRegion != nil {
-			if rec, err := h.LookupIP(raddr.Addr()); err == nil {
+			if rec, err := h.lookupIPTimeout(raddr.Addr()); err == nil {
 				var lat, lon float64
 				if v, _ := rec.GetFloat32(ip2x.Latitude); v != 0 {
 					lat = float64(v)
@@ -181,6 +192,18 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 				}
 
 				region, err := h.GetRegion(raddr.Addr(), rec)
+				if err != nil {
+					h.m().server_upsert_getregion_errors_total.Inc()
+					if region == "" {
+						hlog.FromRequest(r).Err(err).Str("ip", raddr.Addr().String()).Msg("failed to compute region, no best-effort region available")
+					} else {
+						hlog.FromRequest(r).Err(err).Str("ip", raddr.Addr().String()).Msgf("failed to compute region, using best-effort region %q", region)
+					}
+				}
+				if region == "" && h.RegionFallback != "" {
+					h.m().server_upsert_region_fallback_total.Inc()
+					region = h.RegionFallback
+				}
 				if err == nil || region != "" { // if an error occurs, we may still have a best-effort region
 					if canCreate {
 						s.Region = region
@@ -189,34 +212,62 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 						u.Region = &region
 					}
 				}
-				if err != nil {
-					h.m().server_upsert_getregion_errors_total.Inc()
-					if region == "" {
-						hlog.FromRequest(r).Err(err).Str("ip", raddr.Addr().String()).Msg("failed to compute region, no best-effort region available")
-					} else {
-						hlog.FromRequest(r).Err(err).Str("ip", raddr.Addr().String()).Msgf("failed to compute region, using best-effort region %q", region)
+			} else if errors.Is(err, errLookupIPTimeout) {
+				h.m().server_upsert_ip2location_timeouts_total.Inc()
+				hlog.FromRequest(r).Warn().Str("ip", raddr.Addr().String()).Msg("ip2location lookup timed out")
+
+				if region := h.RegionFallback; region != "" {
+					h.m().server_upsert_region_fallback_total.Inc()
+					if canCreate {
+						s.Region = region
+					}
+					if canUpdate {
+						u.Region = &region
 					}
 				}
 			} else {
 				h.m().server_upsert_ip2location_errors_total.Inc()
 				hlog.FromRequest(r).Err(err).Str("ip", raddr.Addr().String()).Msg("failed to lookup remote ip in ip2location database")
+
+				if region := h.RegionFallback; region != "" {
+					h.m().server_upsert_region_fallback_total.Inc()
+					if canCreate {
+						s.Region = region
+					}
+					if canUpdate {
+						u.Region = &region
+					}
+				}
 			}
 		}
 	}
 
 	if canCreate || canUpdate {
-		if v := q.Get("name"); v == "" {
+		if v := h.sanitizeServerText(q.Get("name"), false); v == "" {
 			if isCreate {
 				h.m().server_upsert_requests_total.reject_bad_request(action).Inc()
 				respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("name param must not be empty"))
 				return
 			}
 		} else {
+			if h.BlockServerName != nil && h.BlockServerName(v) {
+				h.m().server_upsert_requests_total.reject_blocked_name(action).Inc()
+				respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("server name is not allowed"))
+				return
+			}
 			if h.CleanBadWords != nil {
 				v = h.CleanBadWords(v)
 			}
+			if n := h.MaxServerNameLength; n > 0 && len(v) > n {
+				if h.RejectLongServerNameDescription {
+					h.m().server_upsert_requests_total.reject_bad_request(action).Inc()
+					respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("name must be at most %d bytes", n))
+					return
+				}
+				v = truncateUTF8(v, n)
+			}
 			if n := 256; len(v) > n { // NorthstarLauncher@v1.9.7 limits it to 63
-				v = v[:n]
+				v = truncateUTF8(v, n)
 			}
 			if canCreate {
 				s.Name = v
@@ -226,12 +277,20 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		if v := q.Get("description"); v != "" {
+		if v := h.sanitizeServerText(q.Get("description"), true); v != "" {
 			if h.CleanBadWords != nil {
 				v = h.CleanBadWords(v)
 			}
+			if n := h.MaxServerDescriptionLength; n > 0 && len(v) > n {
+				if h.RejectLongServerNameDescription {
+					h.m().server_upsert_requests_total.reject_bad_request(action).Inc()
+					respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("description must be at most %d bytes", n))
+					return
+				}
+				v = truncateUTF8(v, n)
+			}
 			if n := 1024; len(v) > n { // NorthstarLauncher@v1.9.7 doesn't have a limit
-				v = v[:n]
+				v = truncateUTF8(v, n)
 			}
 			if canCreate {
 				s.Description = v
@@ -242,8 +301,15 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if v := q.Get("map"); v != "" {
+			if m, ok := normalizeMap(v); ok {
+				v = m
+			} else if h.RejectUnknownMapsPlaylists {
+				h.m().server_upsert_requests_total.reject_unknown_map_playlist(action).Inc()
+				respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("unknown map %.64q", v))
+				return
+			}
 			if n := 64; len(v) > n { // NorthstarLauncher@v1.9.7 limits it to 31
-				v = v[:n]
+				v = truncateUTF8(v, n)
 			}
 			if canCreate {
 				s.Map = v
@@ -254,8 +320,15 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if v := q.Get("playlist"); v != "" {
+			if pl, ok := normalizePlaylist(v); ok {
+				v = pl
+			} else if h.RejectUnknownMapsPlaylists {
+				h.m().server_upsert_requests_total.reject_unknown_map_playlist(action).Inc()
+				respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("unknown playlist %.64q", v))
+				return
+			}
 			if n := 64; len(v) > n { // NorthstarLauncher@v1.9.7 limits it to 15
-				v = v[:n]
+				v = truncateUTF8(v, n)
 			}
 			if canCreate {
 				s.Playlist = v
@@ -288,9 +361,14 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 
 	if canCreate {
 		var modInfoErr error
+		var modInfoOK bool
 		if err := r.ParseMultipartForm(1 << 18 /*.25 MB*/); err == nil {
 			if mf, mfHdr, err := r.FormFile("modinfo"); err == nil {
-				if mfHdr.Size < 1<<18 {
+				maxSize := int64(1 << 18)
+				if n := h.MaxModInfoSize; n > 0 && int64(n) < maxSize {
+					maxSize = int64(n)
+				}
+				if mfHdr.Size < maxSize {
 					var obj struct {
 						Mods []struct {
 							Name             string `json:"Name"`
@@ -304,6 +382,10 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 								if m.Version == "" {
 									m.Version = "0.0.0"
 								}
+								if m.RequiredOnClient && h.AllowRequiredMod != nil && !h.AllowRequiredMod(m.Name) {
+									m.RequiredOnClient = false
+									h.m().server_upsert_modinfo_required_filtered_total.Inc()
+								}
 								s.ModInfo = append(s.ModInfo, ServerModInfo{
 									Name:             m.Name,
 									Version:          m.Version,
@@ -311,10 +393,17 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 								})
 							}
 						}
+						modInfoOK = true
 					} else {
 						modInfoErr = fmt.Errorf("parse modinfo file: %w", err)
 					}
 				} else {
+					if h.RejectModInfoLimit {
+						mf.Close()
+						h.m().server_upsert_requests_total.reject_bad_request(action).Inc()
+						respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("modinfo must be smaller than %d bytes", maxSize))
+						return
+					}
 					modInfoErr = fmt.Errorf("get modinfo file: too large (size %d)", mfHdr.Size)
 				}
 				mf.Close()
@@ -332,6 +421,24 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 				Err(err).
 				Msgf("failed to parse modinfo")
 		}
+		if n := h.MaxMods; n > 0 && len(s.ModInfo) > n {
+			if h.RejectModInfoLimit {
+				h.m().server_upsert_requests_total.reject_bad_request(action).Inc()
+				respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("server must have at most %d mods", n))
+				return
+			}
+			h.m().server_upsert_modinfo_truncated_total.Inc()
+			s.ModInfo = s.ModInfo[:n:n]
+		}
+		if (isCreate || modInfoOK) && !h.hasRequiredMod(s.ModInfo) {
+			h.m().server_upsert_requests_total.reject_required_mod(action).Inc()
+			if h.RequireModMinVersion != "" {
+				respFail(w, r, http.StatusForbidden, ErrorCode_CONNECTION_REJECTED.MessageObjf("server must be running %s %s or newer to be listed", h.RequireMod, h.RequireModMinVersion))
+			} else {
+				respFail(w, r, http.StatusForbidden, ErrorCode_CONNECTION_REJECTED.MessageObjf("server must be running %s to be listed", h.RequireMod))
+			}
+			return
+		}
 	}
 
 	nsrv, err := h.ServerList.ServerHybridUpdatePut(u, s, l)
@@ -351,9 +458,21 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 			respFail(w, r, http.StatusForbidden, ErrorCode_DUPLICATE_SERVER.MessageObjf("%v", err))
 			return
 		}
+		if qe := (ServerListQuarantinedError{}); errors.As(err, &qe) {
+			h.m().server_upsert_requests_total.reject_quarantined(action).Inc()
+			hlog.FromRequest(r).Warn().
+				Err(err).
+				Msgf("refusing registration from quarantined ip")
+			respFailRetry(w, r, http.StatusTooManyRequests, ErrorCode_CONNECTION_REJECTED.MessageObjf("%v", err), qe.Remaining)
+			return
+		}
 		if errors.Is(err, ErrServerListLimitExceeded) {
-			h.m().server_upsert_requests_total.reject_limits_exceeded(action).Inc()
-			respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("%v", err))
+			if trusted {
+				h.m().server_upsert_requests_total.reject_limits_exceeded_trusted(action).Inc()
+			} else {
+				h.m().server_upsert_requests_total.reject_limits_exceeded(action).Inc()
+			}
+			respFailRetry(w, r, http.StatusTooManyRequests, ErrorCode_CONNECTION_REJECTED.MessageObjf("%v", err), h.retryAfter())
 			return
 		}
 		hlog.FromRequest(r).Error().
@@ -364,14 +483,65 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !nsrv.VerificationDeadline.IsZero() {
+	if n, ok := h.PlaylistPlayerCaps[nsrv.Playlist]; ok && (nsrv.PlayerCount > n || nsrv.MaxPlayers > n) {
+		h.m().server_upsert_playlist_cap_exceeded_total(nsrv.Playlist).Inc()
+		hlog.FromRequest(r).Debug().
+			Str("server_id", nsrv.ID).
+			Str("playlist", nsrv.Playlist).
+			Int("player_count", nsrv.PlayerCount).
+			Int("max_players", nsrv.MaxPlayers).
+			Int("playlist_cap", n).
+			Msgf("server player count exceeds playlist cap")
+	}
+
+	// if an existing server needs verification, it's a revived ghost (which
+	// must not be short-circuited by the recent verification cache, since
+	// re-verification was explicitly enabled by ReverifyRevived)
+	reverify := u != nil && nsrv.ID == u.ID
+
+	if !nsrv.VerificationDeadline.IsZero() && h.skipVerify(raddr.Addr()) {
+		if !h.ServerList.VerifyServer(nsrv.ID) {
+			// it was removed or replaced while we were handling the request
+			h.m().server_upsert_requests_total.reject_server_gone(action).Inc()
+			respFail(w, r, http.StatusNotFound, ErrorCode_GAMESERVER_NOT_FOUND.MessageObjf("server is gone"))
+			return
+		}
+
+		h.m().server_upsert_requests_total.success_verified_skipped(action).Inc()
+		h.auditServer(r, action, raddr, nsrv, true)
+	} else if !nsrv.VerificationDeadline.IsZero() && !reverify && h.recentlyVerified(nsrv, time.Now()) {
+		if !h.ServerList.VerifyServer(nsrv.ID) {
+			// it was removed or replaced while we were handling the request
+			h.m().server_upsert_requests_total.reject_server_gone(action).Inc()
+			respFail(w, r, http.StatusNotFound, ErrorCode_GAMESERVER_NOT_FOUND.MessageObjf("server is gone"))
+			return
+		}
+
+		h.m().server_upsert_requests_total.success_verified_recent(action).Inc()
+		h.auditServer(r, action, raddr, nsrv, true)
+	} else if !nsrv.VerificationDeadline.IsZero() {
 		verifyStart := time.Now()
 
 		ctx, cancel := context.WithDeadline(r.Context(), nsrv.VerificationDeadline)
 		defer cancel()
 
+		if sem := h.verifySem(); sem != nil {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				h.m().server_upsert_requests_total.reject_verify_queue_timeout(action).Inc()
+				if reverify {
+					h.m().server_upsert_reverify_total.failure.Inc()
+				}
+				h.ServerList.SetVerifyFailure(nsrv.ID, "timed out waiting for a verification slot")
+				respFailRetry(w, r, http.StatusServiceUnavailable, ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("too many concurrent server verifications"), h.retryAfter())
+				return
+			}
+		}
+
 		if nsrv.AuthPort != 0 {
-			if err := api0gameserver.Verify(ctx, s.AuthAddr()); err != nil {
+			if err := api0gameserver.Verify(ctx, nsrv.AuthAddr()); err != nil {
 				var code ErrorCode
 				switch {
 				case errors.Is(err, context.DeadlineExceeded):
@@ -386,12 +556,16 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 					h.m().server_upsert_requests_total.reject_verify_autherr(action).Inc()
 				}
 				h.m().server_upsert_verify_time_seconds.failure.UpdateDuration(verifyStart)
+				if reverify {
+					h.m().server_upsert_reverify_total.failure.Inc()
+				}
+				h.ServerList.SetVerifyFailure(nsrv.ID, fmt.Sprintf("failed to connect to auth port (addr %s): %v", nsrv.AuthAddr(), err))
 				respFail(w, r, http.StatusBadGateway, code.MessageObjf("failed to connect to auth port (addr %s): %v", nsrv.AuthAddr(), err))
 				return
 			}
 		}
 
-		if err := h.probeUDP(ctx, s.Addr); err != nil {
+		if err := h.probeUDP(ctx, nsrv.Addr); err != nil {
 			var obj ErrorObj
 			switch {
 			case errors.Is(err, context.DeadlineExceeded):
@@ -402,6 +576,10 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 				obj = ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("failed to connect to game port (addr %s): %v", nsrv.Addr, err)
 			}
 			h.m().server_upsert_verify_time_seconds.failure.UpdateDuration(verifyStart)
+			if reverify {
+				h.m().server_upsert_reverify_total.failure.Inc()
+			}
+			h.ServerList.SetVerifyFailure(nsrv.ID, obj.Message)
 			respFail(w, r, http.StatusBadGateway, obj)
 			return
 		}
@@ -414,9 +592,16 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		h.verifiedServerCache().Set(verifiedKeyOf(nsrv), struct{}{}, time.Now())
+
 		h.m().server_upsert_requests_total.success_verified(action).Inc()
+		if reverify {
+			h.m().server_upsert_reverify_total.success.Inc()
+		}
+		h.auditServer(r, action, raddr, nsrv, true)
 	} else {
 		h.m().server_upsert_requests_total.success_updated(action).Inc()
+		h.auditServer(r, action, raddr, nsrv, false)
 	}
 	respJSON(w, r, http.StatusOK, map[string]any{
 		"success":         true,
@@ -425,6 +610,149 @@ func (h *Handler) handleServerUpsert(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// verifySem returns a semaphore limiting the number of concurrent game server
+// verifications, or nil if there is no limit.
+func (h *Handler) verifySem() chan struct{} {
+	h.verifySemInit.Do(func() {
+		if n := h.MaxConcurrentVerifications; n > 0 {
+			h.verifySemChan = make(chan struct{}, n)
+		}
+	})
+	return h.verifySemChan
+}
+
+// TrustedServerLimit overrides MaxServersPerIP for servers registering from
+// Prefix.
+type TrustedServerLimit struct {
+	Prefix netip.Prefix
+
+	// MaxServersPerIP is the limit to use instead. If -1, no limit is applied.
+	MaxServersPerIP int
+}
+
+// ServerLimits contains the reloadable server registration limits (see the
+// Handler fields with the same names).
+type ServerLimits struct {
+	MaxServers          int
+	MaxServersPerIP     int
+	TrustedServerLimits []TrustedServerLimit
+}
+
+// SetServerLimits atomically replaces the server registration limits
+// configured by the Handler fields for subsequent requests. It is safe to call
+// while the Handler is serving requests.
+func (h *Handler) SetServerLimits(l ServerLimits) {
+	h.limitsOverride.Store(&l)
+}
+
+// ServerLimits gets the current server registration limits.
+func (h *Handler) ServerLimits() ServerLimits {
+	if l := h.limitsOverride.Load(); l != nil {
+		return *l
+	}
+	return ServerLimits{
+		MaxServers:          h.MaxServers,
+		MaxServersPerIP:     h.MaxServersPerIP,
+		TrustedServerLimits: h.TrustedServerLimits,
+	}
+}
+
+// serverListLimit gets the server list limits to apply to a server registered
+// from ip, and whether ip matched a trusted server limit.
+func (h *Handler) serverListLimit(ip netip.Addr) (l ServerListLimit, trusted bool) {
+	limits := h.ServerLimits()
+	if n := limits.MaxServers; n > 0 {
+		l.MaxServers = n
+	} else if n == 0 {
+		l.MaxServers = 1000
+	}
+	if n, ok := limits.trustedServerLimit(ip); ok {
+		if n > 0 {
+			l.MaxServersPerIP = n
+		}
+		trusted = true
+	} else if n := limits.MaxServersPerIP; n > 0 {
+		l.MaxServersPerIP = n
+	} else if n == 0 {
+		l.MaxServersPerIP = 50
+	}
+	return
+}
+
+// trustedServerLimit gets the highest per-IP server limit override matching
+// ip, if any.
+func (l ServerLimits) trustedServerLimit(ip netip.Addr) (n int, ok bool) {
+	ip = ip.Unmap()
+	for _, x := range l.TrustedServerLimits {
+		if x.Prefix.Contains(ip) {
+			if x.MaxServersPerIP < 0 {
+				return -1, true
+			}
+			if !ok || x.MaxServersPerIP > n {
+				n, ok = x.MaxServersPerIP, true
+			}
+		}
+	}
+	return
+}
+
+// verifiedKey identifies a verified game server.
+type verifiedKey struct {
+	Addr     netip.AddrPort
+	AuthPort uint16
+}
+
+// verifiedKeyOf gets the verifiedKey for s.
+func verifiedKeyOf(s *Server) verifiedKey {
+	return verifiedKey{s.Addr, s.AuthPort}
+}
+
+// verifiedServerCache gets the cache of recently verified game servers.
+func (h *Handler) verifiedServerCache() *ttlCache[verifiedKey, struct{}] {
+	h.verifiedCacheInit.Do(func() {
+		h.verifiedCache.TTL = h.VerifyDedupTTL
+	})
+	return &h.verifiedCache
+}
+
+// recentlyVerified checks whether a game server with the same address and
+// auth port as s was successfully verified within VerifyDedupTTL of t.
+func (h *Handler) recentlyVerified(s *Server, t time.Time) bool {
+	_, ok := h.verifiedServerCache().Get(verifiedKeyOf(s), t)
+	return ok
+}
+
+// skipVerify checks whether servers registered from ip should be verified
+// without checking the auth and game ports.
+func (h *Handler) skipVerify(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, pfx := range h.VerifySkip {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// auditServer writes an entry to the server audit log, if enabled.
+func (h *Handler) auditServer(r *http.Request, action string, raddr netip.AddrPort, srv *Server, verified bool) {
+	if h.ServerAuditLog == nil {
+		return
+	}
+	e := h.ServerAuditLog.Log().
+		Str("action", action).
+		Str("ip", raddr.Addr().String()).
+		Str("id", srv.ID).
+		Str("addr", srv.Addr.String()).
+		Str("region", srv.Region).
+		Str("name", srv.Name).
+		Bool("verified", verified)
+	if rid, ok := hlog.IDFromRequest(r); ok {
+		e = e.Str("rid", rid.String())
+	}
+	e.Send()
+}
+
 func (h *Handler) probeUDP(ctx context.Context, addr netip.AddrPort) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -479,13 +807,19 @@ func (h *Handler) handleServerRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	raddr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if h.ReadOnlyServerList {
+		h.m().server_remove_requests_total.reject_read_only.Inc()
+		respFailRetry(w, r, http.StatusServiceUnavailable, ErrorCode_INTERNAL_SERVER_ERROR.MessageObjf("server list is read-only"), h.retryAfter())
+		return
+	}
+
+	raddr, err := parseRemoteAddr(r)
 	if err != nil {
-		hlog.FromRequest(r).Error().
+		hlog.FromRequest(r).Warn().
 			Err(err).
 			Msgf("failed to parse remote ip %q", r.RemoteAddr)
-		h.m().server_remove_requests_total.fail_other_error.Inc()
-		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		h.m().server_remove_requests_total.reject_bad_remote_addr.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("unable to determine client address"))
 		return
 	}
 
@@ -512,8 +846,203 @@ func (h *Handler) handleServerRemove(w http.ResponseWriter, r *http.Request) {
 	h.ServerList.DeleteServerByID(id)
 
 	h.m().server_remove_requests_total.success.Inc()
+	h.auditServer(r, "remove_server", raddr, srv, false)
+	respJSON(w, r, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
+
+func (h *Handler) handleServerHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodOptions && r.Method != http.MethodHead && r.Method != http.MethodGet {
+		h.m().server_history_requests_total.http_method_not_allowed.Inc()
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache, no-store")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Pragma", "no-cache")
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, HEAD")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "OPTIONS, HEAD, GET")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		h.m().server_history_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("id param is required"))
+		return
+	}
+
+	samples, ok := h.ServerList.GetPlayerCountHistory(id)
+	if !ok {
+		h.m().server_history_requests_total.reject_server_not_found.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_GAMESERVER_NOT_FOUND.MessageObjf("no such game server, or player count history is disabled"))
+		return
+	}
+
+	type sample struct {
+		Time        int64 `json:"time"`
+		PlayerCount int   `json:"playerCount"`
+	}
+	history := make([]sample, len(samples))
+	for i, x := range samples {
+		history[i] = sample{x.Time.Unix(), x.PlayerCount}
+	}
+
+	h.m().server_history_requests_total.success.Inc()
 	respJSON(w, r, http.StatusOK, map[string]any{
 		"success": true,
+		"history": history,
+	})
+}
+
+func (h *Handler) handleServerStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodOptions && r.Method != http.MethodHead && r.Method != http.MethodGet {
+		h.m().server_status_requests_total.http_method_not_allowed.Inc()
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache, no-store")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Pragma", "no-cache")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "OPTIONS, HEAD, GET")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	q := r.URL.Query()
+
+	id := q.Get("id")
+	if id == "" {
+		h.m().server_status_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("id param is required"))
+		return
+	}
+
+	token := q.Get("token")
+	if token == "" {
+		h.m().server_status_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("token param is required"))
+		return
+	}
+
+	// note: we don't distinguish between a missing server and an incorrect
+	// token so we don't leak whether a server exists
+	st, ok := h.ServerList.GetServerStatus(id, token)
+	if !ok {
+		h.m().server_status_requests_total.reject_server_not_found.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_GAMESERVER_NOT_FOUND.MessageObjf("no such game server, or incorrect token"))
+		return
+	}
+
+	var verificationDeadline, lastHeartbeat *int64
+	if !st.VerificationDeadline.IsZero() {
+		v := st.VerificationDeadline.Unix()
+		verificationDeadline = &v
+	}
+	if !st.LastHeartbeat.IsZero() {
+		v := st.LastHeartbeat.Unix()
+		lastHeartbeat = &v
+	}
+
+	h.m().server_status_requests_total.success.Inc()
+	respJSON(w, r, http.StatusOK, map[string]any{
+		"success":              true,
+		"state":                st.State,
+		"verificationDeadline": verificationDeadline,
+		"lastHeartbeat":        lastHeartbeat,
+	})
+}
+
+// handleServerSelf gets the server's own state as computed by Atlas, including
+// the limits in effect for its IP. It requires the server's auth token.
+func (h *Handler) handleServerSelf(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodOptions && r.Method != http.MethodHead && r.Method != http.MethodGet {
+		h.m().server_self_requests_total.http_method_not_allowed.Inc()
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache, no-store")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Pragma", "no-cache")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "OPTIONS, HEAD, GET")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	q := r.URL.Query()
+
+	id := q.Get("id")
+	if id == "" {
+		h.m().server_self_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("id param is required"))
+		return
+	}
+
+	token := q.Get("token")
+	if token == "" {
+		h.m().server_self_requests_total.reject_bad_request.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("token param is required"))
+		return
+	}
+
+	// note: we don't distinguish between a missing server and an incorrect
+	// token so we don't leak whether a server exists
+	srv, st, ok := h.ServerList.GetServerDebug(id)
+	if !ok || srv.ServerAuthToken == "" || subtle.ConstantTimeCompare([]byte(srv.ServerAuthToken), []byte(token)) != 1 {
+		h.m().server_self_requests_total.reject_server_not_found.Inc()
+		respFail(w, r, http.StatusNotFound, ErrorCode_GAMESERVER_NOT_FOUND.MessageObjf("no such game server, or incorrect token"))
+		return
+	}
+
+	var verificationDeadline, lastHeartbeat, lastVerifyTime *int64
+	if !st.VerificationDeadline.IsZero() {
+		v := st.VerificationDeadline.Unix()
+		verificationDeadline = &v
+	}
+	if !st.LastHeartbeat.IsZero() {
+		v := st.LastHeartbeat.Unix()
+		lastHeartbeat = &v
+	}
+	if !srv.LastVerifyTime.IsZero() {
+		v := srv.LastVerifyTime.Unix()
+		lastVerifyTime = &v
+	}
+
+	l, trusted := h.serverListLimit(srv.Addr.Addr())
+
+	h.m().server_self_requests_total.success.Inc()
+	respJSON(w, r, http.StatusOK, map[string]any{
+		"success":              true,
+		"id":                   srv.ID,
+		"ip":                   srv.Addr.Addr().String(),
+		"port":                 srv.Addr.Port(),
+		"authPort":             srv.AuthAddr().Port(),
+		"region":               srv.Region,
+		"state":                st.State,
+		"verified":             st.VerificationDeadline.IsZero(),
+		"verificationDeadline": verificationDeadline,
+		"lastVerifyTime":       lastVerifyTime,
+		"lastVerifyResult":     srv.LastVerifyResult,
+		"lastHeartbeat":        lastHeartbeat,
+		"limits": map[string]any{
+			"maxServers":      l.MaxServers,
+			"maxServersPerIP": l.MaxServersPerIP,
+			"trusted":         trusted,
+		},
 	})
 }
 
@@ -534,13 +1063,13 @@ func (h *Handler) handleServerConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	raddr, err := netip.ParseAddrPort(r.RemoteAddr)
+	raddr, err := parseRemoteAddr(r)
 	if err != nil {
-		hlog.FromRequest(r).Error().
+		hlog.FromRequest(r).Warn().
 			Err(err).
 			Msgf("failed to parse remote ip %q", r.RemoteAddr)
-		h.m().server_connect_requests_total.fail_other_error.Inc()
-		respFail(w, r, http.StatusInternalServerError, ErrorCode_INTERNAL_SERVER_ERROR.MessageObj())
+		h.m().server_connect_requests_total.reject_bad_remote_addr.Inc()
+		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("unable to determine client address"))
 		return
 	}
 
@@ -570,7 +1099,7 @@ func (h *Handler) handleServerConnect(w http.ResponseWriter, r *http.Request) {
 		h.m().server_connect_requests_total.reject_invalid_connection_token.Inc()
 		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("connection token is required"))
 		return
-	} else if v, ok := h.connect.Load(connectStateKey{
+	} else if v, ok := h.connectLoad(connectStateKey{
 		ServerID: srv.ID,
 		Token:    v,
 	}); !ok {
@@ -578,13 +1107,13 @@ func (h *Handler) handleServerConnect(w http.ResponseWriter, r *http.Request) {
 		respFail(w, r, http.StatusBadRequest, ErrorCode_BAD_REQUEST.MessageObjf("no such connection token (has it already been used?)"))
 		return
 	} else {
-		state = v.(*connectState)
+		state = v
 	}
 
 	if r.Method == http.MethodGet {
 		state.gotPdata.Store(true)
 		h.m().server_connect_requests_total.success_pdata.Inc()
-		respMaybeCompress(w, r, http.StatusOK, state.pdata)
+		h.respMaybeCompress(w, r, http.StatusOK, state.pdata)
 		return
 	}
 
@@ -597,7 +1126,7 @@ func (h *Handler) handleServerConnect(w http.ResponseWriter, r *http.Request) {
 		reject = v[0]
 	}
 	if n := 256; len(reject) > n {
-		reject = reject[:n]
+		reject = truncateUTF8(reject, n)
 	}
 
 	if reject == "" && !state.gotPdata.Load() {
@@ -620,3 +1149,134 @@ func (h *Handler) handleServerConnect(w http.ResponseWriter, r *http.Request) {
 		"success": true,
 	})
 }
+
+var errLookupIPTimeout = errors.New("ip2location lookup timed out")
+
+// lookupIPTimeout calls LookupIP, returning errLookupIPTimeout if it takes
+// longer than LookupIPTimeout. The lookup continues in the background.
+func (h *Handler) lookupIPTimeout(a netip.Addr) (ip2x.Record, error) {
+	if h.LookupIPTimeout <= 0 {
+		return h.LookupIP(a)
+	}
+	type result struct {
+		rec ip2x.Record
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		rec, err := h.LookupIP(a)
+		ch <- result{rec, err}
+	}()
+	tm := time.NewTimer(h.LookupIPTimeout)
+	defer tm.Stop()
+	select {
+	case res := <-ch:
+		return res.rec, res.err
+	case <-tm.C:
+		return ip2x.Record{}, errLookupIPTimeout
+	}
+}
+
+// sanitizeServerText removes control and format characters from s if
+// SanitizeServerText is enabled. If multiline is true, newlines are kept.
+func (h *Handler) sanitizeServerText(s string, multiline bool) string {
+	if !h.SanitizeServerText {
+		return s
+	}
+	x := strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' && multiline:
+			return r
+		case r == utf8.RuneError:
+			return -1 // invalid utf-8
+		case r == '\t' || r == '\n' || r == '\r':
+			return ' '
+		case unicode.Is(unicode.Cc, r), unicode.Is(unicode.Cf, r), unicode.Is(unicode.Co, r):
+			return -1
+		}
+		return r
+	}, s)
+	if x != s {
+		h.m().server_upsert_sanitized_total.Inc()
+	}
+	return strings.TrimSpace(x)
+}
+
+// truncateUTF8 truncates s to at most n bytes without splitting a UTF-8
+// sequence.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// maxConnectMetadataSize is the maximum size of the connect metadata a server
+// can register.
+const maxConnectMetadataSize = 512
+
+// sanitizeConnectMetadata removes invalid UTF-8 and control characters from
+// server connect metadata. Unlike sanitizeServerText, this is always done
+// since the metadata is passed through to clients as-is.
+func sanitizeConnectMetadata(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError:
+			return -1
+		case unicode.Is(unicode.Cc, r), unicode.Is(unicode.Cf, r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// normalizeMap returns the canonical name of m if it is a known map.
+func normalizeMap(m string) (string, bool) {
+	if nstypes.Map(m).Known() {
+		return m, true
+	}
+	if x := strings.ToLower(strings.TrimSpace(m)); nstypes.Map(x).Known() {
+		return x, true
+	}
+	return m, false
+}
+
+// normalizePlaylist returns the canonical name of pl if it is a known
+// playlist.
+func normalizePlaylist(pl string) (string, bool) {
+	if nstypes.Playlist(pl).Known() {
+		return pl, true
+	}
+	if x := strings.ToLower(strings.TrimSpace(pl)); nstypes.Playlist(x).Known() {
+		return x, true
+	}
+	return pl, false
+}
+
+// hasRequiredMod checks whether mods satisfies RequireMod and
+// RequireModMinVersion.
+func (h *Handler) hasRequiredMod(mods []ServerModInfo) bool {
+	if h.RequireMod == "" {
+		return true
+	}
+	for _, m := range mods {
+		if !strings.EqualFold(m.Name, h.RequireMod) {
+			continue
+		}
+		if h.RequireModMinVersion == "" {
+			return true
+		}
+		mver, rver := "v"+strings.TrimPrefix(h.RequireModMinVersion, "v"), "v"+strings.TrimPrefix(m.Version, "v")
+		if semver.IsValid(mver) {
+			if semver.IsValid(rver) && semver.Compare(rver, mver) >= 0 {
+				return true
+			}
+		} else if m.Version == h.RequireModMinVersion {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package api0
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/r2northstar/atlas/pkg/nspkt"
+)
+
+func TestTruncateUTF8(t *testing.T) {
+	for _, c := range []struct {
+		Name   string
+		String string
+		N      int
+		Result string
+	}{
+		{"Short", "test", 8, "test"},
+		{"Exact", "test", 4, "test"},
+		{"ASCII", "testing", 4, "test"},
+		{"Boundary", "aé", 3, "aé"},
+		{"Split2", "aé", 2, "a"},
+		{"Split3", "a€b", 3, "a"},
+		{"Split4", "a😀b", 4, "a"},
+		{"SplitStart", "😀", 3, ""},
+		{"Zero", "test", 0, ""},
+		{"Invalid", "a\xffb", 2, "a\xff"},
+		{"Long", strings.Repeat("é", 40), 63, strings.Repeat("é", 31)},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			v := truncateUTF8(c.String, c.N)
+			if v != c.Result {
+				t.Errorf("expected %q, got %q", c.Result, v)
+			}
+			if len(v) > c.N {
+				t.Errorf("expected at most %d bytes, got %d", c.N, len(v))
+			}
+			if utf8.ValidString(c.String) && !utf8.ValidString(v) {
+				t.Errorf("result %q is not valid utf-8", v)
+			}
+		})
+	}
+}
+
+func TestServerUpsertVerifyDedup(t *testing.T) {
+	h, gs := testServerUpsertHandler(t, NewServerList(time.Second*30, time.Minute, time.Second*5, ServerListConfig{}))
+	h.VerifyDedupTTL = time.Minute
+
+	for i, exp := range []struct {
+		Connects int32
+		Verified uint64
+		Recent   uint64
+	}{
+		{1, 1, 0}, // new server
+		{1, 1, 1}, // re-registered with the same address and auth port
+		{1, 1, 2},
+	} {
+		if status, _, msg := testServerUpsert(h, "add_server", url.Values{"port": {gs.Port}, "authPort": {"udp"}, "name": {"test"}}); status != http.StatusOK {
+			t.Fatalf("register %d: unexpected status %d (%s)", i, status, msg)
+		}
+		if act := gs.Connects.Load(); act != exp.Connects {
+			t.Errorf("register %d: expected %d connect packets, got %d", i, exp.Connects, act)
+		}
+		if act := h.m().server_upsert_requests_total.success_verified("add_server").Get(); act != exp.Verified {
+			t.Errorf("register %d: expected %d verified, got %d", i, exp.Verified, act)
+		}
+		if act := h.m().server_upsert_requests_total.success_verified_recent("add_server").Get(); act != exp.Recent {
+			t.Errorf("register %d: expected %d recently verified, got %d", i, exp.Recent, act)
+		}
+	}
+
+}
+
+func TestServerUpsertReverifyRevived(t *testing.T) {
+	var offset atomic.Int64
+	sl := NewServerList(time.Second*30, time.Minute, time.Second*5, ServerListConfig{
+		ReverifyRevived: true,
+	})
+	sl.__clock = func() time.Time {
+		return time.Now().Add(time.Duration(offset.Load()))
+	}
+
+	h, gs := testServerUpsertHandler(t, sl)
+	h.VerifyDedupTTL = time.Hour
+
+	status, id, msg := testServerUpsert(h, "add_server", url.Values{"port": {gs.Port}, "authPort": {"udp"}, "name": {"test"}})
+	if status != http.StatusOK {
+		t.Fatalf("register: unexpected status %d (%s)", status, msg)
+	}
+	if act := gs.Connects.Load(); act != 1 {
+		t.Fatalf("register: expected 1 connect packet, got %d", act)
+	}
+
+	// heartbeat while alive doesn't need verification
+	if status, _, msg := testServerUpsert(h, "heartbeat", url.Values{"id": {id}}); status != http.StatusOK {
+		t.Fatalf("heartbeat: unexpected status %d (%s)", status, msg)
+	}
+	if act := gs.Connects.Load(); act != 1 {
+		t.Errorf("heartbeat: expected no additional connect packets, got %d", act-1)
+	}
+
+	// revive the ghost, which must be verified again despite being in the
+	// recently verified cache
+	offset.Add(int64(time.Second * 45))
+	if status, _, msg := testServerUpsert(h, "heartbeat", url.Values{"id": {id}}); status != http.StatusOK {
+		t.Fatalf("revive: unexpected status %d (%s)", status, msg)
+	}
+	if act := gs.Connects.Load(); act != 2 {
+		t.Errorf("revive: expected server to be verified again, got %d connect packets", act)
+	}
+	if act := h.m().server_upsert_requests_total.success_verified_recent("heartbeat").Get(); act != 0 {
+		t.Errorf("revive: expected recent verification not to be used")
+	}
+	if act := h.m().server_upsert_reverify_total.success.Get(); act != 1 {
+		t.Errorf("revive: expected 1 successful re-verification, got %d", act)
+	}
+}
+
+type testGameServer struct {
+	Port     string
+	Connects atomic.Int32
+}
+
+// testServerUpsertHandler creates a Handler for testing handleServerUpsert
+// with sl, and a simulated game server on localhost.
+func testServerUpsertHandler(t *testing.T, sl *ServerList) (*Handler, *testGameServer) {
+	listen := func() (*nspkt.Listener, netip.AddrPort) {
+		c, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		l := nspkt.NewListener()
+		go l.Serve(c)
+		t.Cleanup(l.Close)
+		return l, c.LocalAddr().(*net.UDPAddr).AddrPort()
+	}
+
+	ms, _ := listen()
+	gl, gaddr := listen()
+
+	gs := &testGameServer{
+		Port: strconv.Itoa(int(gaddr.Port())),
+	}
+	gl.HandleConnect(func(addr netip.AddrPort, uid uint64) {
+		gs.Connects.Add(1)
+		gl.SendConnectReply(addr, uid)
+	})
+
+	return &Handler{
+		ServerList: sl,
+		NSPkt:      ms,
+	}, gs
+}
+
+// testServerUpsert makes a server upsert request from localhost, returning the
+// status, id, and error message.
+func testServerUpsert(h *Handler, action string, q url.Values) (int, string, string) {
+	r := httptest.NewRequest(http.MethodPost, "/server/"+action+"?"+q.Encode(), nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	r.Header.Set("User-Agent", "R2Northstar/v1.20.0")
+
+	w := httptest.NewRecorder()
+	h.handleServerUpsert(w, r)
+
+	var obj struct {
+		ID    string   `json:"id"`
+		Error ErrorObj `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &obj)
+	return w.Code, obj.ID, obj.Error.Message
+}
+
+func TestServerUpsertQuarantine(t *testing.T) {
+	h := &Handler{
+		ServerList: NewServerList(0, 0, 0, ServerListConfig{
+			QuarantineRegistrations: 1,
+			QuarantineWindow:        time.Minute,
+			QuarantineTime:          time.Minute * 5,
+		}),
+	}
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/server/add_server?port=37015&authPort=udp&name=test", nil)
+		r.RemoteAddr = "127.0.0.1:12345"
+		r.Header.Set("User-Agent", "R2Northstar/v1.20.0")
+
+		w := httptest.NewRecorder()
+		h.handleServerUpsert(w, r)
+
+		if i < 2 {
+			if w.Code != http.StatusOK {
+				t.Fatalf("register %d: unexpected status %d", i, w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("register %d: expected status %d, got %d", i, http.StatusTooManyRequests, w.Code)
+		}
+		if act, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || act < 290 || act > 300 {
+			t.Errorf("register %d: expected Retry-After to be the remaining quarantine time, got %q", i, w.Header().Get("Retry-After"))
+		}
+	}
+}
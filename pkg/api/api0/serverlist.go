@@ -3,12 +3,14 @@ package api0
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/netip"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,6 +19,7 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/klauspost/compress/gzip"
 	"github.com/r2northstar/atlas/pkg/metricsx"
 	"github.com/r2northstar/atlas/pkg/nstypes"
@@ -39,13 +42,25 @@ type ServerList struct {
 	servers2 map[string]*Server         // server id
 	servers3 map[netip.AddrPort]*Server // auth addr
 
+	// if non-nil, replaces servers1 for /client/servers (protected by mu)
+	mirror []*Server
+
+	// lock contention metrics
+	lockMetricsInit sync.Once
+	lockMetricsSet  *metrics.Set
+
+	// flapping server detection (protected by mu)
+	regs map[netip.Addr]*registrationHistory
+
 	// /client/servers json caching
-	csNext     atomic.Pointer[time.Time] // latest next update time for the /client/servers response
-	csForce    atomic.Bool               // flag to force an update
-	csUpdatePf bool                      // ensures only one update runs at a time
-	csUpdateCv *sync.Cond                // allows other goroutines to wait for that update to complete
-	csBytes    atomic.Pointer[[]byte]    // contents of buffer must not be modified; only swapped
-	csEst      atomic.Uint64             // estimated per-server json size
+	csNext     atomic.Pointer[time.Time]         // latest next update time for the /client/servers response
+	csForce    atomic.Bool                       // flag to force an update
+	csUpdatePf bool                              // ensures only one update runs at a time
+	csUpdateCv *sync.Cond                        // allows other goroutines to wait for that update to complete
+	csBytes    atomic.Pointer[csCache]           // contents of buffer must not be modified; only swapped
+	csEst      atomic.Uint64                     // estimated per-server json size
+	csWatch    atomic.Pointer[chan struct{}]     // closed and cleared when csForceUpdate is called
+	csFeatured atomic.Pointer[func(*Server) int] // priority boost for ordering
 
 	// /client/servers gzipped json
 	csgzPool     sync.Pool              // gzip writer pool
@@ -72,7 +87,70 @@ type ServerListConfig struct {
 	// changes their name or description, the ID will not be the same anymore.
 	ExperimentalDeterministicServerIDSecret string
 
+	// AllowUwuify enables uwuifying server names on April 1.
 	AllowUwuify bool
+
+	// PlayerCountHistory is the number of player count changes to keep for
+	// each server. If zero, player count history is disabled.
+	PlayerCountHistory int
+
+	// QuarantineRegistrations, QuarantineWindow, and QuarantineTime configure
+	// quarantining of flapping servers. If an IP registers new servers more
+	// than QuarantineRegistrations times within QuarantineWindow, new
+	// servers from that IP are refused for QuarantineTime. If any are zero,
+	// servers are not quarantined.
+	QuarantineRegistrations int
+	QuarantineWindow        time.Duration
+	QuarantineTime          time.Duration
+
+	// ReverifyRevived controls whether ghost servers revived by a heartbeat
+	// must be verified again (using the verify time passed to NewServerList)
+	// before being listed. This catches servers which moved or changed their
+	// auth port while they were ghosts, at the expense of revival latency.
+	ReverifyRevived bool
+
+	// PopulatedDeadTime, if nonzero, is used instead of the dead time passed
+	// to NewServerList for servers which had players as of their last update.
+	// This allows popular servers to survive brief heartbeat gaps while empty
+	// servers are reaped faster. It must not be greater than the ghost time.
+	PopulatedDeadTime time.Duration
+
+	// ShownPlaylists, if non-nil, limits the servers included in the public
+	// server list to ones running one of the specified playlists. Other
+	// servers can still register and are included in metrics.
+	ShownPlaylists []string
+
+	// GzipLevel is the compression level for the gzipped server list. It must
+	// be between gzip.HuffmanOnly and gzip.BestCompression. If zero,
+	// gzip.DefaultCompression is used.
+	GzipLevel int
+
+	// OnEvent, if provided, is called for server lifecycle events. It is
+	// called while holding a write lock on the server list, so it must not
+	// block or call ServerList methods.
+	OnEvent func(ServerEvent)
+}
+
+// ServerEventType is the type of a server lifecycle event.
+type ServerEventType string
+
+const (
+	ServerEventRegister ServerEventType = "register" // a new server was created
+	ServerEventVerify   ServerEventType = "verify"   // a server completed verification
+	ServerEventRevive   ServerEventType = "revive"   // a ghost server sent a heartbeat
+	ServerEventRemove   ServerEventType = "remove"   // a server was removed by the game server
+	ServerEventExpire   ServerEventType = "expire"   // a dead or unverified server was cleaned up
+)
+
+// ServerEvent is a server lifecycle event.
+type ServerEvent struct {
+	Time   time.Time
+	Type   ServerEventType
+	ID     string
+	Addr   netip.AddrPort
+	Name   string
+	Region string
+	Gap    time.Duration // for ServerEventRevive, the time since the last heartbeat
 }
 
 type Server struct {
@@ -94,6 +172,9 @@ type Server struct {
 	VerificationDeadline time.Time // zero once verified
 	LastHeartbeat        time.Time
 
+	LastVerifyTime   time.Time // zero if never attempted
+	LastVerifyResult string    // "success", or the reason for the failure
+
 	PlayerCount int
 	MaxPlayers  int
 	Map         string
@@ -101,7 +182,11 @@ type Server struct {
 
 	ServerAuthToken string // used for authenticating the masterserver to the gameserver authserver
 
+	ConnectMetadata string // opaque, returned to clients authenticating with the server
+
 	ModInfo []ServerModInfo
+
+	history *playerCountHistory // nil if disabled; not copied by clone
 }
 
 type ServerModInfo struct {
@@ -123,9 +208,67 @@ func (s Server) clone() Server {
 	m := make([]ServerModInfo, len(s.ModInfo))
 	copy(m, s.ModInfo)
 	s.ModInfo = m
+	s.history = nil
 	return s
 }
 
+// PlayerCountSample is a player count at a point in time.
+type PlayerCountSample struct {
+	Time        time.Time
+	PlayerCount int
+}
+
+// playerCountHistory is a fixed-size ring buffer of player count samples.
+type playerCountHistory struct {
+	samples []PlayerCountSample
+	next    int
+	full    bool
+}
+
+func newPlayerCountHistory(n int) *playerCountHistory {
+	return &playerCountHistory{samples: make([]PlayerCountSample, n)}
+}
+
+// Add adds a sample, overwriting the oldest one if full.
+func (h *playerCountHistory) Add(t time.Time, n int) {
+	h.samples[h.next] = PlayerCountSample{t, n}
+	if h.next++; h.next == len(h.samples) {
+		h.next, h.full = 0, true
+	}
+}
+
+// Samples returns a copy of the samples from oldest to newest.
+func (h *playerCountHistory) Samples() []PlayerCountSample {
+	if !h.full {
+		return append([]PlayerCountSample(nil), h.samples[:h.next]...)
+	}
+	r := make([]PlayerCountSample, 0, len(h.samples))
+	r = append(r, h.samples[h.next:]...)
+	r = append(r, h.samples[:h.next]...)
+	return r
+}
+
+// maxRegistrationHistory is the maximum number of IPs to track registrations
+// for when quarantining flapping servers.
+const maxRegistrationHistory = 16384
+
+// registrationHistory tracks recent server registrations for an IP.
+type registrationHistory struct {
+	times []time.Time // within the window, oldest first
+	until time.Time   // end of the quarantine
+}
+
+// prune removes registrations which are no longer within the window, returning
+// false if the history is empty and the IP isn't quarantined.
+func (h *registrationHistory) prune(t time.Time, window time.Duration) bool {
+	var i int
+	for i < len(h.times) && t.Sub(h.times[i]) >= window {
+		i++
+	}
+	h.times = h.times[:copy(h.times, h.times[i:])]
+	return len(h.times) != 0 || t.Before(h.until)
+}
+
 type ServerUpdate struct {
 	ID       string     // server to update
 	ExpectIP netip.Addr // require the server for ID to have this IP address to successfully update
@@ -184,6 +327,15 @@ func NewServerList(deadTime, ghostTime, verifyTime time.Duration, cfg ServerList
 	if deadTime > ghostTime {
 		panic("api0: serverlist: deadTime must be <= ghostTime")
 	}
+	if cfg.PopulatedDeadTime < 0 {
+		panic("api0: serverlist: PopulatedDeadTime must be >= 0")
+	}
+	if cfg.PopulatedDeadTime > ghostTime {
+		panic("api0: serverlist: PopulatedDeadTime must be <= ghostTime")
+	}
+	if cfg.GzipLevel < gzip.HuffmanOnly || cfg.GzipLevel > gzip.BestCompression {
+		panic("api0: serverlist: invalid GzipLevel")
+	}
 	return &ServerList{
 		verifyTime:   verifyTime,
 		deadTime:     deadTime,
@@ -194,9 +346,24 @@ func NewServerList(deadTime, ghostTime, verifyTime time.Duration, cfg ServerList
 	}
 }
 
+// csCache is a generated /client/servers response.
+type csCache struct {
+	buf   []byte     // must not be modified
+	bin   []byte     // binary encoding of buf (see csBinary), must not be modified
+	time  time.Time  // when it was generated
+	count int        // number of servers in buf
+	spans [][2]int   // start and end offsets of each server's object in buf
+	mods  [][]string // names of the client-required mods for each server
+}
+
 // csGetJSON efficiently gets the JSON response for /client/servers.
 // The returned byte slice must not be modified (and will not be modified).
 func (s *ServerList) csGetJSON() []byte {
+	return s.csGet().buf
+}
+
+// csGet is like csGetJSON, but also returns information about the response.
+func (s *ServerList) csGet() *csCache {
 	t := s.now()
 
 	// if we have a cached response
@@ -212,7 +379,7 @@ func (s *ServerList) csGetJSON() []byte {
 			// and we haven't reached the next heartbeat expiry time
 			if forceTime := s.csNext.Load(); forceTime == nil || forceTime.IsZero() || forceTime.After(t) {
 				// then return the existing buffer
-				return *b
+				return b
 			}
 		}
 	}
@@ -242,7 +409,7 @@ func (s *ServerList) csGetJSON() []byte {
 			s.csUpdateCv.Wait()
 		}
 		s.csUpdateCv.L.Unlock()
-		return *s.csBytes.Load()
+		return s.csBytes.Load()
 	} else {
 		// we've been selected to perform the update
 		s.csUpdatePf = true
@@ -259,41 +426,144 @@ func (s *ServerList) csGetJSON() []byte {
 	defer s.csForce.Store(false)
 	defer s.csUpdateNextUpdateTime()
 
-	// get the servers in the original order
-	ss := make([]*Server, 0, len(s.servers1)) // up to the current size of the servers map
-	if s.servers1 != nil {
-		for _, srv := range s.servers1 {
-			if s.serverState(srv, t) == serverListStateAlive {
-				if srv.Map == "mp_lobby" && srv.Playlist != "private_match" {
-					continue // don't include non-private_match servers on lobby
-				}
-				ss = append(ss, srv)
-			}
-		}
-	}
-	sort.Slice(ss, func(i, j int) bool {
-		return ss[i].Order < ss[j].Order
-	})
-
 	// generate the json and cache it
 	//
 	// note: we write it manually to avoid copying the entire list and to avoid the perf overhead of reflection
-	buf, est := csJSON(ss, int(s.csEst.Load()), s.cfg)
-	s.csBytes.Store(&buf)
+	ss := s.csServers(t, nil)
+	spans := make([][2]int, len(ss))
+	buf, est, reallocs := csJSON(ss, int(s.csEst.Load()), s.cfg, spans)
+	s.csJSONMetrics(len(ss), len(buf), reallocs)
+	c := &csCache{
+		buf:   buf,
+		bin:   csBinary(ss, s.cfg),
+		time:  t,
+		count: len(ss),
+		spans: spans,
+		mods:  make([][]string, len(ss)),
+	}
+	for i, srv := range ss {
+		for _, mi := range srv.ModInfo {
+			if mi.RequiredOnClient {
+				c.mods[i] = append(c.mods[i], mi.Name)
+			}
+		}
+	}
+	s.csBytes.Store(c)
 	s.csEst.Store(uint64(est))
 
-	return buf
+	return c
+}
+
+// csGetJSONMods is like csGetJSON, but only includes servers where the name of
+// every mod which is RequiredOnClient is in mods. The response is built from
+// the cached one without locking the server list. If mods is nil, it is the
+// same as csGetJSON.
+func (s *ServerList) csGetJSONMods(mods []string) []byte {
+	c := s.csGet()
+	if mods == nil {
+		return c.buf
+	}
+
+	b := make([]byte, 0, len(c.buf))
+	b = append(b, '[')
+	var n int
+	for i, span := range c.spans {
+		if !containsAll(mods, c.mods[i]) {
+			continue
+		}
+		if n != 0 {
+			b = append(b, ',')
+		}
+		b = append(b, c.buf[span[0]:span[1]]...)
+		n++
+	}
+	b = append(b, ']')
+	return b
+}
+
+// containsAll checks whether every element of b is in a.
+func containsAll(a, b []string) bool {
+	for _, x := range b {
+		if !slices.Contains(a, x) {
+			return false
+		}
+	}
+	return true
 }
 
-func csJSON(ss []*Server, est int, cfg ServerListConfig) ([]byte, int) {
+// serverShown checks whether srv is alive and should be included in the public
+// server list. It must be called while holding a read lock on s.mu.
+func (s *ServerList) serverShown(srv *Server, t time.Time) bool {
+	if s.serverState(srv, t) != serverListStateAlive {
+		return false
+	}
+	if srv.Map == "mp_lobby" && srv.Playlist != "private_match" {
+		return false // don't include non-private_match servers on lobby
+	}
+	if s.cfg.ShownPlaylists != nil && !slices.Contains(s.cfg.ShownPlaylists, srv.Playlist) {
+		return false // don't include servers with playlists which aren't shown
+	}
+	return true
+}
+
+// csServers gets the servers to include in the /client/servers response in
+// order, optionally filtered by fn. It must be called while holding a read
+// lock on s.mu.
+func (s *ServerList) csServers(t time.Time, fn func(*Server) bool) []*Server {
+	// get the servers in the original order
+	ss := make([]*Server, 0, len(s.servers1)+len(s.mirror)) // up to the current size of the servers map
+	add := func(srv *Server) {
+		if s.serverShown(srv, t) {
+			if fn != nil && !fn(srv) {
+				return
+			}
+			ss = append(ss, srv)
+		}
+	}
+	if s.mirror != nil {
+		for _, srv := range s.mirror {
+			add(srv)
+		}
+	} else {
+		for _, srv := range s.servers1 {
+			add(srv)
+		}
+	}
+	if fn := s.csFeatured.Load(); fn != nil && *fn != nil {
+		prio := make(map[*Server]int, len(ss))
+		for _, srv := range ss {
+			prio[srv] = (*fn)(srv)
+		}
+		sort.Slice(ss, func(i, j int) bool {
+			if a, b := prio[ss[i]], prio[ss[j]]; a != b {
+				return a > b
+			}
+			return ss[i].Order < ss[j].Order
+		})
+	} else {
+		sort.Slice(ss, func(i, j int) bool {
+			return ss[i].Order < ss[j].Order
+		})
+	}
+	return ss
+}
+
+// csJSON generates the /client/servers response for ss, using est (the
+// estimated size per server, or zero if unknown) to size the buffer. It returns
+// the new estimate and the number of times the buffer had to be grown. If spans
+// is non-nil, it must be the same length as ss, and the start and end offsets
+// of the object for each server will be written to it.
+func csJSON(ss []*Server, est int, cfg ServerListConfig, spans [][2]int) ([]byte, int, int) {
 	if len(ss) == 0 {
-		return []byte(`[]`), est
+		return []byte(`[]`), est, 0
 	}
 
+	// note: servers with many mods can be over 1 KiB, but the clamp prevents a
+	// few large servers from causing a massive over-allocation
 	const (
 		estMin  = 256
-		estInit = 394
-		estMax  = 512
+		estInit = 512
+		estMax  = 1024
 	)
 	switch {
 	case est == 0:
@@ -306,17 +576,22 @@ func csJSON(ss []*Server, est int, cfg ServerListConfig) ([]byte, int) {
 
 	// note: we use a custom buffer so we can control allocations
 
-	b := make([]byte, 0, len(ss)*est+2)
+	// note: we leave some headroom since the estimate is an average, so we'd
+	// otherwise need to grow the buffer for around half of responses
+	var reallocs int
+	b := make([]byte, 0, len(ss)*(est+est/16)+2)
 	b = append(b, '[')
 	for i, srv := range ss {
 		if r := len(ss) - i - 1; r >= 0 && cap(b)-len(b) < est*r {
-			bn := make([]byte, len(b), cap(b)+est*r)
+			bn := make([]byte, len(b), len(b)+r*(est+est/16)+2)
 			copy(bn, b)
 			b = bn
+			reallocs++
 		}
 		if i != 0 {
 			b = append(b, ',')
 		}
+		start := len(b)
 		b = append(b, `{"lastHeartbeat":`...)
 		b = strconv.AppendInt(b, srv.LastHeartbeat.UnixMilli(), 10)
 		b = append(b, `,"id":"`...)
@@ -364,6 +639,9 @@ func csJSON(ss []*Server, est int, cfg ServerListConfig) ([]byte, int) {
 			}
 		}
 		b = append(b, `]}}`...)
+		if spans != nil {
+			spans[i] = [2]int{start, len(b)}
+		}
 	}
 	b = append(b, ']')
 
@@ -376,7 +654,80 @@ func csJSON(ss []*Server, est int, cfg ServerListConfig) ([]byte, int) {
 	case est > estMax:
 		est = estMax
 	}
-	return b, est
+	return b, est, reallocs
+}
+
+// csJSONMetrics updates the metrics for a generated /client/servers response
+// with n servers.
+func (s *ServerList) csJSONMetrics(n, size, reallocs int) {
+	if n != 0 {
+		s.lockMetrics().GetOrCreateHistogram(`atlas_api0sl_json_server_size_bytes`).Update(float64(size-2-(n-1)) / float64(n))
+	}
+	s.lockMetrics().GetOrCreateCounter(`atlas_api0sl_json_reallocs_total`).Add(reallocs)
+}
+
+// csBinaryVersion is the version of the binary server list encoding.
+const csBinaryVersion = 1
+
+// csBinary generates the compact binary encoding of the server list. It
+// contains the same information as csJSON.
+//
+//	"ATSL" version:u8 count:uvarint server*
+//	server = id:str lastHeartbeat:varint(unix ms) flags:u8 name:str region:str
+//	         description:str playerCount:uvarint maxPlayers:uvarint map:str
+//	         playlist:str modCount:uvarint mod*
+//	mod    = name:str version:str flags:u8
+//	str    = len:uvarint utf8
+//
+// Server flags: 0x01 = hasPassword. Mod flags: 0x01 = RequiredOnClient. The
+// region is empty if the server has a password (like the JSON). New fields
+// must only be added by incrementing csBinaryVersion.
+func csBinary(ss []*Server, cfg ServerListConfig) []byte {
+	appendStr := func(b []byte, s string) []byte {
+		return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+	}
+
+	b := make([]byte, 0, 16+len(ss)*128)
+	b = append(b, "ATSL"...)
+	b = append(b, csBinaryVersion)
+	b = binary.AppendUvarint(b, uint64(len(ss)))
+	for _, srv := range ss {
+		b = appendStr(b, srv.ID)
+		b = binary.AppendVarint(b, srv.LastHeartbeat.UnixMilli())
+		if srv.Password != "" {
+			b = append(b, 0x01)
+		} else {
+			b = append(b, 0x00)
+		}
+		name := srv.Name
+		if cfg.AllowUwuify {
+			if _, m, d := time.Now().UTC().Date(); m == time.April && d == 1 {
+				name = uwuify(name)
+			}
+		}
+		b = appendStr(b, name)
+		if srv.Password == "" {
+			b = appendStr(b, srv.Region)
+		} else {
+			b = appendStr(b, "")
+		}
+		b = appendStr(b, srv.Description)
+		b = binary.AppendUvarint(b, uint64(max(srv.PlayerCount, 0)))
+		b = binary.AppendUvarint(b, uint64(max(srv.MaxPlayers, 0)))
+		b = appendStr(b, srv.Map)
+		b = appendStr(b, srv.Playlist)
+		b = binary.AppendUvarint(b, uint64(len(srv.ModInfo)))
+		for _, mi := range srv.ModInfo {
+			b = appendStr(b, mi.Name)
+			b = appendStr(b, mi.Version)
+			if mi.RequiredOnClient {
+				b = append(b, 0x01)
+			} else {
+				b = append(b, 0x00)
+			}
+		}
+	}
+	return b
 }
 
 // csGetJSONGzip is like csGetJSON, but returns it gzipped with true, or false
@@ -417,7 +768,11 @@ func (s *ServerList) csGetJSONGzip() ([]byte, bool) {
 	var b bytes.Buffer
 	var zw *gzip.Writer
 	if o := s.csgzPool.Get(); o == nil {
-		zw = gzip.NewWriter(&b)
+		lvl := s.cfg.GzipLevel
+		if lvl == 0 {
+			lvl = gzip.DefaultCompression
+		}
+		zw, _ = gzip.NewWriterLevel(&b, lvl) // validated by NewServerList
 	} else {
 		zw = o.(*gzip.Writer)
 		zw.Reset(&b)
@@ -446,20 +801,27 @@ func (s *ServerList) csGetJSONGzip() ([]byte, bool) {
 // holding a write lock on s.mu.
 func (s *ServerList) csUpdateNextUpdateTime() {
 	var u time.Time
-	if s.servers1 != nil {
-		for _, srv := range s.servers1 {
-			if s.deadTime != 0 {
-				if x := srv.LastHeartbeat.Add(s.deadTime); u.IsZero() || x.Before(u) {
-					u = x
-				}
+	next := func(srv *Server) {
+		if deadTime := s.serverDeadTime(srv); deadTime != 0 {
+			if x := srv.LastHeartbeat.Add(deadTime); u.IsZero() || x.Before(u) {
+				u = x
 			}
-			if s.ghostTime != 0 {
-				if x := srv.LastHeartbeat.Add(s.ghostTime); u.IsZero() || x.Before(u) {
-					u = x
-				}
+		}
+		if s.ghostTime != 0 {
+			if x := srv.LastHeartbeat.Add(s.ghostTime); u.IsZero() || x.Before(u) {
+				u = x
 			}
 		}
 	}
+	if s.mirror != nil {
+		for _, srv := range s.mirror {
+			next(srv)
+		}
+	} else {
+		for _, srv := range s.servers1 {
+			next(srv)
+		}
+	}
 	// we don't need to check the old value since while we have s.mu, we're the
 	// only ones who can write to csNext
 	s.csNext.Store(&u)
@@ -469,6 +831,58 @@ func (s *ServerList) csUpdateNextUpdateTime() {
 // must be called after any value updates while holding a write lock on s.mu.
 func (s *ServerList) csForceUpdate() {
 	s.csForce.Store(true)
+	if c := s.csWatch.Swap(nil); c != nil {
+		close(*c)
+	}
+}
+
+// SetFeatured sets the function used to get the priority of a server in the
+// /client/servers response. Servers with a higher priority are listed first,
+// and servers with the same priority are listed in insertion order. If fn is
+// nil, servers are listed in insertion order. The function must not modify
+// the server, and is called while holding a read lock on the server list.
+func (s *ServerList) SetFeatured(fn func(*Server) int) {
+	defer s.lock("set_featured")()
+
+	s.csFeatured.Store(&fn)
+	s.csForceUpdate()
+}
+
+// SetMirror replaces the servers in the /client/servers response with ss (e.g.,
+// from an upstream server list), in the provided order. The servers are treated
+// as verified, but are still hidden once dead based on their last heartbeat. If
+// ss is nil, registered servers are used again. Mirrored servers are not
+// returned by any other methods, nor are they included in metrics.
+func (s *ServerList) SetMirror(ss []*Server) {
+	defer s.lock("set_mirror")()
+
+	if ss == nil {
+		s.mirror = nil
+	} else {
+		s.mirror = make([]*Server, len(ss))
+		for i, srv := range ss {
+			c := srv.clone()
+			c.Order = uint64(i)
+			c.VerificationDeadline = time.Time{}
+			s.mirror[i] = &c
+		}
+	}
+	s.csForceUpdate()
+	s.csUpdateNextUpdateTime()
+}
+
+// csWatchChan returns a channel which is closed the next time csForceUpdate is
+// called. Note that the list may also change when csNext is reached.
+func (s *ServerList) csWatchChan() <-chan struct{} {
+	for {
+		if c := s.csWatch.Load(); c != nil {
+			return *c
+		}
+		c := make(chan struct{})
+		if s.csWatch.CompareAndSwap(nil, &c) {
+			return c
+		}
+	}
 }
 
 // GetMetrics gets Prometheus text format metrics about live servers in the
@@ -534,7 +948,7 @@ func (s *ServerList) GetMetrics() []byte {
 				mplPlayers[mplv] += srv.PlayerCount
 				mplMaxPlayers[mplv] += srv.MaxPlayers
 				mplServers[mplv]++
-				verServers[srv.LauncherVersion]++
+				verServers[launcherVersionLabel(srv.LauncherVersion)]++
 				for _, mi := range srv.ModInfo {
 					modServers[mod(mi)]++
 				}
@@ -697,6 +1111,7 @@ func (s *ServerList) GetMetrics() []byte {
 // WritePrometheus writes metrics for s to w.
 func (s *ServerList) WritePrometheus(w io.Writer) {
 	w.Write(s.GetMetrics())
+	s.lockMetrics().WritePrometheus(w)
 }
 
 // WritePrometheusGeo writes location metrics for s to w.
@@ -745,6 +1160,161 @@ func (s *ServerList) GetLiveServers(fn func(*Server) bool) {
 	}
 }
 
+// ServerQuery contains criteria for FindServers. Zero values match any server.
+type ServerQuery struct {
+	Region     string // exact match
+	Map        string // exact match
+	Playlist   string // exact match
+	HasSpace   bool   // only servers where PlayerCount < MaxPlayers
+	NoPassword bool   // only servers without a password
+	Limit      int    // maximum number of servers to return, if nonzero
+}
+
+// Match checks whether srv matches q.
+func (q ServerQuery) Match(srv *Server) bool {
+	if q.Region != "" && srv.Region != q.Region {
+		return false
+	}
+	if q.Map != "" && srv.Map != q.Map {
+		return false
+	}
+	if q.Playlist != "" && srv.Playlist != q.Playlist {
+		return false
+	}
+	if q.HasSpace && srv.PlayerCount >= srv.MaxPlayers {
+		return false
+	}
+	if q.NoPassword && srv.Password != "" {
+		return false
+	}
+	return true
+}
+
+// FindServers returns deep copies of live servers matching q, sorted by
+// available capacity (most first), then by registration order. Like the public
+// server list, servers which aren't shown (see ShownPlaylists) are excluded.
+func (s *ServerList) FindServers(q ServerQuery) []*Server {
+	t := s.now()
+
+	// take a read lock on the server list
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// find matching servers (don't clone them until we know which ones we're
+	// returning)
+	var ss []*Server
+	if s.servers1 != nil {
+		for _, srv := range s.servers1 {
+			if s.serverShown(srv, t) && q.Match(srv) {
+				ss = append(ss, srv)
+			}
+		}
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		if a, b := ss[i].MaxPlayers-ss[i].PlayerCount, ss[j].MaxPlayers-ss[j].PlayerCount; a != b {
+			return a > b
+		}
+		return ss[i].Order < ss[j].Order
+	})
+	if q.Limit > 0 && len(ss) > q.Limit {
+		ss = ss[:q.Limit]
+	}
+	for i, srv := range ss {
+		c := srv.clone()
+		ss[i] = &c
+	}
+	return ss
+}
+
+// GetPlayerCountHistory returns the player count history from oldest to newest
+// for the live server with id. If the server doesn't exist or player count
+// history is disabled, false is returned.
+func (s *ServerList) GetPlayerCountHistory(id string) ([]PlayerCountSample, bool) {
+	t := s.now()
+
+	// take a read lock on the server list
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.servers2 != nil {
+		if srv, ok := s.servers2[id]; ok && srv.history != nil && s.serverState(srv, t) == serverListStateAlive {
+			return srv.history.Samples(), true
+		}
+	}
+	return nil, false
+}
+
+// ServerStatus describes the state of a server in the server list.
+type ServerStatus struct {
+	State                string    // pending, alive, or ghost
+	VerificationDeadline time.Time // zero once verified
+	LastHeartbeat        time.Time
+}
+
+// GetServerStatus gets the status of the server with id if it exists and token
+// matches its ServerAuthToken.
+func (s *ServerList) GetServerStatus(id, token string) (ServerStatus, bool) {
+	t := s.now()
+
+	// take a read lock on the server list
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.servers2 != nil {
+		if srv, ok := s.servers2[id]; ok && srv.ServerAuthToken != "" && subtle.ConstantTimeCompare([]byte(srv.ServerAuthToken), []byte(token)) == 1 {
+			st := ServerStatus{
+				VerificationDeadline: srv.VerificationDeadline,
+				LastHeartbeat:        srv.LastHeartbeat,
+			}
+			switch s.serverState(srv, t) {
+			case serverListStatePending:
+				st.State = "pending"
+			case serverListStateAlive:
+				st.State = "alive"
+			case serverListStateGhost:
+				st.State = "ghost"
+			default:
+				return ServerStatus{}, false
+			}
+			return st, true
+		}
+	}
+	return ServerStatus{}, false
+}
+
+// GetServerDebug returns a deep copy of the server with id and its status if
+// it is not dead, regardless of whether it is verified. It is intended for
+// troubleshooting.
+func (s *ServerList) GetServerDebug(id string) (*Server, ServerStatus, bool) {
+	t := s.now()
+
+	// take a read lock on the server list
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.servers2 != nil {
+		if srv, ok := s.servers2[id]; ok {
+			st := ServerStatus{
+				VerificationDeadline: srv.VerificationDeadline,
+				LastHeartbeat:        srv.LastHeartbeat,
+			}
+			switch s.serverState(srv, t) {
+			case serverListStatePending:
+				st.State = "pending"
+			case serverListStateAlive:
+				st.State = "alive"
+			case serverListStateGhost:
+				st.State = "ghost"
+			default:
+				return nil, ServerStatus{}, false
+			}
+			c := srv.clone()
+			return &c, st, true
+		}
+	}
+	return nil, ServerStatus{}, false
+}
+
 // GetServerByID returns a deep copy of the server with id, or nil if it is
 // dead.
 func (s *ServerList) GetServerByID(id string) *Server {
@@ -769,8 +1339,7 @@ func (s *ServerList) DeleteServerByID(id string) bool {
 	t := s.now()
 
 	// take a write lock on the server list
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	defer s.lock("delete")()
 
 	// force an update when we're finished
 	defer s.csForceUpdate()
@@ -782,19 +1351,41 @@ func (s *ServerList) DeleteServerByID(id string) bool {
 			if s.serverState(esrv, t) == serverListStateAlive {
 				live = true
 			}
+			s.emitEvent(ServerEventRemove, esrv, t, 0)
 			s.freeServer(esrv)
 		}
 	}
 	return live
 }
 
+// serverIDMaxAttempts is the maximum number of random server IDs to try before
+// giving up. With 128 random bits, even a single collision should never happen
+// unless the RNG is broken, so we don't want to spin forever under the lock.
+const serverIDMaxAttempts = 8
+
 var (
 	ErrServerListDuplicateAuthAddr = errors.New("already have server with auth addr")
 	ErrServerListUpdateServerDead  = errors.New("no server found")
 	ErrServerListUpdateWrongIP     = errors.New("wrong server update ip")
 	ErrServerListLimitExceeded     = errors.New("would exceed server list limits")
+	ErrServerListQuarantined       = errors.New("too many recent registrations from ip")
 )
 
+// ServerListQuarantinedError is returned (wrapping ErrServerListQuarantined)
+// when a new server is refused since its IP is quarantined.
+type ServerListQuarantinedError struct {
+	IP        netip.Addr
+	Remaining time.Duration // until the quarantine ends
+}
+
+func (e ServerListQuarantinedError) Error() string {
+	return fmt.Sprintf("%v %s (quarantined for %s)", ErrServerListQuarantined, e.IP, e.Remaining.Truncate(time.Second))
+}
+
+func (e ServerListQuarantinedError) Unwrap() error {
+	return ErrServerListQuarantined
+}
+
 // ServerHybridUpdatePut attempts to update a server by the server ID (if u is
 // non-nil) (reviving it if necessary), and if that fails, then attempts to
 // create/replace a server by the gameserver ip/port instead (if c is non-nil)
@@ -810,6 +1401,7 @@ var (
 //   - ErrServerListUpdateServerDead - if no server matching the provided id exists (if u) AND c is not provided
 //   - ErrServerListUpdateWrongIP - if a server matching the provided id exists, but the ip doesn't match (if u and u.ExpectIP)
 //   - ErrServerListLimitExceeded - if adding the server would exceed server limits (if c and l)
+//   - ErrServerListQuarantined - if the ip of the server to create (if c) has been temporarily quarantined due to re-registering too often (the error is a ServerListQuarantinedError)
 //
 // When creating a server using the values from c: c.Order, c.ID,
 // c.ServerAuthToken, c.VerificationDeadline, and c.LastHeartbeat will be
@@ -818,8 +1410,7 @@ func (s *ServerList) ServerHybridUpdatePut(u *ServerUpdate, c *Server, l ServerL
 	t := s.now()
 
 	// take a write lock on the server list
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	defer s.lock("update_put")()
 
 	// ensure maps are initialized
 	if s.servers1 == nil {
@@ -849,36 +1440,55 @@ func (s *ServerList) ServerHybridUpdatePut(u *ServerUpdate, c *Server, l ServerL
 				}
 
 				// do the update
+				//
+				// note: we only force a /client/servers update if a value
+				// actually changed or a ghost server was revived since a plain
+				// heartbeat happens much more often (this means lastHeartbeat
+				// in the cached response may be out of date)
 				var changed bool
 				if u.Heartbeat {
-					esrv.LastHeartbeat, changed = t, true
+					if s.serverState(esrv, t) == serverListStateGhost {
+						s.emitEvent(ServerEventRevive, esrv, t, t.Sub(esrv.LastHeartbeat))
+						if s.cfg.ReverifyRevived && s.verifyTime != 0 {
+							esrv.VerificationDeadline = t.Add(s.verifyTime)
+						}
+						changed = true
+					}
+					esrv.LastHeartbeat = t
 					s.csUpdateNextUpdateTime()
 				}
-				if u.Name != nil {
+				if u.Name != nil && esrv.Name != *u.Name {
 					esrv.Name, changed = *u.Name, true
 				}
-				if u.Region != nil {
+				if u.Region != nil && esrv.Region != *u.Region {
 					esrv.Region, changed = *u.Region, true
 				}
-				if u.Description != nil {
+				if u.Description != nil && esrv.Description != *u.Description {
 					esrv.Description, changed = *u.Description, true
 				}
-				if u.Latitude != nil {
+				if u.Latitude != nil && esrv.Latitude != *u.Latitude {
 					esrv.Latitude, changed = *u.Latitude, true
 				}
-				if u.Longitude != nil {
+				if u.Longitude != nil && esrv.Longitude != *u.Longitude {
 					esrv.Longitude, changed = *u.Longitude, true
 				}
-				if u.Map != nil {
+				if u.Map != nil && esrv.Map != *u.Map {
 					esrv.Map, changed = *u.Map, true
 				}
-				if u.Playlist != nil {
+				if u.Playlist != nil && esrv.Playlist != *u.Playlist {
 					esrv.Playlist, changed = *u.Playlist, true
 				}
-				if u.PlayerCount != nil {
+				if u.PlayerCount != nil && esrv.PlayerCount != *u.PlayerCount {
+					if esrv.history != nil {
+						esrv.history.Add(t, *u.PlayerCount)
+					}
+					if s.cfg.PopulatedDeadTime != 0 && (esrv.PlayerCount > 0) != (*u.PlayerCount > 0) {
+						esrv.PlayerCount = *u.PlayerCount
+						s.csUpdateNextUpdateTime() // dead time changed
+					}
 					esrv.PlayerCount, changed = *u.PlayerCount, true
 				}
-				if u.MaxPlayers != nil {
+				if u.MaxPlayers != nil && esrv.MaxPlayers != *u.MaxPlayers {
 					esrv.MaxPlayers, changed = *u.MaxPlayers, true
 				}
 				if changed {
@@ -891,6 +1501,7 @@ func (s *ServerList) ServerHybridUpdatePut(u *ServerUpdate, c *Server, l ServerL
 			}
 		} else {
 			if s.serverState(esrv, t) == serverListStateGone {
+				s.emitEvent(ServerEventExpire, esrv, t, 0)
 				s.freeServer(esrv) // if the server we found shouldn't exist anymore, clean it up
 			}
 		}
@@ -923,11 +1534,17 @@ func (s *ServerList) ServerHybridUpdatePut(u *ServerUpdate, c *Server, l ServerL
 			}
 		}
 
+		// refuse new servers from quarantined IPs
+		if rh := s.regs[nsrv.Addr.Addr()]; rh != nil && s.quarantineEnabled() && t.Before(rh.until) {
+			return nil, ServerListQuarantinedError{nsrv.Addr.Addr(), rh.until.Sub(t)}
+		}
+
 		// we will need to remove an existing server with a matching game
 		// address/port if it exists
 		var toReplace *Server
 		if esrv, exists := s.servers1[nsrv.Addr]; exists {
 			if s.serverState(esrv, t) == serverListStateGone {
+				s.emitEvent(ServerEventExpire, esrv, t, 0)
 				s.freeServer(esrv) // if the server we found shouldn't exist anymore, clean it up
 			} else {
 				toReplace = esrv
@@ -946,10 +1563,10 @@ func (s *ServerList) ServerHybridUpdatePut(u *ServerUpdate, c *Server, l ServerL
 				}
 			}
 			if l.MaxServers > 0 && nSrv > l.MaxServers {
-				return nil, fmt.Errorf("%w: too many servers (%d)", ErrServerListLimitExceeded, nSrv)
+				return nil, fmt.Errorf("%w: too many servers (%d/%d)", ErrServerListLimitExceeded, nSrv, l.MaxServers)
 			}
 			if l.MaxServersPerIP > 0 && nSrvIP > l.MaxServersPerIP {
-				return nil, fmt.Errorf("%w: too many servers for ip %s (%d)", ErrServerListLimitExceeded, nsrv.Addr.Addr(), nSrv)
+				return nil, fmt.Errorf("%w: too many servers for ip %s (%d/%d)", ErrServerListLimitExceeded, nsrv.Addr.Addr(), nSrvIP, l.MaxServersPerIP)
 			}
 		}
 
@@ -985,12 +1602,16 @@ func (s *ServerList) ServerHybridUpdatePut(u *ServerUpdate, c *Server, l ServerL
 
 		// fall back to a random one
 		if nsrv.ID == "" {
-			for {
+			for i := 0; ; i++ {
+				if i == serverIDMaxAttempts {
+					return nil, fmt.Errorf("generate new server id: too many collisions (%d attempts)", i)
+				}
 				sid, err := cryptoRandHex(32)
 				if err != nil {
 					return nil, fmt.Errorf("generate new server id: %w", err)
 				}
 				if _, exists := s.servers2[sid]; exists {
+					s.lockMetrics().GetOrCreateCounter(`atlas_api0sl_server_id_collisions_total`).Inc()
 					continue // try another id since another server already used it
 				}
 				nsrv.ID = sid
@@ -1004,6 +1625,12 @@ func (s *ServerList) ServerHybridUpdatePut(u *ServerUpdate, c *Server, l ServerL
 		// set the heartbeat time to the current time
 		nsrv.LastHeartbeat = t
 
+		// initialize the player count history
+		if n := s.cfg.PlayerCountHistory; n > 0 {
+			nsrv.history = newPlayerCountHistory(n)
+			nsrv.history.Add(t, nsrv.PlayerCount)
+		}
+
 		// set the verification deadline
 		if s.verifyTime != 0 {
 			nsrv.VerificationDeadline = t.Add(s.verifyTime)
@@ -1019,6 +1646,13 @@ func (s *ServerList) ServerHybridUpdatePut(u *ServerUpdate, c *Server, l ServerL
 		s.servers2[nsrv.ID] = &nsrv
 		s.servers3[nsrv.AuthAddr()] = &nsrv
 
+		s.emitEvent(ServerEventRegister, &nsrv, t, 0)
+
+		// track the registration for flapping server detection
+		if s.quarantineEnabled() {
+			s.trackRegistration(nsrv.Addr.Addr(), t)
+		}
+
 		// trigger /client/servers updates
 		s.csForceUpdate()
 		s.csUpdateNextUpdateTime()
@@ -1037,23 +1671,37 @@ func (s *ServerList) ServerHybridUpdatePut(u *ServerUpdate, c *Server, l ServerL
 // not exist, false is returned.
 func (s *ServerList) VerifyServer(id string) bool {
 	// take a write lock on the server list
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	defer s.lock("verify")()
 
 	if srv, exists := s.servers2[id]; exists {
+		t := s.now()
 		srv.VerificationDeadline = time.Time{}
+		srv.LastVerifyTime = t
+		srv.LastVerifyResult = "success"
+		s.emitEvent(ServerEventVerify, srv, t, 0)
 		return true
 	}
 	return false
 }
 
+// SetVerifyFailure records a failed verification attempt for the server with
+// the provided id. If it does not exist, nothing is done.
+func (s *ServerList) SetVerifyFailure(id, reason string) {
+	// take a write lock on the server list
+	defer s.lock("verify")()
+
+	if srv, exists := s.servers2[id]; exists {
+		srv.LastVerifyTime = s.now()
+		srv.LastVerifyResult = reason
+	}
+}
+
 // ReapServers deletes dead servers from memory.
 func (s *ServerList) ReapServers() {
 	t := s.now()
 
 	// take a write lock on the server list
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	defer s.lock("reap")()
 
 	// reap servers
 	//
@@ -1061,10 +1709,94 @@ func (s *ServerList) ReapServers() {
 	if s.servers1 != nil {
 		for _, srv := range s.servers1 {
 			if s.serverState(srv, t) == serverListStateGone {
+				s.emitEvent(ServerEventExpire, srv, t, 0)
 				s.freeServer(srv)
 			}
 		}
 	}
+
+	// reap registration history
+	if s.regs != nil {
+		s.pruneRegistrations(t)
+	}
+}
+
+// lock takes a write lock on s.mu, returning a function to unlock it. The time
+// spent waiting for and holding the lock is recorded for op.
+func (s *ServerList) lock(op string) (unlock func()) {
+	t0 := time.Now()
+	s.mu.Lock()
+	t1 := time.Now()
+	s.lockMetrics().GetOrCreateHistogram(`atlas_api0sl_lock_wait_seconds{op="` + op + `"}`).Update(t1.Sub(t0).Seconds())
+	return func() {
+		s.mu.Unlock()
+		s.lockMetrics().GetOrCreateHistogram(`atlas_api0sl_lock_held_seconds{op="` + op + `"}`).UpdateDuration(t1)
+	}
+}
+
+// lockMetrics gets the metrics set for lock contention metrics.
+func (s *ServerList) lockMetrics() *metrics.Set {
+	s.lockMetricsInit.Do(func() {
+		s.lockMetricsSet = metrics.NewSet()
+	})
+	return s.lockMetricsSet
+}
+
+// emitEvent calls the OnEvent hook, if any, for srv. It must be called while a
+// write lock is held on s.
+func (s *ServerList) emitEvent(typ ServerEventType, srv *Server, t time.Time, gap time.Duration) {
+	if s.cfg.OnEvent != nil {
+		s.cfg.OnEvent(ServerEvent{
+			Time:   t,
+			Type:   typ,
+			ID:     srv.ID,
+			Addr:   srv.Addr,
+			Name:   srv.Name,
+			Region: srv.Region,
+			Gap:    gap,
+		})
+	}
+}
+
+// quarantineEnabled checks whether flapping servers should be quarantined.
+func (s *ServerList) quarantineEnabled() bool {
+	return s.cfg.QuarantineRegistrations > 0 && s.cfg.QuarantineWindow > 0 && s.cfg.QuarantineTime > 0
+}
+
+// trackRegistration records a new server registration from ip, quarantining it
+// if it has registered too many servers recently. It must be called while a
+// write lock is held on s.
+func (s *ServerList) trackRegistration(ip netip.Addr, t time.Time) {
+	if s.regs == nil {
+		s.regs = make(map[netip.Addr]*registrationHistory)
+	}
+	rh, ok := s.regs[ip]
+	if !ok {
+		if len(s.regs) >= maxRegistrationHistory {
+			s.pruneRegistrations(t)
+		}
+		if len(s.regs) >= maxRegistrationHistory {
+			return // too many IPs with recent registrations, don't track it
+		}
+		rh = new(registrationHistory)
+		s.regs[ip] = rh
+	}
+	rh.prune(t, s.cfg.QuarantineWindow)
+	rh.times = append(rh.times, t)
+	if len(rh.times) > s.cfg.QuarantineRegistrations {
+		rh.times = rh.times[:0]
+		rh.until = t.Add(s.cfg.QuarantineTime)
+	}
+}
+
+// pruneRegistrations removes registration history which is no longer needed.
+// It must be called while a write lock is held on s.
+func (s *ServerList) pruneRegistrations(t time.Time) {
+	for ip, rh := range s.regs {
+		if !rh.prune(t, s.cfg.QuarantineWindow) {
+			delete(s.regs, ip)
+		}
+	}
 }
 
 // freeServer frees the provided server from memory. It must be called while a
@@ -1091,6 +1823,7 @@ func (s *ServerList) freeServer(x *Server) {
 			delete(s.servers3, x.AuthAddr())
 		}
 	}
+	x.history = nil
 }
 
 type serverListState int
@@ -1114,7 +1847,7 @@ func (s *ServerList) serverState(x *Server, t time.Time) serverListState {
 	}
 
 	d := t.Sub(x.LastHeartbeat)
-	if s.deadTime == 0 || d < s.deadTime {
+	if deadTime := s.serverDeadTime(x); deadTime == 0 || d < deadTime {
 		return serverListStateAlive
 	}
 	if s.ghostTime == 0 || d < s.ghostTime {
@@ -1123,6 +1856,14 @@ func (s *ServerList) serverState(x *Server, t time.Time) serverListState {
 	return serverListStateGone
 }
 
+// serverDeadTime gets the time since the last heartbeat after which x is dead.
+func (s *ServerList) serverDeadTime(x *Server) time.Duration {
+	if s.deadTime != 0 && s.cfg.PopulatedDeadTime != 0 && x.PlayerCount > 0 {
+		return s.cfg.PopulatedDeadTime
+	}
+	return s.deadTime
+}
+
 func (s *ServerList) now() time.Time {
 	if s.__clock != nil {
 		return s.__clock()
@@ -0,0 +1,689 @@
+package api0
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerListUpdateChanged(t *testing.T) {
+	sl := NewServerList(time.Second*30, time.Minute, 0, ServerListConfig{})
+
+	srv, err := sl.ServerHybridUpdatePut(nil, &Server{
+		Addr:        netip.MustParseAddrPort("10.0.0.1:37015"),
+		Name:        "test",
+		PlayerCount: 1,
+	}, ServerListLimit{})
+	if err != nil {
+		t.Fatalf("add server: %v", err)
+	}
+	sl.csGetJSON()
+
+	name, count := "test", 1
+	for _, c := range []struct {
+		Name    string
+		Update  ServerUpdate
+		Changed bool
+	}{
+		{"Heartbeat", ServerUpdate{Heartbeat: true}, false},
+		{"SameValues", ServerUpdate{Heartbeat: true, Name: &name, PlayerCount: &count}, false},
+		{"NewName", ServerUpdate{Name: ptr("test1")}, true},
+		{"NewPlayerCount", ServerUpdate{Heartbeat: true, PlayerCount: ptr(2)}, true},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			c.Update.ID = srv.ID
+			if _, err := sl.ServerHybridUpdatePut(&c.Update, nil, ServerListLimit{}); err != nil {
+				t.Fatalf("update server: %v", err)
+			}
+			if act := sl.csForce.Load(); act != c.Changed {
+				t.Errorf("expected forced update to be %t, got %t", c.Changed, act)
+			}
+			sl.csGetJSON()
+		})
+	}
+}
+
+func TestServerListFilterClientMods(t *testing.T) {
+	sl := NewServerList(0, 0, 0, ServerListConfig{})
+	for i, mods := range [][]ServerModInfo{
+		nil,
+		{{Name: "A", RequiredOnClient: true}},
+		{{Name: "A", RequiredOnClient: true}, {Name: "B", RequiredOnClient: false}},
+		{{Name: "A", RequiredOnClient: true}, {Name: "C", RequiredOnClient: true}},
+	} {
+		if _, err := sl.ServerHybridUpdatePut(nil, &Server{
+			Addr:    netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 37015),
+			Name:    strconv.Itoa(i),
+			ModInfo: mods,
+		}, ServerListLimit{}); err != nil {
+			t.Fatalf("add server: %v", err)
+		}
+	}
+	for _, c := range []struct {
+		Mods  []string
+		Names []string
+	}{
+		{nil, []string{"0", "1", "2", "3"}},
+		{[]string{}, []string{"0"}},
+		{[]string{"A"}, []string{"0", "1", "2"}},
+		{[]string{"C", "A"}, []string{"0", "1", "2", "3"}},
+		{[]string{"B", "C"}, []string{"0"}},
+	} {
+		var ss []struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(sl.csGetJSONMods(c.Mods), &ss); err != nil {
+			t.Fatalf("%q: invalid json: %v", c.Mods, err)
+		}
+		var names []string
+		for _, s := range ss {
+			names = append(names, s.Name)
+		}
+		if !slices.Equal(names, c.Names) {
+			t.Errorf("%q: expected servers %q, got %q", c.Mods, c.Names, names)
+		}
+	}
+}
+
+func TestServerListShownPlaylists(t *testing.T) {
+	sl := NewServerList(0, 0, 0, ServerListConfig{
+		ShownPlaylists: []string{"aitdm", "ctf"},
+	})
+	for i, pl := range []string{"aitdm", "ps", "ctf", ""} {
+		if _, err := sl.ServerHybridUpdatePut(nil, &Server{
+			Addr:     netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 37015),
+			Name:     pl,
+			Playlist: pl,
+		}, ServerListLimit{}); err != nil {
+			t.Fatalf("add server: %v", err)
+		}
+	}
+	if _, err := sl.ServerHybridUpdatePut(nil, &Server{
+		Addr:     netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, 4}), 37015),
+		Name:     "lobby",
+		Map:      "mp_lobby",
+		Playlist: "aitdm",
+	}, ServerListLimit{}); err != nil {
+		t.Fatalf("add server: %v", err)
+	}
+	var ss []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(sl.csGetJSON(), &ss); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	var names []string
+	for _, s := range ss {
+		names = append(names, s.Name)
+	}
+	if exp := []string{"aitdm", "ctf"}; !slices.Equal(names, exp) {
+		t.Errorf("expected servers %q, got %q", exp, names)
+	}
+
+	names = nil
+	for _, srv := range sl.FindServers(ServerQuery{}) {
+		names = append(names, srv.Name)
+	}
+	slices.Sort(names)
+	if exp := []string{"aitdm", "ctf"}; !slices.Equal(names, exp) {
+		t.Errorf("find servers: expected servers %q, got %q", exp, names)
+	}
+}
+
+func TestServerListBinary(t *testing.T) {
+	ss := []*Server{
+		{
+			ID:            "a",
+			LastHeartbeat: time.UnixMilli(1700000000123),
+			Name:          "test",
+			Region:        "EU West",
+			Description:   "description",
+			PlayerCount:   3,
+			MaxPlayers:    16,
+			Map:           "mp_glitch",
+			Playlist:      "ps",
+			ModInfo: []ServerModInfo{
+				{Name: "Mod.A", Version: "1.0.0", RequiredOnClient: true},
+				{Name: "Mod.B", Version: "2.0.0"},
+			},
+		},
+		{
+			ID:            "b",
+			LastHeartbeat: time.UnixMilli(-1),
+			Name:          "pässwörd 😀",
+			Region:        "hidden",
+			Password:      "test",
+			Description:   strings.Repeat("x", 300),
+			MaxPlayers:    128,
+		},
+		{
+			ID: "c",
+		},
+	}
+
+	type testServer struct {
+		LastHeartbeat int64  `json:"lastHeartbeat"`
+		ID            string `json:"id"`
+		Name          string `json:"name"`
+		Region        string `json:"region"`
+		Description   string `json:"description"`
+		PlayerCount   int    `json:"playerCount"`
+		MaxPlayers    int    `json:"maxPlayers"`
+		Map           string `json:"map"`
+		Playlist      string `json:"playlist"`
+		HasPassword   bool   `json:"hasPassword"`
+		ModInfo       struct {
+			Mods []struct {
+				Name             string
+				Version          string
+				RequiredOnClient bool
+			}
+		} `json:"modInfo"`
+	}
+
+	// reference decoder
+	decode := func(b []byte) ([]testServer, error) {
+		r := bytes.NewReader(b)
+		uvarint := func() int {
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				panic(err)
+			}
+			return int(v)
+		}
+		str := func() string {
+			n := uvarint()
+			if n > r.Len() {
+				panic("string too long")
+			}
+			b := make([]byte, n)
+			r.Read(b)
+			return string(b)
+		}
+		flags := func() byte {
+			x, err := r.ReadByte()
+			if err != nil {
+				panic(err)
+			}
+			return x
+		}
+		var res []testServer
+		err := func() (err error) {
+			defer func() {
+				if x := recover(); x != nil {
+					err = fmt.Errorf("decode: %v", x)
+				}
+			}()
+			var magic [4]byte
+			if _, err := io.ReadFull(r, magic[:]); err != nil || string(magic[:]) != "ATSL" {
+				return errors.New("invalid magic")
+			}
+			if v := flags(); v != csBinaryVersion {
+				return fmt.Errorf("unexpected version %d", v)
+			}
+			res = make([]testServer, uvarint())
+			for i := range res {
+				srv := &res[i]
+				srv.ID = str()
+				hb, err := binary.ReadVarint(r)
+				if err != nil {
+					panic(err)
+				}
+				srv.LastHeartbeat = hb
+				srv.HasPassword = flags()&0x01 != 0
+				srv.Name = str()
+				srv.Region = str()
+				srv.Description = str()
+				srv.PlayerCount = uvarint()
+				srv.MaxPlayers = uvarint()
+				srv.Map = str()
+				srv.Playlist = str()
+				srv.ModInfo.Mods = make([]struct {
+					Name             string
+					Version          string
+					RequiredOnClient bool
+				}, uvarint())
+				for j := range srv.ModInfo.Mods {
+					mi := &srv.ModInfo.Mods[j]
+					mi.Name = str()
+					mi.Version = str()
+					mi.RequiredOnClient = flags()&0x01 != 0
+				}
+			}
+			if r.Len() != 0 {
+				return fmt.Errorf("%d bytes of trailing garbage", r.Len())
+			}
+			return nil
+		}()
+		return res, err
+	}
+
+	for _, n := range []int{0, 1, len(ss)} {
+		act, err := decode(csBinary(ss[:n], ServerListConfig{}))
+		if err != nil {
+			t.Fatalf("%d servers: %v", n, err)
+		}
+		buf, _, _ := csJSON(ss[:n], 0, ServerListConfig{}, nil)
+		exp := []testServer{}
+		if err := json.Unmarshal(buf, &exp); err != nil {
+			t.Fatalf("%d servers: invalid json: %v", n, err)
+		}
+		if !reflect.DeepEqual(act, exp) {
+			t.Errorf("%d servers: binary doesn't match json:\n\tbinary: %+v\n\tjson:   %+v", n, act, exp)
+		}
+	}
+
+	if _, err := decode(csBinary(ss, ServerListConfig{})[:40]); err == nil {
+		t.Errorf("expected error decoding truncated server list")
+	}
+}
+
+func TestServerListQuarantine(t *testing.T) {
+	var offset time.Duration
+	sl := NewServerList(0, 0, 0, ServerListConfig{
+		QuarantineRegistrations: 2,
+		QuarantineWindow:        time.Minute,
+		QuarantineTime:          time.Minute * 5,
+	})
+	start := time.Now()
+	sl.__clock = func() time.Time {
+		return start.Add(offset)
+	}
+
+	register := func(ip string) (*Server, error) {
+		return sl.ServerHybridUpdatePut(nil, &Server{
+			Addr: netip.AddrPortFrom(netip.MustParseAddr(ip), 37015),
+			Name: "test",
+		}, ServerListLimit{})
+	}
+	expectQuarantined := func(ip string, remaining time.Duration) {
+		t.Helper()
+		_, err := register(ip)
+		if !errors.Is(err, ErrServerListQuarantined) {
+			t.Fatalf("%s: expected quarantined error, got %v", ip, err)
+		}
+		var qe ServerListQuarantinedError
+		if !errors.As(err, &qe) {
+			t.Fatalf("%s: expected error to be a ServerListQuarantinedError", ip)
+		}
+		if qe.IP != netip.MustParseAddr(ip) {
+			t.Errorf("%s: expected error ip %s, got %s", ip, ip, qe.IP)
+		}
+		if qe.Remaining != remaining {
+			t.Errorf("%s: expected %s remaining, got %s", ip, remaining, qe.Remaining)
+		}
+	}
+
+	// registrations spread out over more than the window are fine
+	for i := 0; i < 5; i++ {
+		if _, err := register("10.0.0.1"); err != nil {
+			t.Fatalf("registration %d: unexpected error: %v", i, err)
+		}
+		offset += time.Second * 31
+	}
+
+	// but more than QuarantineRegistrations within the window aren't
+	var srv *Server
+	for i := 0; i < 3; i++ {
+		var err error
+		if srv, err = register("10.0.0.2"); err != nil {
+			t.Fatalf("registration %d: unexpected error: %v", i, err)
+		}
+		offset += time.Second
+	}
+	expectQuarantined("10.0.0.2", time.Minute*5-time.Second)
+
+	// other ips aren't affected
+	if _, err := register("10.0.0.3"); err != nil {
+		t.Fatalf("other ip: unexpected error: %v", err)
+	}
+
+	// existing servers can still be updated
+	if _, err := sl.ServerHybridUpdatePut(&ServerUpdate{ID: srv.ID, Heartbeat: true}, nil, ServerListLimit{}); err != nil {
+		t.Errorf("heartbeat: unexpected error: %v", err)
+	}
+
+	offset += time.Minute * 2
+	expectQuarantined("10.0.0.2", time.Minute*3-time.Second)
+
+	// the quarantine ends after QuarantineTime
+	offset += time.Minute * 3
+	if _, err := register("10.0.0.2"); err != nil {
+		t.Fatalf("after quarantine: unexpected error: %v", err)
+	}
+
+	// the history is cleared when quarantined
+	offset += time.Second
+	if _, err := register("10.0.0.2"); err != nil {
+		t.Fatalf("after quarantine: unexpected error: %v", err)
+	}
+
+	// and old entries are pruned
+	offset += time.Minute * 10
+	sl.mu.Lock()
+	sl.pruneRegistrations(sl.now())
+	n := len(sl.regs)
+	sl.mu.Unlock()
+	if n != 0 {
+		t.Errorf("expected registration history to be pruned, got %d ips", n)
+	}
+}
+
+func TestServerListPopulatedDeadTime(t *testing.T) {
+	for _, c := range []struct {
+		Name        string
+		DeadTime    time.Duration
+		Populated   time.Duration
+		PlayerCount int
+		Expected    time.Duration
+	}{
+		{"Empty", time.Second * 30, time.Minute * 2, 0, time.Second * 30},
+		{"Populated", time.Second * 30, time.Minute * 2, 1, time.Minute * 2},
+		{"Disabled", time.Second * 30, 0, 1, time.Second * 30},
+		{"NoDeadTime", 0, time.Minute * 2, 1, 0},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			sl := NewServerList(c.DeadTime, time.Minute*5, 0, ServerListConfig{
+				PopulatedDeadTime: c.Populated,
+			})
+			if act := sl.serverDeadTime(&Server{PlayerCount: c.PlayerCount}); act != c.Expected {
+				t.Errorf("expected dead time %s, got %s", c.Expected, act)
+			}
+		})
+	}
+
+	var offset time.Duration
+	sl := NewServerList(time.Second*30, time.Minute*5, 0, ServerListConfig{
+		PopulatedDeadTime: time.Minute * 2,
+	})
+	start := time.Now()
+	sl.__clock = func() time.Time {
+		return start.Add(offset)
+	}
+
+	expectNext := func(what string, exp time.Duration) {
+		t.Helper()
+		if act := sl.csNext.Load(); act == nil || !act.Equal(start.Add(exp)) {
+			t.Errorf("%s: expected next update at +%s, got %v", what, exp, act)
+		}
+	}
+	expectAlive := func(what string, exp ...string) {
+		t.Helper()
+		var act []string
+		for _, srv := range sl.FindServers(ServerQuery{}) {
+			act = append(act, srv.Name)
+		}
+		slices.Sort(act)
+		if !slices.Equal(act, exp) {
+			t.Errorf("%s: expected live servers %q, got %q", what, exp, act)
+		}
+	}
+
+	populated, err := sl.ServerHybridUpdatePut(nil, &Server{
+		Addr:        netip.MustParseAddrPort("10.0.0.1:37015"),
+		Name:        "populated",
+		PlayerCount: 2,
+	}, ServerListLimit{})
+	if err != nil {
+		t.Fatalf("add server: %v", err)
+	}
+	expectNext("populated", time.Minute*2)
+
+	empty, err := sl.ServerHybridUpdatePut(nil, &Server{
+		Addr: netip.MustParseAddrPort("10.0.0.2:37015"),
+		Name: "empty",
+	}, ServerListLimit{})
+	if err != nil {
+		t.Fatalf("add server: %v", err)
+	}
+	expectNext("empty", time.Second*30)
+	expectAlive("initial", "empty", "populated")
+
+	// the empty one dies after the dead time, but the populated one survives
+	offset = time.Second * 45
+	expectAlive("after dead time", "populated")
+
+	// heartbeats don't change the dead time
+	if _, err := sl.ServerHybridUpdatePut(&ServerUpdate{ID: populated.ID, Heartbeat: true}, nil, ServerListLimit{}); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	expectNext("heartbeat", time.Second*30) // still the empty one
+
+	offset = time.Minute * 2
+	expectAlive("after populated dead time since the heartbeat", "populated")
+
+	// remove the other one so it doesn't affect the next update time (note:
+	// it returns false since it's already dead)
+	sl.DeleteServerByID(empty.ID)
+
+	offset = time.Minute*2 + time.Second*10
+	if _, err := sl.ServerHybridUpdatePut(&ServerUpdate{ID: populated.ID, Heartbeat: true}, nil, ServerListLimit{}); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	expectNext("heartbeat", time.Minute*4+time.Second*10)
+
+	// the server becoming empty makes it use the shorter dead time, and the
+	// next update time must be recomputed
+	if _, err := sl.ServerHybridUpdatePut(&ServerUpdate{ID: populated.ID, PlayerCount: ptr(0)}, nil, ServerListLimit{}); err != nil {
+		t.Fatalf("update player count: %v", err)
+	}
+	expectNext("now empty", time.Minute*2+time.Second*40)
+
+	offset = time.Minute*2 + time.Second*45
+	expectAlive("after empty dead time")
+
+	// and becoming populated again switches it back
+	offset = time.Minute*2 + time.Second*20
+	if _, err := sl.ServerHybridUpdatePut(&ServerUpdate{ID: populated.ID, PlayerCount: ptr(1)}, nil, ServerListLimit{}); err != nil {
+		t.Fatalf("update player count: %v", err)
+	}
+	expectNext("populated again", time.Minute*4+time.Second*10)
+
+	offset = time.Minute*2 + time.Second*45
+	expectAlive("after empty dead time while populated", "populated")
+}
+
+func TestServerListMirror(t *testing.T) {
+	sl := NewServerList(time.Second*30, time.Minute, 0, ServerListConfig{})
+	if _, err := sl.ServerHybridUpdatePut(nil, &Server{
+		Addr: netip.MustParseAddrPort("10.0.0.1:37015"),
+		Name: "registered",
+	}, ServerListLimit{}); err != nil {
+		t.Fatalf("add server: %v", err)
+	}
+
+	names := func() []string {
+		var ss []struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(sl.csGetJSON(), &ss); err != nil {
+			t.Fatalf("invalid json: %v", err)
+		}
+		var names []string
+		for _, s := range ss {
+			names = append(names, s.Name)
+		}
+		return names
+	}
+
+	now := time.Now()
+	sl.SetMirror([]*Server{
+		{ID: "b", Name: "b", LastHeartbeat: now},
+		{ID: "a", Name: "a", LastHeartbeat: now},
+		{ID: "c", Name: "dead", LastHeartbeat: now.Add(-time.Minute)},
+	})
+	if act, exp := names(), []string{"b", "a"}; !slices.Equal(act, exp) {
+		t.Errorf("expected mirrored servers %q, got %q", exp, act)
+	}
+	if sl.GetServerByID("a") != nil {
+		t.Errorf("expected mirrored servers not to be returned by GetServerByID")
+	}
+
+	sl.SetMirror(nil)
+	if act, exp := names(), []string{"registered"}; !slices.Equal(act, exp) {
+		t.Errorf("expected registered servers %q, got %q", exp, act)
+	}
+}
+
+func TestServerListLimitExceeded(t *testing.T) {
+	sl := NewServerList(0, 0, 0, ServerListConfig{})
+	l := ServerListLimit{MaxServersPerIP: 1}
+	for i := 0; i < 2; i++ {
+		_, err := sl.ServerHybridUpdatePut(nil, &Server{
+			Addr: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(37015+i)),
+			Name: strconv.Itoa(i),
+		}, l)
+		if i == 0 {
+			if err != nil {
+				t.Fatalf("add server: %v", err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrServerListLimitExceeded) {
+			t.Fatalf("expected limit exceeded error, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "(2/1)") {
+			t.Errorf("expected error to include the count and limit, got %q", err)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// benchmarkServerCounts are the server list sizes to benchmark.
+var benchmarkServerCounts = []int{10, 100, 1000, 5000}
+
+// benchmarkServerList populates a new server list with n synthetic verified
+// servers with varied names, regions, and mods.
+func benchmarkServerList(tb testing.TB, n int) *ServerList {
+	tb.Helper()
+
+	var (
+		rng       = rand.New(rand.NewSource(int64(n)))
+		regions   = []string{"", "Europe", "North America", "Asia", "South America", "Oceania"}
+		maps      = []string{"mp_forwardbase_kodai", "mp_glitch", "mp_thaw", "mp_black_water_canal", "mp_lf_stacks"}
+		playlists = []string{"aitdm", "ps", "ctf", "lts", "fd_easy", "private_match"}
+		mods      = []string{"Northstar.Client", "Northstar.Custom", "Northstar.CustomServers", "Fifty.ServerUtils", "S2.Parkour", "Karma.Abuse", "Spoon.Sauce"}
+	)
+	word := func(min, max int) string {
+		var b strings.Builder
+		for i, n := 0, min+rng.Intn(max-min+1); i < n; i++ {
+			if i != 0 {
+				b.WriteByte(' ')
+			}
+			for j, m := 0, 2+rng.Intn(8); j < m; j++ {
+				b.WriteByte(byte('a' + rng.Intn(26)))
+			}
+		}
+		return b.String()
+	}
+
+	sl := NewServerList(0, 0, 0, ServerListConfig{})
+	for i := 0; i < n; i++ {
+		srv := &Server{
+			Addr:        netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), 37015),
+			Name:        "[" + strconv.Itoa(i) + "] " + word(1, 6),
+			Region:      regions[rng.Intn(len(regions))],
+			Description: word(0, 24),
+			Map:         maps[rng.Intn(len(maps))],
+			Playlist:    playlists[rng.Intn(len(playlists))],
+			PlayerCount: rng.Intn(17),
+			MaxPlayers:  16,
+		}
+		if rng.Intn(8) == 0 {
+			srv.Password = "password"
+		}
+		for _, j := range rng.Perm(len(mods))[:rng.Intn(len(mods))] {
+			srv.ModInfo = append(srv.ModInfo, ServerModInfo{
+				Name:             mods[j],
+				Version:          strconv.Itoa(rng.Intn(3)) + "." + strconv.Itoa(rng.Intn(30)) + ".0",
+				RequiredOnClient: rng.Intn(2) == 0,
+			})
+		}
+		if _, err := sl.ServerHybridUpdatePut(nil, srv, ServerListLimit{}); err != nil {
+			tb.Fatalf("add server %d: %v", i, err)
+		}
+	}
+	return sl
+}
+
+// csForceUpdateLocked is like csForceUpdate, but takes the lock itself.
+func (s *ServerList) csForceUpdateLocked() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.csForceUpdate()
+}
+
+func BenchmarkServerListJSON(b *testing.B) {
+	for _, n := range benchmarkServerCounts {
+		b.Run("n="+strconv.Itoa(n), func(b *testing.B) {
+			sl := benchmarkServerList(b, n)
+			b.SetBytes(int64(len(sl.csGetJSON())))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sl.csForceUpdateLocked()
+				sl.csGetJSON()
+			}
+		})
+	}
+}
+
+func BenchmarkServerListJSONGzip(b *testing.B) {
+	for _, n := range benchmarkServerCounts {
+		b.Run("n="+strconv.Itoa(n), func(b *testing.B) {
+			sl := benchmarkServerList(b, n)
+			if _, ok := sl.csGetJSONGzip(); !ok {
+				b.Fatalf("failed to gzip server list")
+			}
+			b.SetBytes(int64(len(sl.csGetJSON())))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sl.csForceUpdateLocked()
+				sl.csGetJSONGzip()
+			}
+		})
+	}
+}
+
+// BenchmarkServerListJSONEstimate benchmarks csJSON itself, and reports how
+// the per-server size estimate compares to the actual size.
+func BenchmarkServerListJSONEstimate(b *testing.B) {
+	for _, n := range benchmarkServerCounts {
+		b.Run("n="+strconv.Itoa(n), func(b *testing.B) {
+			sl := benchmarkServerList(b, n)
+			ss := make([]*Server, 0, n)
+			for _, srv := range sl.servers1 {
+				ss = append(ss, srv)
+			}
+			var (
+				buf []byte
+				est int
+			)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buf, est, _ = csJSON(ss, est, sl.cfg, nil)
+			}
+			b.StopTimer()
+			b.SetBytes(int64(len(buf)))
+			b.ReportMetric(float64(len(buf))/float64(n), "actual-B/srv")
+			b.ReportMetric(float64(est), "est-B/srv")
+			b.ReportMetric(float64(cap(buf))/float64(len(buf)), "cap/len")
+		})
+	}
+}
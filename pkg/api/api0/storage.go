@@ -2,7 +2,12 @@ package api0
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
 	"net/netip"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,7 +23,9 @@ type Account struct {
 	// AuthIP is the IP used for the current auth session.
 	AuthIP netip.Addr
 
-	// AuthToken is the random token generated for the current auth session.
+	// AuthToken is the random token generated for the current auth session. If
+	// it starts with "sha256:", it is the hex-encoded hash of the token (see
+	// HashAuthToken) rather than the token itself.
 	AuthToken string
 
 	// AuthTokenExpiry is the expiry date of the current auth token.
@@ -26,12 +33,115 @@ type Account struct {
 
 	// LastServerID is the ID of the last server the account connected to.
 	LastServerID string
+
+	// Flags contains roles assigned to the account by an administrator.
+	Flags AccountFlags
+}
+
+// AccountFlags is a set of roles which can be assigned to an account.
+type AccountFlags uint64
+
+const (
+	AccountFlagTrusted AccountFlags = 1 << iota // trusted server owner
+	AccountFlagBeta                             // beta tester
+)
+
+var accountFlagNames = [...]struct {
+	Flag AccountFlags
+	Name string
+}{
+	{AccountFlagTrusted, "trusted"},
+	{AccountFlagBeta, "beta"},
+}
+
+// Has checks whether all of the provided flags are set.
+func (f AccountFlags) Has(flags AccountFlags) bool {
+	return f&flags == flags
+}
+
+// String returns a comma-separated list of flag names. Unknown flags are
+// included as a hex number.
+func (f AccountFlags) String() string {
+	var b []byte
+	for _, x := range accountFlagNames {
+		if f&x.Flag != 0 {
+			if len(b) != 0 {
+				b = append(b, ',')
+			}
+			b = append(b, x.Name...)
+			f &^= x.Flag
+		}
+	}
+	if f != 0 {
+		if len(b) != 0 {
+			b = append(b, ',')
+		}
+		b = append(b, "0x"...)
+		b = strconv.AppendUint(b, uint64(f), 16)
+	}
+	return string(b)
+}
+
+// ParseAccountFlags parses a comma-separated list of flags in the format
+// returned by AccountFlags.String.
+func ParseAccountFlags(s string) (AccountFlags, error) {
+	var f AccountFlags
+	for _, n := range strings.Split(s, ",") {
+		if n = strings.TrimSpace(n); n == "" {
+			continue
+		}
+		if x, ok := strings.CutPrefix(n, "0x"); ok {
+			v, err := strconv.ParseUint(x, 16, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid flag %q", n)
+			}
+			f |= AccountFlags(v)
+			continue
+		}
+		var found bool
+		for _, x := range accountFlagNames {
+			if x.Name == n {
+				f |= x.Flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown flag %q", n)
+		}
+	}
+	return f, nil
 }
 
 func (a Account) IsOnOwnServer() bool {
 	return a.LastServerID == "self"
 }
 
+// CheckAuthToken checks whether token matches the stored AuthToken, which may
+// be hashed. It does not check the expiry.
+func (a Account) CheckAuthToken(token string) bool {
+	if a.AuthToken == "" {
+		return false
+	}
+	if a.HasHashedAuthToken() {
+		token = HashAuthToken(token)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.AuthToken)) == 1
+}
+
+// HasHashedAuthToken checks whether AuthToken is hashed.
+func (a Account) HasHashedAuthToken() bool {
+	return strings.HasPrefix(a.AuthToken, authTokenHashPrefix)
+}
+
+const authTokenHashPrefix = "sha256:"
+
+// HashAuthToken hashes token for storage in Account.AuthToken.
+func HashAuthToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return authTokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
 // AccountStorage stores information about registered users. It must be safe
 // for concurrent use.
 type AccountStorage interface {
@@ -0,0 +1,35 @@
+package api0
+
+import "testing"
+
+func TestAccountFlags(t *testing.T) {
+	for _, c := range []struct {
+		Flags AccountFlags
+		Str   string
+	}{
+		{0, ""},
+		{AccountFlagTrusted, "trusted"},
+		{AccountFlagTrusted | AccountFlagBeta, "trusted,beta"},
+		{AccountFlagBeta | 1<<63, "beta,0x8000000000000000"},
+	} {
+		if act := c.Flags.String(); act != c.Str {
+			t.Errorf("%d: expected %q, got %q", c.Flags, c.Str, act)
+		}
+		if act, err := ParseAccountFlags(c.Str); err != nil {
+			t.Errorf("%q: unexpected error: %v", c.Str, err)
+		} else if act != c.Flags {
+			t.Errorf("%q: expected %d, got %d", c.Str, c.Flags, act)
+		}
+	}
+	if f, err := ParseAccountFlags(" beta , trusted,"); err != nil || f != AccountFlagTrusted|AccountFlagBeta {
+		t.Errorf("expected whitespace and empty flags to be ignored, got %d (err: %v)", f, err)
+	}
+	for _, s := range []string{"unknown", "trusted,0xz"} {
+		if _, err := ParseAccountFlags(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+	if !(AccountFlagTrusted | AccountFlagBeta).Has(AccountFlagBeta) || AccountFlagTrusted.Has(AccountFlagTrusted|AccountFlagBeta) {
+		t.Errorf("incorrect Has result")
+	}
+}
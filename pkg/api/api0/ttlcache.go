@@ -0,0 +1,79 @@
+package api0
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCacheMaxEntries is the maximum number of keys stored in a ttlCache. Once
+// reached, new keys are not stored until old ones expire.
+const ttlCacheMaxEntries = 1 << 16
+
+// ttlCache is a simple cache where values expire after a fixed amount of time.
+// The zero value is ready to use, but doesn't cache anything.
+type ttlCache[K comparable, V any] struct {
+	TTL time.Duration // amount of time to cache values for (zero to disable)
+
+	mu sync.Mutex
+	m  map[K]ttlCacheEntry[V]
+}
+
+type ttlCacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// Get gets the value for k if it hasn't expired at t.
+func (c *ttlCache[K, V]) Get(k K, t time.Time) (V, bool) {
+	var zero V
+	if c.TTL <= 0 {
+		return zero, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.m[k]; ok && t.Before(e.expires) {
+		return e.value, true
+	}
+	return zero, false
+}
+
+// Set sets the value for k at t.
+func (c *ttlCache[K, V]) Set(k K, v V, t time.Time) {
+	if c.TTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.m == nil {
+		c.m = map[K]ttlCacheEntry[V]{}
+	}
+	if _, ok := c.m[k]; !ok && len(c.m) >= ttlCacheMaxEntries {
+		c.prune(t)
+		if len(c.m) >= ttlCacheMaxEntries {
+			return
+		}
+	}
+	c.m[k] = ttlCacheEntry[V]{v, t.Add(c.TTL)}
+}
+
+// Delete removes the value for k.
+func (c *ttlCache[K, V]) Delete(k K) {
+	if c.TTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.m, k)
+}
+
+// prune removes expired entries. The lock must be held.
+func (c *ttlCache[K, V]) prune(t time.Time) {
+	for k, e := range c.m {
+		if !t.Before(e.expires) {
+			delete(c.m, k)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package api0
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCache(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+
+	var c ttlCache[uint64, string]
+	c.Set(1, "a", t0)
+	if _, ok := c.Get(1, t0); ok {
+		t.Fatalf("expected disabled cache not to store values")
+	}
+
+	c.TTL = time.Minute
+	c.Set(1, "a", t0)
+	if v, ok := c.Get(1, t0.Add(time.Second)); !ok || v != "a" {
+		t.Errorf("expected cached value, got %q (%t)", v, ok)
+	}
+	if _, ok := c.Get(1, t0.Add(time.Minute)); ok {
+		t.Errorf("expected value to expire")
+	}
+
+	c.Set(2, "b", t0)
+	c.Delete(2)
+	if _, ok := c.Get(2, t0); ok {
+		t.Errorf("expected deleted value to be gone")
+	}
+
+	for i := uint64(0); i < ttlCacheMaxEntries+10; i++ {
+		c.Set(100+i, "x", t0.Add(time.Hour))
+	}
+	if n := len(c.m); n > ttlCacheMaxEntries {
+		t.Errorf("expected at most %d entries, got %d", ttlCacheMaxEntries, n)
+	}
+	c.Set(3, "c", t0.Add(time.Hour*2))
+	if v, ok := c.Get(3, t0.Add(time.Hour*2)); !ok || v != "c" {
+		t.Errorf("expected expired entries to be pruned for new value, got %q (%t)", v, ok)
+	}
+}
@@ -0,0 +1,68 @@
+package api0
+
+import "sync"
+
+// uidLockShards is the number of mutexes in a uidLock. It must be a power of
+// two.
+const uidLockShards = 256
+
+// uidLock serializes operations on a single uid without serializing unrelated
+// uids (unless they share a shard). The zero value is ready to use.
+type uidLock struct {
+	mu [uidLockShards]sync.Mutex
+}
+
+// Lock locks the shard for uid, returning a function to unlock it.
+func (l *uidLock) Lock(uid uint64) (unlock func()) {
+	mu := &l.mu[uidLockShard(uid)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func uidLockShard(uid uint64) uint64 {
+	// mix the bits since uids aren't uniformly distributed (murmur3 finalizer)
+	uid ^= uid >> 33
+	uid *= 0xff51afd7ed558ccd
+	uid ^= uid >> 33
+	return uid & (uidLockShards - 1)
+}
+
+// uidFlight coalesces concurrent calls for the same uid. The zero value is
+// ready to use.
+type uidFlight[T any] struct {
+	mu    sync.Mutex
+	calls map[uint64]*uidFlightCall[T]
+}
+
+type uidFlightCall[T any] struct {
+	wg  sync.WaitGroup
+	val T
+	err error
+}
+
+// Do calls fn for uid, or if there is already a call in progress for uid, waits
+// for it and returns its result instead (with shared set to true).
+func (f *uidFlight[T]) Do(uid uint64, fn func() (T, error)) (val T, err error, shared bool) {
+	f.mu.Lock()
+	if c, ok := f.calls[uid]; ok {
+		f.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	if f.calls == nil {
+		f.calls = map[uint64]*uidFlightCall[T]{}
+	}
+	c := new(uidFlightCall[T])
+	c.wg.Add(1)
+	f.calls[uid] = c
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.calls, uid)
+		f.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
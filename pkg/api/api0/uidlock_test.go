@@ -0,0 +1,120 @@
+package api0
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUIDLock(t *testing.T) {
+	var l uidLock
+
+	const uid = 1000000000000
+	var (
+		wg    sync.WaitGroup
+		cur   atomic.Int32
+		max   atomic.Int32
+		count int // not atomic on purpose; the race detector will catch issues
+	)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				unlock := l.Lock(uid)
+				if n := cur.Add(1); n > max.Load() {
+					max.Store(n)
+				}
+				count++
+				cur.Add(-1)
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := max.Load(); n != 1 {
+		t.Errorf("expected at most one concurrent writer for the same uid, got %d", n)
+	}
+	if count != 64*100 {
+		t.Errorf("expected %d writes, got %d", 64*100, count)
+	}
+}
+
+func TestUIDLockIndependent(t *testing.T) {
+	var l uidLock
+
+	var a, b uint64
+	for a = 1; ; a++ {
+		if b = a + 1; uidLockShard(a) != uidLockShard(b) {
+			break
+		}
+	}
+
+	unlock := l.Lock(a)
+	defer unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.Lock(b)()
+	}()
+	<-done // would deadlock if unrelated uids were serialized
+}
+
+func TestUIDFlight(t *testing.T) {
+	var f uidFlight[int]
+
+	const uid = 1000000000000
+	var (
+		wg      sync.WaitGroup
+		calls   atomic.Int32
+		shared  atomic.Int32
+		release = make(chan struct{})
+		started = make(chan struct{})
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, err, sh := f.Do(uid, func() (int, error) {
+			calls.Add(1)
+			close(started)
+			<-release
+			return 1, nil
+		})
+		if v != 1 || err != nil || sh {
+			t.Errorf("leader: got %d %v %t", v, err, sh)
+		}
+	}()
+	<-started
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, sh := f.Do(uid, func() (int, error) {
+				calls.Add(1)
+				return 2, nil
+			})
+			if sh {
+				shared.Add(1)
+				if v != 1 || err != nil {
+					t.Errorf("follower: got %d %v", v, err)
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 50) // let the followers start waiting
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load() + shared.Load(); n != 17 {
+		t.Errorf("expected 17 results, got %d", n)
+	}
+	if shared.Load() == 0 {
+		t.Errorf("expected some calls to be coalesced")
+	}
+	if v, _, sh := f.Do(uid, func() (int, error) { return 3, nil }); v != 3 || sh {
+		t.Errorf("expected a new call after the previous one finished")
+	}
+}
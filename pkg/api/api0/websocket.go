@@ -0,0 +1,246 @@
+package api0
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is the magic value used to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// wsMaxClientFrame is the maximum size of a frame we'll accept from a client.
+// We don't expect clients to send us anything other than control frames.
+const wsMaxClientFrame = 4096
+
+// wsMaxControlFrame is the maximum payload size of a control frame.
+const wsMaxControlFrame = 125
+
+// WebSocket close frame payloads.
+var (
+	wsCloseProtocolError = []byte{0x03, 0xEA} // 1002
+	wsCloseTooBig        = []byte{0x03, 0xF1} // 1009
+)
+
+// wsConn is a minimal server-side RFC 6455 WebSocket connection which only
+// supports what's needed to push messages to clients. Fragmented and masked
+// outgoing messages, and extensions are not supported.
+type wsConn struct {
+	c   net.Conn
+	br  *bufio.Reader
+	wmu sync.Mutex // must be held while writing
+}
+
+// wsIsUpgrade checks if r is requesting an upgrade to a WebSocket connection.
+func wsIsUpgrade(r *http.Request) bool {
+	return wsHeaderHasToken(r.Header, "Connection", "upgrade") && wsHeaderHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// wsHandshake validates a WebSocket upgrade request, returning the value of
+// Sec-WebSocket-Accept and the first subprotocol requested by the client which
+// is in protocols (or an empty string if none matched).
+func wsHandshake(r *http.Request, protocols ...string) (accept, protocol string, err error) {
+	if r.Method != http.MethodGet {
+		return "", "", fmt.Errorf("websocket upgrade must use GET")
+	}
+	if !wsIsUpgrade(r) {
+		return "", "", fmt.Errorf("not a websocket upgrade request")
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		return "", "", fmt.Errorf("unsupported websocket version %q", v)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return "", "", fmt.Errorf("invalid websocket key")
+	}
+	for _, p := range strings.Split(strings.Join(r.Header.Values("Sec-WebSocket-Protocol"), ","), ",") {
+		p = strings.TrimSpace(p)
+		for _, x := range protocols {
+			if p == x {
+				protocol = x
+				break
+			}
+		}
+		if protocol != "" {
+			break
+		}
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:]), protocol, nil
+}
+
+// wsHijack takes over the connection for w and completes the handshake. The
+// accept and protocol values should be obtained from wsHandshake.
+func wsHijack(w http.ResponseWriter, accept, protocol string) (*wsConn, error) {
+	c, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	b.WriteString("Upgrade: websocket\r\n")
+	b.WriteString("Connection: Upgrade\r\n")
+	b.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n")
+	if protocol != "" {
+		b.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	b.WriteString("Server: Atlas\r\n")
+	b.WriteString("\r\n")
+
+	c.SetDeadline(time.Time{})
+	c.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	if _, err := brw.WriteString(b.String()); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := brw.Flush(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &wsConn{c: c, br: brw.Reader}, nil
+}
+
+// WriteMessage writes a single unfragmented message, failing if it takes
+// longer than timeout.
+func (ws *wsConn) WriteMessage(op byte, buf []byte, timeout time.Duration) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	var hdr [10]byte
+	hdr[0] = 0x80 | op // FIN
+	n := 2
+	switch {
+	case len(buf) < 126:
+		hdr[1] = byte(len(buf))
+	case len(buf) <= 0xFFFF:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(buf)))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(len(buf)))
+		n += 8
+	}
+
+	ws.c.SetWriteDeadline(time.Now().Add(timeout))
+	bufs := net.Buffers{hdr[:n], buf}
+	_, err := bufs.WriteTo(ws.c)
+	return err
+}
+
+// ReadLoop reads frames from the client until the connection is closed or an
+// error occurs, responding to pings and close frames. Data frames are
+// discarded.
+func (ws *wsConn) ReadLoop() error {
+	var hdr [8]byte
+	var mask [4]byte
+	for {
+		if _, err := io.ReadFull(ws.br, hdr[:2]); err != nil {
+			return err
+		}
+		op := hdr[0] & 0x0F
+		if hdr[0]&0x70 != 0 {
+			ws.WriteMessage(wsOpClose, wsCloseProtocolError, time.Second)
+			return fmt.Errorf("client frame has reserved bits set")
+		}
+		if hdr[1]&0x80 == 0 {
+			ws.WriteMessage(wsOpClose, wsCloseProtocolError, time.Second)
+			return fmt.Errorf("client frame is not masked")
+		}
+		if op&0x8 != 0 {
+			if hdr[0]&0x80 == 0 {
+				ws.WriteMessage(wsOpClose, wsCloseProtocolError, time.Second)
+				return fmt.Errorf("client control frame is fragmented")
+			}
+			if l := hdr[1] & 0x7F; l > wsMaxControlFrame {
+				ws.WriteMessage(wsOpClose, wsCloseProtocolError, time.Second)
+				return fmt.Errorf("client control frame too large")
+			}
+		}
+		var length uint64
+		switch l := hdr[1] & 0x7F; l {
+		case 126:
+			if _, err := io.ReadFull(ws.br, hdr[:2]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(hdr[:2]))
+		case 127:
+			if _, err := io.ReadFull(ws.br, hdr[:8]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(hdr[:8])
+		default:
+			length = uint64(l)
+		}
+		if length > wsMaxClientFrame {
+			ws.WriteMessage(wsOpClose, wsCloseTooBig, time.Second)
+			return fmt.Errorf("client frame too large (%d bytes)", length)
+		}
+		if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+			return err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case wsOpPing:
+			if err := ws.WriteMessage(wsOpPong, payload, time.Second*10); err != nil {
+				return err
+			}
+		case wsOpClose:
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			ws.WriteMessage(wsOpClose, payload, time.Second)
+			return io.EOF
+		case wsOpPong, wsOpText, wsOpBinary, wsOpContinuation:
+			// ignore
+		default:
+			ws.WriteMessage(wsOpClose, wsCloseProtocolError, time.Second)
+			return fmt.Errorf("unknown websocket opcode %#x", op)
+		}
+	}
+}
+
+// Close closes the underlying connection.
+func (ws *wsConn) Close() error {
+	if err := ws.c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func wsHeaderHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
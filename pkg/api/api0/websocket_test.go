@@ -0,0 +1,261 @@
+package api0
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWSHandshake(t *testing.T) {
+	req := func(mod func(*http.Request)) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Connection", "keep-alive, Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==") // from RFC 6455
+		if mod != nil {
+			mod(r)
+		}
+		return r
+	}
+	for _, c := range []struct {
+		Name     string
+		Request  *http.Request
+		Protocol string
+		Error    bool
+	}{
+		{"Valid", req(nil), "", false},
+		{"Method", req(func(r *http.Request) { r.Method = http.MethodPost }), "", true},
+		{"NoUpgrade", req(func(r *http.Request) { r.Header.Del("Upgrade") }), "", true},
+		{"NoConnection", req(func(r *http.Request) { r.Header.Set("Connection", "keep-alive") }), "", true},
+		{"Version", req(func(r *http.Request) { r.Header.Set("Sec-WebSocket-Version", "8") }), "", true},
+		{"NoKey", req(func(r *http.Request) { r.Header.Del("Sec-WebSocket-Key") }), "", true},
+		{"ShortKey", req(func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", "AAAA") }), "", true},
+		{"Protocol", req(func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "chat, gzip") }), "gzip", false},
+		{"ProtocolMultiple", req(func(r *http.Request) {
+			r.Header.Add("Sec-WebSocket-Protocol", "chat")
+			r.Header.Add("Sec-WebSocket-Protocol", "gzip, json")
+		}), "gzip", false},
+		{"ProtocolUnknown", req(func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "chat") }), "", false},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			accept, protocol, err := wsHandshake(c.Request, "gzip", "json")
+			if c.Error {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if exp := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; accept != exp {
+				t.Errorf("expected accept %q, got %q", exp, accept)
+			}
+			if protocol != c.Protocol {
+				t.Errorf("expected protocol %q, got %q", c.Protocol, protocol)
+			}
+		})
+	}
+}
+
+func TestWSConn(t *testing.T) {
+	done := make(chan error, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept, protocol, err := wsHandshake(r, "gzip")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ws, err := wsHijack(w, accept, protocol)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer ws.Close()
+		if err := ws.WriteMessage(wsOpText, []byte("hello"), time.Second); err != nil {
+			done <- err
+			return
+		}
+		if err := ws.WriteMessage(wsOpBinary, bytes.Repeat([]byte{'x'}, 300), time.Second); err != nil {
+			done <- err
+			return
+		}
+		done <- ws.ReadLoop()
+	}))
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err := io.WriteString(c, "GET / HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Protocol: gzip\r\n"+
+		"\r\n"); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+	if act, exp := resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; act != exp {
+		t.Errorf("expected accept %q, got %q", exp, act)
+	}
+	if act, exp := resp.Header.Get("Sec-WebSocket-Protocol"), "gzip"; act != exp {
+		t.Errorf("expected protocol %q, got %q", exp, act)
+	}
+
+	wsExpectFrame(t, br, wsOpText, []byte("hello"))
+	wsExpectFrame(t, br, wsOpBinary, bytes.Repeat([]byte{'x'}, 300))
+
+	c.Write(wsClientFrame(true, wsOpPing, []byte("ping"), true))
+	wsExpectFrame(t, br, wsOpPong, []byte("ping"))
+
+	c.Write(wsClientFrame(true, wsOpText, []byte("ignored"), true))
+	c.Write(wsClientFrame(true, wsOpClose, []byte{0x03, 0xE8, 'b', 'y', 'e'}, true))
+	wsExpectFrame(t, br, wsOpClose, []byte{0x03, 0xE8})
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("expected read loop to end with EOF, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("read loop did not exit")
+	}
+}
+
+func TestWSReadLoopInvalid(t *testing.T) {
+	for _, c := range []struct {
+		Name  string
+		Frame []byte
+		Close []byte // expected close payload
+	}{
+		{"Unmasked", wsClientFrame(true, wsOpText, []byte("test"), false), wsCloseProtocolError},
+		{"ReservedBits", func() []byte {
+			b := wsClientFrame(true, wsOpText, []byte("test"), true)
+			b[0] |= 0x40
+			return b
+		}(), wsCloseProtocolError},
+		{"TooLarge", wsClientFrame(true, wsOpBinary, make([]byte, wsMaxClientFrame+1), true), wsCloseTooBig},
+		{"ControlTooLarge", wsClientFrame(true, wsOpPing, make([]byte, wsMaxControlFrame+1), true), wsCloseProtocolError},
+		{"ControlFragmented", wsClientFrame(false, wsOpPing, []byte("ping"), true), wsCloseProtocolError},
+		{"UnknownOpcode", wsClientFrame(true, 0x3, nil, true), wsCloseProtocolError},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			sc, cc := net.Pipe()
+			defer cc.Close()
+			cc.SetDeadline(time.Now().Add(time.Second * 5))
+
+			ws := &wsConn{c: sc, br: bufio.NewReader(sc)}
+			done := make(chan error, 1)
+			go func() {
+				defer sc.Close()
+				done <- ws.ReadLoop()
+			}()
+
+			// write in the background since the frame may not be read
+			// entirely before the server responds
+			go cc.Write(c.Frame)
+
+			br := bufio.NewReader(cc)
+			wsExpectFrame(t, br, wsOpClose, c.Close)
+
+			if err := <-done; err == nil || errors.Is(err, io.EOF) {
+				t.Errorf("expected read loop to fail, got %v", err)
+			}
+		})
+	}
+}
+
+// wsClientFrame encodes a client frame, optionally masking it.
+func wsClientFrame(fin bool, op byte, payload []byte, masked bool) []byte {
+	var b []byte
+	if fin {
+		b = append(b, 0x80|op)
+	} else {
+		b = append(b, op)
+	}
+	var m byte
+	if masked {
+		m = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, m|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		b = append(b, m|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, m|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	if masked {
+		mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+		b = append(b, mask[:]...)
+		for i, x := range payload {
+			b = append(b, x^mask[i%4])
+		}
+	} else {
+		b = append(b, payload...)
+	}
+	return b
+}
+
+// wsExpectFrame reads an unmasked server frame from br and checks it.
+func wsExpectFrame(t *testing.T, br *bufio.Reader, op byte, payload []byte) {
+	t.Helper()
+
+	var hdr [8]byte
+	if _, err := io.ReadFull(br, hdr[:2]); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if hdr[0] != 0x80|op {
+		t.Fatalf("expected unfragmented frame with opcode %#x, got %#x", op, hdr[0])
+	}
+	if hdr[1]&0x80 != 0 {
+		t.Fatalf("expected server frame not to be masked")
+	}
+	var n int
+	switch l := hdr[1] & 0x7F; l {
+	case 126:
+		if _, err := io.ReadFull(br, hdr[:2]); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		n = int(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err := io.ReadFull(br, hdr[:8]); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		n = int(binary.BigEndian.Uint64(hdr[:8]))
+	default:
+		n = int(l)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if !bytes.Equal(buf, payload) {
+		t.Fatalf("expected payload %q, got %q", payload, buf)
+	}
+}
@@ -31,6 +31,26 @@ type Config struct {
 	// The addresses to listen on with TLS (comma-separated).
 	AddrTLS []string `env:"ATLAS_ADDR_HTTPS"`
 
+	// Timeouts for HTTP connections. If zero, there is no timeout. Note that
+	// the write timeout must be long enough for game server verification
+	// (ATLAS_API0_SERVERLIST_VERIFY_TIME) and player auth to complete.
+	// WebSocket connections are exempt from these once established.
+	HTTPReadHeaderTimeout time.Duration `env:"ATLAS_HTTP_READ_HEADER_TIMEOUT=10s"`
+	HTTPReadTimeout       time.Duration `env:"ATLAS_HTTP_READ_TIMEOUT=30s"`
+	HTTPWriteTimeout      time.Duration `env:"ATLAS_HTTP_WRITE_TIMEOUT=1m"`
+	HTTPIdleTimeout       time.Duration `env:"ATLAS_HTTP_IDLE_TIMEOUT=2m"`
+
+	// The maximum number of concurrent TCP connections to accept from a single
+	// IP. If zero, no limit is applied.
+	//
+	// Note that this applies to the actual TCP peer (or the client address
+	// from the PROXY protocol header if ProxyProtocol is enabled), not the
+	// client IP from Cloudflare or DevMapIP, since it is enforced before any
+	// HTTP requests are read. If you are behind a reverse proxy or Cloudflare,
+	// either leave this disabled or set it high enough to account for many
+	// clients sharing the same proxy IP.
+	HTTPMaxConnsPerIP int `env:"ATLAS_HTTP_MAX_CONNS_PER_IP"`
+
 	// The address to listen on and use to send connectionless packets. If the
 	// port is 0, a random one is chosen.
 	AddrUDP netip.AddrPort `env:"ATLAS_ADDR_UDP=:0"`
@@ -42,10 +62,52 @@ type Config struct {
 	//  - Use an IP whitelist, or client certificates with mTLS-only origin pull.
 	Cloudflare bool `env:"ATLAS_CLOUDFLARE"`
 
+	// Whether to require a PROXY protocol v2 header on incoming TCP
+	// connections, using the client address from it. This is intended for
+	// running behind L4 load balancers, and cannot be used with Cloudflare.
+	//
+	// This is not safe to use unless Atlas can only be reached via the load
+	// balancer, since the header can be trivially spoofed otherwise.
+	ProxyProtocol bool `env:"ATLAS_PROXY_PROTOCOL"`
+
+	// Comma-separated list of IPs or CIDRs of reverse proxies to trust the
+	// X-Forwarded-For header from. The client IP is the rightmost address in
+	// the header which isn't a trusted proxy. This cannot be used with
+	// Cloudflare.
+	TrustXFF []string `env:"ATLAS_TRUST_XFF"`
+
+	// Comma-separated list of IPs or CIDRs of reverse proxies or services to
+	// trust the X-Atlas-Request-Id header from, so request IDs can be
+	// propagated across services. The W3C traceparent header from them is also
+	// included in the access log. This is checked against the address of the
+	// direct peer (before X-Forwarded-For is applied).
+	TrustRequestID []string `env:"ATLAS_TRUST_REQUEST_ID"`
+
 	// Comma-separated list of case-insensitive hostnames to accept via the Host
-	// header. If not provided, all hostnames are allowed.
+	// header. If not provided, all hostnames are allowed. It is reloaded on
+	// SIGHUP if using an env file.
 	Host []string `env:"ATLAS_HOST"`
 
+	// Whether to set the X-Atlas-Instance header on all responses to identify
+	// the instance which handled the request.
+	InstanceHeader bool `env:"ATLAS_INSTANCE_HEADER"`
+
+	// The instance name to use for InstanceHeader. If not provided, the
+	// hostname is used.
+	InstanceName string `env:"ATLAS_INSTANCE_NAME"`
+
+	// Where to set security headers (X-Content-Type-Options, Referrer-Policy,
+	// and Strict-Transport-Security for TLS requests). Disable this if your
+	// reverse proxy sets them instead.
+	//  - none
+	//  - web (the website, static files, and other non-API paths)
+	//  - all (including the API)
+	SecurityHeaders string `env:"ATLAS_SECURITY_HEADERS=web"`
+
+	// The max-age for the Strict-Transport-Security header. If zero, it is not
+	// set.
+	SecurityHeadersHSTSMaxAge time.Duration `env:"ATLAS_SECURITY_HEADERS_HSTS_MAX_AGE=8760h"`
+
 	// Comma-separated list of paths to SSL server certificates to use for SSL.
 	// The .crt and .key extensions will be appended automatically. If not
 	// provided, SSL is disabled. If a path begins with @, it is treated as a
@@ -72,6 +134,16 @@ type Config struct {
 	// The minimum log level for stdout.
 	LogStdoutLevel zerolog.Level `env:"ATLAS_LOG_STDOUT_LEVEL=trace"`
 
+	// The fraction (0 to 1) of requests to log in full (including headers and
+	// a snippet of the request/response bodies) at the debug level, with
+	// tokens and passwords (in the query, headers, and JSON bodies) redacted.
+	// If zero, no requests are sampled.
+	DebugSampleRate float64 `env:"ATLAS_DEBUG_SAMPLE_RATE"`
+
+	// If nonzero, requests taking at least this long are additionally logged
+	// at the warn level.
+	SlowRequestThreshold time.Duration `env:"ATLAS_SLOW_REQUEST_THRESHOLD=0s"`
+
 	// The log file to output to, if provided. Reopened on SIGHUP.
 	LogFile string `env:"ATLAS_LOG_FILE"`
 
@@ -90,19 +162,160 @@ type Config struct {
 	// 192.168.0.0/24=1.2.3.4).
 	DevMapIP []string `env:"ATLAS_DEV_MAP_IP"`
 
+	// The file to write a JSON log of successful server registrations,
+	// updates, heartbeats, and removals to, if provided. Reopened on SIGHUP.
+	// The chmod/chown options for the main log file are also used for this.
+	API0_ServerAuditLog string `env:"ATLAS_API0_SERVER_AUDIT_LOG"`
+
 	// The maximum number of gameservers to allow. If -1, no limit is applied.
+	// This, API0_MaxServersPerIP, and API0_TrustedServerLimits are reloaded on
+	// SIGHUP if using an env file (other limits are not).
 	API0_MaxServers int `env:"ATLAS_API0_MAX_SERVERS=1000"`
 
 	// The maximum number of gameservers to allow per IP. If -1, no limit is
 	// applied.
 	API0_MaxServersPerIP int `env:"ATLAS_API0_MAX_SERVERS_PER_IP=25"`
 
+	// Comma-separated list of IPs or CIDRs with a higher maximum number of
+	// gameservers per IP, in the form cidr=n (e.g., 192.0.2.0/24=100). If n
+	// is -1, no limit is applied. This is intended for trusted community
+	// hosters running many servers from one IP.
+	API0_TrustedServerLimits []string `env:"ATLAS_API0_TRUSTED_SERVER_LIMITS"`
+
+	// The maximum number of concurrent server list WebSocket connections. If
+	// -1, no limit is applied.
+	API0_MaxServerListWebSockets int `env:"ATLAS_API0_MAX_SERVERLIST_WEBSOCKETS=1000"`
+
+	// The maximum number of concurrent server list Server-Sent Events streams.
+	// If -1, no limit is applied.
+	API0_MaxServerListSSE int `env:"ATLAS_API0_MAX_SERVERLIST_SSE=1000"`
+
+	// The minimum size in bytes of the server list response to compress. If
+	// -1, the response is always compressed if the client supports it.
+	API0_MinCompressSize int `env:"ATLAS_API0_MIN_COMPRESS_SIZE=512"`
+
+	// Content encodings which may be used to compress API responses. If
+	// explicitly set to an empty value, responses are never compressed.
+	API0_AllowedEncodings []string `env:"ATLAS_API0_ALLOWED_ENCODINGS?=gzip"`
+
+	// Whether API responses may be compressed for requests without an
+	// Accept-Encoding header.
+	API0_CompressWithoutAcceptEncoding bool `env:"ATLAS_API0_COMPRESS_WITHOUT_ACCEPT_ENCODING"`
+
+	// The maximum number of pending UDP connection authentication requests.
+	// If -1, no limit is applied.
+	API0_MaxConnectStates int `env:"ATLAS_API0_MAX_CONNECT_STATES=10000"`
+
+	// The default Retry-After duration to suggest to clients when rejecting
+	// requests due to rate limits, maintenance, or overload. If negative, no
+	// Retry-After header is sent.
+	API0_RetryAfter time.Duration `env:"ATLAS_API0_RETRY_AFTER=30s"`
+
 	// The amount of time for player masterserver auth tokens to be valid for.
 	API0_TokenExpiryTime time.Duration `env:"ATLAS_API0_TOKEN_EXPIRY_TIME=24h"`
 
+	// Whether to store a hash of player masterserver auth tokens instead of the
+	// plaintext token. Plaintext tokens (e.g., from atlas-import) are still
+	// accepted, and are hashed after the next successful auth.
+	API0_HashAuthTokens bool `env:"ATLAS_API0_HASH_AUTH_TOKENS"`
+
+	// If provided, the secret key used to issue player masterserver auth
+	// tokens which can be verified without checking the stored token. Signed
+	// tokens aren't invalidated when the player re-authenticates, and the
+	// latest one is still stored, so it remains valid until it expires even if
+	// the key is changed. Consider a shorter token expiry time.
+	API0_TokenSigningKey string `env:"ATLAS_API0_TOKEN_SIGNING_KEY" sdcreds:"load,trimspace"`
+
+	// The number of failed player masterserver auth token checks for a UID
+	// from an IP (or IPv6 /64) within the window after which further attempts
+	// for the UID from that IP are rejected until the lockout expires. Since
+	// it is per-IP, other clients can't use it to lock a player out. If zero,
+	// there is no limit.
+	API0_AuthFailLimit   int           `env:"ATLAS_API0_AUTH_FAIL_LIMIT=10"`
+	API0_AuthFailWindow  time.Duration `env:"ATLAS_API0_AUTH_FAIL_WINDOW=1m"`
+	API0_AuthFailLockout time.Duration `env:"ATLAS_API0_AUTH_FAIL_LOCKOUT=5m"`
+
+	// The number of failed stryder auths from an IP (or IPv6 /64) within the
+	// window after which further origin_auth attempts are rejected until the
+	// lockout expires. If zero, there is no limit. Note that many players may
+	// share an IP (e.g., CGNAT).
+	API0_OriginAuthFailLimit   int           `env:"ATLAS_API0_ORIGIN_AUTH_FAIL_LIMIT"`
+	API0_OriginAuthFailWindow  time.Duration `env:"ATLAS_API0_ORIGIN_AUTH_FAIL_WINDOW=1m"`
+	API0_OriginAuthFailLockout time.Duration `env:"ATLAS_API0_ORIGIN_AUTH_FAIL_LOCKOUT=5m"`
+
+	// The amount of time to cache get_username and lookup_uid results for. If
+	// zero, results are not cached.
+	API0_AccountLookupCacheTTL time.Duration `env:"ATLAS_API0_ACCOUNT_LOOKUP_CACHE_TTL=0s"`
+
 	// Don't check player masterserver auth tokens, disable stryder auth.
 	API0_InsecureDevNoCheckPlayerAuth bool `env:"ATLAS_API0_INSECURE_DEV_NO_CHECK_PLAYER_AUTH"`
 
+	// Whether to log and count disagreements between the account and pdata
+	// storage (e.g., from a partial atlas-import). This adds a pdata lookup
+	// when creating new accounts.
+	API0_CheckStorageConsistency bool `env:"ATLAS_API0_CHECK_STORAGE_CONSISTENCY"`
+
+	// Secret token for the admin API (e.g., /admin/account/flags), passed as
+	// a bearer token. If not provided, the admin API is disabled.
+	API0_AdminSecret string `env:"ATLAS_API0_ADMIN_SECRET" sdcreds:"load,trimspace"`
+
+	// The maximum length in bytes of server names and descriptions (after
+	// filtering bad words). Longer names and descriptions are truncated (or
+	// rejected if ATLAS_API0_SERVER_REJECT_OVERLONG is set). If zero, only the
+	// hard caps of 256 and 1024 bytes are applied (names and descriptions
+	// longer than those are always truncated).
+	API0_ServerNameMaxLen        int `env:"ATLAS_API0_SERVER_NAME_MAXLEN=63"`
+	API0_ServerDescriptionMaxLen int `env:"ATLAS_API0_SERVER_DESCRIPTION_MAXLEN"`
+
+	// Whether to reject game servers with a name or description longer than
+	// the configured maximum length instead of truncating it.
+	API0_ServerRejectOverlong bool `env:"ATLAS_API0_SERVER_REJECT_OVERLONG"`
+
+	// Whether to remove control and format characters (e.g., zero-width spaces
+	// and bidi overrides) from game server names and descriptions.
+	API0_ServerSanitizeText bool `env:"ATLAS_API0_SERVER_SANITIZE_TEXT"`
+
+	// The maximum size in bytes of the modinfo file sent by game servers (up to
+	// 256 KiB), and the maximum number of mods listed for a server. Servers
+	// over the limits have the mod list truncated (or the modinfo ignored if
+	// it's too large), or are rejected if ATLAS_API0_SERVER_REJECT_MODINFO_LIMIT
+	// is set. If zero, only the hard cap on the modinfo size is applied.
+	API0_ServerModInfoMaxSize int `env:"ATLAS_API0_SERVER_MODINFO_MAXSIZE"`
+	API0_ServerModsMax        int `env:"ATLAS_API0_SERVER_MODS_MAX"`
+
+	// Whether to reject game servers exceeding the modinfo size or mod count
+	// limits instead of truncating the mod list.
+	API0_ServerRejectModInfoLimit bool `env:"ATLAS_API0_SERVER_REJECT_MODINFO_LIMIT"`
+
+	// If provided, the path to a file containing regular expressions (one per
+	// line, with blank lines and lines starting with # ignored) matching game
+	// server names to reject. It is reloaded on SIGHUP.
+	API0_ServerNameBlock string `env:"ATLAS_API0_SERVER_NAME_BLOCK"`
+
+	// Comma-separated case-insensitive lists of mod names which game servers
+	// are or aren't allowed to mark as required on the client. If the allow
+	// list is non-empty, only those mods can be required. Mods which aren't
+	// allowed are still listed, but not as required.
+	API0_RequiredMods_Allow []string `env:"ATLAS_API0_REQUIRED_MODS_ALLOW"`
+	API0_RequiredMods_Deny  []string `env:"ATLAS_API0_REQUIRED_MODS_DENY"`
+
+	// If set, game servers must be running the mod with this name
+	// (case-insensitive) to be listed.
+	API0_RequireMod string `env:"ATLAS_API0_REQUIRE_MOD"`
+
+	// If set along with API0_RequireMod, the minimum semver version of the mod
+	// game servers must be running.
+	API0_RequireModMinVersion string `env:"ATLAS_API0_REQUIRE_MOD_MIN_VERSION"`
+
+	// Comma-separated list of playlist=max expected player counts. Game servers
+	// advertising more players than this are logged and counted in metrics,
+	// but are still listed. Playlists must be known to Atlas.
+	API0_PlaylistPlayerCaps []string `env:"ATLAS_API0_PLAYLIST_PLAYER_CAPS"`
+
+	// Whether to reject game servers using a map or playlist not known to
+	// Atlas.
+	API0_RejectUnknownMapsPlaylists bool `env:"ATLAS_API0_REJECT_UNKNOWN_MAPS_PLAYLISTS"`
+
 	// Whether to allow games to register via IPv6. Not recommended.
 	API0_AllowGameServerIPv6 bool `env:"ATLAS_API0_ALLOW_GAME_SERVER_IPV6"`
 
@@ -128,6 +341,16 @@ type Config struct {
 	// Region mapping overrides. Comma-separated list of prefix=region.
 	API0_RegionMap_Override []string `env:"ATLAS_API0_REGION_MAP_OVERRIDE"`
 
+	// If provided, the path to a file containing additional region mapping
+	// overrides, one prefix=region per line (blank lines and lines starting
+	// with # are ignored). It takes precedence over API0_RegionMap_Override,
+	// and is reloaded on SIGHUP.
+	API0_RegionMap_OverrideFile string `env:"ATLAS_API0_REGION_MAP_OVERRIDE_FILE"`
+
+	// Region to assign to game servers if a region could not be determined.
+	// Has no effect if region maps or IP2Location are disabled.
+	API0_RegionFallback string `env:"ATLAS_API0_REGION_FALLBACK"`
+
 	// The time after registration for a gameserver to complete verification by.
 	API0_ServerList_VerifyTime time.Duration `env:"ATLAS_API0_SERVERLIST_VERIFY_TIME=10s"`
 
@@ -135,10 +358,77 @@ type Config struct {
 	// dead.
 	API0_ServerList_DeadTime time.Duration `env:"ATLAS_API0_SERVERLIST_DEAD_TIME=30s"`
 
+	// If nonzero, the time since the last heartbeat for a gameserver which had
+	// players as of its last update to be marked as dead. It must not be
+	// greater than the ghost time.
+	API0_ServerList_PopulatedDeadTime time.Duration `env:"ATLAS_API0_SERVERLIST_POPULATED_DEAD_TIME=0s"`
+
+	// Comma-separated list of playlists to show on the server list. If set,
+	// servers running other playlists are hidden from the server list (but
+	// can still register). If unset, all servers are shown.
+	API0_ServerList_ShownPlaylists []string `env:"ATLAS_API0_SERVERLIST_SHOWN_PLAYLISTS"`
+
+	// The gzip compression level (-2 for huffman-only, 1 for fastest, 9 for
+	// best compression) for the server list. If zero, the default level is
+	// used.
+	API0_ServerList_GzipLevel int `env:"ATLAS_API0_SERVERLIST_GZIP_LEVEL"`
+
+	// If provided, the /client/servers URL of an upstream masterserver to
+	// mirror the server list from. Game servers cannot register with a mirror,
+	// so it is only useful for offloading server list requests.
+	API0_ServerList_MirrorURL string `env:"ATLAS_API0_SERVERLIST_MIRROR_URL"`
+
+	// The interval at which to update the mirrored server list. Mirrored
+	// servers are treated as having sent a heartbeat when they were last
+	// fetched, so the dead time should be longer than this.
+	API0_ServerList_MirrorInterval time.Duration `env:"ATLAS_API0_SERVERLIST_MIRROR_INTERVAL=5s"`
+
 	// The time since the last heartbeat for a gameserver to be discarded (i.e.,
 	// it can't be added again without re-verifying).
 	API0_ServerList_GhostTime time.Duration `env:"ATLAS_API0_SERVERLIST_GHOST_TIME=2m"`
 
+	// The number of player count changes to keep for each server (exposed via
+	// /server/history). If zero, player count history is disabled.
+	API0_ServerList_PlayerCountHistory int `env:"ATLAS_API0_SERVERLIST_PLAYER_COUNT_HISTORY"`
+
+	// Comma-separated list of IPs or CIDRs which gameservers can register
+	// from without being verified. This is intended for trusted hosts or for
+	// local testing (e.g., alongside DevMapIP).
+	API0_ServerList_VerifySkipCIDRs []string `env:"ATLAS_API0_SERVERLIST_VERIFY_SKIP_CIDRS"`
+
+	// The maximum number of gameserver verifications to run at once.
+	// Registrations exceeding this wait for a slot until their verification
+	// deadline. This protects atlas during mass server restarts. If zero, no
+	// limit is applied.
+	API0_ServerList_MaxConcurrentVerifications int `env:"ATLAS_API0_SERVERLIST_MAX_CONCURRENT_VERIFICATIONS"`
+
+	// The amount of time to remember successful gameserver verifications for.
+	// Servers re-registering with the same game and auth ports within this
+	// window skip verification. If zero, servers are always verified.
+	API0_ServerList_VerifyDedupTTL time.Duration `env:"ATLAS_API0_SERVERLIST_VERIFY_DEDUP_TTL=0s"`
+
+	// If an IP registers new gameservers more than this many times within the
+	// window, further registrations from it are refused for the quarantine
+	// time. This is intended to protect the server list from servers
+	// rapidly re-registering due to network issues. If zero, servers are not
+	// quarantined.
+	API0_ServerList_QuarantineRegistrations int           `env:"ATLAS_API0_SERVERLIST_QUARANTINE_REGISTRATIONS"`
+	API0_ServerList_QuarantineWindow        time.Duration `env:"ATLAS_API0_SERVERLIST_QUARANTINE_WINDOW=5m"`
+	API0_ServerList_QuarantineTime          time.Duration `env:"ATLAS_API0_SERVERLIST_QUARANTINE_TIME=10m"`
+
+	// Whether ghost servers revived by a heartbeat must be verified again
+	// before being listed. This adds latency to revival.
+	API0_ServerList_ReverifyRevived bool `env:"ATLAS_API0_SERVERLIST_REVERIFY_REVIVED"`
+
+	// Path to a JSON file containing an array of rules for pinning featured
+	// servers to the top of the server list. Each rule is an object with a
+	// priority and any of an id, a name regexp, and a registration IP prefix,
+	// all of which must match. The priority of the first matching rule is
+	// used, and servers with a higher priority are listed first. If empty, no
+	// servers are featured and the list is in insertion order. The file is
+	// reloaded on SIGHUP.
+	API0_ServerList_Featured string `env:"ATLAS_API0_SERVERLIST_FEATURED"`
+
 	// Experimental option to use deterministic server ID generation based on
 	// the provided secret and the server info. The secret is used to prevent
 	// brute-forcing server IDs from the ID and known server info. If it begins
@@ -147,19 +437,71 @@ type Config struct {
 
 	// The storage to use for accounts:
 	//  - memory
+	//  - memory:max=N (refuse to create more than N accounts; this is a safety
+	//    valve for accidental production use, not an eviction policy)
 	//  - sqlite3:/path/to/atlas.db
 	API0_Storage_Accounts string `env:"ATLAS_API0_STORAGE_ACCOUNTS=memory"`
 
+	// If provided, a read-only replica of the account storage to use for
+	// read-only lookups (username and uid lookups), while auth and everything
+	// else which updates accounts still uses API0_Storage_Accounts:
+	//  - sqlite3:/path/to/atlas-replica.db
+	//
+	// Lookups may be slightly stale. Accounts not found in the replica are read
+	// from the primary.
+	API0_Storage_AccountsReplica string `env:"ATLAS_API0_STORAGE_ACCOUNTS_REPLICA"`
+
 	// The storage to use for pdata:
 	//  - memory:compress
+	//  - memory:compress,max=10000,maxbytes=104857600
 	//  - sqlite3:/path/to/pdata.db
+	//
+	// For memory, max and maxbytes limit the number of players and the total
+	// stored size, evicting the least recently used pdata. Since memory storage
+	// isn't persisted, evicted pdata is lost.
 	API0_Storage_Pdata string `env:"ATLAS_API0_STORAGE_PDATA=memory:compress"`
 
+	// The overall deadline for requests which depend on external services
+	// (origin auth and auth with server). If zero, no additional deadline is
+	// applied.
+	API0_RequestTimeout time.Duration `env:"ATLAS_API0_REQUEST_TIMEOUT=15s"`
+
+	// The path to a pdata file to use for players without any stored pdata
+	// instead of the built-in default.
+	API0_DefaultPdata string `env:"ATLAS_API0_DEFAULT_PDATA"`
+
+	// If non-zero, log a warning when the stored size of a player's pdata
+	// exceeds this many bytes. For reference, compressed pdata is usually
+	// under 2200 bytes.
+	API0_PdataWarnSize int `env:"ATLAS_API0_PDATA_WARN_SIZE"`
+
+	// The storage to use for server lifecycle events (registration,
+	// verification, revival, removal, expiry) for analytics. Events are
+	// written asynchronously, and are dropped if the storage can't keep up.
+	//  - none
+	//  - sqlite3:/path/to/events.db
+	API0_Storage_ServerEvents string `env:"ATLAS_API0_STORAGE_SERVER_EVENTS=none"`
+
+	// If provided, the path to a UTF-8 text file containing a message of the
+	// day to include in auth responses. It is reloaded on SIGHUP.
+	API0_MOTD string `env:"ATLAS_API0_MOTD"`
+
 	// The source to use for mainmenupromos:
 	//  - none
 	//  - file:/path/to/mainmenupromos.json
 	API0_MainMenuPromos string `env:"ATLAS_API0_MAINMENUPROMOS=none"`
 
+	// Comma-separated list of min..max=/path/to/mainmenupromos.json to use
+	// instead of API0_MainMenuPromos for clients with a launcher version at
+	// least min and less than max (either may be omitted). The first matching
+	// range is used. Clients without a valid launcher version get the default.
+	API0_MainMenuPromos_Versions []string `env:"ATLAS_API0_MAINMENUPROMOS_VERSIONS"`
+
+	// If provided, the min..max (inclusive) range of image indices supported
+	// by clients. Mainmenupromos with button image indices outside of this
+	// range are rejected when loaded at startup.
+	API0_MainMenuPromos_ImageIndexRange string `env:"ATLAS_API0_MAINMENUPROMOS_IMAGE_INDEX_RANGE"`
+
 	// If provided, the mainmenupromos will be merged with the provided source
 	// (same syntax as API0_MAINEMENUPROMOS) if the client is older than the
 	// API0_MinimumLauncherVersion.
@@ -172,6 +514,7 @@ type Config struct {
 	//  - stryder (get the username from Stryder)
 	//  - stryder-eax (get the username from Stryder, but fall back to EAX on failure)
 	//  - stryder-eax-debug (get the username from Stryder, but also check EAX and warn if it's different)
+	//  - auto (get the username from whichever of Stryder or EAX has been more reliable recently, falling back to the other)
 	UsernameSource string `env:"ATLAS_USERNAMESOURCE"`
 
 	// Override the EAX EA App version. If specified, updates will not be
@@ -186,19 +529,58 @@ type Config struct {
 	// updates.
 	EAXUpdateBucket int `env:"EAX_UPDATE_BUCKET=0"`
 
-	// Secret token for accessing internal metrics. If it begins with @, it is
-	// treated as the name of a systemd credential to load.
+	// EAXSelfTestUID is the UID of an existing account to periodically look up
+	// using the EAX API to check if username lookups are working. If it fails,
+	// the EA App version is updated. The result is exposed as the
+	// atlas_origin_auth_healthy metric. If zero, the self-test is disabled.
+	EAXSelfTestUID uint64 `env:"EAX_SELF_TEST_UID"`
+
+	// EAXSelfTestInterval is the interval at which to do the EAX self-test.
+	EAXSelfTestInterval time.Duration `env:"EAX_SELF_TEST_INTERVAL=15m"`
+
+	// Secret token for accessing internal metrics and server connection
+	// details (/debug/server?id=). If it begins with @, it is treated as the
+	// name of a systemd credential to load.
 	MetricsSecret string `env:"ATLAS_METRICS_SECRET" sdcreds:"load,trimspace"`
 
+	// The amount of time to reuse the rendered /metrics output for. This
+	// reduces CPU usage from misconfigured scrapers. If zero, metrics are
+	// rendered for every request.
+	MetricsCacheTime time.Duration `env:"ATLAS_METRICS_CACHE_TIME=0s"`
+
+	// If provided, the Prometheus Pushgateway URL (including the job, e.g.,
+	// http://pushgateway:9091/metrics/job/atlas/instance/atlas1) to
+	// periodically push internal metrics to. If it begins with @, it is
+	// treated as the name of a systemd credential to load.
+	MetricsPushURL string `env:"ATLAS_METRICS_PUSH_URL" sdcreds:"load,trimspace"`
+
+	// The interval at which to push metrics to MetricsPushURL.
+	MetricsPushInterval time.Duration `env:"ATLAS_METRICS_PUSH_INTERVAL=30s"`
+
 	// The path to use for static website files. If a file named redirects.json
 	// exists, it is read at startup, reloaded on SIGHUP, and used as a mapping
 	// of top-level names to URLs. Custom error pages can be named
 	// {status}.html.
 	Web string `env:"ATLAS_WEB"`
 
+	// Whether to serve pre-compressed {file}.br and {file}.gz static website
+	// files instead of {file} if they exist and the client supports it.
+	WebPrecompressed bool `env:"ATLAS_WEB_PRECOMPRESSED"`
+
+	// If Web is not set, the URL to redirect / to instead of responding with
+	// RootMessage.
+	RootRedirect string `env:"ATLAS_ROOT_REDIRECT"`
+
+	// If Web is not set, the message to respond to / with.
+	RootMessage string `env:"ATLAS_ROOT_MESSAGE=Go away."`
+
 	// For the Funny:tm:
 	AllowJokes bool `env:"ATLAS_JOKES"`
 
+	// Whether to uwuify server names on April 1 if AllowJokes is set. This
+	// can be disabled to keep other jokes without mangling server names.
+	AllowJokesUwuify bool `env:"ATLAS_JOKES_UWUIFY=true"`
+
 	// The path to the IP2Location database, which should contain at least the
 	// country and region fields. The database must not be modified while atlas
 	// is running, but it can be replaced (and a reload can be triggered with
@@ -207,6 +589,19 @@ type Config struct {
 	// info, geo metrics will be disabled too.
 	IP2Location string `env:"ATLAS_IP2LOCATION"`
 
+	// The paths to IP2Location databases to use for IPv4 and IPv6 addresses
+	// respectively instead of IP2Location. This can be used if there are
+	// separate databases for each address family, or to use a different
+	// database for one of them. These have the same requirements as
+	// IP2Location, and are also reloaded on SIGHUP.
+	IP2Location_IPv4 string `env:"ATLAS_IP2LOCATION_IPV4"`
+	IP2Location_IPv6 string `env:"ATLAS_IP2LOCATION_IPV6"`
+
+	// The maximum amount of time to wait for an IP2Location lookup during
+	// game server registration before registering it without a region. If
+	// zero, there is no limit.
+	IP2Location_Timeout time.Duration `env:"ATLAS_IP2LOCATION_TIMEOUT=0s"`
+
 	// For sd-notify.
 	NotifySocket string `env:"NOTIFY_SOCKET"`
 
@@ -273,6 +668,14 @@ func (c *Config) UnmarshalEnv(es []string, incremental bool) error {
 			} else {
 				return fmt.Errorf("env %s (%T): parse %q: %w", key, cvf.Interface(), val, err)
 			}
+		case uint, uint8, uint16, uint32, uint64:
+			if val == "" {
+				cvf.SetUint(0)
+			} else if v, err := strconv.ParseUint(val, 10, 64); err == nil {
+				cvf.SetUint(v)
+			} else {
+				return fmt.Errorf("env %s (%T): parse %q: %w", key, cvf.Interface(), val, err)
+			}
 		case bool:
 			if val == "" {
 				cvf.SetBool(false)
@@ -287,6 +690,14 @@ func (c *Config) UnmarshalEnv(es []string, incremental bool) error {
 			} else {
 				cvf.Set(reflect.ValueOf(strings.Split(val, ",")))
 			}
+		case float64:
+			if val == "" {
+				cvf.SetFloat(0)
+			} else if v, err := strconv.ParseFloat(val, 64); err == nil {
+				cvf.SetFloat(v)
+			} else {
+				return fmt.Errorf("env %s (%T): parse %q: %w", key, cvf.Interface(), val, err)
+			}
 		case zerolog.Level:
 			if v, err := zerolog.ParseLevel(val); err == nil {
 				cvf.Set(reflect.ValueOf(v))
@@ -2,6 +2,7 @@ package atlas
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -12,22 +13,29 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/pg9182/ip2x"
 	"github.com/r2northstar/atlas/db/atlasdb"
+	"github.com/r2northstar/atlas/db/eventsdb"
 	"github.com/r2northstar/atlas/db/pdatadb"
 	"github.com/r2northstar/atlas/pkg/api/api0"
 	"github.com/r2northstar/atlas/pkg/cloudflare"
 	"github.com/r2northstar/atlas/pkg/eax"
 	"github.com/r2northstar/atlas/pkg/memstore"
 	"github.com/r2northstar/atlas/pkg/nspkt"
+	"github.com/r2northstar/atlas/pkg/nstypes"
+	"github.com/r2northstar/atlas/pkg/pdata"
 	"github.com/r2northstar/atlas/pkg/regionmap"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
@@ -40,17 +48,40 @@ type Server struct {
 	Addr          []string
 	AddrTLS       []string
 	AddrUDP       netip.AddrPort
+	HTTPTimeout   struct{ ReadHeader, Read, Write, Idle time.Duration }
+	MaxConnsPerIP int
+	EAXSelfTest   struct {
+		UID      uint64
+		Interval time.Duration
+	}
+	MetricsPush struct {
+		URL      string
+		Interval time.Duration
+	}
+	ServerListMirror struct {
+		URL      string
+		Interval time.Duration
+	}
+	ProxyProtocol bool
 	Handler       http.Handler
 	Web           http.Handler
 	Redirects     map[string]string
+	RootRedirect  string
+	RootMessage   string
 	NotifySocket  string
 	MetricsSecret string
+	MetricsCache  time.Duration
 	API0          *api0.Handler
 	Middleware    []func(http.Handler) http.Handler
 	TLSConfig     *tls.Config
 
-	reload []func()
-	closed bool
+	reload       []func()
+	reloadConfig []func(*Config) error // for the hot-reloadable subset of the config
+	closed       bool
+
+	metricsCacheMu  sync.Mutex
+	metricsCacheBuf [2][2][]byte    // [internal][geo]
+	metricsCacheExp [2][2]time.Time // [internal][geo]
 }
 
 // NewServer configures a new server using c, which is assumed to be initialized
@@ -66,6 +97,13 @@ func NewServer(c *Config) (*Server, error) {
 	if c.API0_MinimumLauncherVersionServer != "" && !semver.IsValid("v"+strings.TrimPrefix(c.API0_MinimumLauncherVersionServer, "v")) {
 		return nil, fmt.Errorf("invalid minimum launcher server version semver %q", c.API0_MinimumLauncherVersionServer)
 	}
+	if c.API0_RequireModMinVersion != "" && c.API0_RequireMod == "" {
+		return nil, fmt.Errorf("required mod min version set without a required mod")
+	}
+
+	if c.HTTPWriteTimeout > 0 && c.HTTPWriteTimeout <= c.API0_ServerList_VerifyTime {
+		return nil, fmt.Errorf("http write timeout (%s) must be longer than the server verification time (%s)", c.HTTPWriteTimeout, c.API0_ServerList_VerifyTime)
+	}
 
 	var s Server
 	var success bool
@@ -73,9 +111,45 @@ func NewServer(c *Config) (*Server, error) {
 	s.Addr = c.Addr
 	s.AddrTLS = c.AddrTLS
 	s.AddrUDP = c.AddrUDP
+	s.HTTPTimeout.ReadHeader = c.HTTPReadHeaderTimeout
+	s.HTTPTimeout.Read = c.HTTPReadTimeout
+	s.HTTPTimeout.Write = c.HTTPWriteTimeout
+	s.HTTPTimeout.Idle = c.HTTPIdleTimeout
+	s.MaxConnsPerIP = c.HTTPMaxConnsPerIP
+	s.ProxyProtocol = c.ProxyProtocol
+	s.EAXSelfTest.UID = c.EAXSelfTestUID
+	s.EAXSelfTest.Interval = c.EAXSelfTestInterval
+	s.MetricsPush.URL = c.MetricsPushURL
+	s.MetricsPush.Interval = c.MetricsPushInterval
+	s.ServerListMirror.URL = c.API0_ServerList_MirrorURL
+	s.ServerListMirror.Interval = c.API0_ServerList_MirrorInterval
+
+	if v := s.ServerListMirror.URL; v != "" {
+		if u, err := url.Parse(v); err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("invalid server list mirror url %q: must be an absolute url", v)
+		}
+		if s.ServerListMirror.Interval <= 0 {
+			return nil, fmt.Errorf("server list mirror interval must be positive")
+		}
+	}
+
+	if c.ProxyProtocol && c.Cloudflare {
+		return nil, fmt.Errorf("proxy protocol cannot be used with cloudflare")
+	}
+	if len(c.TrustXFF) != 0 && c.Cloudflare {
+		return nil, fmt.Errorf("x-forwarded-for cannot be used with cloudflare")
+	}
 
 	s.NotifySocket = c.NotifySocket
 
+	s.RootRedirect = c.RootRedirect
+	s.RootMessage = c.RootMessage
+	if v := s.RootRedirect; v != "" {
+		if u, err := url.Parse(v); err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("invalid root redirect %q: must be an absolute url", v)
+		}
+	}
+
 	if c.Web != "" {
 		if p, err := filepath.Abs(c.Web); err == nil {
 			var redirects sync.Map
@@ -139,8 +213,12 @@ func NewServer(c *Config) (*Server, error) {
 			}
 			s.reload = append(s.reload, reload)
 
+			var fs http.Handler = http.FileServer(http.Dir(c.Web))
+			if c.WebPrecompressed {
+				fs = precompressedFileServer(http.Dir(c.Web), fs)
+			}
 			fsrv := &statusInterceptor{
-				Handler: http.FileServer(http.Dir(c.Web)),
+				Handler: fs,
 				Error: func(s int) http.Handler {
 					switch s {
 					case http.StatusNotFound, http.StatusInternalServerError, http.StatusForbidden:
@@ -205,15 +283,68 @@ func NewServer(c *Config) (*Server, error) {
 		m.Add(fn)
 	}
 
+	if len(c.TrustRequestID) != 0 {
+		pfxs, err := parsePrefixes(c.TrustRequestID)
+		if err != nil {
+			return nil, fmt.Errorf("parse trusted request id proxies: %w", err)
+		}
+		m.Add(trustRequestID(pfxs))
+	}
+
 	m.Add(hlog.RequestIDHandler("", "X-Atlas-Request-Id"))
 
-	if len(c.Host) != 0 {
-		ns := map[string]struct{}{}
-		for _, n := range c.Host {
-			ns[strings.ToLower(n)] = struct{}{}
+	if c.InstanceHeader {
+		name := c.InstanceName
+		if name == "" {
+			if hn, err := os.Hostname(); err == nil {
+				name = hn
+			} else {
+				return nil, fmt.Errorf("initialize instance header: get hostname: %w", err)
+			}
+		}
+		m.Add(func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Atlas-Instance", name)
+				h.ServeHTTP(w, r)
+			})
+		})
+	}
+
+	var webSecurityHeaders bool
+	switch c.SecurityHeaders {
+	case "none":
+	case "web":
+		webSecurityHeaders = true
+	case "all":
+		m.Add(securityHeaders(c.SecurityHeadersHSTSMaxAge))
+	default:
+		return nil, fmt.Errorf("invalid security headers mode %q", c.SecurityHeaders)
+	}
+
+	{
+		var hosts atomic.Pointer[map[string]struct{}] // nil to allow all
+		configureHosts := func(c *Config) error {
+			if len(c.Host) == 0 {
+				hosts.Store(nil)
+				return nil
+			}
+			ns := map[string]struct{}{}
+			for _, n := range c.Host {
+				ns[strings.ToLower(n)] = struct{}{}
+			}
+			hosts.Store(&ns)
+			return nil
 		}
+		configureHosts(c)
+		s.reloadConfig = append(s.reloadConfig, configureHosts)
+
 		m.Add(func(h http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ns := hosts.Load()
+				if ns == nil {
+					h.ServeHTTP(w, r)
+					return
+				}
 				x := []byte(r.Host)
 				for i := len(x) - 1; i >= 0; i-- {
 					xc := x[i]
@@ -224,7 +355,7 @@ func NewServer(c *Config) (*Server, error) {
 						break
 					}
 				}
-				if _, ok := ns[strings.ToLower(string(x))]; ok {
+				if _, ok := (*ns)[strings.ToLower(string(x))]; ok {
 					h.ServeHTTP(w, r)
 					return
 				}
@@ -250,11 +381,34 @@ func NewServer(c *Config) (*Server, error) {
 		}))
 	}
 
+	if len(c.TrustXFF) != 0 {
+		pfxs, err := parsePrefixes(c.TrustXFF)
+		if err != nil {
+			return nil, fmt.Errorf("parse trusted x-forwarded-for proxies: %w", err)
+		}
+		m.Add(realIPXFF(pfxs, func(r *http.Request, err error) {
+			e := s.Logger.Warn()
+			if rid, ok := hlog.IDFromRequest(r); ok {
+				e = e.Stringer("rid", rid)
+			}
+			e.
+				Err(err).
+				Str("component", "http").
+				Str("request_ip", r.RemoteAddr).
+				Msg("use x-forwarded-for ip")
+		}))
+	}
+
 	m.Add(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
 		e := s.Logger.Info()
 		if rid, ok := hlog.IDFromRequest(r); ok {
 			e = e.Stringer("rid", rid)
 		}
+		if len(c.TrustRequestID) != 0 {
+			if v := r.Header.Get("traceparent"); v != "" {
+				e = e.Str("traceparent", v)
+			}
+		}
 		e.
 			Str("request_ip", r.RemoteAddr).
 			Str("request_host", r.Host).
@@ -265,24 +419,152 @@ func NewServer(c *Config) (*Server, error) {
 			Int("response_size", size).
 			Dur("response_duration", duration).
 			Msg("handle request")
+
+		if c.SlowRequestThreshold > 0 && duration >= c.SlowRequestThreshold {
+			e := s.Logger.Warn()
+			if rid, ok := hlog.IDFromRequest(r); ok {
+				e = e.Stringer("rid", rid)
+			}
+			e.
+				Str("request_method", r.Method).
+				Str("request_path", r.URL.Path).
+				Int("response_status", status).
+				Dur("response_duration", duration).
+				Dur("threshold", c.SlowRequestThreshold).
+				Msg("slow request")
+		}
 	}))
 
+	if c.DebugSampleRate > 0 {
+		m.Add(debugSampler(s.Logger, c.DebugSampleRate))
+	}
+
 	m.Add(hlog.NewHandler(s.Logger.With().Str("component", "api0").Logger()))
 	m.Add(hlog.RequestIDHandler("rid", ""))
 
+	if lvl := c.API0_ServerList_GzipLevel; lvl < gzip.HuffmanOnly || lvl > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid server list gzip level %d", lvl)
+	}
+
+	onServerEvent, err := configureServerEvents(c, s.Logger.With().Str("component", "server_events").Logger())
+	if err != nil {
+		return nil, fmt.Errorf("initialize server event storage: %w", err)
+	}
+
 	s.API0 = &api0.Handler{
 		NSPkt: nspkt.NewListener(),
 		ServerList: api0.NewServerList(c.API0_ServerList_DeadTime, c.API0_ServerList_GhostTime, c.API0_ServerList_VerifyTime, api0.ServerListConfig{
 			ExperimentalDeterministicServerIDSecret: c.API0_ServerList_ExperimentalDeterministicServerIDSecret,
-			AllowUwuify:                             c.AllowJokes,
+			AllowUwuify:                             c.AllowJokes && c.AllowJokesUwuify,
+			PlayerCountHistory:                      c.API0_ServerList_PlayerCountHistory,
+			QuarantineRegistrations:                 c.API0_ServerList_QuarantineRegistrations,
+			QuarantineWindow:                        c.API0_ServerList_QuarantineWindow,
+			QuarantineTime:                          c.API0_ServerList_QuarantineTime,
+			ReverifyRevived:                         c.API0_ServerList_ReverifyRevived,
+			PopulatedDeadTime:                       c.API0_ServerList_PopulatedDeadTime,
+			ShownPlaylists:                          configureShownPlaylists(c),
+			GzipLevel:                               c.API0_ServerList_GzipLevel,
+			OnEvent:                                 onServerEvent,
 		}),
-		MaxServers:                   c.API0_MaxServers,
-		MaxServersPerIP:              c.API0_MaxServersPerIP,
-		InsecureDevNoCheckPlayerAuth: c.API0_InsecureDevNoCheckPlayerAuth,
-		MinimumLauncherVersionClient: c.API0_MinimumLauncherVersionClient,
-		MinimumLauncherVersionServer: c.API0_MinimumLauncherVersionServer,
-		TokenExpiryTime:              c.API0_TokenExpiryTime,
-		AllowGameServerIPv6:          c.API0_AllowGameServerIPv6,
+		MaxServers:                      c.API0_MaxServers,
+		MaxServersPerIP:                 c.API0_MaxServersPerIP,
+		MaxServerListWebSockets:         c.API0_MaxServerListWebSockets,
+		MaxServerListSSE:                c.API0_MaxServerListSSE,
+		MinCompressSize:                 c.API0_MinCompressSize,
+		AllowedEncodings:                c.API0_AllowedEncodings,
+		CompressWithoutAcceptEncoding:   c.API0_CompressWithoutAcceptEncoding,
+		MaxConnectStates:                c.API0_MaxConnectStates,
+		InsecureDevNoCheckPlayerAuth:    c.API0_InsecureDevNoCheckPlayerAuth,
+		CheckStorageConsistency:         c.API0_CheckStorageConsistency,
+		AdminSecret:                     c.API0_AdminSecret,
+		MinimumLauncherVersionClient:    c.API0_MinimumLauncherVersionClient,
+		MinimumLauncherVersionServer:    c.API0_MinimumLauncherVersionServer,
+		TokenExpiryTime:                 c.API0_TokenExpiryTime,
+		RetryAfter:                      c.API0_RetryAfter,
+		AllowGameServerIPv6:             c.API0_AllowGameServerIPv6,
+		ReadOnlyServerList:              c.API0_ServerList_MirrorURL != "",
+		RejectUnknownMapsPlaylists:      c.API0_RejectUnknownMapsPlaylists,
+		MaxServerNameLength:             c.API0_ServerNameMaxLen,
+		MaxServerDescriptionLength:      c.API0_ServerDescriptionMaxLen,
+		RejectLongServerNameDescription: c.API0_ServerRejectOverlong,
+		SanitizeServerText:              c.API0_ServerSanitizeText,
+		MaxModInfoSize:                  c.API0_ServerModInfoMaxSize,
+		MaxMods:                         c.API0_ServerModsMax,
+		RejectModInfoLimit:              c.API0_ServerRejectModInfoLimit,
+		RegionFallback:                  c.API0_RegionFallback,
+		RequestTimeout:                  c.API0_RequestTimeout,
+		PdataWarnSize:                   c.API0_PdataWarnSize,
+		HashAuthTokens:                  c.API0_HashAuthTokens,
+		TokenSigningKey:                 []byte(c.API0_TokenSigningKey),
+		AccountLookupCacheTTL:           c.API0_AccountLookupCacheTTL,
+		AuthFailLimit:                   c.API0_AuthFailLimit,
+		AuthFailWindow:                  c.API0_AuthFailWindow,
+		AuthFailLockout:                 c.API0_AuthFailLockout,
+		LookupIPTimeout:                 c.IP2Location_Timeout,
+		MaxConcurrentVerifications:      c.API0_ServerList_MaxConcurrentVerifications,
+		VerifyDedupTTL:                  c.API0_ServerList_VerifyDedupTTL,
+		OriginAuthFailLimit:             c.API0_OriginAuthFailLimit,
+		OriginAuthFailWindow:            c.API0_OriginAuthFailWindow,
+		OriginAuthFailLockout:           c.API0_OriginAuthFailLockout,
+		RequireMod:                      c.API0_RequireMod,
+		RequireModMinVersion:            c.API0_RequireModMinVersion,
+	}
+	s.API0.AllowRequiredMod = configureAllowRequiredMod(c)
+	if fn, reload, err := configureServerNameBlock(c); err == nil {
+		s.API0.BlockServerName = fn
+		if reload != nil {
+			s.reload = append(s.reload, func() {
+				if err := reload(); err != nil {
+					s.Logger.Err(err).Msg("failed to reload blocked server names")
+				}
+			})
+		}
+	} else {
+		return nil, fmt.Errorf("initialize blocked server names: %w", err)
+	}
+	if caps, err := configurePlaylistPlayerCaps(c); err == nil {
+		s.API0.PlaylistPlayerCaps = caps
+	} else {
+		return nil, fmt.Errorf("initialize playlist player caps: %w", err)
+	}
+	if ls, err := configureTrustedServerLimits(c); err == nil {
+		s.API0.TrustedServerLimits = ls
+	} else {
+		return nil, fmt.Errorf("initialize trusted server limits: %w", err)
+	}
+	s.reloadConfig = append(s.reloadConfig, func(c *Config) error {
+		ls, err := configureTrustedServerLimits(c)
+		if err != nil {
+			return fmt.Errorf("trusted server limits: %w", err)
+		}
+		s.API0.SetServerLimits(api0.ServerLimits{
+			MaxServers:          c.API0_MaxServers,
+			MaxServersPerIP:     c.API0_MaxServersPerIP,
+			TrustedServerLimits: ls,
+		})
+		return nil
+	})
+	if pfxs, err := configureVerifySkip(c); err == nil {
+		s.API0.VerifySkip = pfxs
+	} else {
+		return nil, fmt.Errorf("initialize verification skip: %w", err)
+	}
+	if l, fn, err := configureServerAuditLog(c); err == nil {
+		s.API0.ServerAuditLog = l
+		s.reload = append(s.reload, fn)
+	} else {
+		return nil, fmt.Errorf("initialize server audit log: %w", err)
+	}
+	if fn, err := configureFeaturedServers(c, s.API0.ServerList); err == nil {
+		if fn != nil {
+			s.reload = append(s.reload, func() {
+				if err := fn(); err != nil {
+					s.Logger.Err(err).Msg("failed to reload featured servers")
+				}
+			})
+		}
+	} else {
+		return nil, fmt.Errorf("initialize featured servers: %w", err)
 	}
 	if v := c.API0_MinimumLauncherVersion; v != "" {
 		if s.API0.MinimumLauncherVersionClient == "" {
@@ -293,10 +575,13 @@ func NewServer(c *Config) (*Server, error) {
 		}
 	}
 
-	s.API0.NotFound = new(middlewares).
+	nf := new(middlewares).
 		Add(hlog.NewHandler(s.Logger)).
-		Add(hlog.RequestIDHandler("rid", "")).
-		Then(http.HandlerFunc(s.serveRest))
+		Add(hlog.RequestIDHandler("rid", ""))
+	if webSecurityHeaders {
+		nf.Add(securityHeaders(c.SecurityHeadersHSTSMaxAge))
+	}
+	s.API0.NotFound = nf.Then(http.HandlerFunc(s.serveRest))
 
 	if exc, err := configureEAX(c, s.Logger.With().Str("component", "eax").Logger()); err == nil {
 		s.API0.EAXClient = exc
@@ -308,8 +593,9 @@ func NewServer(c *Config) (*Server, error) {
 	} else {
 		return nil, fmt.Errorf("initialize username lookup: %w", err)
 	}
-	if astore, err := configureAccountStorage(c); err == nil {
+	if astore, lstore, err := configureAccountStorage(c); err == nil {
 		s.API0.AccountStorage = astore
+		s.API0.AccountLookupStorage = lstore
 	} else {
 		return nil, fmt.Errorf("initialize account storage: %w", err)
 	}
@@ -318,7 +604,24 @@ func NewServer(c *Config) (*Server, error) {
 	} else {
 		return nil, fmt.Errorf("initialize pdata storage: %w", err)
 	}
-	if mmp, err := configureMainMenuPromos(c); err == nil {
+	if buf, err := configureDefaultPdata(c); err == nil {
+		s.API0.DefaultPdata = buf
+	} else {
+		return nil, fmt.Errorf("initialize default pdata: %w", err)
+	}
+	if get, fn, err := configureMOTD(c); err == nil {
+		s.API0.MOTD = get
+		if fn != nil {
+			s.reload = append(s.reload, func() {
+				if err := fn(); err != nil {
+					s.Logger.Err(err).Msg("failed to reload motd")
+				}
+			})
+		}
+	} else {
+		return nil, fmt.Errorf("initialize motd: %w", err)
+	}
+	if mmp, err := configureMainMenuPromos(c, s.API0); err == nil {
 		s.API0.MainMenuPromos = mmp
 	} else {
 		return nil, fmt.Errorf("initialize main menu promos: %w", err)
@@ -327,24 +630,50 @@ func NewServer(c *Config) (*Server, error) {
 		return nil, fmt.Errorf("configure main menu promos when update needed: %w", err)
 	}
 	if ip2l, err := configureIP2Location(c); err == nil {
-		if ip2l != nil {
+		for _, fn := range ip2LocationReloaders(ip2l) {
+			fn := fn
 			s.reload = append(s.reload, func() {
-				if err := ip2l.Load(""); err != nil {
+				if err := fn(); err != nil {
 					s.Logger.Err(err).Msg("failed to reload ip2location database")
 				}
 			})
-			s.API0.LookupIP = ip2l.LookupFields
+		}
+		switch v4, v6 := ip2l[0], ip2l[1]; {
+		case v4 == nil && v6 == nil:
+		case v4 == v6:
+			s.API0.LookupIP = v4.LookupFields
+		default:
+			s.API0.LookupIP = func(a netip.Addr) (ip2x.Record, error) {
+				if a.Unmap().Is4() {
+					if v4 == nil {
+						return ip2x.Record{}, fmt.Errorf("no ip2location database loaded for ipv4")
+					}
+					return v4.LookupFields(a)
+				}
+				if v6 == nil {
+					return ip2x.Record{}, fmt.Errorf("no ip2location database loaded for ipv6")
+				}
+				return v6.LookupFields(a)
+			}
 		}
 	} else {
 		return nil, fmt.Errorf("initialize ip2location: %w", err)
 	}
-	if m, err := configureRegionMap(c); err == nil {
+	if m, fn, err := configureRegionMap(c); err == nil {
 		s.API0.GetRegion = m
+		if fn != nil {
+			s.reload = append(s.reload, func() {
+				if err := fn(); err != nil {
+					s.Logger.Err(err).Msg("failed to reload region map overrides")
+				}
+			})
+		}
 	} else {
 		return nil, fmt.Errorf("initialize region map: %w", err)
 	}
 
 	s.MetricsSecret = c.MetricsSecret
+	s.MetricsCache = c.MetricsCacheTime
 
 	s.Handler = m.Then(s.API0)
 
@@ -459,25 +788,7 @@ func configureLogging(c *Config) (l zerolog.Logger, reopen func(), err error) {
 		}
 		reopen = func() {
 			x.SwapWriter(func(old io.Writer) io.Writer {
-				if o, ok := old.(io.Closer); ok {
-					o.Close()
-				}
-				if f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666); err == nil {
-					if c.LogFileChown != nil {
-						if err := f.Chown((*c.LogFileChown)[0], (*c.LogFileChown)[1]); err != nil {
-							fmt.Fprintf(os.Stderr, "error: chown log file: %v\n", err)
-						}
-					}
-					if c.LogFileChmod != 0 {
-						if err := f.Chmod(c.LogFileChmod); err != nil {
-							fmt.Fprintf(os.Stderr, "error: chmod log file: %v\n", err)
-						}
-					}
-					return f
-				} else {
-					fmt.Fprintf(os.Stderr, "error: failed to open log file: %v\n", err)
-				}
-				return nil
+				return reopenLogFile(c, fn, old)
 			})
 		}
 		outputs = append(outputs, x)
@@ -491,6 +802,283 @@ func configureLogging(c *Config) (l zerolog.Logger, reopen func(), err error) {
 	return
 }
 
+func configureVerifySkip(c *Config) ([]netip.Prefix, error) {
+	return parsePrefixes(c.API0_ServerList_VerifySkipCIDRs)
+}
+
+// parsePrefixes parses a list of CIDRs or single IPs.
+func parsePrefixes(a []string) ([]netip.Prefix, error) {
+	var pfxs []netip.Prefix
+	for _, a := range a {
+		if strings.ContainsRune(a, '/') {
+			if pfx, err := netip.ParsePrefix(a); err == nil {
+				pfxs = append(pfxs, pfx.Masked())
+			} else {
+				return nil, fmt.Errorf("parse prefix %q: %w", a, err)
+			}
+		} else {
+			if x, err := netip.ParseAddr(a); err == nil {
+				if pfx, err := x.Unmap().Prefix(x.Unmap().BitLen()); err == nil {
+					pfxs = append(pfxs, pfx)
+				} else {
+					panic(err)
+				}
+			} else {
+				return nil, fmt.Errorf("parse prefix %q: %w", a, err)
+			}
+		}
+	}
+	return pfxs, nil
+}
+
+func configureTrustedServerLimits(c *Config) ([]api0.TrustedServerLimit, error) {
+	var ls []api0.TrustedServerLimit
+	for _, x := range c.API0_TrustedServerLimits {
+		a, v, ok := strings.Cut(x, "=")
+		if !ok {
+			return nil, fmt.Errorf("parse %q: missing equals sign", x)
+		}
+		pfxs, err := parsePrefixes([]string{a})
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || (n <= 0 && n != -1) {
+			return nil, fmt.Errorf("parse %q: invalid server count %q", x, v)
+		}
+		ls = append(ls, api0.TrustedServerLimit{
+			Prefix:          pfxs[0],
+			MaxServersPerIP: n,
+		})
+	}
+	return ls, nil
+}
+
+func configureShownPlaylists(c *Config) []string {
+	if len(c.API0_ServerList_ShownPlaylists) == 0 {
+		return nil // show everything
+	}
+	return c.API0_ServerList_ShownPlaylists
+}
+
+func configurePlaylistPlayerCaps(c *Config) (map[string]int, error) {
+	if len(c.API0_PlaylistPlayerCaps) == 0 {
+		return nil, nil
+	}
+	caps := map[string]int{}
+	for _, x := range c.API0_PlaylistPlayerCaps {
+		pl, v, ok := strings.Cut(x, "=")
+		if !ok {
+			return nil, fmt.Errorf("parse %q: missing equals sign", x)
+		}
+		if !nstypes.Playlist(pl).Known() {
+			return nil, fmt.Errorf("parse %q: unknown playlist %q", x, pl)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("parse %q: invalid player count %q", x, v)
+		}
+		caps[pl] = n
+	}
+	return caps, nil
+}
+
+func configureServerNameBlock(c *Config) (block func(string) bool, reload func() error, err error) {
+	fn := c.API0_ServerNameBlock
+	if fn == "" {
+		return nil, nil, nil
+	}
+	if fn, err = filepath.Abs(fn); err != nil {
+		return nil, nil, fmt.Errorf("resolve blocked server names file: %w", err)
+	}
+	var res atomic.Pointer[[]*regexp.Regexp]
+	reload = func() error {
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		var rs []*regexp.Regexp
+		for i, line := range strings.Split(string(buf), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			re, err := regexp.Compile(line)
+			if err != nil {
+				return fmt.Errorf("parse %q: line %d: %w", fn, i+1, err)
+			}
+			rs = append(rs, re)
+		}
+		res.Store(&rs)
+		return nil
+	}
+	if err := reload(); err != nil {
+		return nil, nil, err
+	}
+	block = func(name string) bool {
+		for _, re := range *res.Load() {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}
+	return block, reload, nil
+}
+
+func configureAllowRequiredMod(c *Config) func(string) bool {
+	if len(c.API0_RequiredMods_Allow) == 0 && len(c.API0_RequiredMods_Deny) == 0 {
+		return nil
+	}
+	allow := map[string]struct{}{}
+	for _, n := range c.API0_RequiredMods_Allow {
+		allow[strings.ToLower(strings.TrimSpace(n))] = struct{}{}
+	}
+	deny := map[string]struct{}{}
+	for _, n := range c.API0_RequiredMods_Deny {
+		deny[strings.ToLower(strings.TrimSpace(n))] = struct{}{}
+	}
+	return func(name string) bool {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := deny[name]; ok {
+			return false
+		}
+		if len(allow) != 0 {
+			if _, ok := allow[name]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func configureFeaturedServers(c *Config, sl *api0.ServerList) (reload func() error, err error) {
+	fn := c.API0_ServerList_Featured
+	if fn == "" {
+		return nil, nil
+	}
+	if fn, err = filepath.Abs(fn); err != nil {
+		return nil, fmt.Errorf("resolve featured servers file: %w", err)
+	}
+	reload = func() error {
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		var rules []struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			IP       string `json:"ip"`
+			Priority int    `json:"priority"`
+		}
+		if err := json.Unmarshal(buf, &rules); err != nil {
+			return fmt.Errorf("parse %q: %w", fn, err)
+		}
+		type rule struct {
+			id       string
+			name     *regexp.Regexp
+			ip       netip.Prefix
+			priority int
+		}
+		rs := make([]rule, len(rules))
+		for i, x := range rules {
+			rs[i].id = x.ID
+			rs[i].priority = x.Priority
+			if x.Name != "" {
+				if rs[i].name, err = regexp.Compile(x.Name); err != nil {
+					return fmt.Errorf("parse %q: rule %d: name: %w", fn, i, err)
+				}
+			}
+			if x.IP != "" {
+				if rs[i].ip, err = netip.ParsePrefix(x.IP); err != nil {
+					if a, err1 := netip.ParseAddr(x.IP); err1 == nil {
+						rs[i].ip, err = a.Prefix(a.BitLen())
+					}
+				}
+				if err != nil {
+					return fmt.Errorf("parse %q: rule %d: ip: %w", fn, i, err)
+				}
+				rs[i].ip = rs[i].ip.Masked()
+			}
+			if x.ID == "" && x.Name == "" && x.IP == "" {
+				return fmt.Errorf("parse %q: rule %d: no id, name, or ip to match", fn, i)
+			}
+		}
+		if len(rs) == 0 {
+			sl.SetFeatured(nil)
+			return nil
+		}
+		sl.SetFeatured(func(srv *api0.Server) int {
+			for _, r := range rs {
+				if r.id != "" && r.id != srv.ID {
+					continue
+				}
+				if r.name != nil && !r.name.MatchString(srv.Name) {
+					continue
+				}
+				if r.ip.IsValid() && !r.ip.Contains(srv.Addr.Addr().Unmap()) {
+					continue
+				}
+				return r.priority
+			}
+			return 0
+		})
+		return nil
+	}
+	if err := reload(); err != nil {
+		return nil, err
+	}
+	return reload, nil
+}
+
+func configureServerAuditLog(c *Config) (l *zerolog.Logger, reopen func(), err error) {
+	fn := c.API0_ServerAuditLog
+	if fn == "" {
+		return nil, func() {}, nil
+	}
+	if fn, err = filepath.Abs(fn); err != nil {
+		return nil, nil, fmt.Errorf("resolve server audit log file: %w", err)
+	}
+	x := newZerologWriterLevel(nil, zerolog.TraceLevel)
+	reopen = func() {
+		x.SwapWriter(func(old io.Writer) io.Writer {
+			return reopenLogFile(c, fn, old)
+		})
+	}
+	reopen()
+
+	v := zerolog.New(x).
+		With().
+		Timestamp().
+		Logger()
+	return &v, reopen, nil
+}
+
+// reopenLogFile closes old (if it is an io.Closer) and opens fn for appending,
+// applying the log file chown/chmod options. On error, it is written to stderr
+// and nil is returned.
+func reopenLogFile(c *Config, fn string, old io.Writer) io.Writer {
+	if o, ok := old.(io.Closer); ok {
+		o.Close()
+	}
+	if f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666); err == nil {
+		if c.LogFileChown != nil {
+			if err := f.Chown((*c.LogFileChown)[0], (*c.LogFileChown)[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "error: chown log file: %v\n", err)
+			}
+		}
+		if c.LogFileChmod != 0 {
+			if err := f.Chmod(c.LogFileChmod); err != nil {
+				fmt.Fprintf(os.Stderr, "error: chmod log file: %v\n", err)
+			}
+		}
+		return f
+	} else {
+		fmt.Fprintf(os.Stderr, "error: failed to open log file: %v\n", err)
+	}
+	return nil
+}
+
 func configureEAX(c *Config, l zerolog.Logger) (*eax.Client, error) {
 	mgr := &eax.UpdateMgr{
 		AutoUpdateBackoff: expbackoff,
@@ -538,6 +1126,8 @@ func configureUsernameSource(c *Config) (api0.UsernameSource, error) {
 		return api0.UsernameSourceStryderEAX, nil
 	case "stryder-eax-debug":
 		return api0.UsernameSourceStryderEAXDebug, nil
+	case "auto":
+		return api0.UsernameSourceAuto, nil
 	case "":
 		return api0.UsernameSourceNone, nil
 	default:
@@ -545,13 +1135,53 @@ func configureUsernameSource(c *Config) (api0.UsernameSource, error) {
 	}
 }
 
-func configureAccountStorage(c *Config) (api0.AccountStorage, error) {
+// configureAccountStorage configures the account storage, and the storage for
+// read-only lookups if a replica is configured.
+func configureAccountStorage(c *Config) (api0.AccountStorage, api0.AccountStorage, error) {
+	s, err := configureAccountStoragePrimary(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.API0_Storage_AccountsReplica == "" {
+		return s, nil, nil
+	}
+	switch typ, arg, _ := strings.Cut(c.API0_Storage_AccountsReplica, ":"); typ {
+	case "sqlite3":
+		p, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("replica: sqlite3: resolve %q: %w", arg, err)
+		}
+		r, err := atlasdb.OpenReadOnly(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("replica: sqlite3: %w", err)
+		}
+		if cur, to, err := r.Version(); err != nil {
+			return nil, nil, fmt.Errorf("replica: sqlite3: check version: %w", err)
+		} else if cur != to {
+			return nil, nil, fmt.Errorf("replica: sqlite3: database version %d does not match %d", cur, to)
+		}
+		return s, &replicaAccountStorage{primary: s, replica: r}, nil
+	default:
+		return nil, nil, fmt.Errorf("replica: unknown type %q", typ)
+	}
+}
+
+func configureAccountStoragePrimary(c *Config) (api0.AccountStorage, error) {
 	switch typ, arg, _ := strings.Cut(c.API0_Storage_Accounts, ":"); typ {
 	case "memory":
+		var max int
 		if arg != "" {
-			return nil, fmt.Errorf("memory: invalid argument %q", arg)
+			v, ok := strings.CutPrefix(arg, "max=")
+			if !ok {
+				return nil, fmt.Errorf("memory: invalid argument %q", arg)
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("memory: invalid max accounts %q", v)
+			}
+			max = n
 		}
-		return memstore.NewAccountStore(), nil
+		return memstore.NewAccountStoreLimit(max), nil
 	case "sqlite3":
 		p, err := filepath.Abs(arg)
 		if err != nil {
@@ -576,17 +1206,65 @@ func configureAccountStorage(c *Config) (api0.AccountStorage, error) {
 	}
 }
 
-func configurePdataStorage(c *Config) (api0.PdataStorage, error) {
-	switch typ, arg, _ := strings.Cut(c.API0_Storage_Pdata, ":"); typ {
-	case "memory":
-		switch arg {
-		case "":
-			return memstore.NewPdataStore(false), nil
-		case "compress":
-			return memstore.NewPdataStore(true), nil
-		default:
-			return nil, fmt.Errorf("memory: invalid argument %q", arg)
+func configureServerEvents(c *Config, l zerolog.Logger) (func(api0.ServerEvent), error) {
+	switch typ, arg, _ := strings.Cut(c.API0_Storage_ServerEvents, ":"); typ {
+	case "", "none":
+		return nil, nil
+	case "sqlite3":
+		p, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite3: resolve %q: %w", arg, err)
+		}
+		s, err := eventsdb.Open(p)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite3: %w", err)
 		}
+		if cur, to, err := s.Version(); err != nil {
+			return nil, fmt.Errorf("sqlite3: migrate: %w", err)
+		} else if cur > to {
+			return nil, fmt.Errorf("sqlite3: migrate: database version %d is too new", cur)
+		} else if cur != to {
+			if err := s.MigrateUp(context.Background(), to); err != nil {
+				return nil, fmt.Errorf("sqlite3: migrate (%d to %d): %w", cur, to, err)
+			}
+		}
+		return newServerEventWriter(l, 4096, s.AddServerEvents).Add, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+}
+
+func configurePdataStorage(c *Config) (api0.PdataStorage, error) {
+	switch typ, arg, _ := strings.Cut(c.API0_Storage_Pdata, ":"); typ {
+	case "memory":
+		var (
+			compress   bool
+			maxEntries int
+			maxBytes   int64
+		)
+		if arg != "" {
+			for _, opt := range strings.Split(arg, ",") {
+				switch k, v, _ := strings.Cut(opt, "="); k {
+				case "compress":
+					compress = true
+				case "max":
+					n, err := strconv.Atoi(v)
+					if err != nil || n < 0 {
+						return nil, fmt.Errorf("memory: invalid max entries %q", v)
+					}
+					maxEntries = n
+				case "maxbytes":
+					n, err := strconv.ParseInt(v, 10, 64)
+					if err != nil || n < 0 {
+						return nil, fmt.Errorf("memory: invalid max bytes %q", v)
+					}
+					maxBytes = n
+				default:
+					return nil, fmt.Errorf("memory: invalid argument %q", opt)
+				}
+			}
+		}
+		return memstore.NewPdataStoreLimit(compress, maxEntries, maxBytes), nil
 	case "sqlite3":
 		p, err := filepath.Abs(arg)
 		if err != nil {
@@ -611,31 +1289,175 @@ func configurePdataStorage(c *Config) (api0.PdataStorage, error) {
 	}
 }
 
-func configureMainMenuPromos(c *Config) (func(*http.Request) api0.MainMenuPromos, error) {
+func configureDefaultPdata(c *Config) ([]byte, error) {
+	if c.API0_DefaultPdata == "" {
+		return nil, nil
+	}
+	buf, err := os.ReadFile(c.API0_DefaultPdata)
+	if err != nil {
+		return nil, err
+	}
+	var pd pdata.Pdata
+	if err := pd.UnmarshalBinary(buf); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", c.API0_DefaultPdata, err)
+	}
+	return buf, nil
+}
+
+func configureMOTD(c *Config) (get func() string, reload func() error, err error) {
+	fn := c.API0_MOTD
+	if fn == "" {
+		return nil, nil, nil
+	}
+	if fn, err = filepath.Abs(fn); err != nil {
+		return nil, nil, fmt.Errorf("resolve motd file: %w", err)
+	}
+	var motd atomic.Pointer[string]
+	reload = func() error {
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(buf) {
+			return fmt.Errorf("parse %q: invalid utf-8", fn)
+		}
+		v := strings.TrimSpace(string(buf))
+		motd.Store(&v)
+		return nil
+	}
+	if err := reload(); err != nil {
+		return nil, nil, err
+	}
+	get = func() string {
+		return *motd.Load()
+	}
+	return get, reload, nil
+}
+
+func configureMainMenuPromos(c *Config, h *api0.Handler) (func(*http.Request) api0.MainMenuPromos, error) {
+	var def func(*http.Request) api0.MainMenuPromos
 	switch typ, arg, _ := strings.Cut(c.API0_MainMenuPromos, ":"); typ {
 	case "none":
-		return nil, nil
+		def = nil
 	case "file":
 		p, err := filepath.Abs(arg)
 		if err != nil {
 			return nil, fmt.Errorf("file: resolve %q: %w", arg, err)
 		}
-		fn := func(*http.Request) api0.MainMenuPromos {
-			var mmp api0.MainMenuPromos
-			if buf, err1 := os.ReadFile(p); err1 != nil {
-				err = err1
-			} else if err = json.Unmarshal(buf, &mmp); err != nil {
-				err = err1
-			}
-			return mmp
-		}
-		if fn(nil); err != nil {
+		if mmp, err := readMainMenuPromos(p); err != nil {
 			return nil, fmt.Errorf("file: %w", err)
+		} else if err := checkMainMenuPromos(c, mmp); err != nil {
+			return nil, fmt.Errorf("file: %q: %w", p, err)
+		}
+		def = func(*http.Request) api0.MainMenuPromos {
+			mmp, _ := readMainMenuPromos(p)
+			return mmp
 		}
-		return fn, nil
 	default:
 		return nil, fmt.Errorf("unknown source %q", typ)
 	}
+	if len(c.API0_MainMenuPromos_Versions) == 0 {
+		return def, nil
+	}
+
+	type variant struct {
+		min, max string // semver with v prefix, or empty
+		path     string
+	}
+	var vs []variant
+	for _, x := range c.API0_MainMenuPromos_Versions {
+		rng, p, ok := strings.Cut(strings.TrimSpace(x), "=")
+		if !ok {
+			return nil, fmt.Errorf("parse version variant %q: missing =", x)
+		}
+		var v variant
+		min, max, ok := strings.Cut(rng, "..")
+		if !ok {
+			return nil, fmt.Errorf("parse version variant %q: missing ..", x)
+		}
+		if min != "" {
+			if v.min = "v" + strings.TrimPrefix(min, "v"); !semver.IsValid(v.min) {
+				return nil, fmt.Errorf("parse version variant %q: invalid semver %q", x, min)
+			}
+		}
+		if max != "" {
+			if v.max = "v" + strings.TrimPrefix(max, "v"); !semver.IsValid(v.max) {
+				return nil, fmt.Errorf("parse version variant %q: invalid semver %q", x, max)
+			}
+		}
+		var err error
+		if v.path, err = filepath.Abs(p); err != nil {
+			return nil, fmt.Errorf("parse version variant %q: resolve %q: %w", x, p, err)
+		}
+		if mmp, err := readMainMenuPromos(v.path); err != nil {
+			return nil, fmt.Errorf("parse version variant %q: %w", x, err)
+		} else if err := checkMainMenuPromos(c, mmp); err != nil {
+			return nil, fmt.Errorf("parse version variant %q: %w", x, err)
+		}
+		vs = append(vs, v)
+	}
+	return func(r *http.Request) api0.MainMenuPromos {
+		if r != nil {
+			if ver := h.ExtractLauncherVersion(r); ver != "" {
+				ver = "v" + ver
+				for _, v := range vs {
+					if (v.min == "" || semver.Compare(ver, v.min) >= 0) && (v.max == "" || semver.Compare(ver, v.max) < 0) {
+						mmp, _ := readMainMenuPromos(v.path)
+						return mmp
+					}
+				}
+			}
+		}
+		if def != nil {
+			return def(r)
+		}
+		return api0.MainMenuPromos{}
+	}, nil
+}
+
+// checkMainMenuPromos validates mmp according to c.
+func checkMainMenuPromos(c *Config, mmp api0.MainMenuPromos) error {
+	if c.API0_MainMenuPromos_ImageIndexRange == "" {
+		return nil
+	}
+	a, b, ok := strings.Cut(c.API0_MainMenuPromos_ImageIndexRange, "..")
+	if !ok {
+		return fmt.Errorf("invalid image index range %q: missing ..", c.API0_MainMenuPromos_ImageIndexRange)
+	}
+	min, err := strconv.Atoi(a)
+	if err != nil {
+		return fmt.Errorf("invalid image index range %q: %w", c.API0_MainMenuPromos_ImageIndexRange, err)
+	}
+	max, err := strconv.Atoi(b)
+	if err != nil {
+		return fmt.Errorf("invalid image index range %q: %w", c.API0_MainMenuPromos_ImageIndexRange, err)
+	}
+	for _, x := range []struct {
+		name  string
+		index int
+	}{
+		{"largeButton", mmp.LargeButton.ImageIndex},
+		{"smallButton1", mmp.SmallButton1.ImageIndex},
+		{"smallButton2", mmp.SmallButton2.ImageIndex},
+	} {
+		if x.index < min || x.index > max {
+			return fmt.Errorf("%s image index %d out of range %d..%d", x.name, x.index, min, max)
+		}
+	}
+	return nil
+}
+
+// readMainMenuPromos reads mainmenupromos from the JSON file at p.
+func readMainMenuPromos(p string) (api0.MainMenuPromos, error) {
+	var mmp api0.MainMenuPromos
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return mmp, err
+	}
+	if err := json.Unmarshal(buf, &mmp); err != nil {
+		return mmp, fmt.Errorf("parse %q: %w", p, err)
+	}
+	return mmp, nil
 }
 
 func configureMainMenuPromosUpdateNeeded(c *Config, h *api0.Handler) error {
@@ -647,6 +1469,11 @@ func configureMainMenuPromosUpdateNeeded(c *Config, h *api0.Handler) error {
 		if err != nil {
 			return fmt.Errorf("file: resolve %q: %w", arg, err)
 		}
+		if mmp, err := readMainMenuPromos(p); err != nil {
+			return fmt.Errorf("file: %w", err)
+		} else if err := checkMainMenuPromos(c, mmp); err != nil {
+			return fmt.Errorf("file: %q: %w", p, err)
+		}
 		fn1 := h.MainMenuPromos
 		h.MainMenuPromos = func(r *http.Request) api0.MainMenuPromos {
 			var mmp api0.MainMenuPromos
@@ -654,80 +1481,161 @@ func configureMainMenuPromosUpdateNeeded(c *Config, h *api0.Handler) error {
 				mmp = fn1(r)
 			}
 			if r == nil || !h.CheckLauncherVersion(r, true) {
-				if buf, err1 := os.ReadFile(p); err1 != nil {
-					err = err1
-				} else if err = json.Unmarshal(buf, &mmp); err != nil {
-					err = err1
+				if buf, err := os.ReadFile(p); err == nil {
+					json.Unmarshal(buf, &mmp)
 				}
 			}
 			return mmp
 		}
-		if h.MainMenuPromos(nil); err != nil {
-			return fmt.Errorf("file: %w", err)
-		}
 		return nil
 	default:
 		return fmt.Errorf("unknown source %q", typ)
 	}
 }
 
-func configureIP2Location(c *Config) (*ip2xMgr, error) {
-	if c.IP2Location == "" {
-		return nil, nil
+// configureIP2Location loads the IP2Location databases for IPv4 and IPv6
+// addresses (which may be the same, or nil if not configured).
+func configureIP2Location(c *Config) (mgr [2]*ip2xMgr, err error) {
+	var def *ip2xMgr
+	if c.IP2Location != "" && (c.IP2Location_IPv4 == "" || c.IP2Location_IPv6 == "") {
+		def = new(ip2xMgr)
+		if err := def.Load(c.IP2Location); err != nil {
+			return mgr, err
+		}
+	}
+	for i, fn := range []string{c.IP2Location_IPv4, c.IP2Location_IPv6} {
+		if fn == "" {
+			mgr[i] = def
+			continue
+		}
+		mgr[i] = new(ip2xMgr)
+		if err := mgr[i].Load(fn); err != nil {
+			return mgr, fmt.Errorf("load %q: %w", fn, err)
+		}
 	}
-	mgr := new(ip2xMgr)
-	return mgr, mgr.Load(c.IP2Location)
+	return mgr, nil
 }
 
-func configureRegionMap(c *Config) (fn func(netip.Addr, ip2x.Record) (string, error), err error) {
+// ip2LocationReloaders returns functions to reopen each distinct database in
+// ip2l.
+func ip2LocationReloaders(ip2l [2]*ip2xMgr) []func() error {
+	var fns []func() error
+	for i, mgr := range ip2l {
+		if mgr != nil && (i == 0 || mgr != ip2l[0]) {
+			mgr := mgr
+			fns = append(fns, func() error {
+				return mgr.Load("")
+			})
+		}
+	}
+	return fns
+}
+
+func configureRegionMap(c *Config) (fn func(netip.Addr, ip2x.Record) (string, error), reload func() error, err error) {
 	switch m := c.API0_RegionMap; m {
 	case "", "none":
 		fn = nil
 	case "default":
 		fn = regionmap.GetRegion
 	default:
-		return nil, fmt.Errorf("unknown region map type %q", m)
+		return nil, nil, fmt.Errorf("unknown region map type %q", m)
 	}
 	if len(c.API0_RegionMap_Override) != 0 {
-		type regionMapOverride struct {
-			Prefix netip.Prefix
-			Region string
+		mos, err := parseRegionMapOverrides(c.API0_RegionMap_Override)
+		if err != nil {
+			return nil, nil, err
 		}
-		var mos []regionMapOverride
-		for _, x := range c.API0_RegionMap_Override {
-			a, r, ok := strings.Cut(x, "=")
-			if !ok {
-				return nil, fmt.Errorf("parse region override %q: missing equals sign", x)
+		fn = mos.Wrap(fn)
+	}
+	if c.API0_RegionMap_OverrideFile != "" {
+		p, err := filepath.Abs(c.API0_RegionMap_OverrideFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolve region override file: %w", err)
+		}
+
+		// swap the entire composed function so lookups always see a
+		// consistent set of overrides
+		var cur atomic.Pointer[func(netip.Addr, ip2x.Record) (string, error)]
+		next := fn
+		reload = func() error {
+			buf, err := os.ReadFile(p)
+			if err != nil {
+				return err
 			}
-			if strings.ContainsRune(a, '/') {
-				if pfx, err := netip.ParsePrefix(a); err == nil {
-					mos = append(mos, regionMapOverride{pfx, r})
-				} else {
-					return nil, fmt.Errorf("parse region override %q: invalid prefix: %w", x, err)
-				}
-			} else {
-				if x, err := netip.ParseAddr(a); err == nil {
-					if pfx, err := x.Prefix(x.BitLen()); err == nil {
-						mos = append(mos, regionMapOverride{pfx, r})
-					} else {
-						panic(err)
-					}
-				} else {
-					return nil, fmt.Errorf("parse region override %q: invalid prefix: %w", x, err)
+			var lines []string
+			for _, line := range strings.Split(string(buf), "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					lines = append(lines, line)
 				}
 			}
+			mos, err := parseRegionMapOverrides(lines)
+			if err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			x := mos.Wrap(next)
+			cur.Store(&x)
+			return nil
+		}
+		if err := reload(); err != nil {
+			return nil, nil, err
 		}
-		next := fn
 		fn = func(a netip.Addr, r ip2x.Record) (string, error) {
-			for _, mo := range mos {
-				if mo.Prefix.Contains(a) {
-					return mo.Region, nil
+			return (*cur.Load())(a, r)
+		}
+	}
+	return
+}
+
+type regionMapOverride struct {
+	Prefix netip.Prefix
+	Region string
+}
+
+type regionMapOverrides []regionMapOverride
+
+// Wrap returns a region function which uses the overrides, falling back to
+// next (which may be nil if there isn't a region map).
+func (mos regionMapOverrides) Wrap(next func(netip.Addr, ip2x.Record) (string, error)) func(netip.Addr, ip2x.Record) (string, error) {
+	return func(a netip.Addr, r ip2x.Record) (string, error) {
+		for _, mo := range mos {
+			if mo.Prefix.Contains(a) {
+				return mo.Region, nil
+			}
+		}
+		if next == nil {
+			return "", nil
+		}
+		return next(a, r)
+	}
+}
+
+// parseRegionMapOverrides parses a list of prefix=region overrides.
+func parseRegionMapOverrides(a []string) (regionMapOverrides, error) {
+	var mos regionMapOverrides
+	for _, x := range a {
+		a, r, ok := strings.Cut(x, "=")
+		if !ok {
+			return nil, fmt.Errorf("parse region override %q: missing equals sign", x)
+		}
+		if strings.ContainsRune(a, '/') {
+			if pfx, err := netip.ParsePrefix(a); err == nil {
+				mos = append(mos, regionMapOverride{pfx, r})
+			} else {
+				return nil, fmt.Errorf("parse region override %q: invalid prefix: %w", x, err)
+			}
+		} else {
+			if x, err := netip.ParseAddr(a); err == nil {
+				if pfx, err := x.Prefix(x.BitLen()); err == nil {
+					mos = append(mos, regionMapOverride{pfx, r})
+				} else {
+					panic(err)
 				}
+			} else {
+				return nil, fmt.Errorf("parse region override %q: invalid prefix: %w", x, err)
 			}
-			return next(a, r)
 		}
 	}
-	return
+	return mos, nil
 }
 
 // Run runs the server, shutting it down gracefully when ctx is canceled, then
@@ -752,20 +1660,105 @@ func (s *Server) Run(ctx context.Context) error {
 		}
 	}()
 
+	go func() {
+		tk := time.NewTicker(time.Second * 30)
+		defer tk.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tk.C:
+				s.API0.ReapConnectStates()
+			}
+		}
+	}()
+
+	if s.EAXSelfTest.UID != 0 && s.EAXSelfTest.Interval > 0 {
+		go func() {
+			tk := time.NewTicker(s.EAXSelfTest.Interval)
+			defer tk.Stop()
+
+			for {
+				tctx, cancel := context.WithTimeout(ctx, time.Second*15)
+				if err := s.API0.CheckEAXHealth(tctx, s.EAXSelfTest.UID); err != nil && ctx.Err() == nil {
+					s.Logger.Warn().Err(err).Uint64("uid", s.EAXSelfTest.UID).Msg("eax self-test failed")
+				}
+				cancel()
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-tk.C:
+				}
+			}
+		}()
+	}
+
+	if s.ServerListMirror.URL != "" && s.ServerListMirror.Interval > 0 {
+		go func() {
+			tk := time.NewTicker(s.ServerListMirror.Interval)
+			defer tk.Stop()
+
+			for {
+				tctx, cancel := context.WithTimeout(ctx, s.ServerListMirror.Interval)
+				if err := s.pullServerList(tctx); err != nil && ctx.Err() == nil {
+					s.Logger.Warn().Err(err).Msg("failed to update server list mirror")
+				}
+				cancel()
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-tk.C:
+				}
+			}
+		}()
+	}
+
+	if s.MetricsPush.URL != "" && s.MetricsPush.Interval > 0 {
+		go func() {
+			tk := time.NewTicker(s.MetricsPush.Interval)
+			defer tk.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tk.C:
+				}
+
+				tctx, cancel := context.WithTimeout(ctx, s.MetricsPush.Interval)
+				if err := s.pushMetrics(tctx); err != nil && ctx.Err() == nil {
+					s.Logger.Warn().Err(err).Msg("failed to push metrics")
+				}
+				cancel()
+			}
+		}()
+	}
+
 	var hs []*http.Server
 	var as []string
 	for _, a := range s.Addr {
 		hs = append(hs, &http.Server{
-			Addr:    a,
-			Handler: s.Handler,
+			Addr:              a,
+			Handler:           s.Handler,
+			ReadHeaderTimeout: s.HTTPTimeout.ReadHeader,
+			ReadTimeout:       s.HTTPTimeout.Read,
+			WriteTimeout:      s.HTTPTimeout.Write,
+			IdleTimeout:       s.HTTPTimeout.Idle,
 		})
 		as = append(as, "http://"+a)
 	}
 	for _, a := range s.AddrTLS {
 		hs = append(hs, &http.Server{
-			Addr:      a,
-			Handler:   s.Handler,
-			TLSConfig: s.TLSConfig,
+			Addr:              a,
+			Handler:           s.Handler,
+			TLSConfig:         s.TLSConfig,
+			ReadHeaderTimeout: s.HTTPTimeout.ReadHeader,
+			ReadTimeout:       s.HTTPTimeout.Read,
+			WriteTimeout:      s.HTTPTimeout.Write,
+			IdleTimeout:       s.HTTPTimeout.Idle,
 		})
 		as = append(as, "https://"+a)
 	}
@@ -778,10 +1771,29 @@ func (s *Server) Run(ctx context.Context) error {
 	for _, h := range hs {
 		h := h
 		go func() {
+			addr := h.Addr
+			if addr == "" {
+				if h.TLSConfig != nil {
+					addr = ":https"
+				} else {
+					addr = ":http"
+				}
+			}
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				errch <- err
+				return
+			}
+			if s.ProxyProtocol {
+				ln = newProxyProtoListener(ln, s.HTTPTimeout.ReadHeader)
+			}
+			if s.MaxConnsPerIP > 0 {
+				ln = newConnLimitListener(ln, s.MaxConnsPerIP) // after the proxy protocol so it uses the client address
+			}
 			if h.TLSConfig != nil {
-				errch <- h.ListenAndServeTLS("", "")
+				errch <- h.ServeTLS(ln, "", "")
 			} else {
-				errch <- h.ListenAndServe()
+				errch <- h.Serve(ln)
 			}
 		}()
 	}
@@ -829,7 +1841,13 @@ func (s *Server) Run(ctx context.Context) error {
 	}
 }
 
-func (s *Server) HandleSIGHUP() {
+// HandleSIGHUP reloads external files. If c is non-nil, the hot-reloadable
+// subset of the config (the allowed hosts and the server registration limits)
+// is also updated from it. Other settings, including the auth fail limits and
+// rate limits, require a restart. If any part of the subset is invalid, an
+// error is logged, that part keeps its old values, and the rest is still
+// updated.
+func (s *Server) HandleSIGHUP(c *Config) {
 	if s.closed {
 		return
 	}
@@ -837,6 +1855,13 @@ func (s *Server) HandleSIGHUP() {
 	s.sdnotify("RELOADING=1")
 	defer s.sdnotify("READY=1")
 
+	if c != nil {
+		for _, fn := range s.reloadConfig {
+			if err := fn(c); err != nil {
+				s.Logger.Err(err).Msg("failed to reload config")
+			}
+		}
+	}
 	for _, fn := range s.reload {
 		if fn != nil {
 			fn()
@@ -844,6 +1869,149 @@ func (s *Server) HandleSIGHUP() {
 	}
 }
 
+// writeMetrics writes Prometheus text metrics to b. If internal is false, only
+// the public server list metrics are written.
+func (s *Server) writeMetrics(b *bytes.Buffer, internal, geo bool) {
+	var ms []func(io.Writer)
+	if internal {
+		ms = append(ms, metrics.WriteProcessMetrics)
+		ms = append(ms, s.API0.WritePrometheus)
+		ms = append(ms, s.API0.NSPkt.WritePrometheus)
+	}
+	ms = append(ms, s.API0.ServerList.WritePrometheus)
+	if internal && geo {
+		ms = append(ms, s.API0.WritePrometheusGeo)
+		ms = append(ms, s.API0.ServerList.WritePrometheusGeo)
+	}
+	for i, m := range ms {
+		if i != 0 {
+			b.WriteByte('\n')
+		}
+		m(b)
+	}
+}
+
+// cachedMetrics returns the output of writeMetrics, reusing the previous output
+// for the same arguments if it was generated less than MetricsCache ago. The
+// returned slice must not be modified.
+func (s *Server) cachedMetrics(internal, geo bool) []byte {
+	if s.MetricsCache <= 0 {
+		var b bytes.Buffer
+		s.writeMetrics(&b, internal, geo)
+		return b.Bytes()
+	}
+
+	var i, j int
+	if internal {
+		i = 1
+	}
+	if geo {
+		j = 1
+	}
+
+	s.metricsCacheMu.Lock()
+	defer s.metricsCacheMu.Unlock()
+
+	if t := time.Now(); t.After(s.metricsCacheExp[i][j]) {
+		var b bytes.Buffer
+		s.writeMetrics(&b, internal, geo)
+		s.metricsCacheBuf[i][j] = b.Bytes()
+		s.metricsCacheExp[i][j] = t.Add(s.MetricsCache)
+	}
+	return s.metricsCacheBuf[i][j]
+}
+
+// pushMetrics pushes internal metrics to the configured Prometheus Pushgateway
+// URL.
+func (s *Server) pushMetrics(ctx context.Context) error {
+	var b bytes.Buffer
+	s.writeMetrics(&b, true, false)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.MetricsPush.URL, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		buf, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("response status %d (%q)", resp.StatusCode, buf)
+	}
+	return nil
+}
+
+// pullServerList replaces the server list with the one from the upstream
+// masterserver.
+func (s *Server) pullServerList(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.ServerListMirror.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		buf, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("response status %d (%q)", resp.StatusCode, buf)
+	}
+
+	var obj []struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		Region      string `json:"region"`
+		Description string `json:"description"`
+		PlayerCount int    `json:"playerCount"`
+		MaxPlayers  int    `json:"maxPlayers"`
+		Map         string `json:"map"`
+		Playlist    string `json:"playlist"`
+		HasPassword bool   `json:"hasPassword"`
+		ModInfo     struct {
+			Mods []api0.ServerModInfo `json:"Mods"`
+		} `json:"modInfo"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&obj); err != nil {
+		return fmt.Errorf("decode server list: %w", err)
+	}
+
+	// note: the upstream lastHeartbeat isn't updated in its cached server list
+	// on every heartbeat, so it may be stale by up to the upstream dead time;
+	// since the upstream only lists live servers, use the fetch time instead
+	fetched := time.Now()
+
+	ss := make([]*api0.Server, 0, len(obj))
+	for _, x := range obj {
+		srv := &api0.Server{
+			ID:            x.ID,
+			LastHeartbeat: fetched,
+			Name:          x.Name,
+			Region:        x.Region,
+			Description:   x.Description,
+			PlayerCount:   x.PlayerCount,
+			MaxPlayers:    x.MaxPlayers,
+			Map:           x.Map,
+			Playlist:      x.Playlist,
+			ModInfo:       x.ModInfo.Mods,
+		}
+		if x.HasPassword {
+			srv.Password = "*" // we don't know the actual password, but it only needs to be non-empty
+		}
+		ss = append(ss, srv)
+	}
+	s.API0.ServerList.SetMirror(ss)
+	return nil
+}
+
 // serveRest handles endpoints not handled by the API.
 func (s *Server) serveRest(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/metrics" {
@@ -853,27 +2021,9 @@ func (s *Server) serveRest(w http.ResponseWriter, r *http.Request) {
 				internal = true
 			}
 		}
-		geo = r.URL.Query().Has("geo")
-
-		var ms []func(io.Writer)
-		if internal {
-			ms = append(ms, metrics.WriteProcessMetrics)
-			ms = append(ms, s.API0.WritePrometheus)
-			ms = append(ms, s.API0.NSPkt.WritePrometheus)
-		}
-		ms = append(ms, s.API0.ServerList.WritePrometheus)
-		if internal && geo {
-			ms = append(ms, s.API0.WritePrometheusGeo)
-			ms = append(ms, s.API0.ServerList.WritePrometheusGeo)
-		}
+		geo = internal && r.URL.Query().Has("geo")
 
-		var b bytes.Buffer
-		for i, m := range ms {
-			if i != 0 {
-				b.WriteByte('\n')
-			}
-			m(&b)
-		}
+		b := bytes.NewBuffer(s.cachedMetrics(internal, geo))
 
 		w.Header().Set("Cache-Control", "private, no-cache, no-store")
 		w.Header().Set("Expires", "0")
@@ -885,6 +2035,40 @@ func (s *Server) serveRest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == "/debug/server" && s.MetricsSecret != "" && r.URL.Query().Get("secret") == s.MetricsSecret {
+		w.Header().Set("Cache-Control", "private, no-cache, no-store")
+		w.Header().Set("Expires", "0")
+		w.Header().Set("Pragma", "no-cache")
+
+		srv, st, ok := s.API0.ServerList.GetServerDebug(r.URL.Query().Get("id"))
+		if !ok {
+			http.Error(w, "server not found", http.StatusNotFound)
+			return
+		}
+		buf, err := json.Marshal(map[string]any{
+			"id":                    srv.ID,
+			"name":                  srv.Name,
+			"launcher_version":      srv.LauncherVersion,
+			"addr":                  srv.Addr.String(),
+			"auth_addr":             srv.AuthAddr().String(),
+			"auth_port":             srv.AuthPort,
+			"state":                 st.State,
+			"verification_deadline": st.VerificationDeadline,
+			"last_heartbeat":        st.LastHeartbeat,
+			"last_verify_time":      srv.LastVerifyTime,
+			"last_verify_result":    srv.LastVerifyResult,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf)
+		return
+	}
+
 	if s.Web != nil {
 		s.Web.ServeHTTP(w, r)
 		return
@@ -895,8 +2079,12 @@ func (s *Server) serveRest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Pragma", "no-cache")
 
 	if r.URL.Path == "/" {
+		if s.RootRedirect != "" {
+			http.Redirect(w, r, s.RootRedirect, http.StatusFound)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, "Go away.\n")
+		io.WriteString(w, strings.TrimSuffix(s.RootMessage, "\n")+"\n")
 		return
 	}
 
@@ -0,0 +1,107 @@
+package atlas
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/r2northstar/atlas/pkg/api/api0"
+)
+
+func TestIP2LocationReloaders(t *testing.T) {
+	// a database which fails to parse, so we can tell which one was reloaded
+	// by the error
+	f, err := os.Create(filepath.Join(t.TempDir(), "invalid.bin"))
+	if err != nil {
+		t.Fatalf("create file: %v", err)
+	}
+	defer f.Close()
+	invalid := &ip2xMgr{file: f}
+	unloaded := &ip2xMgr{}
+
+	invalidErr := invalid.Load("")
+	unloadedErr := unloaded.Load("")
+	if invalidErr == nil || unloadedErr == nil || invalidErr.Error() == unloadedErr.Error() {
+		t.Fatalf("expected distinct reload errors, got %v and %v", invalidErr, unloadedErr)
+	}
+
+	for _, c := range []struct {
+		Name string
+		DBs  [2]*ip2xMgr
+		Errs []error
+	}{
+		{"None", [2]*ip2xMgr{nil, nil}, nil},
+		{"Same", [2]*ip2xMgr{invalid, invalid}, []error{invalidErr}},
+		{"Separate", [2]*ip2xMgr{invalid, unloaded}, []error{invalidErr, unloadedErr}},
+		{"IPv4Only", [2]*ip2xMgr{invalid, nil}, []error{invalidErr}},
+		{"IPv6Only", [2]*ip2xMgr{nil, unloaded}, []error{unloadedErr}},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			fns := ip2LocationReloaders(c.DBs)
+			if len(fns) != len(c.Errs) {
+				t.Fatalf("expected %d reloaders, got %d", len(c.Errs), len(fns))
+			}
+			for i, fn := range fns {
+				if err := fn(); err == nil || err.Error() != c.Errs[i].Error() {
+					t.Errorf("reloader %d: expected error %v, got %v", i, c.Errs[i], err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleSIGHUP(t *testing.T) {
+	config := func(es ...string) *Config {
+		var c Config
+		if err := c.UnmarshalEnv(es, false); err != nil {
+			t.Fatalf("parse config: %v", err)
+		}
+		return &c
+	}
+
+	s, err := NewServer(config(
+		"ATLAS_API0_MAX_SERVERS=100",
+		"ATLAS_API0_MAX_SERVERS_PER_IP=5",
+		"ATLAS_API0_TRUSTED_SERVER_LIMITS=10.0.0.0/8=50",
+	))
+	if err != nil {
+		t.Fatalf("create server: %v", err)
+	}
+	initial := api0.ServerLimits{
+		MaxServers:      100,
+		MaxServersPerIP: 5,
+		TrustedServerLimits: []api0.TrustedServerLimit{
+			{Prefix: netip.MustParsePrefix("10.0.0.0/8"), MaxServersPerIP: 50},
+		},
+	}
+	if act := s.API0.ServerLimits(); !reflect.DeepEqual(act, initial) {
+		t.Fatalf("expected initial limits %+v, got %+v", initial, act)
+	}
+
+	s.HandleSIGHUP(config(
+		"ATLAS_API0_MAX_SERVERS=200",
+		"ATLAS_API0_MAX_SERVERS_PER_IP=10",
+		"ATLAS_API0_TRUSTED_SERVER_LIMITS=invalid",
+	))
+	if act := s.API0.ServerLimits(); !reflect.DeepEqual(act, initial) {
+		t.Errorf("expected invalid reload to keep limits %+v, got %+v", initial, act)
+	}
+
+	s.HandleSIGHUP(config(
+		"ATLAS_API0_MAX_SERVERS=200",
+		"ATLAS_API0_MAX_SERVERS_PER_IP=10",
+		"ATLAS_API0_TRUSTED_SERVER_LIMITS=192.0.2.0/24=-1",
+	))
+	reloaded := api0.ServerLimits{
+		MaxServers:      200,
+		MaxServersPerIP: 10,
+		TrustedServerLimits: []api0.TrustedServerLimit{
+			{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxServersPerIP: -1},
+		},
+	}
+	if act := s.API0.ServerLimits(); !reflect.DeepEqual(act, reloaded) {
+		t.Errorf("expected reloaded limits %+v, got %+v", reloaded, act)
+	}
+}
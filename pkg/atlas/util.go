@@ -1,15 +1,31 @@
 package atlas
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pg9182/ip2x"
+	"github.com/r2northstar/atlas/pkg/api/api0"
+	"github.com/rs/xid"
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
 )
 
 // ip2xMgr wraps a file-backed IP2Location database.
@@ -25,6 +41,7 @@ func (m *ip2xMgr) Load(name string) error {
 	if name == "" {
 		m.mu.RLock()
 		if m.file == nil {
+			m.mu.RUnlock()
 			return fmt.Errorf("no ip2location database loaded")
 		}
 		name = m.file.Name()
@@ -121,6 +138,168 @@ func (ms *middlewares) Then(h http.Handler) http.Handler {
 	return h
 }
 
+// securityHeaders sets security-related headers on responses. It does not
+// modify caching headers. If hstsMaxAge is non-zero, Strict-Transport-Security
+// is set for TLS requests.
+func securityHeaders(hstsMaxAge time.Duration) func(http.Handler) http.Handler {
+	var hsts string
+	if hstsMaxAge > 0 {
+		hsts = "max-age=" + strconv.FormatInt(int64(hstsMaxAge/time.Second), 10)
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+			if hsts != "" && r.TLS != nil {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// realIPXFF replaces the remote address with the client IP from
+// X-Forwarded-For if the request came from a trusted proxy. The header is read
+// right-to-left, skipping trusted proxies, so clients can't spoof it by adding
+// their own entries.
+func realIPXFF(trusted []netip.Prefix, onError func(*http.Request, error)) func(http.Handler) http.Handler {
+	isTrusted := func(ip netip.Addr) bool {
+		ip = ip.Unmap()
+		for _, pfx := range trusted {
+			if pfx.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if xff := r.Header.Values("X-Forwarded-For"); len(xff) != 0 {
+				if raddr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+					if isTrusted(raddr.Addr()) {
+						var ips []string
+						for _, v := range xff {
+							ips = append(ips, strings.Split(v, ",")...)
+						}
+						var client netip.Addr
+						for i := len(ips) - 1; i >= 0; i-- {
+							x, err := netip.ParseAddr(strings.TrimSpace(ips[i]))
+							if err != nil {
+								if onError != nil {
+									onError(r, fmt.Errorf("parse X-Forwarded-For: %w", err))
+								}
+								client = netip.Addr{}
+								break
+							}
+							client = x.Unmap()
+							if !isTrusted(client) {
+								break
+							}
+						}
+						if client.IsValid() {
+							r2 := *r
+							r2.RemoteAddr = netip.AddrPortFrom(client, raddr.Port()).String()
+							r = &r2
+						}
+					} else if onError != nil {
+						onError(r, fmt.Errorf("have X-Forwarded-For, but ip %s is not a trusted proxy", raddr.Addr()))
+					}
+				} else if onError != nil {
+					onError(r, fmt.Errorf("parse remote addr: %w", err))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// trustRequestID uses the request ID from the X-Atlas-Request-Id header (which
+// must be a valid xid) if the request came from a trusted proxy. The W3C
+// traceparent header is removed from requests not from a trusted proxy so it
+// can be safely logged. It must be used before hlog.RequestIDHandler.
+func trustRequestID(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	isTrusted := func(ip netip.Addr) bool {
+		ip = ip.Unmap()
+		for _, pfx := range trusted {
+			if pfx.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if raddr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil && isTrusted(raddr.Addr()) {
+				if v := r.Header.Get("X-Atlas-Request-Id"); v != "" {
+					if id, err := xid.FromString(v); err == nil {
+						r = r.WithContext(hlog.CtxWithID(r.Context(), id))
+					}
+				}
+			} else {
+				r.Header.Del("traceparent")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// precompressedEncodings are the encodings supported by
+// precompressedFileServer, in order of preference.
+var precompressedEncodings = [...]struct {
+	Encoding string
+	Ext      string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressedFileServer serves {file}.br or {file}.gz from root instead of
+// {file} if the client accepts it and it exists, otherwise it calls next. The
+// Content-Type is determined from the original file extension.
+func precompressedFileServer(root http.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = path.Join(name, "index.html")
+		}
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		accept := map[string]bool{}
+		for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+			t, p, _ := strings.Cut(e, ";")
+			accept[strings.ToLower(strings.TrimSpace(t))] = strings.ReplaceAll(p, " ", "") != "q=0"
+		}
+		for _, pe := range precompressedEncodings {
+			if !accept[pe.Encoding] {
+				continue
+			}
+			f, err := root.Open(name + pe.Ext)
+			if err != nil {
+				continue
+			}
+			st, err := f.Stat()
+			if err != nil || !st.Mode().IsRegular() {
+				f.Close()
+				continue
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.Header().Set("Content-Encoding", pe.Encoding)
+			http.ServeContent(w, r, name, st.ModTime(), f)
+			f.Close()
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 type statusInterceptor struct {
 	Handler http.Handler
 	Error   func(s int) http.Handler
@@ -165,3 +344,469 @@ func (i *statusInterceptorResponse) WriteHeader(statusCode int) {
 	i.hdr = true
 	i.w.WriteHeader(statusCode)
 }
+
+// debugSampler logs the full details of a random fraction of requests.
+func debugSampler(l zerolog.Logger, rate float64) func(http.Handler) http.Handler {
+	const snippet = 512
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rand.Float64() >= rate {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			var reqBody []byte
+			if r.Body != nil {
+				reqBody, _ = io.ReadAll(io.LimitReader(r.Body, snippet))
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(reqBody), r.Body), r.Body}
+			}
+
+			sw := &debugSamplerResponse{w: w, status: http.StatusOK}
+			start := time.Now()
+			h.ServeHTTP(sw, r)
+
+			u := *r.URL
+			u.RawQuery = redactQuery(u.Query()).Encode()
+
+			e := l.Debug()
+			if rid, ok := hlog.IDFromRequest(r); ok {
+				e = e.Stringer("rid", rid)
+			}
+			e.
+				Str("component", "debug-sample").
+				Str("request_ip", r.RemoteAddr).
+				Str("request_host", r.Host).
+				Str("request_method", r.Method).
+				Str("request_uri", u.String()).
+				Interface("request_headers", redactHeaders(r.Header)).
+				Str("request_body", string(redactJSON(reqBody))).
+				Int("response_status", sw.status).
+				Int("response_size", sw.size).
+				Interface("response_headers", redactHeaders(w.Header())).
+				Str("response_body", string(redactJSON(sw.body))).
+				Dur("response_duration", time.Since(start)).
+				Msg("sampled request")
+		})
+	}
+}
+
+type debugSamplerResponse struct {
+	w      http.ResponseWriter
+	status int
+	size   int
+	body   []byte
+}
+
+func (d *debugSamplerResponse) Header() http.Header {
+	return d.w.Header()
+}
+
+func (d *debugSamplerResponse) WriteHeader(statusCode int) {
+	d.status = statusCode
+	d.w.WriteHeader(statusCode)
+}
+
+func (d *debugSamplerResponse) Write(b []byte) (int, error) {
+	if n := 512 - len(d.body); n > 0 {
+		d.body = append(d.body, b[:min(n, len(b))]...)
+	}
+	n, err := d.w.Write(b)
+	d.size += n
+	return n, err
+}
+
+func (d *debugSamplerResponse) Unwrap() http.ResponseWriter {
+	return d.w // for http.ResponseController
+}
+
+// redactQuery returns a copy of q with the values of sensitive parameters
+// replaced.
+func redactQuery(q url.Values) url.Values {
+	r := make(url.Values, len(q))
+	for k, v := range q {
+		v = slices.Clone(v)
+		if isSensitiveKey(k) {
+			for i := range v {
+				v[i] = "REDACTED"
+			}
+		}
+		r[k] = v
+	}
+	return r
+}
+
+// redactHeaders returns a copy of h with the values of sensitive headers
+// replaced.
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for k, v := range h {
+		if isSensitiveKey(k) || strings.EqualFold(k, "Authorization") || strings.EqualFold(k, "Cookie") {
+			for i := range v {
+				v[i] = "REDACTED"
+			}
+		}
+	}
+	return h
+}
+
+// redactJSON returns a copy of b with the values of string, number, boolean,
+// and null fields with sensitive keys replaced (objects and arrays are left
+// as-is, but fields within them are redacted as usual). It does not validate
+// the JSON, and works on truncated snippets (an unterminated sensitive value is
+// redacted to the end). Anything which isn't JSON is returned as-is.
+func redactJSON(b []byte) []byte {
+	// scanString returns the index after the end of the string starting at
+	// b[i] (which must be a quote), or len(b) if it is unterminated
+	scanString := func(i int) int {
+		for i++; i < len(b); i++ {
+			switch b[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1
+			}
+		}
+		return len(b)
+	}
+	skipSpace := func(i int) int {
+		for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\r' || b[i] == '\n') {
+			i++
+		}
+		return i
+	}
+	var (
+		r    []byte
+		last int
+	)
+	for i := 0; i < len(b); {
+		if b[i] != '"' {
+			i++
+			continue
+		}
+		j := scanString(i)
+		k := skipSpace(j)
+		if k >= len(b) || b[k] != ':' || !isSensitiveKey(string(b[i:j])) {
+			i = j
+			continue
+		}
+		if k = skipSpace(k + 1); k >= len(b) || b[k] == '{' || b[k] == '[' {
+			i = k
+			continue
+		}
+		r = append(r, b[last:k]...)
+		r = append(r, `"REDACTED"`...)
+		if b[k] == '"' {
+			i = scanString(k)
+		} else {
+			i = k
+			for i < len(b) && !strings.ContainsRune(",}] \t\r\n", rune(b[i])) {
+				i++
+			}
+		}
+		last = i
+	}
+	if r == nil {
+		return b
+	}
+	return append(r, b[last:]...)
+}
+
+func isSensitiveKey(k string) bool {
+	k = strings.ToLower(k)
+	return strings.Contains(k, "token") || strings.Contains(k, "password") || strings.Contains(k, "secret")
+}
+
+// connLimitListener limits the number of concurrent connections from each
+// remote IP, closing new connections which exceed the limit.
+//
+// The limit is checked on the first read or write rather than in Accept so the
+// remote address can be taken from a PROXY protocol header (which is read
+// lazily) without blocking the accept loop.
+type connLimitListener struct {
+	net.Listener
+	max int
+
+	mu sync.Mutex
+	n  map[netip.Addr]int
+}
+
+// errConnLimit is returned when reading from or writing to a connection which
+// was closed for exceeding the per-IP limit.
+var errConnLimit = errors.New("too many connections from ip")
+
+func newConnLimitListener(l net.Listener, max int) *connLimitListener {
+	return &connLimitListener{
+		Listener: l,
+		max:      max,
+		n:        make(map[netip.Addr]int),
+	}
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &connLimitConn{Conn: c, l: l}, nil
+}
+
+func (l *connLimitListener) acquire(ip netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n[ip] >= l.max {
+		return false
+	}
+	l.n[ip]++
+	return true
+}
+
+func (l *connLimitListener) release(ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n[ip]--; l.n[ip] <= 0 {
+		delete(l.n, ip)
+	}
+}
+
+type connLimitConn struct {
+	net.Conn
+	l    *connLimitListener
+	once sync.Once
+	ip   netip.Addr // valid if counted
+	err  error
+	rel  sync.Once
+}
+
+func (c *connLimitConn) init() {
+	c.once.Do(func() {
+		a, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return
+		}
+		if ip := a.AddrPort().Addr().Unmap(); c.l.acquire(ip) {
+			c.ip = ip
+		} else {
+			c.err = errConnLimit
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *connLimitConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *connLimitConn) Write(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *connLimitConn) Close() error {
+	c.once.Do(func() {
+		c.err = net.ErrClosed
+	})
+	c.rel.Do(func() {
+		if c.ip.IsValid() {
+			c.l.release(c.ip)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// proxyProtoListener reads a PROXY protocol v2 header from each connection,
+// replacing the remote address with the one from the header.
+type proxyProtoListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func newProxyProtoListener(l net.Listener, timeout time.Duration) *proxyProtoListener {
+	return &proxyProtoListener{
+		Listener: l,
+		timeout:  timeout,
+	}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// note: the header is read lazily so we don't block the accept loop
+	return &proxyProtoConn{Conn: c, timeout: l.timeout}, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	timeout time.Duration
+	once    sync.Once
+	raddr   net.Addr
+	err     error
+}
+
+// proxyProtoSig is the PROXY protocol v2 signature.
+var proxyProtoSig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoMaxLen is the maximum length of the address block (including
+// TLVs) accepted in a PROXY protocol v2 header.
+const proxyProtoMaxLen = 1024
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		if c.raddr, c.err = readProxyProtoHeader(c.Conn); c.err != nil {
+			c.err = fmt.Errorf("proxy protocol: %w", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.init(); c.raddr != nil {
+		return c.raddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtoHeader reads a PROXY protocol v2 header from r, returning the
+// source address, or nil if the connection isn't being proxied (i.e., it's a
+// health check from the proxy itself).
+func readProxyProtoHeader(r io.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if !bytes.Equal(hdr[:12], proxyProtoSig) {
+		return nil, errors.New("invalid signature")
+	}
+	if v := hdr[12] >> 4; v != 2 {
+		return nil, fmt.Errorf("unsupported version %d", v)
+	}
+
+	n := binary.BigEndian.Uint16(hdr[14:])
+	if n > proxyProtoMaxLen {
+		return nil, fmt.Errorf("address block too long (%d > %d)", n, proxyProtoMaxLen)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("read addresses: %w", err)
+	}
+
+	switch cmd := hdr[12] & 0xF; cmd {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %#x", cmd)
+	}
+
+	switch fam := hdr[13]; fam {
+	case 0x11: // TCP over IPv4
+		if len(buf) < 12 {
+			return nil, errors.New("address block too short")
+		}
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte(buf[0:4])), binary.BigEndian.Uint16(buf[8:]))), nil
+	case 0x21: // TCP over IPv6
+		if len(buf) < 36 {
+			return nil, errors.New("address block too short")
+		}
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom16([16]byte(buf[0:16])), binary.BigEndian.Uint16(buf[32:]))), nil
+	case 0x00: // UNSPEC
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported address family/protocol %#x", fam)
+	}
+}
+
+// replicaAccountStorage reads accounts from a read-only replica, falling back
+// to the primary if the account doesn't exist there yet. Writes always go to
+// the primary. Since reads may be stale, it must only be used for lookups which
+// aren't followed by a write (otherwise the stale account would be saved over
+// the current one).
+type replicaAccountStorage struct {
+	primary api0.AccountStorage
+	replica api0.AccountStorage
+}
+
+func (s *replicaAccountStorage) GetUIDsByUsername(username string) ([]uint64, error) {
+	return s.replica.GetUIDsByUsername(username)
+}
+
+func (s *replicaAccountStorage) GetAccount(uid uint64) (*api0.Account, error) {
+	if a, err := s.replica.GetAccount(uid); err != nil || a != nil {
+		return a, err
+	}
+	return s.primary.GetAccount(uid)
+}
+
+func (s *replicaAccountStorage) SaveAccount(a *api0.Account) error {
+	return s.primary.SaveAccount(a)
+}
+
+// serverEventWriter asynchronously writes server events in batches. Events are
+// dropped if the queue is full so a slow write never blocks the server list.
+type serverEventWriter struct {
+	l       zerolog.Logger
+	ch      chan api0.ServerEvent
+	write   func([]api0.ServerEvent) error
+	dropped atomic.Uint64
+}
+
+func newServerEventWriter(l zerolog.Logger, n int, write func([]api0.ServerEvent) error) *serverEventWriter {
+	w := &serverEventWriter{
+		l:     l,
+		ch:    make(chan api0.ServerEvent, n),
+		write: write,
+	}
+	go w.run()
+	return w
+}
+
+// Add queues e to be written. It never blocks.
+func (w *serverEventWriter) Add(e api0.ServerEvent) {
+	select {
+	case w.ch <- e:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func (w *serverEventWriter) run() {
+	batch := make([]api0.ServerEvent, 0, 256)
+	for e := range w.ch {
+		batch = append(batch[:0], e)
+	more:
+		for len(batch) < cap(batch) {
+			select {
+			case e := <-w.ch:
+				batch = append(batch, e)
+			default:
+				break more
+			}
+		}
+		if err := w.write(batch); err != nil {
+			w.l.Err(err).Int("count", len(batch)).Msg("failed to write server events")
+		}
+		if n := w.dropped.Swap(0); n != 0 {
+			w.l.Warn().Uint64("count", n).Msg("dropped server events since the queue was full")
+		}
+	}
+}
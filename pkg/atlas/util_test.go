@@ -0,0 +1,453 @@
+package atlas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r2northstar/atlas/pkg/api/api0"
+	"github.com/r2northstar/atlas/pkg/memstore"
+	"github.com/rs/zerolog"
+)
+
+func TestReplicaAccountStorage(t *testing.T) {
+	primary, replica := memstore.NewAccountStore(), memstore.NewAccountStore()
+	s := &replicaAccountStorage{primary: primary, replica: replica}
+
+	// stale in the replica
+	if err := primary.SaveAccount(&api0.Account{UID: 1, Username: "new"}); err != nil {
+		t.Fatalf("save account: %v", err)
+	}
+	if err := replica.SaveAccount(&api0.Account{UID: 1, Username: "old"}); err != nil {
+		t.Fatalf("save account: %v", err)
+	}
+
+	// only in the primary
+	if err := primary.SaveAccount(&api0.Account{UID: 2, Username: "primary"}); err != nil {
+		t.Fatalf("save account: %v", err)
+	}
+
+	for uid, exp := range map[uint64]string{
+		1: "old",
+		2: "primary",
+		3: "",
+	} {
+		a, err := s.GetAccount(uid)
+		if err != nil {
+			t.Fatalf("get account %d: %v", uid, err)
+		}
+		if act := ""; a != nil {
+			if act = a.Username; act != exp {
+				t.Errorf("get account %d: expected username %q, got %q", uid, exp, act)
+			}
+		} else if exp != "" {
+			t.Errorf("get account %d: expected username %q, got no account", uid, exp)
+		}
+	}
+
+	if uids, err := s.GetUIDsByUsername("old"); err != nil {
+		t.Fatalf("get uids: %v", err)
+	} else if !slices.Equal(uids, []uint64{1}) {
+		t.Errorf("expected uids to be looked up in the replica, got %v", uids)
+	}
+
+	if err := s.SaveAccount(&api0.Account{UID: 3, Username: "saved"}); err != nil {
+		t.Fatalf("save account: %v", err)
+	}
+	if a, err := primary.GetAccount(3); err != nil || a == nil || a.Username != "saved" {
+		t.Errorf("expected account to be saved to the primary, got %v %v", a, err)
+	}
+	if a, err := replica.GetAccount(3); err != nil || a != nil {
+		t.Errorf("expected account not to be saved to the replica, got %v %v", a, err)
+	}
+}
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	hdr := func(verCmd, fam byte, addr []byte) []byte {
+		b := append([]byte{}, proxyProtoSig...)
+		b = append(b, verCmd, fam)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(addr)))
+		return append(b, addr...)
+	}
+	ipv4 := []byte{
+		192, 0, 2, 1, // src
+		198, 51, 100, 1, // dst
+		0x30, 0x39, // src port
+		0x01, 0xBB, // dst port
+	}
+	ipv6 := netip.MustParseAddr("2001:db8::1").AsSlice()                 // src
+	ipv6 = append(ipv6, netip.MustParseAddr("2001:db8::2").AsSlice()...) // dst
+	ipv6 = append(ipv6, 0x30, 0x39, 0x01, 0xBB)                          // ports
+	for _, c := range []struct {
+		Name  string
+		Input []byte
+		Addr  string // empty for nil
+		Error string // empty for none
+	}{
+		{"IPv4", hdr(0x21, 0x11, ipv4), "192.0.2.1:12345", ""},
+		{"IPv6", hdr(0x21, 0x21, ipv6), "[2001:db8::1]:12345", ""},
+		{"IPv4TLV", hdr(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)), "192.0.2.1:12345", ""},
+		{"Local", hdr(0x20, 0x00, nil), "", ""},
+		{"LocalIPv4", hdr(0x20, 0x11, ipv4), "", ""},
+		{"Unspec", hdr(0x21, 0x00, nil), "", ""},
+		{"Empty", nil, "", "read header"},
+		{"TruncatedHeader", hdr(0x21, 0x11, ipv4)[:14], "", "read header"},
+		{"TruncatedAddress", hdr(0x21, 0x11, ipv4)[:20], "", "read addresses"},
+		{"Signature", append([]byte("GET / HTTP/1.1\r\n"), ipv4...), "", "invalid signature"},
+		{"Version1", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"), "", "invalid signature"},
+		{"Version", hdr(0x11, 0x11, ipv4), "", "unsupported version"},
+		{"Command", hdr(0x22, 0x11, ipv4), "", "unsupported command"},
+		{"Family", hdr(0x21, 0x12, ipv4), "", "unsupported address family"},
+		{"ShortIPv4", hdr(0x21, 0x11, ipv4[:11]), "", "too short"},
+		{"ShortIPv6", hdr(0x21, 0x21, ipv6[:35]), "", "too short"},
+		{"Oversized", hdr(0x21, 0x11, make([]byte, proxyProtoMaxLen+1)), "", "too long"},
+		{"MaxLength", func() []byte {
+			b := hdr(0x21, 0x11, ipv4)
+			return append(binary.BigEndian.AppendUint16(b[:14], 0xFFFF), ipv4...)
+		}(), "", "too long"},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			addr, err := readProxyProtoHeader(bytes.NewReader(c.Input))
+			if c.Error != "" {
+				if err == nil || !strings.Contains(err.Error(), c.Error) {
+					t.Errorf("expected error containing %q, got %v", c.Error, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.Addr == "" {
+				if addr != nil {
+					t.Errorf("expected nil address, got %v", addr)
+				}
+			} else if addr == nil || addr.String() != c.Addr {
+				t.Errorf("expected address %s, got %v", c.Addr, addr)
+			}
+		})
+	}
+}
+
+func TestConnLimitListenerProxyProto(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	lln := newConnLimitListener(newProxyProtoListener(ln, time.Second*5), 1)
+	go func() {
+		for {
+			c, err := lln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	dial := func(src string) net.Conn {
+		t.Helper()
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		c.SetDeadline(time.Now().Add(time.Second * 5))
+
+		ap := netip.MustParseAddrPort(src)
+		b := append([]byte{}, proxyProtoSig...)
+		b = append(b, 0x21, 0x11, 0x00, 12)
+		b = append(b, ap.Addr().AsSlice()...)
+		b = append(b, 127, 0, 0, 1)
+		b = binary.BigEndian.AppendUint16(b, ap.Port())
+		b = binary.BigEndian.AppendUint16(b, 443)
+		if _, err := c.Write(b); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		return c
+	}
+	echo := func(c net.Conn) error {
+		if _, err := c.Write([]byte("test")); err != nil {
+			return err
+		}
+		var buf [4]byte
+		_, err := io.ReadFull(c, buf[:])
+		return err
+	}
+
+	c1 := dial("192.0.2.1:1000")
+	defer c1.Close()
+	if err := echo(c1); err != nil {
+		t.Fatalf("first connection: unexpected error: %v", err)
+	}
+
+	// different client behind the same load balancer
+	c2 := dial("192.0.2.2:1000")
+	defer c2.Close()
+	if err := echo(c2); err != nil {
+		t.Fatalf("connection from another client: unexpected error: %v", err)
+	}
+
+	// same client
+	c3 := dial("192.0.2.1:1001")
+	defer c3.Close()
+	if err := echo(c3); err == nil {
+		t.Fatalf("connection exceeding limit: expected connection to be closed")
+	}
+
+	// after the first one is closed
+	c1.Close()
+	for i := 0; ; i++ {
+		c4 := dial("192.0.2.1:1002")
+		err := echo(c4)
+		c4.Close()
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("connection after the previous one was closed: unexpected error: %v", err)
+		}
+		time.Sleep(time.Millisecond * 10) // wait for the server to notice
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	for _, c := range []struct {
+		Name   string
+		Input  string
+		Output string
+	}{
+		{"Empty", ``, ``},
+		{"NotJSON", `token=abc`, `token=abc`},
+		{"None", `{"name":"test","uid":1}`, `{"name":"test","uid":1}`},
+		{"String", `{"token":"abc","name":"test"}`, `{"token":"REDACTED","name":"test"}`},
+		{"CaseInsensitive", `{"AuthToken":"abc","Password":"def"}`, `{"AuthToken":"REDACTED","Password":"REDACTED"}`},
+		{"Whitespace", "{ \"secret\" :\n\t\"abc\" }", "{ \"secret\" :\n\t\"REDACTED\" }"},
+		{"Nested", `{"a":{"b":[{"serverAuthToken":"abc"}]},"c":"d"}`, `{"a":{"b":[{"serverAuthToken":"REDACTED"}]},"c":"d"}`},
+		{"NestedObject", `{"secrets":{"x":"abc","token":"def"}}`, `{"secrets":{"x":"abc","token":"REDACTED"}}`},
+		{"Array", `{"tokens":["abc","def"]}`, `{"tokens":["abc","def"]}`},
+		{"EscapedValue", `{"token":"a\"b\\","name":"test"}`, `{"token":"REDACTED","name":"test"}`},
+		{"EscapedKey", `{"x\"token":"abc"}`, `{"x\"token":"REDACTED"}`},
+		{"EscapedQuoteNotKey", `{"name":"\"token\":\"abc"}`, `{"name":"\"token\":\"abc"}`},
+		{"SensitiveValueNotKey", `{"name":"token","x":"y"}`, `{"name":"token","x":"y"}`},
+		{"Number", `{"token":12345,"name":"test"}`, `{"token":"REDACTED","name":"test"}`},
+		{"Bool", `{"secret":true}`, `{"secret":"REDACTED"}`},
+		{"Null", `{"password": null }`, `{"password": "REDACTED" }`},
+		{"Multiple", `[{"token":"a"},{"token":"b"}]`, `[{"token":"REDACTED"},{"token":"REDACTED"}]`},
+		{"TruncatedValue", `{"token":"abcdef`, `{"token":"REDACTED"`},
+		{"TruncatedNumber", `{"token":123`, `{"token":"REDACTED"`},
+		{"TruncatedAfterColon", `{"token":`, `{"token":`},
+		{"TruncatedKey", `{"name":"test","tok`, `{"name":"test","tok`},
+		{"TruncatedEscape", `{"token":"abc\`, `{"token":"REDACTED"`},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			if act := string(redactJSON([]byte(c.Input))); act != c.Output {
+				t.Errorf("expected %s, got %s", c.Output, act)
+			}
+		})
+	}
+}
+
+func TestRedactQuery(t *testing.T) {
+	q := url.Values{
+		"id":          {"1"},
+		"token":       {"abc"},
+		"playerToken": {"def", "ghi"},
+		"Password":    {"jkl"},
+	}
+	r := redactQuery(q)
+	if exp := "Password=REDACTED&id=1&playerToken=REDACTED&playerToken=REDACTED&token=REDACTED"; r.Encode() != exp {
+		t.Errorf("expected %s, got %s", exp, r.Encode())
+	}
+	if q.Get("token") != "abc" {
+		t.Errorf("original query was modified")
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	h := http.Header{
+		"User-Agent":     {"test"},
+		"Authorization":  {"Bearer abc"},
+		"Cookie":         {"a=b"},
+		"X-Server-Token": {"def"},
+		"X-Secret-Key":   {"ghi", "jkl"},
+	}
+	r := redactHeaders(h)
+	for k, exp := range map[string][]string{
+		"User-Agent":     {"test"},
+		"Authorization":  {"REDACTED"},
+		"Cookie":         {"REDACTED"},
+		"X-Server-Token": {"REDACTED"},
+		"X-Secret-Key":   {"REDACTED", "REDACTED"},
+	} {
+		if act := r.Values(k); !slices.Equal(act, exp) {
+			t.Errorf("%s: expected %q, got %q", k, exp, act)
+		}
+	}
+	if h.Get("Authorization") != "Bearer abc" {
+		t.Errorf("original headers were modified")
+	}
+}
+
+func TestDebugSampler(t *testing.T) {
+	for _, c := range []struct {
+		Name   string
+		Rate   float64
+		Body   string
+		Logged string // expected request body suffix, empty if not logged
+	}{
+		{"Disabled", 0, `{"token":"reqsecret"}`, ""},
+		{"Sampled", 1, `{"token":"reqsecret"}`, `{"token":"REDACTED"}`},
+		{"Truncated", 1, `{"name":"` + strings.Repeat("x", 600) + `","token":"reqsecret"}`, `xxx`},
+		{"TruncatedValue", 1, `{"name":"` + strings.Repeat("x", 490) + `","token":"reqsecret"}`, `xxx","token":"REDACTED"`},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			h := debugSampler(zerolog.New(&buf).Level(zerolog.DebugLevel), c.Rate)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Errorf("read body: %v", err)
+				}
+				if string(b) != c.Body {
+					t.Errorf("handler didn't get the full request body")
+				}
+				w.Header().Set("X-Auth-Token", "respheadersecret")
+				w.WriteHeader(http.StatusTeapot)
+				w.Write([]byte(`{"success":true,"token":"respsecret"}`))
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/test?id=1&token=querysecret", strings.NewReader(c.Body))
+			r.Header.Set("Authorization", "headersecret")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != http.StatusTeapot {
+				t.Errorf("expected status %d, got %d", http.StatusTeapot, w.Code)
+			}
+			if w.Body.String() != `{"success":true,"token":"respsecret"}` {
+				t.Errorf("response body was modified")
+			}
+			if w.Header().Get("X-Auth-Token") != "respheadersecret" {
+				t.Errorf("response headers were modified")
+			}
+
+			if c.Logged == "" {
+				if buf.Len() != 0 {
+					t.Errorf("expected nothing to be logged, got %s", buf.String())
+				}
+				return
+			}
+			var obj struct {
+				RequestURI      string      `json:"request_uri"`
+				RequestHeaders  http.Header `json:"request_headers"`
+				RequestBody     string      `json:"request_body"`
+				ResponseStatus  int         `json:"response_status"`
+				ResponseHeaders http.Header `json:"response_headers"`
+				ResponseBody    string      `json:"response_body"`
+			}
+			if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+				t.Fatalf("invalid log entry %q: %v", buf.String(), err)
+			}
+			for _, x := range []string{"querysecret", "headersecret", "reqsecret", "respsecret", "respheadersecret"} {
+				if strings.Contains(buf.String(), x) {
+					t.Errorf("log entry contains %q: %s", x, buf.String())
+				}
+			}
+			if exp := "/test?id=1&token=REDACTED"; obj.RequestURI != exp {
+				t.Errorf("expected request uri %q, got %q", exp, obj.RequestURI)
+			}
+			if exp := "REDACTED"; obj.RequestHeaders.Get("Authorization") != exp {
+				t.Errorf("expected authorization header %q, got %q", exp, obj.RequestHeaders.Get("Authorization"))
+			}
+			if exp := "REDACTED"; obj.ResponseHeaders.Get("X-Auth-Token") != exp {
+				t.Errorf("expected response token header %q, got %q", exp, obj.ResponseHeaders.Get("X-Auth-Token"))
+			}
+			if !strings.HasSuffix(obj.RequestBody, c.Logged) {
+				t.Errorf("expected request body to end with %s, got %s", c.Logged, obj.RequestBody)
+			}
+			if len(obj.RequestBody) > 512+len(`"REDACTED"`) {
+				t.Errorf("expected request body to be truncated, got %d bytes", len(obj.RequestBody))
+			}
+			if exp := `{"success":true,"token":"REDACTED"}`; obj.ResponseBody != exp {
+				t.Errorf("expected response body %s, got %s", exp, obj.ResponseBody)
+			}
+			if obj.ResponseStatus != http.StatusTeapot {
+				t.Errorf("expected response status %d, got %d", http.StatusTeapot, obj.ResponseStatus)
+			}
+		})
+	}
+}
+
+func TestRealIPXFF(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+	for _, c := range []struct {
+		Name       string
+		RemoteAddr string
+		XFF        []string
+		Result     string
+		Error      bool
+	}{
+		{"None", "10.0.0.1:1234", nil, "10.0.0.1:1234", false},
+		{"Untrusted", "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1:1234", true},
+		{"Single", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1:1234", false},
+		{"SingleIPv6", "[fd00::1]:1234", []string{"2001:db8::1"}, "[2001:db8::1]:1234", false},
+		{"MappedRemote", "[::ffff:10.0.0.1]:1234", []string{"198.51.100.1"}, "198.51.100.1:1234", false},
+		{"MappedClient", "10.0.0.1:1234", []string{"::ffff:198.51.100.1"}, "198.51.100.1:1234", false},
+		{"TrustedChain", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2, fd00::2"}, "198.51.100.1:1234", false},
+		{"Spoofed", "10.0.0.1:1234", []string{"203.0.113.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1:1234", false},
+		{"SpoofedTrusted", "10.0.0.1:1234", []string{"10.0.0.5, 198.51.100.1"}, "198.51.100.1:1234", false},
+		{"AllTrusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3:1234", false},
+		{"Whitespace", "10.0.0.1:1234", []string{" 198.51.100.1 ,10.0.0.2 "}, "198.51.100.1:1234", false},
+		{"MultipleHeaders", "10.0.0.1:1234", []string{"203.0.113.1", "198.51.100.1, 10.0.0.2"}, "198.51.100.1:1234", false},
+		{"MultipleHeadersTrusted", "10.0.0.1:1234", []string{"198.51.100.1", "10.0.0.2"}, "198.51.100.1:1234", false},
+		{"MalformedClient", "10.0.0.1:1234", []string{"198.51.100.1, garbage"}, "10.0.0.1:1234", true},
+		{"MalformedAfterTrusted", "10.0.0.1:1234", []string{"garbage, 10.0.0.2"}, "10.0.0.1:1234", true},
+		{"MalformedSpoofed", "10.0.0.1:1234", []string{"garbage, 198.51.100.1"}, "198.51.100.1:1234", false},
+		{"WithPort", "10.0.0.1:1234", []string{"198.51.100.1:5678"}, "10.0.0.1:1234", true},
+		{"Empty", "10.0.0.1:1234", []string{""}, "10.0.0.1:1234", true},
+		{"EmptyEntry", "10.0.0.1:1234", []string{"198.51.100.1,,10.0.0.2"}, "10.0.0.1:1234", true},
+		{"InvalidRemoteAddr", "garbage", []string{"198.51.100.1"}, "garbage", true},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			var (
+				remoteAddr string
+				gotError   bool
+			)
+			h := realIPXFF(trusted, func(r *http.Request, err error) {
+				gotError = true
+			})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remoteAddr = r.RemoteAddr
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = c.RemoteAddr
+			for _, v := range c.XFF {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if remoteAddr != c.Result {
+				t.Errorf("expected remote addr %q, got %q", c.Result, remoteAddr)
+			}
+			if gotError != c.Error {
+				t.Errorf("expected error to be %t, got %t", c.Error, gotError)
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ package memstore
 
 import (
 	"bytes"
+	"container/list"
 	"crypto/sha256"
+	"errors"
 	"io"
 	"strings"
 	"sync"
@@ -12,9 +14,16 @@ import (
 	"github.com/r2northstar/atlas/pkg/api/api0"
 )
 
+// ErrAccountLimit is returned by AccountStore.SaveAccount if a new account
+// cannot be created since the store is full.
+var ErrAccountLimit = errors.New("memstore: account limit reached")
+
 // AccountStore stores accounts in-memory.
 type AccountStore struct {
+	max      int
 	accounts sync.Map
+	newMu    sync.Mutex // held while creating new accounts
+	count    int        // protected by newMu
 }
 
 // NewPdataStore creates a new MemoryPdataStore.
@@ -22,6 +31,16 @@ func NewAccountStore() *AccountStore {
 	return &AccountStore{}
 }
 
+// NewAccountStoreLimit is like NewAccountStore, but refuses to create more than
+// max accounts. If max is zero, it is ignored.
+//
+// This is intended as a safety valve for when the memory store is mistakenly
+// used in production, not as an eviction policy: accounts cannot be evicted
+// since they would lose their auth tokens.
+func NewAccountStoreLimit(max int) *AccountStore {
+	return &AccountStore{max: max}
+}
+
 func (m *AccountStore) GetUIDsByUsername(username string) ([]uint64, error) {
 	var uids []uint64
 	if username != "" {
@@ -46,43 +65,91 @@ func (m *AccountStore) GetAccount(uid uint64) (*api0.Account, error) {
 
 func (m *AccountStore) SaveAccount(a *api0.Account) error {
 	if a != nil {
+		if _, ok := m.accounts.Load(a.UID); ok {
+			m.accounts.Store(a.UID, *a)
+			return nil
+		}
+		m.newMu.Lock()
+		defer m.newMu.Unlock()
+
+		if _, ok := m.accounts.Load(a.UID); !ok {
+			if m.max > 0 && m.count >= m.max {
+				return ErrAccountLimit
+			}
+			m.count++
+		}
 		m.accounts.Store(a.UID, *a)
 	}
 	return nil
 }
 
-// PdataStore stores pdata in-memory, with optional compression.
+// PdataStore stores pdata in-memory, with optional compression and LRU
+// eviction.
+//
+// Note that if limits are set, evicted pdata is lost (i.e., players will get
+// the default pdata next time they log in) since nothing else persists it.
 type PdataStore struct {
-	gzip  bool
-	pdata sync.Map
+	gzip       bool
+	maxEntries int
+	maxBytes   int64
+
+	mu    sync.Mutex
+	pdata map[uint64]*list.Element // of *pdataStoreEntry
+	lru   *list.List               // most recently used first
+	bytes int64
 }
 
 type pdataStoreEntry struct {
+	UID  uint64
 	Hash [sha256.Size]byte
 	Data []byte
 }
 
 // NewPdataStore creates a new MemoryPdataStore.
 func NewPdataStore(compress bool) *PdataStore {
+	return NewPdataStoreLimit(compress, 0, 0)
+}
+
+// NewPdataStoreLimit is like NewPdataStore, but evicts the least recently used
+// pdata once there are more than maxEntries entries or the stored (possibly
+// compressed) data is larger than maxBytes. If either limit is zero, it is
+// ignored.
+func NewPdataStoreLimit(compress bool, maxEntries int, maxBytes int64) *PdataStore {
 	return &PdataStore{
-		gzip: compress,
+		gzip:       compress,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		pdata:      map[uint64]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// get gets the entry for uid, marking it as recently used.
+func (m *PdataStore) get(uid uint64) (*pdataStoreEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.pdata[uid]
+	if !ok {
+		return nil, false
 	}
+	m.lru.MoveToFront(el)
+	return el.Value.(*pdataStoreEntry), true
 }
 
 func (m *PdataStore) GetPdataHash(uid uint64) ([sha256.Size]byte, bool, error) {
-	v, ok := m.pdata.Load(uid)
+	e, ok := m.get(uid)
 	if !ok {
 		return [sha256.Size]byte{}, ok, nil
 	}
-	return v.(pdataStoreEntry).Hash, ok, nil
+	return e.Hash, ok, nil
 }
 
 func (m *PdataStore) GetPdataCached(uid uint64, sha [sha256.Size]byte) ([]byte, bool, error) {
-	v, ok := m.pdata.Load(uid)
+	e, ok := m.get(uid)
 	if !ok {
 		return nil, ok, nil
 	}
-	e := v.(pdataStoreEntry)
 	if sha != [sha256.Size]byte{} && sha == e.Hash {
 		return nil, ok, nil
 	}
@@ -119,9 +186,29 @@ func (m *PdataStore) SetPdata(uid uint64, buf []byte) (int, error) {
 		b = make([]byte, len(buf))
 		copy(b, buf)
 	}
-	m.pdata.Store(uid, pdataStoreEntry{
+	e := &pdataStoreEntry{
+		UID:  uid,
 		Hash: sha256.Sum256(buf),
 		Data: b,
-	})
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.pdata[uid]; ok {
+		m.bytes -= int64(len(el.Value.(*pdataStoreEntry).Data))
+		el.Value = e
+		m.lru.MoveToFront(el)
+	} else {
+		m.pdata[uid] = m.lru.PushFront(e)
+	}
+	m.bytes += int64(len(e.Data))
+
+	// evict the least recently used entries (but never the one we just set)
+	for m.lru.Len() > 1 && ((m.maxEntries > 0 && m.lru.Len() > m.maxEntries) || (m.maxBytes > 0 && m.bytes > m.maxBytes)) {
+		x := m.lru.Remove(m.lru.Back()).(*pdataStoreEntry)
+		delete(m.pdata, x.UID)
+		m.bytes -= int64(len(x.Data))
+	}
 	return len(b), nil
 }
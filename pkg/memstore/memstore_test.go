@@ -1,6 +1,7 @@
 package memstore
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/r2northstar/atlas/pkg/api/api0/api0testutil"
@@ -10,6 +11,15 @@ func TestAccountStore(t *testing.T) {
 	api0testutil.TestAccountStorage(t, NewAccountStore())
 }
 
+func TestAccountStoreLimit(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		api0testutil.TestAccountStorage(t, NewAccountStoreLimit(1<<20))
+	})
+	t.Run("Limit", func(t *testing.T) {
+		api0testutil.TestAccountStorageLimit(t, NewAccountStoreLimit(10), 10)
+	})
+}
+
 func TestPdataStore(t *testing.T) {
 	t.Run("Default", func(t *testing.T) {
 		api0testutil.TestPdataStorage(t, NewPdataStore(false))
@@ -18,3 +28,44 @@ func TestPdataStore(t *testing.T) {
 		api0testutil.TestPdataStorage(t, NewPdataStore(true))
 	})
 }
+
+func TestPdataStoreLimit(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		api0testutil.TestPdataStorage(t, NewPdataStoreLimit(false, 1<<20, 1<<30))
+	})
+	t.Run("MaxEntries", func(t *testing.T) {
+		m := NewPdataStoreLimit(false, 3, 0)
+		for uid := uint64(1); uid <= 4; uid++ {
+			if _, err := m.SetPdata(uid, []byte(strconv.FormatUint(uid, 10))); err != nil {
+				t.Fatalf("set %d: %v", uid, err)
+			}
+			if uid == 3 {
+				m.GetPdataHash(1) // mark as recently used
+			}
+		}
+		for uid, exp := range map[uint64]bool{1: true, 2: false, 3: true, 4: true} {
+			if _, ok, _ := m.GetPdataHash(uid); ok != exp {
+				t.Errorf("uid %d: expected exists=%t, got %t", uid, exp, ok)
+			}
+		}
+	})
+	t.Run("MaxBytes", func(t *testing.T) {
+		m := NewPdataStoreLimit(false, 0, 10)
+		m.SetPdata(1, make([]byte, 4))
+		m.SetPdata(2, make([]byte, 4))
+		m.SetPdata(3, make([]byte, 4))
+		if _, ok, _ := m.GetPdataHash(1); ok {
+			t.Errorf("expected uid 1 to be evicted")
+		}
+		if _, ok, _ := m.GetPdataHash(3); !ok {
+			t.Errorf("expected uid 3 to exist")
+		}
+		m.SetPdata(4, make([]byte, 20))
+		if _, ok, _ := m.GetPdataHash(4); !ok {
+			t.Errorf("expected oversized uid 4 to exist")
+		}
+		if _, ok, _ := m.GetPdataHash(3); ok {
+			t.Errorf("expected uid 3 to be evicted")
+		}
+	})
+}
@@ -126,6 +126,15 @@ func (c *GeoCounter2) SetUnknown(v uint64) {
 	atomic.StoreUint64(&c.unk, v)
 }
 
+// Resolution returns the sum of the counters for known locations, and the value
+// of the unknown counter.
+func (c *GeoCounter2) Resolution() (known, unknown uint64) {
+	for h := range c.ctr {
+		known += atomic.LoadUint64(&c.ctr[h])
+	}
+	return known, atomic.LoadUint64(&c.unk)
+}
+
 // WritePrometheus writes the Promethus text metrics.
 func (c *GeoCounter2) WritePrometheus(w io.Writer) {
 	n := len(c.name)
@@ -117,3 +117,16 @@ func BenchmarkGeoCounter2(b *testing.B) {
 		})
 	})
 }
+
+func TestGeoCounter2Resolution(t *testing.T) {
+	ctr := NewGeoCounter2(`test`)
+	for i := 0; i < 5; i++ {
+		ctr.Inc(float64(i*10), float64(i*20))
+	}
+	ctr.Inc(0, 0)
+	ctr.IncUnknown()
+	ctr.IncUnknown()
+	if known, unknown := ctr.Resolution(); known != 6 || unknown != 2 {
+		t.Errorf("expected 6 known and 2 unknown, got %d known and %d unknown", known, unknown)
+	}
+}
@@ -31,17 +31,20 @@ type Listener struct {
 
 	mon map[chan<- MonitorPacket]struct{}
 	wcr map[wcrKey]map[chan struct{}]struct{}
+	hcr func(addr netip.AddrPort, uid uint64)
 
 	metrics struct {
 		rx_count, rx_bytes struct {
 			invalid         atomic.Uint64
 			ignored         atomic.Uint64
+			r2_connect      atomic.Uint64
 			r2_connect_resp atomic.Uint64
 			other           atomic.Uint64
 		}
 		tx_count, tx_bytes struct {
-			atlas_sigreq1 atomic.Uint64
-			r2_connect    atomic.Uint64
+			atlas_sigreq1   atomic.Uint64
+			r2_connect      atomic.Uint64
+			r2_connect_resp atomic.Uint64
 		}
 		tx_err_count struct {
 			nonce atomic.Uint64
@@ -163,6 +166,26 @@ func (l *Listener) Serve(conn *net.UDPConn) error {
 			}
 			delete(l.wcr, key)
 			l.mu.Unlock()
+		case kind == 'H' && len(pkt.Data()) >= 4+1+len("connect\x00")+8 && string(pkt.Data()[4+1:][:8]) == "connect\x00":
+			l.metrics.rx_count.r2_connect.Add(1)
+			l.metrics.rx_bytes.r2_connect.Add(uint64(n))
+
+			// 4: i32 = -1
+			// 1: u8  = 'H'
+			// 8: str = "connect\0"
+			// 8: u64 = uid
+			// 1: ?
+
+			uid := binary.LittleEndian.Uint64(pkt.Data()[4+1+8:])
+			desc = "r2_connect uid=" + strconv.FormatUint(uid, 10)
+
+			l.mu.Lock()
+			hcr := l.hcr
+			l.mu.Unlock()
+
+			if hcr != nil {
+				go hcr(addr, uid)
+			}
 		default:
 			l.metrics.rx_count.other.Add(1)
 			l.metrics.rx_bytes.other.Add(uint64(n))
@@ -308,6 +331,34 @@ func (l *Listener) SendConnect(addr netip.AddrPort, uid uint64) error {
 	return err
 }
 
+// SendConnectReply sends a `Iconnect` packet to addr for uid, as a game server
+// would in response to `Hconnect`.
+func (l *Listener) SendConnectReply(addr netip.AddrPort, uid uint64) error {
+	var b []byte
+	b = append(b, "\xFF\xFF\xFF\xFF"...)
+	b = append(b, 'I')
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, uid)
+	b = append(b, "connect\x00"...)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+
+	n, err := l.send(addr, b, "r2_connect_resp uid="+strconv.FormatUint(uid, 10))
+	if err == nil {
+		l.metrics.tx_count.r2_connect_resp.Add(1)
+		l.metrics.tx_bytes.r2_connect_resp.Add(uint64(n))
+	}
+	return err
+}
+
+// HandleConnect sets fn to be called in a new goroutine whenever a `Hconnect`
+// packet is received. If fn is nil, they will be ignored. This is mainly useful
+// for simulating a game server.
+func (l *Listener) HandleConnect(fn func(addr netip.AddrPort, uid uint64)) {
+	l.mu.Lock()
+	l.hcr = fn
+	l.mu.Unlock()
+}
+
 // WaitConnectReply waits for a reply to `Hconnect` from addr with uid.
 func (l *Listener) WaitConnectReply(ctx context.Context, addr netip.AddrPort, uid uint64) error {
 	key := wcrKey{
@@ -366,16 +417,20 @@ func (l *Listener) Monitor(ctx context.Context, c chan<- MonitorPacket) {
 func (l *Listener) WritePrometheus(w io.Writer) {
 	fmt.Fprintln(w, `atlas_nspkt_rx_count{type="invalid"}`, l.metrics.rx_count.invalid.Load())
 	fmt.Fprintln(w, `atlas_nspkt_rx_count{type="ignored"}`, l.metrics.rx_count.ignored.Load())
+	fmt.Fprintln(w, `atlas_nspkt_rx_count{type="r2_connect"}`, l.metrics.rx_count.r2_connect.Load())
 	fmt.Fprintln(w, `atlas_nspkt_rx_count{type="r2_connect_resp"}`, l.metrics.rx_count.r2_connect_resp.Load())
 	fmt.Fprintln(w, `atlas_nspkt_rx_count{type="other"}`, l.metrics.rx_count.other.Load())
 	fmt.Fprintln(w, `atlas_nspkt_rx_bytes{type="invalid"}`, l.metrics.rx_bytes.invalid.Load())
 	fmt.Fprintln(w, `atlas_nspkt_rx_bytes{type="ignored"}`, l.metrics.rx_bytes.ignored.Load())
+	fmt.Fprintln(w, `atlas_nspkt_rx_bytes{type="r2_connect"}`, l.metrics.rx_bytes.r2_connect.Load())
 	fmt.Fprintln(w, `atlas_nspkt_rx_bytes{type="r2_connect_resp"}`, l.metrics.rx_bytes.r2_connect_resp.Load())
 	fmt.Fprintln(w, `atlas_nspkt_rx_bytes{type="other"}`, l.metrics.rx_bytes.other.Load())
 	fmt.Fprintln(w, `atlas_nspkt_tx_count{type="atlas_sigreq1"}`, l.metrics.tx_count.atlas_sigreq1.Load())
 	fmt.Fprintln(w, `atlas_nspkt_tx_count{type="r2_connect"}`, l.metrics.tx_count.r2_connect.Load())
+	fmt.Fprintln(w, `atlas_nspkt_tx_count{type="r2_connect_resp"}`, l.metrics.tx_count.r2_connect_resp.Load())
 	fmt.Fprintln(w, `atlas_nspkt_tx_bytes{type="atlas_sigreq1"}`, l.metrics.tx_bytes.atlas_sigreq1.Load())
 	fmt.Fprintln(w, `atlas_nspkt_tx_bytes{type="r2_connect"}`, l.metrics.tx_bytes.r2_connect.Load())
+	fmt.Fprintln(w, `atlas_nspkt_tx_bytes{type="r2_connect_resp"}`, l.metrics.tx_bytes.r2_connect_resp.Load())
 	fmt.Fprintln(w, `atlas_nspkt_tx_err_count{cause="nonce"}`, l.metrics.tx_err_count.nonce.Load())
 	fmt.Fprintln(w, `atlas_nspkt_tx_err_count{cause="conn"}`, l.metrics.tx_err_count.conn.Load())
 	fmt.Fprintln(w, `atlas_nspkt_rx_wait_count{type="r2_connect_resp",result="timeout"}`, l.metrics.rx_wait_count.r2_connect_resp.timeout.Load())
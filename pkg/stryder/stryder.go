@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -53,28 +54,10 @@ func nucleusAuth(r *http.Response) ([]byte, error) {
 		return buf, fmt.Errorf("%w: empty response", ErrStryder)
 	}
 
-	// the subset of the response that we care about
-	var obj struct {
-		// error
-		Success *bool       `json:"success,omitempty"`
-		Status  json.Number `json:"status,omitempty"`
-		Error   any         `json:"error,omitempty"`
-
-		// success
-		StoreURI        string      `json:"storeUri,omitempty"`
-		HasOnlineAccess json.Number `json:"hasOnlineAccess,omitempty"`
-	}
-
-	// parse it as normal json
-	if err = json.Unmarshal(buf, &obj); err != nil {
-		// fix nested json objects inserted as-is
-		tmp := bytes.ReplaceAll(buf, []byte(`"{`), []byte(`{`))
-		tmp = bytes.ReplaceAll(tmp, []byte(`}"`), []byte(`}`))
-
-		// parse the fixed json, but return the original error if it's also bad
-		if json.Unmarshal(tmp, &obj) != nil {
-			return buf, fmt.Errorf("%w: invalid json response %#q: %v", ErrStryder, string(buf), err)
-		}
+	// parse it
+	obj, err := decodeNucleusAuth(buf)
+	if err != nil {
+		return buf, fmt.Errorf("%w: invalid json response %#q: %v", ErrStryder, string(buf), err)
 	}
 
 	// check if it's a stryder error response
@@ -103,6 +86,85 @@ func nucleusAuth(r *http.Response) ([]byte, error) {
 	return buf, nil
 }
 
+// nucleusAuthResponse is the subset of the nucleus auth response we care about.
+type nucleusAuthResponse struct {
+	// error
+	Success *bool       `json:"success,omitempty"`
+	Status  json.Number `json:"status,omitempty"`
+	Error   any         `json:"error,omitempty"`
+
+	// success
+	Expiry          json.Number `json:"expiry,omitempty"`
+	StoreURI        string      `json:"storeUri,omitempty"`
+	HasOnlineAccess json.Number `json:"hasOnlineAccess,omitempty"`
+	Username        *string     `json:"userName,omitempty"`
+}
+
+func decodeNucleusAuth(buf []byte) (obj nucleusAuthResponse, err error) {
+	// parse it as normal json
+	if err = json.Unmarshal(buf, &obj); err != nil {
+		// fix nested json objects inserted as-is
+		tmp := bytes.ReplaceAll(buf, []byte(`"{`), []byte(`{`))
+		tmp = bytes.ReplaceAll(tmp, []byte(`}"`), []byte(`}`))
+
+		// parse the fixed json, but return the original error if it's also bad
+		obj = nucleusAuthResponse{}
+		if json.Unmarshal(tmp, &obj) != nil {
+			return obj, err
+		}
+	}
+	return obj, nil
+}
+
+// NucleusAuthResponse contains the parsed fields of a nucleus auth response.
+// Fields which weren't present in the response are left empty.
+type NucleusAuthResponse struct {
+	// Success response fields.
+	HasOnlineAccess bool          `json:"has_online_access"`
+	Expiry          time.Duration `json:"expiry,omitempty"`
+	StoreURI        string        `json:"store_uri,omitempty"`
+	Username        *string       `json:"username,omitempty"` // since October 2, 2023
+
+	// Error response fields.
+	Failed           bool   `json:"failed,omitempty"`
+	Status           string `json:"status,omitempty"`
+	Error            string `json:"error,omitempty"` // e.g., invalid_grant
+	ErrorDescription string `json:"error_description,omitempty"`
+	ErrorCode        int64  `json:"error_code,omitempty"`
+}
+
+// DecodeNucleusAuth parses the fields of a nucleus auth response as returned
+// by NucleusAuth. It does not check whether the response is successful. If
+// resp is empty or invalid, an error will be returned.
+func DecodeNucleusAuth(resp []byte) (NucleusAuthResponse, error) {
+	if len(resp) == 0 {
+		return NucleusAuthResponse{}, fmt.Errorf("empty or missing nucleus auth response")
+	}
+	obj, err := decodeNucleusAuth(resp)
+	if err != nil {
+		return NucleusAuthResponse{}, fmt.Errorf("%w: invalid nucleus auth response json: %v", ErrStryder, err)
+	}
+	r := NucleusAuthResponse{
+		HasOnlineAccess: obj.HasOnlineAccess == "1",
+		StoreURI:        obj.StoreURI,
+		Username:        obj.Username,
+		Failed:          obj.Success != nil && !*obj.Success,
+		Status:          obj.Status.String(),
+	}
+	if v, err := obj.Expiry.Int64(); err == nil {
+		r.Expiry = time.Duration(v) * time.Second
+	}
+	switch e := obj.Error.(type) {
+	case string:
+		r.Error = e
+	case map[string]any:
+		r.Error = castOr(e["error"], "")
+		r.ErrorDescription = castOr(e["error_description"], "")
+		r.ErrorCode = int64(castOr(e["code"], float64(0)))
+	}
+	return r, nil
+}
+
 // NucleusAuthUsername extracts the username field from the nucleus auth
 // response (since October 2, 2023). This field is usually empty for
 // unsuccessful responses, but is always present (if not, an error will be
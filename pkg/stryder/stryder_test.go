@@ -5,8 +5,10 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNucleusAuth(t *testing.T) {
@@ -56,6 +58,45 @@ func testNucleusAuth(t *testing.T, name, resp string, username *string, res erro
 	})
 }
 
+func TestDecodeNucleusAuth(t *testing.T) {
+	for _, tc := range []struct {
+		Name string
+		Resp string
+		Res  NucleusAuthResponse
+	}{
+		{"Success", `{"token":"...","hasOnlineAccess":"1","expiry":"14399","storeUri":"https://www.origin.com/store/titanfall/titanfall-2/standard-edition","userName":"test"}`, NucleusAuthResponse{
+			HasOnlineAccess: true,
+			Expiry:          time.Second * 14399,
+			StoreURI:        "https://www.origin.com/store/titanfall/titanfall-2/standard-edition",
+			Username:        strPtr("test"),
+		}},
+		{"NoMultiplayer", `{"token":"NO_ONLINE_ACCESS","hasOnlineAccess":"0","expiry":"14399","storeUri":"https://www.origin.com/store/titanfall/titanfall-2/standard-edition"}`, NucleusAuthResponse{
+			Expiry:   time.Second * 14399,
+			StoreURI: "https://www.origin.com/store/titanfall/titanfall-2/standard-edition",
+		}},
+		{"InvalidToken", `{"success": false, "status": "400", "error": "{"error":"invalid_grant","error_description":"code is invalid","code":100100}"}`, NucleusAuthResponse{
+			Failed:           true,
+			Status:           "400",
+			Error:            "invalid_grant",
+			ErrorDescription: "code is invalid",
+			ErrorCode:        100100,
+		}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			r, err := DecodeNucleusAuth([]byte(tc.Resp))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(r, tc.Res) {
+				t.Errorf("expected %+v, got %+v", tc.Res, r)
+			}
+		})
+	}
+	if _, err := DecodeNucleusAuth([]byte("Go away.\n")); err == nil {
+		t.Errorf("expected error for invalid response")
+	}
+}
+
 func strPtr(x string) *string {
 	return &x
 }